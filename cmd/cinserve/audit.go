@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+)
+
+const auditUsage = "usage: cinserve audit verify [file]"
+
+var errAuditUsage = errors.New(auditUsage)
+
+// auditCommand runs the audit command, verify checks the hash chain of the log at path
+// or of the file given as argument
+func auditCommand(path string, args []string, out io.Writer) error {
+	if len(args) == 0 || len(args) > 2 || args[0] != "verify" {
+		return errAuditUsage
+	}
+	if len(args) == 2 {
+		path = args[1]
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	count, err := audit.Verify(file)
+	fmt.Fprintf(out, "%s: %d events verified\n", path, count)
+	return err
+}
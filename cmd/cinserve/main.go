@@ -5,13 +5,17 @@ import (
 	"errors"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
 	"github.com/myLogic207/gotils/config"
 	log "github.com/myLogic207/gotils/logger"
 
+	"github.com/myLogic207/cinnamon/internal/admin"
+	"github.com/myLogic207/cinnamon/internal/audit"
 	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/cinnamon/internal/metrics"
 	"github.com/myLogic207/cinnamon/internal/models"
 	ssh "github.com/myLogic207/cinnamon/patchssh"
 )
@@ -19,12 +23,13 @@ import (
 const (
 	ENV_PREFIX    = "CINNAMON"
 	CANCEL_BUFFER = 10
-	END_TIMEOUT   = 1 * time.Second
 )
 
 var (
 	defaultConfig = map[string]interface{}{
 		"WORKDIR": "work",
+		// time active sessions get to finish before they are closed
+		"SHUTDOWNTIMEOUT": "30s",
 		"LOGGER": map[string]interface{}{
 			"PREFIX":       "CINNAMON",
 			"PREFIXLENGTH": 20,
@@ -43,6 +48,11 @@ var (
 			"ADDRESS": "127.0.0.1",
 			"PORT":    2222,
 			"WORKERS": 3,
+			"LIMITS": map[string]interface{}{
+				"CONNECTIONS": 3,
+				"PERIP":       2,
+				"PERUSER":     2,
+			},
 			"LOGGER": map[string]interface{}{
 				"PREFIX": "CINNAMON-SERVER",
 				"WRITERS": map[string]interface{}{
@@ -56,6 +66,46 @@ var (
 			"KEYFILE":       "ssh/server_key",
 			"KNOWNHOSTFILE": "ssh/known_clients",
 		},
+		"ADMIN": map[string]interface{}{
+			"ACTIVE":  false,
+			"ADDRESS": "127.0.0.1:2223",
+			"LOGGER": map[string]interface{}{
+				"PREFIX": "CINNAMON-ADMIN",
+				"WRITERS": map[string]interface{}{
+					"STDOUT": true,
+					"FILE": map[string]interface{}{
+						"ACTIVE": true,
+						"FOLDER": "logs",
+					},
+				},
+			},
+		},
+		// security events as hash chained json lines, relative to WORKDIR
+		"AUDIT": map[string]interface{}{
+			"FILE": "audit.log",
+			"DB":   false,
+			"LOGGER": map[string]interface{}{
+				"PREFIX": "CINNAMON-AUDIT",
+				"WRITERS": map[string]interface{}{
+					"STDOUT": true,
+					"FILE": map[string]interface{}{
+						"ACTIVE": true,
+						"FOLDER": "logs",
+					},
+				},
+			},
+		},
+		// deleted users can be restored until RETENTION passes, 0 keeps them
+		"USERS": map[string]interface{}{
+			"RETENTION":     "720h",
+			"PURGEINTERVAL": "1h",
+		},
+		// prometheus scrape endpoint, served under /metrics
+		"METRICS": map[string]interface{}{
+			"ACTIVE":  false,
+			"ADDRESS": "127.0.0.1:9222",
+		},
+		// TYPE is postgres, mysql (also MariaDB), mssql or sqlite3, PORT belongs to the server
 		"DB": map[string]interface{}{
 			"TYPE":     "postgres",
 			"HOST":     "localhost",
@@ -65,7 +115,13 @@ var (
 			"NAME":     "postgres",
 			"SSLMODE":  "disable",
 			"TIMEZONE": "Europe/Berlin",
-			"POOL":     map[string]interface{}{},
+			// TYPE sqlite3 needs no server, the file is relative to WORKDIR
+			"SQLITE": map[string]interface{}{
+				"PATH":        "cinnamon.db",
+				"WAL":         true,
+				"BUSYTIMEOUT": "5s",
+			},
+			"POOL": map[string]interface{}{},
 			"LOGGER": map[string]interface{}{
 				"PREFIX": "CINNAMON-DB",
 				"WRITERS": map[string]interface{}{
@@ -79,6 +135,10 @@ var (
 			"CACHE": map[string]interface{}{
 				"ACTIVE": false,
 			},
+			// migrations added to the embedded ones, in a folder named after TYPE, relative to WORKDIR
+			"INITPATH": "db.init.d",
+			// apply pending migrations before the server starts
+			"MIGRATE": false,
 		},
 	}
 )
@@ -86,11 +146,26 @@ var (
 func main() {
 	mainCtx, mainCancel := context.WithCancelCause(context.Background())
 
+	// prep changes into WORKDIR, files given to commands are relative to the caller
+	callerDir, _ := os.Getwd()
 	masterConfig, err := prep(mainCtx)
 	if err != nil {
 		mainCancel(err)
 	}
 
+	if len(os.Args) > 1 && (os.Args[1] == "migrate" || os.Args[1] == "audit") {
+		if err == nil && os.Args[1] == "migrate" {
+			err = runMigrate(mainCtx, masterConfig, os.Args[2:])
+		} else if err == nil {
+			err = runAudit(masterConfig, callerDir, os.Args[2:])
+		}
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
@@ -144,18 +219,41 @@ func run(ctx context.Context, masterConfig config.Config) error {
 	}
 	logger.Info(ctx, "Logger initialized")
 
-	dbConfig, _ := masterConfig.GetConfig("DB")
-	db, err := dbconnect.NewDB(dbConfig)
+	db, err := openDB(masterConfig)
 	if err != nil {
 		return err
 	}
 	logger.Info(ctx, "Database initialized")
+	if migrate, _ := masterConfig.GetBool("DB/MIGRATE"); migrate {
+		migrator, err := dbconnect.NewMigrator(db)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx, 0)
+		if err != nil {
+			return err
+		}
+		logger.Info(ctx, "Database migrated, %d migrations applied", len(applied))
+	}
+
+	auditConfig, _ := masterConfig.GetConfig("AUDIT")
+	auditor, err := audit.NewAuditor(auditConfig, db)
+	if err != nil {
+		return err
+	}
+	defer auditor.Close()
+	audit.SetDefault(auditor)
+	logger.Info(ctx, "Audit log initialized")
 
-	// userDB, err := models.NewUserDB(db)
-	// if err != nil {
-	// 	return err
-	// }
-	// logger.Info(ctx, "UserDB initialized")
+	userDB, err := models.NewUserDB(db)
+	if err != nil {
+		return err
+	}
+	logger.Info(ctx, "UserDB initialized")
+	if retention, _ := masterConfig.GetDuration("USERS/RETENTION"); retention > 0 {
+		interval, _ := masterConfig.GetDuration("USERS/PURGEINTERVAL")
+		go purgeDeletedUsers(ctx, userDB, retention, interval, logger)
+	}
 
 	keyDB, err := models.NewKeyDB(db)
 	if err != nil {
@@ -163,35 +261,151 @@ func run(ctx context.Context, masterConfig config.Config) error {
 	}
 	logger.Info(ctx, "KeyDB initialized")
 
+	historyDB, err := models.NewHistoryDB(db)
+	if err != nil {
+		return err
+	}
+	logger.Info(ctx, "HistoryDB initialized")
+
+	roleDB, err := models.NewRoleDB(db)
+	if err != nil {
+		return err
+	}
+	logger.Info(ctx, "RoleDB initialized")
+
 	serverConfig, _ := masterConfig.GetConfig("SERVER")
 	server, err := ssh.NewServer(serverConfig, keyDB)
 	if err != nil {
 		return err
 	}
+	server.SetHistoryDB(historyDB)
+	server.SetRoleDB(roleDB)
+	server.SetUserDB(userDB)
 	logger.Info(ctx, "Server initialized")
-	if err := server.Serve(ctx); err != nil {
+	// the server outlives ctx, so sessions can be drained on shutdown
+	serverCtx, serverCancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer serverCancel()
+	if err := server.Serve(serverCtx); err != nil {
 		return err
 	}
 	logger.Info(ctx, "Server started")
 
-	// wait for context to be done/run indefinitely
-	<-ctx.Done()
-	if err := ctx.Err(); err != nil && err != context.Canceled {
+	adminConfig, _ := masterConfig.GetConfig("ADMIN")
+	if active, _ := adminConfig.GetBool("ACTIVE"); active {
+		adminServer, err := admin.NewServer(adminConfig, userDB, keyDB, server, server.PasswordPolicy())
+		if err != nil {
+			return err
+		}
+		if err := adminServer.Serve(serverCtx); err != nil {
+			return err
+		}
+		logger.Info(ctx, "Admin api started")
+	}
+
+	if active, _ := masterConfig.GetBool("METRICS/ACTIVE"); active {
+		address, _ := masterConfig.GetString("METRICS/ADDRESS")
+		if err := metrics.Serve(serverCtx, address, logger); err != nil {
+			return err
+		}
+	}
+
+	// wait for context to be done or the server to fail
+	select {
+	case <-ctx.Done():
+	case <-server.Done():
+		if err := server.Err(); err != nil {
+			return err
+		}
+	}
+	logger.Info(ctx, "Draining active sessions")
+	timeout, _ := masterConfig.GetDuration("SHUTDOWNTIMEOUT")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), timeout)
+	defer shutdownCancel()
+	cutOff, err := server.Shutdown(shutdownCtx)
+	if err != nil {
 		return err
 	}
+	logger.Info(ctx, "Server drained, %d sessions cut off", cutOff)
+
+	if err := context.Cause(ctx); err != nil && err != context.Canceled {
+		logger.Info(ctx, "Reason: %s", err.Error())
+	}
 	return nil
 }
 
+// openDB connects to the database of the DB section, dbconnect expects the connection
+// settings below DB and the LOGGER, CACHE and INITPATH of the section next to them
+func openDB(masterConfig config.Config) (*dbconnect.DB, error) {
+	dbConfig, _ := masterConfig.GetConfig("DB")
+	options := config.New()
+	if err := options.Set("DB", dbConfig, true); err != nil {
+		return nil, err
+	}
+	for _, section := range []string{"LOGGER", "CACHE"} {
+		sectionConfig, _ := dbConfig.GetConfig(section)
+		if err := options.Set(section, sectionConfig, true); err != nil {
+			return nil, err
+		}
+	}
+	initPath, _ := dbConfig.GetString("INITPATH")
+	if err := options.Set("INITPATH", initPath, true); err != nil {
+		return nil, err
+	}
+	return dbconnect.NewDB(options)
+}
+
+// runMigrate runs the migrate command against the configured database
+func runMigrate(ctx context.Context, masterConfig config.Config, args []string) error {
+	db, err := openDB(masterConfig)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	migrator, err := dbconnect.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, migrator, args, os.Stdout)
+}
+
+// runAudit runs the audit command against the configured audit log
+func runAudit(masterConfig config.Config, callerDir string, args []string) error {
+	path, _ := masterConfig.GetString("AUDIT/FILE")
+	if len(args) == 2 && !filepath.IsAbs(args[1]) {
+		args = []string{args[0], filepath.Join(callerDir, args[1])}
+	}
+	return auditCommand(path, args, os.Stdout)
+}
+
+// purgeDeletedUsers removes users deleted longer than retention ago, once at start and then every interval
+func purgeDeletedUsers(ctx context.Context, userDB models.UserDB, retention, interval time.Duration, logger log.Logger) {
+	ticker := time.NewTicker(max(interval, time.Minute))
+	defer ticker.Stop()
+	for {
+		if purged, err := userDB.PurgeDeleted(ctx, time.Now().Add(-retention)); err != nil {
+			logger.Error(ctx, "Purging deleted users failed: %s", err.Error())
+		} else if purged > 0 {
+			logger.Info(ctx, "Purged %d deleted users", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func shutdown(ctx context.Context) {
 	println("Server received shutdown signal")
+	exitCode := 0
 	if rec := recover(); rec != nil {
 		println("panic recovered: %s (%v)", rec)
+		// let supervisors know the server failed
+		exitCode = 1
 	}
-	// wait for all workers to finish etc.
-	<-time.After(END_TIMEOUT)
 	if err := ctx.Err(); err != nil && err != context.Canceled {
 		println("Reason: %v", err)
 	}
 	println("Server stopped")
-	os.Exit(0)
+	os.Exit(exitCode)
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+)
+
+const migrateUsage = "usage: cinserve migrate [status | up [version] | down [version]]"
+
+var errMigrateUsage = errors.New(migrateUsage)
+
+// migrate runs the migrate command, up applies all pending migrations without a version,
+// down reverts the newest applied one without a version and all above the version with one
+func migrate(ctx context.Context, migrator *dbconnect.Migrator, args []string, out io.Writer) error {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if len(args) > 2 || command == "status" && len(args) > 1 {
+		return errMigrateUsage
+	}
+	version := int64(-1)
+	if len(args) == 2 {
+		parsed, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || parsed < 0 {
+			return errMigrateUsage
+		}
+		version = parsed
+	}
+
+	switch command {
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		return writeMigrationStatus(out, status)
+	case "up":
+		applied, err := migrator.Up(ctx, max(version, 0))
+		for _, migration := range applied {
+			fmt.Fprintf(out, "applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "nothing to apply")
+		}
+		return err
+	case "down":
+		if version < 0 {
+			status, err := migrator.Status(ctx)
+			if err != nil {
+				return err
+			}
+			// the target is the applied migration before the newest one
+			applied := []int64{}
+			for _, migration := range status {
+				if migration.State != dbconnect.MigrationPending {
+					applied = append(applied, migration.Version)
+				}
+			}
+			version = 0
+			if len(applied) > 1 {
+				version = applied[len(applied)-2]
+			}
+		}
+		reverted, err := migrator.Down(ctx, version)
+		for _, migration := range reverted {
+			fmt.Fprintf(out, "reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Fprintln(out, "nothing to revert")
+		}
+		return err
+	}
+	return errMigrateUsage
+}
+
+func writeMigrationStatus(out io.Writer, status []dbconnect.MigrationStatus) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "VERSION\tNAME\tSTATE\tAPPLIED")
+	for _, migration := range status {
+		applied := "-"
+		if !migration.AppliedAt.IsZero() {
+			applied = migration.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\n", migration.Version, migration.Name, migration.State, applied)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,255 @@
+package admin
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh"
+	"github.com/myLogic207/gotils/config"
+	"golang.org/x/crypto/ssh"
+)
+
+const testToken = "secret"
+
+type testUserDB struct {
+	models.UserDB
+	users  map[string]*models.UserImpl
+	lastID uint
+}
+
+func (db *testUserDB) Register(ctx context.Context, user models.User, password string) error {
+	if _, ok := db.users[user.GetUsername()]; ok {
+		return models.ErrUserAlreadyExists
+	}
+	registered := models.NewUser(user.GetUsername(), user.GetNickname(), user.GetEmail())
+	db.lastID++
+	registered.ID = db.lastID
+	db.users[user.GetUsername()] = registered
+	return nil
+}
+
+// ListUsers pages by username with the prefix filter, the cursor is the last username
+func (db *testUserDB) ListUsers(ctx context.Context, query models.UserQuery) (models.UserPage, error) {
+	names := []string{}
+	for name := range db.users {
+		if strings.HasPrefix(name, query.UsernamePrefix) && (query.Cursor == "" || name > query.Cursor) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	page := models.UserPage{Users: []models.User{}}
+	for _, name := range names {
+		if query.Limit > 0 && len(page.Users) == query.Limit {
+			page.Next = page.Users[len(page.Users)-1].GetUsername()
+			break
+		}
+		page.Users = append(page.Users, db.users[name])
+	}
+	return page, nil
+}
+
+func (db *testUserDB) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	user, ok := db.users[username]
+	if !ok {
+		return nil, models.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (db *testUserDB) DeleteUser(ctx context.Context, id uint) error {
+	for name, user := range db.users {
+		if user.GetID() == id {
+			delete(db.users, name)
+		}
+	}
+	return nil
+}
+
+type testKeyDB struct {
+	models.KeyDB
+	keys map[string][]models.Key
+	// users resolves the owner of ListKeys queries
+	users *testUserDB
+}
+
+func (db *testKeyDB) AddKnownHost(ctx context.Context, identifier string, key ssh.PublicKey) error {
+	db.keys[identifier] = append(db.keys[identifier], models.NewKey(identifier, string(ssh.MarshalAuthorizedKey(key))))
+	return nil
+}
+
+func (db *testKeyDB) GetKnownHosts(ctx context.Context, identifier string) ([]models.Key, error) {
+	return db.keys[identifier], nil
+}
+
+func (db *testKeyDB) ListKeys(ctx context.Context, query models.KeyQuery) (models.KeyPage, error) {
+	page := models.KeyPage{Keys: []models.Key{}}
+	for name, user := range db.users.users {
+		if user.GetID() == query.UserID {
+			page.Keys = append(page.Keys, db.keys[name]...)
+		}
+	}
+	return page, nil
+}
+
+func newTestAPI(t *testing.T) (*Server, *testUserDB) {
+	userDB := &testUserDB{users: map[string]*models.UserImpl{}}
+	keyDB := &testKeyDB{keys: map[string][]models.Key{}, users: userDB}
+	sshServer, err := patchssh.NewServer(config.New(), keyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := config.NewWithInitialValues(map[string]interface{}{
+		"TOKEN": testToken,
+	})
+	server, err := NewServer(options, userDB, keyDB, sshServer, sshServer.PasswordPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, userDB
+}
+
+func request(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestMissingToken(t *testing.T) {
+	if _, err := NewServer(config.New(), nil, nil, nil, models.DefaultPasswordPolicy); err != ErrMissingToken {
+		t.Errorf("Expected ErrMissingToken, got %v", err)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	server, _ := newTestAPI(t)
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	recorder := httptest.NewRecorder()
+	server.Handler().ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401, got %d", recorder.Code)
+	}
+}
+
+func TestUsersAndKeys(t *testing.T) {
+	server, userDB := newTestAPI(t)
+	handler := server.Handler()
+
+	if res := request(t, handler, http.MethodPost, "/users", `{"username":"alice","email":"alice@example.net","password":"Secret pass 1"}`); res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(t, handler, http.MethodPost, "/users", `{"username":"alice","email":"alice@example.net","password":"Secret pass 1"}`); res.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate user, got %d", res.Code)
+	}
+	if res := request(t, handler, http.MethodPost, "/users", `{"username":"bob"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for missing fields, got %d", res.Code)
+	}
+	if res := request(t, handler, http.MethodPost, "/users", `{"username":"bob","email":"bob@example.net","password":"pw"}`); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "policy") {
+		t.Errorf("Expected 400 for a weak password, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(t, handler, http.MethodPut, "/users/alice/password", `{"password":"alice alice 1"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a weak password, got %d", res.Code)
+	}
+
+	res := request(t, handler, http.MethodGet, "/users/alice", "")
+	user := userView{}
+	if err := json.Unmarshal(res.Body.Bytes(), &user); err != nil || user.Email != "alice@example.net" {
+		t.Errorf("Expected alice, got %s (%v)", res.Body.String(), err)
+	}
+	if res := request(t, handler, http.MethodGet, "/users/nobody", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", res.Code)
+	}
+
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	sshKey, _ := ssh.NewPublicKey(publicKey)
+	body, _ := json.Marshal(keyRequest{Key: string(ssh.MarshalAuthorizedKey(sshKey))})
+	if res := request(t, handler, http.MethodPost, "/users/alice/keys", string(body)); res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	res = request(t, handler, http.MethodGet, "/users/alice/keys", "")
+	keys := []keyView{}
+	if err := json.Unmarshal(res.Body.Bytes(), &keys); err != nil || len(keys) != 1 || keys[0].Fingerprint != ssh.FingerprintSHA256(sshKey) {
+		t.Errorf("Expected the added key, got %s (%v)", res.Body.String(), err)
+	}
+	if res := request(t, handler, http.MethodGet, "/users/nobody/keys", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the keys of an unknown user, got %d", res.Code)
+	}
+
+	if res := request(t, handler, http.MethodDelete, "/users/alice", ""); res.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", res.Code)
+	} else if len(userDB.users) != 0 {
+		t.Errorf("Expected user to be deleted, got %v", userDB.users)
+	}
+}
+
+func TestListUsersPaging(t *testing.T) {
+	server, _ := newTestAPI(t)
+	handler := server.Handler()
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if res := request(t, handler, http.MethodPost, "/users", `{"username":"`+name+`","email":"`+name+`@example.net","password":"Secret pass 1"}`); res.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+		}
+	}
+
+	res := request(t, handler, http.MethodGet, "/users?limit=2", "")
+	users := []userView{}
+	if err := json.Unmarshal(res.Body.Bytes(), &users); err != nil || len(users) != 2 || users[0].Username != "alice" || res.Header().Get(nextCursorHeader) == "" {
+		t.Fatalf("Expected the first page with a cursor, got %s %v (%v)", res.Body.String(), res.Header(), err)
+	}
+	res = request(t, handler, http.MethodGet, "/users?limit=2&cursor="+url.QueryEscape(res.Header().Get(nextCursorHeader)), "")
+	if err := json.Unmarshal(res.Body.Bytes(), &users); err != nil || len(users) != 1 || users[0].Username != "carol" || res.Header().Get(nextCursorHeader) != "" {
+		t.Errorf("Expected the last page, got %s (%v)", res.Body.String(), err)
+	}
+	for _, query := range []string{"limit=0", "order=sideways", "state=gone", "created_after=yesterday"} {
+		if res := request(t, handler, http.MethodGet, "/users?"+query, ""); res.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", query, res.Code)
+		}
+	}
+}
+
+func TestSessionsAndBans(t *testing.T) {
+	server, _ := newTestAPI(t)
+	handler := server.Handler()
+
+	if res := request(t, handler, http.MethodGet, "/sessions", ""); res.Code != http.StatusOK || strings.TrimSpace(res.Body.String()) != "[]" {
+		t.Errorf("Expected no sessions, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(t, handler, http.MethodDelete, "/sessions/7", ""); res.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown session, got %d", res.Code)
+	}
+
+	if res := request(t, handler, http.MethodPost, "/bans", `{"target":"10.0.0.0/8","reason":"test","duration":"1h"}`); res.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(t, handler, http.MethodPost, "/bans", `{"target":"nonsense"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid target, got %d", res.Code)
+	}
+	res := request(t, handler, http.MethodGet, "/bans", "")
+	bans := []patchssh.Ban{}
+	if err := json.Unmarshal(res.Body.Bytes(), &bans); err != nil || len(bans) != 1 || bans[0].Target != "10.0.0.0/8" {
+		t.Errorf("Expected the added ban, got %s (%v)", res.Body.String(), err)
+	}
+	if res := request(t, handler, http.MethodDelete, "/bans/"+url.PathEscape("10.0.0.0/8"), ""); res.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d: %s", res.Code, res.Body.String())
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	server, _ := newTestAPI(t)
+	res := request(t, server.Handler(), http.MethodGet, "/openapi.json", "")
+	spec := map[string]interface{}{}
+	if err := json.Unmarshal(res.Body.Bytes(), &spec); err != nil || spec["openapi"] == nil {
+		t.Errorf("Expected an openapi document, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+package admin
+
+import "errors"
+
+var (
+	ErrMissingToken      = errors.New("admin api requires a TOKEN")
+	ErrMissingDependency = errors.New("admin api requires user db, key db and ssh server")
+	ErrUnauthorized      = errors.New("unauthorized")
+	ErrNotFound          = errors.New("not found")
+	ErrMissingField      = errors.New("missing required field")
+	ErrInvalidParameter  = errors.New("invalid query parameter")
+)
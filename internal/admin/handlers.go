@@ -0,0 +1,612 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh"
+	"github.com/myLogic207/cinnamon/patchssh/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// request bodies are small, anything larger is rejected
+const maxBodySize = 64 * 1024
+
+// nextCursorHeader carries the cursor of the next page of a listing, it is missing on the last page
+const nextCursorHeader = "X-Next-Cursor"
+
+type userView struct {
+	ID        uint      `json:"id"`
+	Username  string    `json:"username"`
+	Nickname  string    `json:"nickname,omitempty"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Disabled  bool      `json:"disabled"`
+	Deleted   bool      `json:"deleted"`
+}
+
+func newUserView(user models.User) userView {
+	return userView{
+		ID:        user.GetID(),
+		Username:  user.GetUsername(),
+		Nickname:  user.GetNickname(),
+		Email:     user.GetEmail(),
+		CreatedAt: user.GetCreatedAt(),
+		UpdatedAt: user.GetUpdatedAt(),
+		Disabled:  user.IsDisabled(),
+		Deleted:   user.IsDeleted(),
+	}
+}
+
+type keyView struct {
+	ID          uint      `json:"id"`
+	UserID      uint      `json:"user_id,omitempty"`
+	Identifier  string    `json:"identifier"`
+	Key         string    `json:"key"`
+	Name        string    `json:"name,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func newKeyView(key models.Key) keyView {
+	view := keyView{
+		ID:         key.GetID(),
+		UserID:     key.GetUserID(),
+		Identifier: key.GetIdentifier(),
+		Key:        key.GetKey(),
+		Name:       key.GetName(),
+		CreatedAt:  key.GetCreatedAt(),
+	}
+	if parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.GetKey())); err == nil {
+		view.Fingerprint = ssh.FingerprintSHA256(parsed)
+	}
+	return view
+}
+
+type userRequest struct {
+	Username string  `json:"username"`
+	Nickname *string `json:"nickname"`
+	Email    *string `json:"email"`
+	Password string  `json:"password"`
+}
+
+type keyRequest struct {
+	Key string `json:"key"`
+}
+
+type messageRequest struct {
+	Message string `json:"message"`
+}
+
+type banRequest struct {
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+type hostKeyRequest struct {
+	PrivateKey string `json:"private_key"`
+}
+
+type hostKeyView struct {
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// routeUsers handles /users, /users/{name}, /users/{name}/password and /users/{name}/keys[/{fingerprint}]
+func (s *Server) routeUsers(w http.ResponseWriter, r *http.Request, segments []string) bool {
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		s.listUsers(w, r)
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		s.createUser(w, r)
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		s.getUser(w, r, segments[0])
+	case len(segments) == 1 && r.Method == http.MethodPatch:
+		s.updateUser(w, r, segments[0])
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		s.deleteUser(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "password" && r.Method == http.MethodPut:
+		s.setPassword(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "keys" && r.Method == http.MethodGet:
+		s.listKeys(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "keys" && r.Method == http.MethodPost:
+		s.addKey(w, r, segments[0])
+	case len(segments) == 3 && segments[1] == "keys" && r.Method == http.MethodDelete:
+		s.removeKey(w, r, segments[0], segments[2])
+	default:
+		return false
+	}
+	return true
+}
+
+// listUsers returns a page of users, the cursor of the next page is sent in the X-Next-Cursor header
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	page, err := readPage(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	query := models.UserQuery{
+		UsernamePrefix: params.Get("prefix"),
+		Email:          params.Get("email"),
+		Role:           params.Get("role"),
+		Sort:           models.UserSort(params.Get("sort")),
+		Page:           page,
+	}
+	if query.CreatedAfter, query.CreatedBefore, err = readCreated(params); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	switch params.Get("state") {
+	case "":
+	case "active":
+		query.Disabled = models.OnlyEnabled
+	case "disabled":
+		query.Disabled = models.OnlyDisabled
+	case "deleted":
+		query.Deleted = models.OnlyDeleted
+	case "all":
+		query.Deleted = models.IncludeDeleted
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%w: state", ErrInvalidParameter))
+		return
+	}
+	users, err := s.userDB.ListUsers(r.Context(), query)
+	if errors.Is(err, models.ErrInvalidCursor) || errors.Is(err, models.ErrInvalidSort) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	views := []userView{}
+	for _, user := range users.Users {
+		views = append(views, newUserView(user))
+	}
+	if users.Next != "" {
+		w.Header().Set(nextCursorHeader, users.Next)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// readPage reads the limit, cursor and order parameters of a listing
+func readPage(params url.Values) (models.Page, error) {
+	page := models.Page{Cursor: params.Get("cursor")}
+	if limit := params.Get("limit"); limit != "" {
+		number, err := strconv.Atoi(limit)
+		if err != nil || number < 1 || number > models.MaxPageSize {
+			return page, fmt.Errorf("%w: limit between 1 and %d", ErrInvalidParameter, models.MaxPageSize)
+		}
+		page.Limit = number
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return page, fmt.Errorf("%w: order", ErrInvalidParameter)
+	}
+	return page, nil
+}
+
+// readCreated reads the created_after and created_before parameters as RFC 3339 times
+func readCreated(params url.Values) (after, before time.Time, err error) {
+	for name, target := range map[string]*time.Time{"created_after": &after, "created_before": &before} {
+		if value := params.Get(name); value != "" {
+			if *target, err = time.Parse(time.RFC3339, value); err != nil {
+				return after, before, fmt.Errorf("%w: %s", ErrInvalidParameter, name)
+			}
+		}
+	}
+	return after, before, nil
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	request := userRequest{}
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Username == "" || request.Email == nil || request.Password == "" {
+		writeError(w, http.StatusBadRequest, ErrMissingField)
+		return
+	}
+	nickname := request.Username
+	if request.Nickname != nil {
+		nickname = *request.Nickname
+	}
+	if err := s.policy.Check(request.Username, request.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := models.HashPassword(request.Password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	user := models.NewUser(request.Username, nickname, *request.Email)
+	if err := s.userDB.Register(r.Context(), user, hash); errors.Is(err, models.ErrUserAlreadyExists) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api created user '%s'", request.Username)
+	recordAction(r, "user_created", "username", request.Username)
+	writeJSON(w, http.StatusCreated, newUserView(user))
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, username string) {
+	user, ok := s.lookupUser(w, r, username)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserView(user))
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, username string) {
+	user, ok := s.lookupUser(w, r, username)
+	if !ok {
+		return
+	}
+	request := userRequest{}
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	nickname, email := user.GetNickname(), user.GetEmail()
+	if request.Nickname != nil {
+		nickname = *request.Nickname
+	}
+	if request.Email != nil {
+		email = *request.Email
+	}
+	updated := models.NewUser(user.GetUsername(), nickname, email)
+	updated.ID = user.GetID()
+	if err := s.userDB.Update(r.Context(), updated); errors.Is(err, models.ErrUserAlreadyExists) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api updated user '%s'", username)
+	recordAction(r, "user_updated", "username", username)
+	writeJSON(w, http.StatusOK, newUserView(updated))
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, username string) {
+	user, ok := s.lookupUser(w, r, username)
+	if !ok {
+		return
+	}
+	if err := s.userDB.DeleteUser(r.Context(), user.GetID()); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api deleted user '%s'", username)
+	recordAction(r, "user_deleted", "username", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setPassword(w http.ResponseWriter, r *http.Request, username string) {
+	user, ok := s.lookupUser(w, r, username)
+	if !ok {
+		return
+	}
+	request := userRequest{}
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if request.Password == "" {
+		writeError(w, http.StatusBadRequest, ErrMissingField)
+		return
+	} else if err := s.policy.Check(username, request.Password); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	hash, err := models.HashPassword(request.Password)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := s.userDB.UpdatePassword(r.Context(), user, hash); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api changed password of user '%s'", username)
+	recordAction(r, "password_changed", "username", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) lookupUser(w http.ResponseWriter, r *http.Request, username string) (models.User, bool) {
+	user, err := s.userDB.GetByUsername(r.Context(), username)
+	if errors.Is(err, models.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return user, true
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request, username string) {
+	page, err := readPage(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	user, ok := s.lookupUser(w, r, username)
+	if !ok {
+		return
+	}
+	keys, err := s.keyDB.ListKeys(r.Context(), models.KeyQuery{UserID: user.GetID(), Sort: models.SortKeysByCreated, Page: page})
+	if errors.Is(err, models.ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	views := []keyView{}
+	for _, key := range keys.Keys {
+		views = append(views, newKeyView(key))
+	}
+	if keys.Next != "" {
+		w.Header().Set(nextCursorHeader, keys.Next)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) addKey(w http.ResponseWriter, r *http.Request, username string) {
+	request := keyRequest{}
+	if err := readJSON(r, &request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.Key))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.keyDB.AddKnownHost(r.Context(), username, key); errors.Is(err, models.ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api added key %s to '%s'", ssh.FingerprintSHA256(key), username)
+	audit.Record(r.Context(), audit.Event{
+		Type:        audit.EventKeyAdded,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Details:     map[string]string{"username": username},
+	})
+	writeJSON(w, http.StatusCreated, keyView{
+		Identifier:  username,
+		Key:         string(ssh.MarshalAuthorizedKey(key)),
+		Fingerprint: ssh.FingerprintSHA256(key),
+	})
+}
+
+func (s *Server) removeKey(w http.ResponseWriter, r *http.Request, username, fingerprint string) {
+	if err := s.keyDB.RemoveKnownHost(r.Context(), username, fingerprint); errors.Is(err, models.ErrKeyNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if errors.Is(err, models.ErrLastKey) {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.logger.Info(r.Context(), "Admin api removed key %s from '%s'", fingerprint, username)
+	audit.Record(r.Context(), audit.Event{
+		Type:        audit.EventKeyRemoved,
+		Fingerprint: fingerprint,
+		Details:     map[string]string{"username": username},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// routeSessions handles /sessions, /sessions/{id} and /sessions/{id}/message
+func (s *Server) routeSessions(w http.ResponseWriter, r *http.Request, segments []string) bool {
+	sessions := s.sshServer.Registry()
+	if len(segments) == 0 {
+		if r.Method != http.MethodGet {
+			return false
+		}
+		writeJSON(w, http.StatusOK, sessions.List())
+		return true
+	}
+
+	id, err := strconv.ParseUint(segments[0], 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return true
+	}
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodGet:
+		info, err := sessions.Get(id)
+		if err != nil {
+			writeRegistryError(w, err)
+			return true
+		}
+		writeJSON(w, http.StatusOK, info)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		reason := r.URL.Query().Get("reason")
+		if reason == "" {
+			reason = "disconnected by admin"
+		}
+		if err := sessions.Kick(r.Context(), id, reason); err != nil {
+			writeRegistryError(w, err)
+			return true
+		}
+		s.logger.Info(r.Context(), "Admin api disconnected session %d", id)
+		recordAction(r, "session_kicked", "session", segments[0], "reason", reason)
+		w.WriteHeader(http.StatusNoContent)
+	case len(segments) == 2 && segments[1] == "message" && r.Method == http.MethodPost:
+		request := messageRequest{}
+		if err := readJSON(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		if err := sessions.Message(r.Context(), id, "Message from admin: "+request.Message); err != nil {
+			writeRegistryError(w, err)
+			return true
+		}
+		recordAction(r, "session_messaged", "session", segments[0], "message", request.Message)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
+
+func writeRegistryError(w http.ResponseWriter, err error) {
+	if errors.Is(err, registry.ErrConnNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// routeBans handles /bans and /bans/{target}
+func (s *Server) routeBans(w http.ResponseWriter, r *http.Request, segments []string) bool {
+	bans := s.sshServer.Bans()
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, bans.List())
+	case len(segments) == 0 && r.Method == http.MethodPost:
+		request := banRequest{}
+		if err := readJSON(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		duration := time.Duration(0)
+		if request.Duration != "" {
+			var err error
+			if duration, err = time.ParseDuration(request.Duration); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return true
+			}
+		}
+		ban, err := bans.Add(request.Target, request.Reason, duration)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		s.logger.Info(r.Context(), "Admin api banned '%s'", ban.Target)
+		recordAction(r, "ban_added", "target", ban.Target, "reason", ban.Reason)
+		writeJSON(w, http.StatusCreated, ban)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		if err := bans.Remove(segments[0]); errors.Is(err, patchssh.ErrBanNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return true
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		s.logger.Info(r.Context(), "Admin api lifted ban of '%s'", segments[0])
+		recordAction(r, "ban_removed", "target", segments[0])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
+
+// routeHostKey handles /hostkey, a new key is used after the next restart unless HOSTKEY is configured
+func (s *Server) routeHostKey(w http.ResponseWriter, r *http.Request, segments []string) bool {
+	if len(segments) != 0 {
+		return false
+	}
+	switch r.Method {
+	case http.MethodGet:
+		pemBytes, err := s.keyDB.GetHostKey(r.Context())
+		if errors.Is(err, models.ErrKeyNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return true
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		writeJSON(w, http.StatusOK, hostKeyView{
+			PublicKey:   string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+			Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		})
+	case http.MethodPut:
+		request := hostKeyRequest{}
+		if err := readJSON(r, &request); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		signer, err := ssh.ParsePrivateKey([]byte(request.PrivateKey))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return true
+		}
+		if err := s.keyDB.SetHostKey(r.Context(), []byte(request.PrivateKey)); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		s.logger.Warn(r.Context(), "Admin api replaced host key, now %s", ssh.FingerprintSHA256(signer.PublicKey()))
+		audit.Record(r.Context(), audit.Event{
+			Type:        audit.EventHostKeyChanged,
+			Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+			Details:     map[string]string{"source": "admin-api"},
+		})
+		writeJSON(w, http.StatusOK, hostKeyView{
+			PublicKey:   string(ssh.MarshalAuthorizedKey(signer.PublicKey())),
+			Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+// recordAction audits an admin action, details alternate keys and values
+func recordAction(r *http.Request, action string, details ...string) {
+	event := audit.Event{
+		Type:    audit.EventAdminAction,
+		Details: map[string]string{"action": action},
+	}
+	for i := 0; i+1 < len(details); i += 2 {
+		event.Details[details[i]] = details[i+1]
+	}
+	audit.Record(r.Context(), event)
+}
+
+func readJSON(r *http.Request, target interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(target)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
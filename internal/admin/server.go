@@ -0,0 +1,222 @@
+// Package admin provides a token protected HTTP/JSON API to manage a running server.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh"
+	"github.com/myLogic207/gotils/config"
+	log "github.com/myLogic207/gotils/logger"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+var defaultAdminConfig = map[string]interface{}{
+	"LOGGER": map[string]interface{}{
+		"PREFIX":       "ADMIN-API",
+		"PREFIXLENGTH": 20,
+	},
+	"ACTIVE": false,
+	// tcp address or unix:///path/to/socket, keep it local
+	"ADDRESS": "127.0.0.1:2223",
+	"TIMEOUT": "10s",
+	// required, clients send it as "Authorization: Bearer <token>"
+	// "TOKEN": "",
+}
+
+// Server serves the admin API on its own listener
+type Server struct {
+	logger     log.Logger
+	config     config.Config
+	token      []byte
+	userDB     models.UserDB
+	keyDB      models.KeyDB
+	sshServer  *patchssh.SocketServer
+	policy     models.PasswordPolicy
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+func NewServer(options config.Config, userDB models.UserDB, keyDB models.KeyDB, sshServer *patchssh.SocketServer, policy models.PasswordPolicy) (*Server, error) {
+	cnf := config.NewWithInitialValues(defaultAdminConfig)
+	if err := cnf.Merge(options, true); err != nil {
+		return nil, err
+	}
+	if err := cnf.CompareDefault(defaultAdminConfig); err != nil {
+		return nil, err
+	}
+
+	token, err := cnf.GetString("TOKEN")
+	if err != nil || token == "" {
+		return nil, ErrMissingToken
+	}
+	if userDB == nil || keyDB == nil || sshServer == nil {
+		return nil, ErrMissingDependency
+	}
+
+	loggerConfig, _ := cnf.GetConfig("LOGGER")
+	logger, err := log.NewLogger(loggerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		logger:    logger,
+		config:    cnf,
+		token:     []byte(token),
+		userDB:    userDB,
+		keyDB:     keyDB,
+		sshServer: sshServer,
+		policy:    policy,
+	}
+	timeout, _ := cnf.GetDuration("TIMEOUT")
+	server.httpServer = &http.Server{
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: timeout,
+		ReadTimeout:       timeout,
+		WriteTimeout:      timeout,
+	}
+	return server, nil
+}
+
+// Serve starts the api on the configured address, is non blocking and stops when ctx is done
+func (s *Server) Serve(ctx context.Context) error {
+	address, _ := s.config.GetString("ADDRESS")
+	listener, err := listen(ctx, address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.logger.Info(ctx, "Admin api listening on %s", address)
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error(ctx, err.Error())
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error(ctx, err.Error())
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the api, waiting for running requests until ctx is done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+func listen(ctx context.Context, address string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if !strings.HasPrefix(address, "unix://") {
+		return listenConfig.Listen(ctx, "tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	if stat, err := os.Lstat(path); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := listenConfig.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the token is the only protection left, keep the socket private
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Handler returns the routed and authenticated api
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized)
+			return
+		}
+		segments, err := pathSegments(r.URL)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Debug(r.Context(), "%s %s", r.Method, r.URL.Path)
+		// admin actions are audited as the api, not as a user
+		r = r.WithContext(audit.WithSession(r.Context(), audit.Session{
+			User:       "admin-api",
+			RemoteAddr: r.RemoteAddr,
+		}))
+		s.route(w, r, segments)
+	})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), s.token) == 1
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request, segments []string) {
+	if len(segments) == 0 {
+		writeError(w, http.StatusNotFound, ErrNotFound)
+		return
+	}
+	switch segments[0] {
+	case "openapi.json":
+		if len(segments) == 1 && r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(openAPISpec)
+			return
+		}
+	case "users":
+		if s.routeUsers(w, r, segments[1:]) {
+			return
+		}
+	case "sessions":
+		if s.routeSessions(w, r, segments[1:]) {
+			return
+		}
+	case "bans":
+		if s.routeBans(w, r, segments[1:]) {
+			return
+		}
+	case "hostkey":
+		if s.routeHostKey(w, r, segments[1:]) {
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, ErrNotFound)
+}
+
+// pathSegments splits the escaped path, so segments may contain encoded slashes
+func pathSegments(u *url.URL) ([]string, error) {
+	segments := []string{}
+	for _, raw := range strings.Split(strings.Trim(u.EscapedPath(), "/"), "/") {
+		if raw == "" {
+			continue
+		}
+		segment, err := url.PathUnescape(raw)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
@@ -0,0 +1,271 @@
+// Package audit records security relevant events as an append-only JSON lines file,
+// optionally mirrored into the audit_events table. Every event carries the hash of its
+// predecessor, so removed, reordered or edited lines are detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/gotils/config"
+	log "github.com/myLogic207/gotils/logger"
+)
+
+const audit_TABLENAME = "audit_events"
+
+type EventType string
+
+const (
+	EventLogin           EventType = "login"
+	EventLoginFailed     EventType = "login_failed"
+	EventKeyAdded        EventType = "key_added"
+	EventKeyRemoved      EventType = "key_removed"
+	EventHostKeyChanged  EventType = "hostkey_changed"
+	EventCommand         EventType = "command"
+	EventForward         EventType = "forward_opened"
+	EventAdminAction     EventType = "admin_action"
+	EventAccessDenied    EventType = "access_denied"
+	EventPasswordChanged EventType = "password_changed"
+	EventProfileChanged  EventType = "profile_changed"
+)
+
+// Event is a single line of the audit log
+type Event struct {
+	Seq         uint64            `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Type        EventType         `json:"type"`
+	User        string            `json:"user,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	RemoteAddr  string            `json:"remote_addr,omitempty"`
+	SessionID   string            `json:"session_id,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	// PrevHash is the hash of the previous event, empty for the first one
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// computeHash hashes the event without its own hash, map keys are sorted by encoding/json
+func (e Event) computeHash() (string, error) {
+	e.Hash = ""
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+var defaultAuditConfig = map[string]interface{}{
+	"LOGGER": map[string]interface{}{
+		"PREFIX":       "AUDIT",
+		"PREFIXLENGTH": 20,
+	},
+	// relative to the working directory
+	"FILE": "audit.log",
+	// mirror events into the audit_events table
+	"DB": false,
+}
+
+// Auditor appends events to the audit log
+type Auditor struct {
+	logger   log.Logger
+	mutex    sync.Mutex
+	file     *os.File
+	db       *dbconnect.DB
+	seq      uint64
+	lastHash string
+}
+
+// NewAuditor opens the audit log and continues its hash chain, db may be nil if DB is disabled
+func NewAuditor(options config.Config, db *dbconnect.DB) (*Auditor, error) {
+	cnf := config.NewWithInitialValues(defaultAuditConfig)
+	if err := cnf.Merge(options, true); err != nil {
+		return nil, err
+	}
+	if err := cnf.CompareDefault(defaultAuditConfig); err != nil {
+		return nil, err
+	}
+
+	loggerConfig, _ := cnf.GetConfig("LOGGER")
+	logger, err := log.NewLogger(loggerConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	auditor := &Auditor{logger: logger}
+	if useDB, _ := cnf.GetBool("DB"); useDB {
+		if db == nil {
+			return nil, ErrMissingDB
+		}
+		auditor.db = db
+	}
+
+	path, _ := cnf.GetString("FILE")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, size, err := lastEvent(file)
+	if errors.Is(err, ErrTruncatedLog) {
+		// the server stopped while writing, the cut off event is lost
+		logger.Warn(context.Background(), "Audit log %s ends with a cut off event, truncating it to %d bytes", path, size)
+		err = file.Truncate(size)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if last != nil {
+		auditor.seq = last.Seq
+		auditor.lastHash = last.Hash
+	}
+	auditor.file = file
+	return auditor, nil
+}
+
+// lastEvent reads the last event of the log, nil for an empty log, and the size of the complete lines.
+// A last line without its newline was cut off while writing, it is reported as ErrTruncatedLog.
+func lastEvent(reader io.Reader) (*Event, int64, error) {
+	var last *Event
+	size := int64(0)
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			return last, size, ErrTruncatedLog
+		} else if err == io.EOF {
+			return last, size, nil
+		} else if err != nil {
+			return nil, size, err
+		}
+		size += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		event := &Event{}
+		if err := json.Unmarshal(line, event); err != nil {
+			return nil, size, ErrInvalidLogReason{err}
+		}
+		last = event
+	}
+}
+
+// Log chains the event to the previous one and appends it
+func (a *Auditor) Log(ctx context.Context, event Event) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	event.Seq = a.seq + 1
+	event.Time = time.Now().UTC()
+	event.PrevHash = a.lastHash
+	hash, err := event.computeHash()
+	if err != nil {
+		return err
+	}
+	event.Hash = hash
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	a.seq = event.Seq
+	a.lastHash = event.Hash
+
+	if a.db != nil {
+		return a.insert(ctx, event)
+	}
+	return nil
+}
+
+func (a *Auditor) insert(ctx context.Context, event Event) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+	return a.db.Transaction(ctx, func(tx *sql.Tx) error {
+		_, err := a.db.NewBuilder().Insert(audit_TABLENAME).
+			Columns("seq", "created_at", "type", "username", "fingerprint", "remote_addr", "session_id", "details", "prev_hash", "hash").
+			Values(event.Seq, event.Time, string(event.Type), event.User, event.Fingerprint, event.RemoteAddr, event.SessionID, string(details), event.PrevHash, event.Hash).
+			RunWith(tx).ExecContext(ctx)
+		return err
+	}, nil)
+}
+
+// Close closes the audit log file
+func (a *Auditor) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// Verify checks the hash chain of a log and returns the number of valid events.
+// The error is an ErrChainBrokenReason naming the first event that does not fit.
+func Verify(reader io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	count, lastHash := uint64(0), ""
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		event := Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return count, ErrChainBrokenReason{count + 1, err}
+		}
+		if event.Seq != count+1 || event.PrevHash != lastHash {
+			return count, ErrChainBrokenReason{count + 1, ErrChainGap}
+		}
+		if hash, err := event.computeHash(); err != nil || hash != event.Hash {
+			return count, ErrChainBrokenReason{count + 1, ErrHashMismatch}
+		}
+		count, lastHash = event.Seq, event.Hash
+	}
+	return count, scanner.Err()
+}
+
+// the auditor used by Record, events are dropped while none is set
+var defaultAuditor atomic.Pointer[Auditor]
+
+// SetDefault makes the auditor receive the events passed to Record
+func SetDefault(auditor *Auditor) {
+	defaultAuditor.Store(auditor)
+}
+
+// Record fills the session details of ctx into the event and logs it with the default auditor
+func Record(ctx context.Context, event Event) {
+	auditor := defaultAuditor.Load()
+	if auditor == nil {
+		return
+	}
+	if session, ok := SessionFrom(ctx); ok {
+		if event.User == "" {
+			event.User = session.User
+		}
+		if event.Fingerprint == "" {
+			event.Fingerprint = session.Fingerprint
+		}
+		if event.RemoteAddr == "" {
+			event.RemoteAddr = session.RemoteAddr
+		}
+		if event.SessionID == "" {
+			event.SessionID = session.SessionID
+		}
+	}
+	if err := auditor.Log(ctx, event); err != nil && !errors.Is(err, context.Canceled) {
+		auditor.logger.Error(ctx, "Error writing %s event: %s", event.Type, err.Error())
+	}
+}
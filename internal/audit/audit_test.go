@@ -0,0 +1,138 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/gotils/config"
+)
+
+func newTestAuditor(t *testing.T, path string, db *dbconnect.DB) *Auditor {
+	options := config.NewWithInitialValues(map[string]interface{}{
+		"FILE": path,
+		"DB":   db != nil,
+	})
+	auditor, err := NewAuditor(options, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auditor
+}
+
+func TestHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor := newTestAuditor(t, path, nil)
+	ctx := WithSession(context.Background(), Session{User: "alice", SessionID: "abc"})
+	if err := auditor.Log(ctx, Event{Type: EventLogin, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	auditor.Close()
+
+	// a reopened log continues the chain
+	auditor = newTestAuditor(t, path, nil)
+	SetDefault(auditor)
+	defer SetDefault(nil)
+	Record(ctx, Event{Type: EventCommand, Details: map[string]string{"command": "echo hi"}})
+	auditor.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := Verify(file)
+	file.Close()
+	if err != nil || count != 2 {
+		t.Fatalf("Expected 2 valid events, got %d (%v)", count, err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if !strings.Contains(string(raw), `"session_id":"abc"`) {
+		t.Errorf("Expected the session to be recorded, got %s", raw)
+	}
+	tampered := strings.Replace(string(raw), "echo hi", "echo ho", 1)
+	if count, err := Verify(strings.NewReader(tampered)); !errors.Is(err, ErrChainBroken) || count != 1 {
+		t.Errorf("Expected the edited event to break the chain, got %d (%v)", count, err)
+	}
+	lines := strings.SplitAfter(string(raw), "\n")
+	if _, err := Verify(strings.NewReader(lines[1])); !errors.Is(err, ErrChainBroken) {
+		t.Errorf("Expected a removed event to break the chain, got %v", err)
+	}
+}
+
+func TestTruncatedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor := newTestAuditor(t, path, nil)
+	if err := auditor.Log(context.Background(), Event{Type: EventLogin, User: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	auditor.Close()
+	// a crash while writing leaves half an event behind
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"seq":2,"time":"2026-`)
+	file.Close()
+
+	auditor = newTestAuditor(t, path, nil)
+	if err := auditor.Log(context.Background(), Event{Type: EventLogin, User: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	auditor.Close()
+	file, _ = os.Open(path)
+	defer file.Close()
+	if count, err := Verify(file); err != nil || count != 2 {
+		t.Errorf("Expected the cut off event to be dropped, got %d (%v)", count, err)
+	}
+
+	// broken lines before the end are not repaired
+	os.WriteFile(path, []byte("not json\n"), 0600)
+	if _, err := NewAuditor(config.NewWithInitialValues(map[string]interface{}{"FILE": path}), nil); !errors.Is(err, ErrInvalidLog) {
+		t.Errorf("Expected ErrInvalidLog, got %v", err)
+	}
+}
+
+func TestDBMirror(t *testing.T) {
+	options := config.NewWithInitialValues(map[string]interface{}{
+		"DB": map[string]interface{}{
+			"TYPE": "postgres",
+		},
+	})
+	db, mock, err := dbconnect.NewDBMock(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditor := newTestAuditor(t, filepath.Join(t.TempDir(), "audit.log"), db)
+	defer auditor.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO audit_events").
+		WithArgs(1, sqlmock.AnyArg(), "key_added", "alice", "SHA256:abc", "", "", `{"username":"alice"}`, "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	err = auditor.Log(context.Background(), Event{
+		Type:        EventKeyAdded,
+		User:        "alice",
+		Fingerprint: "SHA256:abc",
+		Details:     map[string]string{"username": "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMissingDB(t *testing.T) {
+	options := config.NewWithInitialValues(map[string]interface{}{
+		"FILE": filepath.Join(t.TempDir(), "audit.log"),
+		"DB":   true,
+	})
+	if _, err := NewAuditor(options, nil); !errors.Is(err, ErrMissingDB) {
+		t.Errorf("Expected ErrMissingDB, got %v", err)
+	}
+}
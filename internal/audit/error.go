@@ -0,0 +1,41 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrMissingDB    = errors.New("audit events to the database need a database connection")
+	ErrInvalidLog   = errors.New("invalid audit log")
+	ErrTruncatedLog = errors.New("audit log ends with a cut off event")
+	ErrChainBroken  = errors.New("audit log chain broken")
+	ErrChainGap     = errors.New("event missing or out of order")
+	ErrHashMismatch = errors.New("event hash mismatch")
+)
+
+type ErrInvalidLogReason struct {
+	reason error
+}
+
+func (e ErrInvalidLogReason) Error() string {
+	return fmt.Sprintf("invalid audit log: %s", e.reason.Error())
+}
+
+func (e ErrInvalidLogReason) Unwrap() error {
+	return ErrInvalidLog
+}
+
+// ErrChainBrokenReason names the first event of the log that fails verification
+type ErrChainBrokenReason struct {
+	Seq    uint64
+	reason error
+}
+
+func (e ErrChainBrokenReason) Error() string {
+	return fmt.Sprintf("audit log chain broken at event %d: %s", e.Seq, e.reason.Error())
+}
+
+func (e ErrChainBrokenReason) Unwrap() error {
+	return ErrChainBroken
+}
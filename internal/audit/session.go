@@ -0,0 +1,26 @@
+package audit
+
+import "context"
+
+type contextKey string
+
+const contextKeySession = contextKey("audit-session")
+
+// Session identifies the connection an event originates from
+type Session struct {
+	User        string
+	Fingerprint string
+	RemoteAddr  string
+	SessionID   string
+}
+
+// WithSession attaches the session to ctx, events recorded with it carry its details
+func WithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, contextKeySession, session)
+}
+
+// SessionFrom returns the session attached to ctx
+func SessionFrom(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(contextKeySession).(Session)
+	return session, ok
+}
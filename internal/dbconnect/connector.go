@@ -5,14 +5,20 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/Masterminds/squirrel"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
 	_ "github.com/microsoft/go-mssqldb"
+	"github.com/myLogic207/cinnamon/internal/metrics"
 	"github.com/myLogic207/gotils/config"
 	log "github.com/myLogic207/gotils/logger"
 )
@@ -24,8 +30,9 @@ const (
 )
 
 var (
-	ErrUnknownDBType = errors.New("unknown database type")
-	ErrUnknownTable  = errors.New("unknown table")
+	ErrUnknownDBType  = errors.New("unknown database type")
+	ErrUnknownTable   = errors.New("unknown table")
+	ErrUnknownSSLMode = errors.New("unknown ssl mode")
 )
 
 var defaultDBConfig = map[string]interface{}{
@@ -38,6 +45,12 @@ var defaultDBConfig = map[string]interface{}{
 		"NAME":     "postgres",
 		// "SSLMODE":  "disable",
 		"TIMEZONE": "Europe/Berlin",
+		// TYPE sqlite3 keeps the database in a local file instead, PATH is created if missing
+		"SQLITE": map[string]interface{}{
+			"PATH":        "cinnamon.db",
+			"WAL":         true,
+			"BUSYTIMEOUT": "5s",
+		},
 		"POOL": map[string]interface{}{
 			"CONNS_OPEN":    10,
 			"CONNS_IDLE":    5,
@@ -62,16 +75,30 @@ var defaultDBConfig = map[string]interface{}{
 	},
 }
 
+var (
+	transactionDuration = metrics.NewHistogram("cinnamon_db_transaction_duration_seconds", "Duration of database transactions, by result.", nil, "result")
+	transactionsTotal   = metrics.NewCounter("cinnamon_db_transactions_total", "Database transactions, by result.", "result")
+)
+
+// driverNames maps the database types to their sql driver, if the names differ
+var driverNames = map[string]string{
+	"postgres": "pgx",
+	"mssql":    "sqlserver",
+}
+
 type urlGenerator func(config.Config) (string, error)
 
 var dbTypeLookup = map[string]urlGenerator{
 	"postgres": newPostgresConnector,
-	// "mysql":    newMysqlConnector,
-	// "mssql":    newMssqlConnector,
+	"sqlite3":  newSqliteConnector,
+	"mysql":    newMysqlConnector,
+	"mssql":    newMssqlConnector,
 }
 
 type DB struct {
 	*sql.DB
+	// reader runs the read only transactions on SQLite, nil for the other databases
+	reader *sql.DB
 	conf   config.Config
 	logger log.Logger
 }
@@ -96,50 +123,100 @@ func NewDB(options config.Config) (*DB, error) {
 	if err := connector.Ping(); err != nil {
 		return nil, err
 	}
+	var reader *sql.DB
+	if dbType, _ := conf.GetString("DB/TYPE"); dbType == "sqlite3" {
+		if reader, err = newSqliteReader(conf); err != nil {
+			connector.Close()
+			return nil, err
+		}
+	}
+	metrics.Default.Register("cinnamon_db_pool", metrics.NewDBStats("cinnamon_db_pool", connector))
 
 	return &DB{
 		DB:     connector,
+		reader: reader,
 		logger: logger,
 		conf:   conf,
 	}, nil
 }
 
 func NewDBMock(options config.Config) (*DB, sqlmock.Sqlmock, error) {
-	conf, err := resolveDBConfig(defaultDBConfig, options)
+	connector, mocker, err := sqlmock.New()
 	if err != nil {
 		return nil, nil, err
 	}
-
-	loggerConf, _ := conf.GetConfig("LOGGER")
-	logger, err := log.NewLogger(loggerConf)
+	db, err := NewDBFromConn(options, connector)
 	if err != nil {
 		return nil, nil, err
 	}
+	return db, mocker, nil
+}
 
-	connector, mocker, err := sqlmock.New()
+// NewDBFromConn wraps an open connection, DB/TYPE in options has to match its driver
+func NewDBFromConn(options config.Config, connector *sql.DB) (*DB, error) {
+	conf, err := resolveDBConfig(defaultDBConfig, options)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+
+	loggerConf, _ := conf.GetConfig("LOGGER")
+	logger, err := log.NewLogger(loggerConf)
+	if err != nil {
+		return nil, err
 	}
 
 	return &DB{
 		DB:     connector,
 		logger: logger,
 		conf:   conf,
-	}, mocker, nil
+	}, nil
 }
 
 func (db *DB) NewBuilder() squirrel.StatementBuilderType {
 	builder := squirrel.StatementBuilder
-	if dbType, _ := db.conf.GetString("DB/TYPE"); dbType == "postgres" {
+	switch dbType, _ := db.conf.GetString("DB/TYPE"); dbType {
+	case "postgres":
 		builder = builder.PlaceholderFormat(squirrel.Dollar)
+	case "mssql":
+		builder = builder.PlaceholderFormat(squirrel.AtP)
 	}
 	return builder
 }
 
+// Limit selects limit rows of query after skipping offset, query has to be ordered
+// as SQL Server only pages ordered results and has no LIMIT
+func (db *DB) Limit(query squirrel.SelectBuilder, limit, offset uint64) squirrel.SelectBuilder {
+	if dbType, _ := db.conf.GetString("DB/TYPE"); dbType == "mssql" {
+		return query.Suffix("OFFSET ? ROWS FETCH NEXT ? ROWS ONLY", offset, limit)
+	}
+	query = query.Limit(limit)
+	if offset > 0 {
+		query = query.Offset(offset)
+	}
+	return query
+}
+
 type TransactionFunc func(tx *sql.Tx) error
 
-func (db *DB) Transaction(ctx context.Context, transaction TransactionFunc, options *sql.TxOptions) error {
-	tx, err := db.BeginTx(ctx, options)
+func (db *DB) Transaction(ctx context.Context, transaction TransactionFunc, options *sql.TxOptions) (err error) {
+	start := time.Now()
+	defer func() {
+		result := "commit"
+		if err != nil {
+			result = "error"
+		}
+		transactionDuration.Observe(time.Since(start).Seconds(), result)
+		transactionsTotal.Inc(result)
+	}()
+	if dbType, _ := db.conf.GetString("DB/TYPE"); dbType == "mssql" && options != nil && options.ReadOnly {
+		// SQL Server has no read only transactions
+		options = &sql.TxOptions{Isolation: options.Isolation}
+	}
+	begin := db.DB
+	if db.reader != nil && options != nil && options.ReadOnly {
+		begin = db.reader
+	}
+	tx, err := begin.BeginTx(ctx, options)
 	if err != nil {
 		return err
 	}
@@ -161,18 +238,29 @@ func (db *DB) Transaction(ctx context.Context, transaction TransactionFunc, opti
 	return nil
 }
 
-func (db *DB) CheckTableExists(table string) (bool, error) {
-	builder := squirrel.StatementBuilder
-	if dbType, _ := db.conf.GetString("DB/TYPE"); dbType == "postgres" {
-		builder = builder.PlaceholderFormat(squirrel.Dollar)
+// Close closes the connection pools
+func (db *DB) Close() error {
+	if db.reader != nil {
+		db.reader.Close()
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return false, err
+	return db.DB.Close()
+}
+
+func (db *DB) CheckTableExists(table string) (bool, error) {
+	query := db.NewBuilder().Select("table_name").From("information_schema.tables").Where(squirrel.Eq{"table_name": table})
+	switch dbType, _ := db.conf.GetString("DB/TYPE"); dbType {
+	case "sqlite3":
+		query = db.NewBuilder().Select("name").From("sqlite_master").Where(squirrel.Eq{"type": "table", "name": table})
+	case "mysql":
+		// information_schema lists the tables of every database on the server
+		query = query.Where("table_schema = DATABASE()")
+	case "mssql":
+		query = query.Where(squirrel.Eq{"table_type": "BASE TABLE"})
 	}
 	var name string
-	err = builder.Select("table_name").From("information_schema.tables").Where(squirrel.Eq{"table_name": table}).RunWith(tx).QueryRow().Scan(name)
-	if err != nil {
+	if err := query.RunWith(db.DB).QueryRow().Scan(&name); errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
 		return false, err
 	}
 	return name == table, nil
@@ -200,10 +288,8 @@ func resolveDBConnector(conf config.Config) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	var driver string
-	if dbType == "postgres" {
-		driver = "pgx"
-	} else {
+	driver, ok := driverNames[dbType]
+	if !ok {
 		driver = dbType
 	}
 	db, err := sql.Open(driver, connector)
@@ -245,34 +331,110 @@ func newPostgresConnector(conf config.Config) (url string, err error) {
 	return dsn, nil
 }
 
-// func newMysqlConnector(conf config.Config) (url string, err error) {
-// 	user, _ := conf.GetString("DB/USERNAME")
-// 	password, _ := conf.GetString("DB/PASSWORD")
-// 	host, _ := conf.GetString("DB/HOST")
-// 	port, _ := conf.GetString("DB/PORT")
-// 	dbName, _ := conf.GetString("DB/NAME")
-
-// 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", user, password, host, port, dbName)
-
-// 	if charset, _ := conf.GetString("DB/CHARSET"); charset != "" {
-// 		dsn += fmt.Sprintf("?charset=%s", charset)
-// 	}
+// newSqliteConnector opens the file at DB/SQLITE/PATH with foreign keys enforced.
+// Transactions take the write lock when they begin, so concurrent writers wait
+// for up to BUSYTIMEOUT instead of failing when a read turns into a write.
+// Read only transactions run on the pool of newSqliteReader instead.
+func newSqliteConnector(conf config.Config) (url string, err error) {
+	path, _ := conf.GetString("DB/SQLITE/PATH")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_txlock=immediate", path)
+	if wal, _ := conf.GetBool("DB/SQLITE/WAL"); wal {
+		dsn += "&_journal_mode=WAL"
+	}
+	if timeout, err := conf.GetDuration("DB/SQLITE/BUSYTIMEOUT"); err == nil {
+		dsn += fmt.Sprintf("&_busy_timeout=%d", timeout.Milliseconds())
+	}
+	return dsn, nil
+}
 
-// 	return dsn, nil
-// }
+// newSqliteReader opens a second pool on the file that may not write. Its transactions
+// begin deferred, so they do not wait for writers and with WAL do not block them either.
+func newSqliteReader(conf config.Config) (*sql.DB, error) {
+	path, _ := conf.GetString("DB/SQLITE/PATH")
+	dsn := fmt.Sprintf("file:%s?_query_only=on", path)
+	if timeout, err := conf.GetDuration("DB/SQLITE/BUSYTIMEOUT"); err == nil {
+		dsn += fmt.Sprintf("&_busy_timeout=%d", timeout.Milliseconds())
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	poolConfig, _ := conf.GetConfig("DB/POOL")
+	return applyPoolConfig(db, poolConfig), nil
+}
 
-// func newMssqlConnector(conf config.Config) (url string, err error) {
-// 	user, _ := conf.GetString("DB/USERNAME")
-// 	password, _ := conf.GetString("DB/PASSWORD")
-// 	host, _ := conf.GetString("DB/HOST")
-// 	port, _ := conf.GetString("DB/PORT")
-// 	dbName, _ := conf.GetString("DB/NAME")
+// newMysqlConnector connects to MySQL or MariaDB. Times are read as time.Time in
+// DB/TIMEZONE, updates report the rows they matched like the other databases and
+// migrations may hold several statements.
+func newMysqlConnector(conf config.Config) (url string, err error) {
+	dsn := mysql.NewConfig()
+	dsn.User, _ = conf.GetString("DB/USERNAME")
+	dsn.Passwd, _ = conf.GetString("DB/PASSWORD")
+	host, _ := conf.GetString("DB/HOST")
+	port, _ := conf.GetString("DB/PORT")
+	dsn.Net, dsn.Addr = "tcp", net.JoinHostPort(host, port)
+	dsn.DBName, _ = conf.GetString("DB/NAME")
+	dsn.ParseTime, dsn.ClientFoundRows, dsn.MultiStatements = true, true, true
 
-// 	dsn := fmt.Sprintf("sqlserver://%s:%s@%s:%s?database=%s", user, password, host, port, dbName)
+	charset := "utf8mb4"
+	if configured, err := conf.GetString("DB/CHARSET"); err == nil {
+		charset = configured
+	}
+	dsn.Params = map[string]string{"charset": charset}
+	if timezone, err := conf.GetString("DB/TIMEZONE"); err == nil {
+		if dsn.Loc, err = time.LoadLocation(timezone); err != nil {
+			return "", err
+		}
+	}
 
-// 	if charset, _ := conf.GetString("DB/CHARSET"); charset != "" {
-// 		dsn += fmt.Sprintf("&charset=%s", charset)
-// 	}
+	sslMode, _ := conf.GetString("DB/SSLMODE")
+	switch sslMode {
+	case "", "disable":
+		dsn.TLSConfig = "false"
+	case "allow", "prefer":
+		dsn.TLSConfig = "preferred"
+	case "require":
+		dsn.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		dsn.TLSConfig = "true"
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownSSLMode, sslMode)
+	}
+	return dsn.FormatDSN(), nil
+}
 
-// 	return dsn, nil
-// }
+// newMssqlConnector connects to SQL Server. Strings are always unicode and times are
+// stored without a zone, so DB/CHARSET and DB/TIMEZONE do not apply.
+func newMssqlConnector(conf config.Config) (url string, err error) {
+	user, _ := conf.GetString("DB/USERNAME")
+	password, _ := conf.GetString("DB/PASSWORD")
+	host, _ := conf.GetString("DB/HOST")
+	port, _ := conf.GetString("DB/PORT")
+	dbName, _ := conf.GetString("DB/NAME")
+	params := neturl.Values{"database": {dbName}}
+
+	sslMode, _ := conf.GetString("DB/SSLMODE")
+	switch sslMode {
+	case "", "disable":
+		params.Set("encrypt", "disable")
+	case "allow", "prefer":
+		params.Set("encrypt", "false")
+	case "require":
+		params.Set("encrypt", "true")
+		params.Set("TrustServerCertificate", "true")
+	case "verify-ca", "verify-full":
+		params.Set("encrypt", "true")
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownSSLMode, sslMode)
+	}
+	dsn := neturl.URL{
+		Scheme:   "sqlserver",
+		User:     neturl.UserPassword(user, password),
+		Host:     net.JoinHostPort(host, port),
+		RawQuery: params.Encode(),
+	}
+	return dsn.String(), nil
+}
@@ -0,0 +1,410 @@
+package dbconnect
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+)
+
+const migration_TABLENAME = "schema_migrations"
+
+var (
+	ErrInvalidMigration   = errors.New("invalid migration file")
+	ErrDuplicateMigration = errors.New("duplicate migration version")
+	ErrChecksumMismatch   = errors.New("migration changed after it was applied")
+	ErrMigrationMissing   = errors.New("applied migration not found")
+	ErrNoDownMigration    = errors.New("migration can not be reverted")
+)
+
+// embeddedMigrations holds the schema of every dialect, one folder named after DB/TYPE each
+//
+//go:embed migrations
+var embeddedMigrations embed.FS
+
+// migrationFile matches <version>_<name>.up.sql and <version>_<name>.down.sql
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migrationDialect holds the statements the runner itself needs, lock and unlock are
+// run on the connection applying the migrations and keep other runners waiting
+type migrationDialect struct {
+	createTable string
+	lock        string
+	unlock      string
+}
+
+var migrationDialects = map[string]migrationDialect{
+	"postgres": {
+		createTable: `CREATE TABLE IF NOT EXISTS ` + migration_TABLENAME + ` (
+  version BIGINT PRIMARY KEY,
+  name TEXT NOT NULL,
+  checksum TEXT NOT NULL,
+  applied_at TIMESTAMP NOT NULL
+)`,
+		// the key is arbitrary, it only has to be the same for every runner
+		lock:   "SELECT pg_advisory_lock(7235376470394658112)",
+		unlock: "SELECT pg_advisory_unlock(7235376470394658112)",
+	},
+	// SQLite has no lock to hold across transactions, but every migration runs in a transaction
+	// that takes the write lock right away, a concurrent runner waits for it and then fails to
+	// record the same version again
+	"sqlite3": {
+		createTable: `CREATE TABLE IF NOT EXISTS ` + migration_TABLENAME + ` (
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  checksum TEXT NOT NULL,
+  applied_at TIMESTAMP NOT NULL
+)`,
+	},
+	// MySQL commits before every schema change, a failed migration may be applied in part
+	"mysql": {
+		createTable: `CREATE TABLE IF NOT EXISTS ` + migration_TABLENAME + ` (
+  version BIGINT PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  checksum CHAR(64) NOT NULL,
+  applied_at DATETIME NOT NULL
+)`,
+		lock:   "SELECT GET_LOCK('cinnamon_schema_migrations', -1)",
+		unlock: "SELECT RELEASE_LOCK('cinnamon_schema_migrations')",
+	},
+	"mssql": {
+		createTable: `IF OBJECT_ID('` + migration_TABLENAME + `', 'U') IS NULL CREATE TABLE ` + migration_TABLENAME + ` (
+  version BIGINT PRIMARY KEY,
+  name NVARCHAR(255) NOT NULL,
+  checksum CHAR(64) NOT NULL,
+  applied_at DATETIME2 NOT NULL
+)`,
+		lock:   "EXEC sp_getapplock @Resource = 'cinnamon_schema_migrations', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = -1",
+		unlock: "EXEC sp_releaseapplock @Resource = 'cinnamon_schema_migrations', @LockOwner = 'Session'",
+	},
+}
+
+// Migration is one versioned schema change, Down is empty if it can not be reverted
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type MigrationState string
+
+const (
+	MigrationPending MigrationState = "pending"
+	MigrationApplied MigrationState = "applied"
+	// MigrationModified was applied, but its file changed since
+	MigrationModified MigrationState = "modified"
+	// MigrationMissing was applied, but its file no longer exists
+	MigrationMissing MigrationState = "missing"
+)
+
+// MigrationStatus is the state of a migration in the database, AppliedAt is zero while pending
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	State     MigrationState
+	AppliedAt time.Time
+}
+
+// appliedMigration is a row of the schema_migrations table
+type appliedMigration struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+type Migrator struct {
+	db         *DB
+	dialect    migrationDialect
+	migrations []Migration
+}
+
+// NewMigrator reads the embedded migrations of the database type and the ones found in the
+// same named folder below INITPATH, a missing INITPATH only leaves the embedded migrations.
+func NewMigrator(db *DB) (*Migrator, error) {
+	embedded, _ := fs.Sub(embeddedMigrations, "migrations")
+	sources := []fs.FS{embedded}
+	initPath, _ := db.conf.GetString("INITPATH")
+	if stat, err := os.Stat(initPath); err == nil && stat.IsDir() {
+		sources = append(sources, os.DirFS(initPath))
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return newMigrator(db, sources...)
+}
+
+func newMigrator(db *DB, sources ...fs.FS) (*Migrator, error) {
+	dbType, _ := db.conf.GetString("DB/TYPE")
+	dialect, ok := migrationDialects[dbType]
+	if !ok {
+		return nil, ErrUnknownDBType
+	}
+	migrations := map[int64]*Migration{}
+	for _, source := range sources {
+		if err := readMigrations(source, dbType, migrations); err != nil {
+			return nil, err
+		}
+	}
+	migrator := &Migrator{
+		db:         db,
+		dialect:    dialect,
+		migrations: make([]Migration, 0, len(migrations)),
+	}
+	for _, migration := range migrations {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("%w: %d_%s has no up file", ErrInvalidMigration, migration.Version, migration.Name)
+		}
+		migrator.migrations = append(migrator.migrations, *migration)
+	}
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].Version < migrator.migrations[j].Version
+	})
+	return migrator, nil
+}
+
+// readMigrations adds the files in the dialect folder of source, a source without the folder adds none
+func readMigrations(source fs.FS, dialect string, migrations map[int64]*Migration) error {
+	entries, err := fs.ReadDir(source, dialect)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// files of one source may share a version, the same version in two sources may not
+	known := map[int64]bool{}
+	for version := range migrations {
+		known[version] = true
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		parts := migrationFile.FindStringSubmatch(entry.Name())
+		if parts == nil {
+			return fmt.Errorf("%w: %s", ErrInvalidMigration, entry.Name())
+		}
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || version <= 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidMigration, entry.Name())
+		}
+		if known[version] {
+			return fmt.Errorf("%w: %s", ErrDuplicateMigration, entry.Name())
+		}
+		content, err := fs.ReadFile(source, path.Join(dialect, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		migration, ok := migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: parts[2]}
+			migrations[version] = migration
+		} else if migration.Name != parts[2] {
+			return fmt.Errorf("%w: %s", ErrDuplicateMigration, entry.Name())
+		}
+		if parts[3] == "up" {
+			migration.Up = string(content)
+			sum := sha256.Sum256(content)
+			migration.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	return nil
+}
+
+// Migrations returns the known migrations ordered by version
+func (m *Migrator) Migrations() []Migration {
+	return append([]Migration(nil), m.migrations...)
+}
+
+// Status lists the known migrations and the applied ones without a file, ordered by version
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := []MigrationStatus{}
+	for _, migration := range m.migrations {
+		row, ok := applied[migration.Version]
+		if !ok {
+			status = append(status, MigrationStatus{Version: migration.Version, Name: migration.Name, State: MigrationPending})
+			continue
+		}
+		delete(applied, migration.Version)
+		state := MigrationApplied
+		if row.checksum != migration.Checksum {
+			state = MigrationModified
+		}
+		status = append(status, MigrationStatus{Version: migration.Version, Name: migration.Name, State: state, AppliedAt: row.appliedAt})
+	}
+	for _, row := range applied {
+		status = append(status, MigrationStatus{Version: row.version, Name: row.name, State: MigrationMissing, AppliedAt: row.appliedAt})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+// Up applies the pending migrations up to and including target, 0 applies all of them.
+// Nothing is applied if an applied migration changed or went missing.
+func (m *Migrator) Up(ctx context.Context, target int64) ([]Migration, error) {
+	done := []Migration{}
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		for _, migration := range m.migrations {
+			if target > 0 && migration.Version > target {
+				break
+			}
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			insert := m.db.NewBuilder().Insert(migration_TABLENAME).
+				Columns("version", "name", "checksum", "applied_at").
+				Values(migration.Version, migration.Name, migration.Checksum, time.Now().UTC())
+			if err := m.step(ctx, conn, migration, migration.Up, insert); err != nil {
+				return err
+			}
+			m.db.logger.Info(ctx, "applied migration %d_%s", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the applied migrations above target, newest first, 0 reverts all of them.
+// Nothing is reverted if one of them has no down file.
+func (m *Migrator) Down(ctx context.Context, target int64) ([]Migration, error) {
+	done := []Migration{}
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		revert := []Migration{}
+		for i := len(m.migrations) - 1; i >= 0 && m.migrations[i].Version > target; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("%w: %d_%s", ErrNoDownMigration, migration.Version, migration.Name)
+			}
+			revert = append(revert, migration)
+		}
+		for _, migration := range revert {
+			remove := m.db.NewBuilder().Delete(migration_TABLENAME).Where(squirrel.Eq{"version": migration.Version})
+			if err := m.step(ctx, conn, migration, migration.Down, remove); err != nil {
+				return err
+			}
+			m.db.logger.Info(ctx, "reverted migration %d_%s", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// locked runs migrate on a connection holding the migration lock,
+// after the applied migrations were checked against the files
+func (m *Migrator) locked(ctx context.Context, migrate func(*sql.Conn, map[int64]appliedMigration) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if m.dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.lock); err != nil {
+			return err
+		}
+		defer func() {
+			if _, err := conn.ExecContext(context.WithoutCancel(ctx), m.dialect.unlock); err != nil {
+				m.db.logger.Error(ctx, "releasing the migration lock failed: %s", err.Error())
+			}
+		}()
+	}
+	if _, err := conn.ExecContext(ctx, m.dialect.createTable); err != nil {
+		return err
+	}
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	known := map[int64]Migration{}
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+	for version, row := range applied {
+		migration, ok := known[version]
+		if !ok {
+			return fmt.Errorf("%w: %d_%s", ErrMigrationMissing, version, row.name)
+		}
+		if migration.Checksum != row.checksum {
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, version, row.name)
+		}
+	}
+	return migrate(conn, applied)
+}
+
+// step runs the statements of a migration and records it in one transaction
+func (m *Migrator) step(ctx context.Context, conn *sql.Conn, migration Migration, statements string, record squirrel.Sqlizer) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, statements); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+	query, args, err := record.ToSql()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]appliedMigration, error) {
+	query, args, err := m.db.NewBuilder().Select("version", "name", "checksum", "applied_at").From(migration_TABLENAME).ToSql()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		row := appliedMigration{}
+		if err := rows.Scan(&row.version, &row.name, &row.checksum, &row.appliedAt); err != nil {
+			return nil, err
+		}
+		applied[row.version] = row
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,257 @@
+package dbconnect
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/myLogic207/gotils/config"
+)
+
+var testOptions = map[string]interface{}{
+	"LOGGER": map[string]interface{}{
+		"LEVEL":  "DEBUG",
+		"PREFIX": "TEST-DB",
+		"WRITERS": map[string]interface{}{
+			"STDOUT": true,
+			"FILE": map[string]interface{}{
+				"ACTIVE": false,
+			},
+		},
+	},
+}
+
+var testMigrations = fstest.MapFS{
+	"postgres/0001_init.up.sql":    {Data: []byte("CREATE TABLE users (id INT);")},
+	"postgres/0001_init.down.sql":  {Data: []byte("DROP TABLE users;")},
+	"postgres/0002_keys.up.sql":    {Data: []byte("CREATE TABLE sshkeys (id INT);")},
+	"postgres/0002_keys.down.sql":  {Data: []byte("DROP TABLE sshkeys;")},
+	"postgres/0003_roles.up.sql":   {Data: []byte("CREATE TABLE roles (id INT);")},
+	"postgres/0003_roles.down.sql": {Data: []byte("DROP TABLE roles;")},
+	"postgres/README.md":           {Data: []byte("not a migration")},
+	"postgres/archive/0004_x.sql":  {Data: []byte("folders are skipped")},
+	"mysql/0001_other.up.sql":      {Data: []byte("CREATE TABLE other (id INT);")},
+}
+
+const (
+	queryLock    = `SELECT pg_advisory_lock\(\d+\)`
+	queryUnlock  = `SELECT pg_advisory_unlock\(\d+\)`
+	queryCreate  = `CREATE TABLE IF NOT EXISTS schema_migrations`
+	queryApplied = `SELECT version, name, checksum, applied_at FROM schema_migrations`
+)
+
+func newTestMigrator(t *testing.T, sources ...fs.FS) (*Migrator, sqlmock.Sqlmock) {
+	db, mock, err := NewDBMock(config.NewWithInitialValues(testOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := newMigrator(db, sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator, mock
+}
+
+// expectLocked expects the lock, the migration table and the applied versions
+func expectLocked(mock sqlmock.Sqlmock, migrator *Migrator, applied ...int64) {
+	mock.ExpectExec(queryLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(queryCreate).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+	for _, version := range applied {
+		migration := migrator.migrations[version-1]
+		rows.AddRow(version, migration.Name, migration.Checksum, time.Now())
+	}
+	mock.ExpectQuery(queryApplied).WillReturnRows(rows)
+}
+
+func TestReadMigrations(t *testing.T) {
+	migrator, _ := newTestMigrator(t, testMigrations)
+	migrations := migrator.Migrations()
+	if len(migrations) != 3 {
+		t.Fatalf("Expected 3 postgres migrations, got %d", len(migrations))
+	}
+	for i, name := range []string{"init", "keys", "roles"} {
+		if migrations[i].Version != int64(i+1) || migrations[i].Name != name || migrations[i].Down == "" || len(migrations[i].Checksum) != 64 {
+			t.Errorf("Unexpected migration %d: %+v", i, migrations[i])
+		}
+	}
+
+	local := fstest.MapFS{"postgres/20260101_site.up.sql": {Data: []byte("INSERT INTO roles VALUES (1);")}}
+	migrator, _ = newTestMigrator(t, testMigrations, local)
+	if migrations := migrator.Migrations(); len(migrations) != 4 || migrations[3].Name != "site" || migrations[3].Down != "" {
+		t.Errorf("Expected the local migration last, got %+v", migrations)
+	}
+
+	db, _, _ := NewDBMock(config.NewWithInitialValues(testOptions))
+	defer db.Close()
+	cases := []struct {
+		name     string
+		sources  []fs.FS
+		expected error
+	}{
+		{"same version twice", []fs.FS{testMigrations, fstest.MapFS{"postgres/0002_other.up.sql": {Data: []byte("SELECT 1;")}}}, ErrDuplicateMigration},
+		{"same version renamed", []fs.FS{fstest.MapFS{"postgres/0001_a.up.sql": {}, "postgres/0001_b.down.sql": {}}}, ErrDuplicateMigration},
+		{"bad name", []fs.FS{fstest.MapFS{"postgres/init.sql": {}}}, ErrInvalidMigration},
+		{"down only", []fs.FS{fstest.MapFS{"postgres/0001_a.down.sql": {}}}, ErrInvalidMigration},
+	}
+	for _, c := range cases {
+		if _, err := newMigrator(db, c.sources...); !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	db, _, _ := NewDBMock(config.NewWithInitialValues(testOptions))
+	defer db.Close()
+	for dialect := range migrationDialects {
+		db.conf.Set("DB/TYPE", dialect, true)
+		migrator, err := NewMigrator(db)
+		if err != nil {
+			t.Fatalf("%s: %v", dialect, err)
+		}
+		migrations := migrator.Migrations()
+		if len(migrations) == 0 {
+			t.Errorf("%s: expected embedded migrations", dialect)
+		}
+		for _, migration := range migrations {
+			if migration.Down == "" {
+				t.Errorf("%s: %d_%s can not be reverted", dialect, migration.Version, migration.Name)
+			}
+		}
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	migrator, mock := newTestMigrator(t, testMigrations)
+	expectLocked(mock, migrator, 1)
+	for _, migration := range migrator.migrations[1:] {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(migration.Up)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`INSERT INTO schema_migrations \(version,name,checksum,applied_at\) VALUES \(\$1,\$2,\$3,\$4\)`).
+			WithArgs(migration.Version, migration.Name, migration.Checksum, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := migrator.Up(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Version != 2 || applied[1].Version != 3 {
+		t.Errorf("Expected 2 and 3 to be applied, got %+v", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateUpFailure(t *testing.T) {
+	migrator, mock := newTestMigrator(t, testMigrations)
+	expectLocked(mock, migrator)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(migrator.migrations[0].Up)).WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := migrator.Up(context.Background(), 2)
+	if err == nil || len(applied) != 0 {
+		t.Errorf("Expected the first migration to fail, got %v (%+v)", err, applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateChecksum(t *testing.T) {
+	migrator, mock := newTestMigrator(t, testMigrations)
+	mock.ExpectExec(queryLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(queryCreate).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(queryApplied).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", "edited", time.Now()))
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := migrator.Up(context.Background(), 0); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+	}
+
+	mock.ExpectExec(queryLock).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(queryCreate).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(queryApplied).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(9, "gone", "sum", time.Now()))
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if _, err := migrator.Up(context.Background(), 0); !errors.Is(err, ErrMigrationMissing) {
+		t.Errorf("Expected ErrMigrationMissing, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	migrator, mock := newTestMigrator(t, testMigrations)
+	expectLocked(mock, migrator, 1, 2, 3)
+	for _, migration := range []Migration{migrator.migrations[2], migrator.migrations[1]} {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(migration.Down)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(`DELETE FROM schema_migrations WHERE version = \$1`).WithArgs(migration.Version).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	reverted, err := migrator.Down(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 2 || reverted[0].Version != 3 || reverted[1].Version != 2 {
+		t.Errorf("Expected 3 and 2 to be reverted, got %+v", reverted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// without a down file nothing is reverted
+	migrator.migrations[1].Down = ""
+	expectLocked(mock, migrator, 1, 2, 3)
+	mock.ExpectExec(queryUnlock).WillReturnResult(sqlmock.NewResult(0, 0))
+	if _, err := migrator.Down(context.Background(), 0); !errors.Is(err, ErrNoDownMigration) {
+		t.Errorf("Expected ErrNoDownMigration, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateStatus(t *testing.T) {
+	migrator, mock := newTestMigrator(t, testMigrations)
+	mock.ExpectExec(queryCreate).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(queryApplied).WillReturnRows(sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"}).
+		AddRow(1, "init", migrator.migrations[0].Checksum, time.Now()).
+		AddRow(2, "keys", "edited", time.Now()).
+		AddRow(7, "gone", "sum", time.Now()))
+
+	status, err := migrator.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MigrationState{MigrationApplied, MigrationModified, MigrationPending, MigrationMissing}
+	if len(status) != len(expected) {
+		t.Fatalf("Expected %d entries, got %+v", len(expected), status)
+	}
+	for i, state := range expected {
+		if status[i].State != state {
+			t.Errorf("Expected %d to be %s, got %s", status[i].Version, state, status[i].State)
+		}
+	}
+	if !status[2].AppliedAt.IsZero() || status[3].Name != "gone" {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
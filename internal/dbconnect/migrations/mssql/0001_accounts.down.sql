@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS hashes;
+DROP TABLE IF EXISTS sshkeys;
+DROP TABLE IF EXISTS users;
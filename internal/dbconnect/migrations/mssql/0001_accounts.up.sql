@@ -0,0 +1,39 @@
+-- User Schema, times are stored in UTC
+CREATE TABLE users (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  username NVARCHAR(255) NOT NULL UNIQUE,
+  nickname NVARCHAR(MAX) NULL,
+  email NVARCHAR(255) NOT NULL UNIQUE,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  updated_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  last_login DATETIME2 NULL,
+  disabled_at DATETIME2 NULL,
+  deleted_at DATETIME2 NULL
+);
+
+-- Key Schema, users may have several keys, the host key stored as localhost has no user.
+-- Keys are too long for an index, their hash is unique instead.
+CREATE TABLE sshkeys (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  user_id INT NULL REFERENCES users (id) ON DELETE CASCADE,
+  identifier NVARCHAR(255) NOT NULL,
+  keystring NVARCHAR(MAX) NOT NULL,
+  keystring_hash AS CAST(HASHBYTES('SHA2_256', keystring) AS BINARY(32)) PERSISTED CONSTRAINT sshkeys_keystring UNIQUE,
+  name NVARCHAR(MAX) NULL,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  updated_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  deleted_at DATETIME2 NULL
+);
+
+CREATE INDEX sshkeys_identifier ON sshkeys (identifier);
+CREATE INDEX sshkeys_user_id ON sshkeys (user_id);
+
+-- User PW Hash Schema
+CREATE TABLE hashes (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  user_id INT NULL REFERENCES users (id),
+  pw_hash NVARCHAR(MAX) NOT NULL,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  updated_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  deleted_at DATETIME2 NULL
+);
@@ -0,0 +1,14 @@
+-- Audit Schema, mirrors the audit log file, rows are never updated
+CREATE TABLE audit_events (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  seq BIGINT NOT NULL UNIQUE,
+  created_at DATETIME2 NOT NULL,
+  type NVARCHAR(255) NOT NULL,
+  username NVARCHAR(255) NULL,
+  fingerprint NVARCHAR(255) NULL,
+  remote_addr NVARCHAR(255) NULL,
+  session_id NVARCHAR(255) NULL,
+  details NVARCHAR(MAX) NULL,
+  prev_hash NVARCHAR(255) NOT NULL,
+  hash NVARCHAR(255) NOT NULL UNIQUE
+);
@@ -0,0 +1,9 @@
+-- Shell History Schema, trimmed to the configured size per user
+CREATE TABLE command_history (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  username NVARCHAR(255) NOT NULL,
+  line NVARCHAR(MAX) NOT NULL,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+);
+
+CREATE INDEX command_history_username ON command_history (username, id);
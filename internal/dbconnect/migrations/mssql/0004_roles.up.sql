@@ -0,0 +1,37 @@
+-- Role Schema
+CREATE TABLE roles (
+  id INT IDENTITY(1,1) PRIMARY KEY,
+  name NVARCHAR(255) NOT NULL UNIQUE,
+  description NVARCHAR(MAX) NULL,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+);
+
+-- Role Permission Schema, "*" grants everything, "prefix.*" a group
+CREATE TABLE role_permissions (
+  role_id INT NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+  permission NVARCHAR(255) NOT NULL,
+  UNIQUE (role_id, permission)
+);
+
+-- User Role Schema
+CREATE TABLE user_roles (
+  username NVARCHAR(255) NOT NULL,
+  role_id INT NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+  created_at DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+  UNIQUE (username, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES
+  ('admin', 'Full access, including the management commands'),
+  ('user', 'Shell, own keys and account, agent or X11 forwarding, given to users without roles');
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT roles.id, grants.permission FROM roles JOIN (VALUES
+  ('admin', '*'),
+  ('user', 'shell'),
+  ('user', 'keys'),
+  ('user', 'account'),
+  ('user', 'channel.session'),
+  ('user', 'forward.agent'),
+  ('user', 'forward.x11')
+) AS grants (role, permission) ON grants.role = roles.name;
@@ -0,0 +1,39 @@
+-- User Schema
+CREATE TABLE IF NOT EXISTS users (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  username VARCHAR(255) NOT NULL UNIQUE,
+  nickname TEXT NULL,
+  email VARCHAR(255) NOT NULL UNIQUE,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_login DATETIME NULL,
+  disabled_at DATETIME NULL,
+  deleted_at DATETIME NULL
+);
+
+-- Key Schema, users may have several keys, the host key stored as localhost has no user.
+-- Keys are too long for a full index, they differ well within the indexed prefix.
+CREATE TABLE IF NOT EXISTS sshkeys (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  user_id INT NULL,
+  identifier VARCHAR(255) NOT NULL,
+  keystring TEXT NOT NULL,
+  name TEXT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  deleted_at DATETIME NULL,
+  UNIQUE KEY sshkeys_keystring (keystring(700)),
+  KEY sshkeys_identifier (identifier),
+  CONSTRAINT sshkeys_user_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+-- User PW Hash Schema
+CREATE TABLE IF NOT EXISTS hashes (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  user_id INT NULL,
+  pw_hash TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  deleted_at DATETIME NULL,
+  CONSTRAINT hashes_user_id FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,14 @@
+-- Audit Schema, mirrors the audit log file, rows are never updated
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  seq BIGINT NOT NULL UNIQUE,
+  created_at DATETIME NOT NULL,
+  type VARCHAR(255) NOT NULL,
+  username VARCHAR(255) NULL,
+  fingerprint VARCHAR(255) NULL,
+  remote_addr VARCHAR(255) NULL,
+  session_id VARCHAR(255) NULL,
+  details TEXT NULL,
+  prev_hash VARCHAR(255) NOT NULL,
+  hash VARCHAR(255) NOT NULL UNIQUE
+);
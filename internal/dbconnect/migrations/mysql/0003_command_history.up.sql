@@ -0,0 +1,8 @@
+-- Shell History Schema, trimmed to the configured size per user
+CREATE TABLE IF NOT EXISTS command_history (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  username VARCHAR(255) NOT NULL,
+  line TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  KEY command_history_username (username, id)
+);
@@ -0,0 +1,39 @@
+-- Role Schema
+CREATE TABLE IF NOT EXISTS roles (
+  id INT PRIMARY KEY AUTO_INCREMENT,
+  name VARCHAR(255) NOT NULL UNIQUE,
+  description TEXT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Role Permission Schema, "*" grants everything, "prefix.*" a group
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role_id INT NOT NULL,
+  permission VARCHAR(255) NOT NULL,
+  UNIQUE KEY role_permissions_grant (role_id, permission),
+  CONSTRAINT role_permissions_role_id FOREIGN KEY (role_id) REFERENCES roles (id) ON DELETE CASCADE
+);
+
+-- User Role Schema
+CREATE TABLE IF NOT EXISTS user_roles (
+  username VARCHAR(255) NOT NULL,
+  role_id INT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY user_roles_grant (username, role_id),
+  CONSTRAINT user_roles_role_id FOREIGN KEY (role_id) REFERENCES roles (id) ON DELETE CASCADE
+);
+
+INSERT IGNORE INTO roles (name, description) VALUES
+  ('admin', 'Full access, including the management commands'),
+  ('user', 'Shell, own keys and account, agent or X11 forwarding, given to users without roles');
+
+INSERT IGNORE INTO role_permissions (role_id, permission)
+SELECT roles.id, grants.permission FROM roles JOIN (
+  SELECT 'admin' AS role, '*' AS permission
+  UNION ALL SELECT 'user', 'shell'
+  UNION ALL SELECT 'user', 'keys'
+  UNION ALL SELECT 'user', 'account'
+  UNION ALL SELECT 'user', 'channel.session'
+  UNION ALL SELECT 'user', 'forward.agent'
+  UNION ALL SELECT 'user', 'forward.x11'
+) AS grants ON grants.role = roles.name;
@@ -0,0 +1,48 @@
+-- Key Schema, users may have several keys, the host key stored as localhost has no user
+CREATE TABLE IF NOT EXISTS sshkeys (
+  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  identifier TEXT NOT NULL,
+  keystring TEXT NOT NULL UNIQUE,
+  name TEXT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP NULL
+);
+
+-- User Schema
+CREATE TABLE IF NOT EXISTS users (
+  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  username TEXT NOT NULL UNIQUE,
+  nickname TEXT NULL,
+  email TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_login TIMESTAMP NULL,
+  disabled_at TIMESTAMP NULL,
+  deleted_at TIMESTAMP NULL
+);
+
+-- User PW Hash Schema
+CREATE TABLE IF NOT EXISTS hashes (
+  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  user_id INT REFERENCES users (id),
+  pw_hash TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP NULL
+);
+
+-- Databases created by the old init script before named keys allowed a single key per identifier
+ALTER TABLE sshkeys DROP CONSTRAINT IF EXISTS sshkeys_identifier_key;
+ALTER TABLE sshkeys ADD COLUMN IF NOT EXISTS name TEXT NULL;
+CREATE INDEX IF NOT EXISTS sshkeys_identifier ON sshkeys (identifier);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP NULL;
+
+ALTER TABLE sshkeys ADD COLUMN IF NOT EXISTS user_id INT NULL REFERENCES users (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS sshkeys_user_id ON sshkeys (user_id);
+
+-- Databases created before keys were linked only name the owner in identifier,
+-- keys without a matching user stay unlinked and no longer log in
+UPDATE sshkeys SET user_id = users.id
+FROM users
+WHERE sshkeys.user_id IS NULL AND sshkeys.identifier = users.username AND users.deleted_at IS NULL;
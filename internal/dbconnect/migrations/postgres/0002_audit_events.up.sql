@@ -0,0 +1,14 @@
+-- Audit Schema, mirrors the audit log file, rows are never updated
+CREATE TABLE IF NOT EXISTS audit_events (
+  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  seq BIGINT NOT NULL UNIQUE,
+  created_at TIMESTAMP NOT NULL,
+  type TEXT NOT NULL,
+  username TEXT NULL,
+  fingerprint TEXT NULL,
+  remote_addr TEXT NULL,
+  session_id TEXT NULL,
+  details TEXT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE
+);
@@ -0,0 +1,39 @@
+-- Role Schema
+CREATE TABLE IF NOT EXISTS roles (
+  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  name TEXT NOT NULL UNIQUE,
+  description TEXT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Role Permission Schema, "*" grants everything, "prefix.*" a group
+CREATE TABLE IF NOT EXISTS role_permissions (
+  role_id INT NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+  permission TEXT NOT NULL,
+  UNIQUE (role_id, permission)
+);
+
+-- User Role Schema
+CREATE TABLE IF NOT EXISTS user_roles (
+  username TEXT NOT NULL,
+  role_id INT NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE (username, role_id)
+);
+
+INSERT INTO roles (name, description) VALUES
+  ('admin', 'Full access, including the management commands'),
+  ('user', 'Shell, own keys and account, agent or X11 forwarding, given to users without roles')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT roles.id, grants.permission FROM roles JOIN (VALUES
+  ('admin', '*'),
+  ('user', 'shell'),
+  ('user', 'keys'),
+  ('user', 'account'),
+  ('user', 'channel.session'),
+  ('user', 'forward.agent'),
+  ('user', 'forward.x11')
+) AS grants (role, permission) ON grants.role = roles.name
+ON CONFLICT (role_id, permission) DO NOTHING;
@@ -1,37 +1,37 @@
-START TRANSACTION;-- Transaction for safety.
-
---  Create the database schema for Cinnamon.
-CREATE TABLE IF NOT EXISTS sshkeys (
-  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
-  identifier TEXT NOT NULL UNIQUE,
-  keystring TEXT NOT NULL UNIQUE,
-  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-  deleted_at TIMESTAMP NULL
-);-- Key Schema
-
+-- User Schema
 CREATE TABLE IF NOT EXISTS users (
-  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
   username TEXT NOT NULL UNIQUE,
   nickname TEXT NULL,
   email TEXT NOT NULL UNIQUE,
   created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
-  last_login TIMESTAMP NULL
+  last_login TIMESTAMP NULL,
+  disabled_at TIMESTAMP NULL,
   deleted_at TIMESTAMP NULL
-);-- User Schema
+);
 
-CREATE TABLE IF NOT EXISTS hashes (
-  id INT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
-  user_id INT REFERENCES users (id),
-  pw_hash TEXT NOT NULL,
+-- Key Schema, users may have several keys, the host key stored as localhost has no user
+CREATE TABLE IF NOT EXISTS sshkeys (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NULL REFERENCES users (id) ON DELETE CASCADE,
+  identifier TEXT NOT NULL,
+  keystring TEXT NOT NULL UNIQUE,
+  name TEXT NULL,
   created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
   deleted_at TIMESTAMP NULL
-); -- User PW Hash Schema
+);
 
-COMMIT;-- Commit the transaction.
+CREATE INDEX IF NOT EXISTS sshkeys_identifier ON sshkeys (identifier);
+CREATE INDEX IF NOT EXISTS sshkeys_user_id ON sshkeys (user_id);
 
--- It is recommended to also insert the private key for the server into the sshkeys table
-
-INSERT INTO sshkeys (identifier, keystring) VALUES ('localhost', 'ssh-rsa AAAAB...');
\ No newline at end of file
+-- User PW Hash Schema
+CREATE TABLE IF NOT EXISTS hashes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER REFERENCES users (id),
+  pw_hash TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  deleted_at TIMESTAMP NULL
+);
@@ -0,0 +1,9 @@
+-- Shell History Schema, trimmed to the configured size per user
+CREATE TABLE IF NOT EXISTS command_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  username TEXT NOT NULL,
+  line TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS command_history_username ON command_history (username, id);
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"database/sql"
+	"io"
+)
+
+// DBStats exposes the connection pool statistics of a database
+type DBStats struct {
+	prefix string
+	db     *sql.DB
+}
+
+// NewDBStats creates a collector for db, its metrics are named <prefix>_<stat>
+func NewDBStats(prefix string, db *sql.DB) *DBStats {
+	return &DBStats{prefix: prefix, db: db}
+}
+
+func (d *DBStats) Collect(w io.Writer) {
+	stats := d.db.Stats()
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"max_open_connections", "Maximum number of open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"open_connections", "Number of established connections, in use and idle.", float64(stats.OpenConnections)},
+		{"in_use_connections", "Number of connections currently in use.", float64(stats.InUse)},
+		{"idle_connections", "Number of idle connections.", float64(stats.Idle)},
+	}
+	for _, gauge := range gauges {
+		writeHeader(w, d.prefix+"_"+gauge.name, gauge.help, "gauge")
+		writeSample(w, d.prefix+"_"+gauge.name, gauge.value)
+	}
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"wait_count_total", "Total number of connections waited for.", float64(stats.WaitCount)},
+		{"wait_duration_seconds_total", "Total time blocked waiting for a new connection.", stats.WaitDuration.Seconds()},
+		{"max_idle_closed_total", "Total number of connections closed due to the idle limit.", float64(stats.MaxIdleClosed)},
+		{"max_idle_time_closed_total", "Total number of connections closed due to the idle time limit.", float64(stats.MaxIdleTimeClosed)},
+		{"max_lifetime_closed_total", "Total number of connections closed due to the lifetime limit.", float64(stats.MaxLifetimeClosed)},
+	}
+	for _, counter := range counters {
+		writeHeader(w, d.prefix+"_"+counter.name, counter.help, "counter")
+		writeSample(w, d.prefix+"_"+counter.name, counter.value)
+	}
+}
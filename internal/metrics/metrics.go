@@ -0,0 +1,157 @@
+// Package metrics collects counters, gauges and histograms and exposes them in the
+// Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets fit durations in seconds, from a millisecond to ten seconds
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Collector writes one or more metric families in the text format
+type Collector interface {
+	Collect(w io.Writer)
+}
+
+// Registry holds the collectors exposed together on one endpoint
+type Registry struct {
+	mutex      sync.RWMutex
+	collectors map[string]Collector
+}
+
+// Default is the registry the application metrics are registered with
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: map[string]Collector{},
+	}
+}
+
+// Register adds a collector under name, replacing a collector already registered under it
+func (r *Registry) Register(name string, collector Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors[name] = collector
+}
+
+// Unregister removes the collector registered under name
+func (r *Registry) Unregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.collectors, name)
+}
+
+// WriteTo writes all collectors ordered by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]Collector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mutex.RUnlock()
+
+	counter := &countingWriter{writer: w}
+	buffered := bufio.NewWriter(counter)
+	for _, collector := range collectors {
+		collector.Collect(buffered)
+	}
+	err := buffered.Flush()
+	return counter.count, err
+}
+
+// Handler serves the registry for scraping
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		r.WriteTo(w)
+	})
+}
+
+// NewCounter creates and registers a counter in the default registry
+func NewCounter(name, help string, labels ...string) *Counter {
+	counter := newCounter(name, help, labels)
+	Default.Register(name, counter)
+	return counter
+}
+
+// NewGauge creates and registers a gauge in the default registry
+func NewGauge(name, help string, labels ...string) *Gauge {
+	gauge := newGauge(name, help, labels)
+	Default.Register(name, gauge)
+	return gauge
+}
+
+// NewHistogram creates and registers a histogram in the default registry, nil buckets use DefaultBuckets
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := newHistogram(name, help, buckets, labels)
+	Default.Register(name, histogram)
+	return histogram
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.count += int64(n)
+	return n, err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeHeader writes the HELP and TYPE lines of a family
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeSample writes a single sample line, pairs alternates label names and values
+func writeSample(w io.Writer, name string, value float64, pairs ...string) {
+	io.WriteString(w, name)
+	if len(pairs) > 0 {
+		io.WriteString(w, "{")
+		for i := 0; i+1 < len(pairs); i += 2 {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", pairs[i], labelEscaper.Replace(pairs[i+1]))
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatValue(value)+"\n")
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
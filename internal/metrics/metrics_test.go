@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestExposition(t *testing.T) {
+	registry := NewRegistry()
+	counter := newCounter("test_requests_total", "Requests handled.", []string{"method", "path"})
+	gauge := newGauge("test_active", "Active things.", nil)
+	histogram := newHistogram("test_duration_seconds", "Durations.", []float64{0.1, 1}, nil)
+	registry.Register("counter", counter)
+	registry.Register("gauge", gauge)
+	registry.Register("histogram", histogram)
+
+	counter.Inc("GET", `/a"b`)
+	counter.Add(2, "GET", `/a"b`)
+	counter.Add(-1, "GET", `/a"b`)
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	histogram.Observe(0.05)
+	histogram.Observe(0.1)
+	histogram.Observe(5)
+
+	builder := &strings.Builder{}
+	if _, err := registry.WriteTo(builder); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="GET",path="/a\"b"} 3`,
+		"# TYPE test_active gauge",
+		"test_active 1",
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{le="0.1"} 2`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 3`,
+		"test_duration_seconds_sum 5.15",
+		"test_duration_seconds_count 3",
+	}
+	for _, line := range expected {
+		if !strings.Contains(builder.String(), line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, builder.String())
+		}
+	}
+}
+
+func TestWrongLabels(t *testing.T) {
+	counter := newCounter("test_total", "", []string{"result"})
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for missing label values")
+		}
+	}()
+	counter.Inc()
+}
+
+func TestHandler(t *testing.T) {
+	registry := NewRegistry()
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	registry.Register("db", NewDBStats("test_db", db))
+
+	recorder := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != contentType {
+		t.Errorf("Unexpected response %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "test_db_open_connections ") {
+		t.Errorf("Expected pool statistics, got:\n%s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/myLogic207/gotils/logger"
+)
+
+// Serve exposes the default registry on address under /metrics. It is non blocking,
+// reports listen errors directly and stops when ctx is done.
+func Serve(ctx context.Context, address string, logger log.Logger) error {
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default.Handler())
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	logger.Info(ctx, "Metrics listening on %s", listener.Addr().String())
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(ctx, err.Error())
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
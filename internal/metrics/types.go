@@ -0,0 +1,260 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// separates label values in series keys, it can not appear in valid UTF-8
+const labelSeparator = "\xff"
+
+// family holds the series of one metric, keyed by their label values
+type family[T any] struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string]*T
+	create func() *T
+}
+
+func (f *family[T]) get(values []string) *T {
+	if len(values) != len(f.labels) {
+		panic("metrics: " + f.name + " expects labels " + strings.Join(f.labels, ", "))
+	}
+	key := strings.Join(values, labelSeparator)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	series, ok := f.series[key]
+	if !ok {
+		series = f.create()
+		f.series[key] = series
+	}
+	return series
+}
+
+// each calls fn for every series ordered by label values, with the label pairs of the series
+func (f *family[T]) each(fn func(pairs []string, series *T)) {
+	f.mutex.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*T, 0, len(keys))
+	for _, key := range keys {
+		series = append(series, f.series[key])
+	}
+	f.mutex.Unlock()
+
+	for i, key := range keys {
+		pairs := []string{}
+		if len(f.labels) > 0 {
+			for j, value := range strings.Split(key, labelSeparator) {
+				pairs = append(pairs, f.labels[j], value)
+			}
+		}
+		fn(pairs, series[i])
+	}
+}
+
+func newFamily[T any](name, help string, labels []string, create func() *T) *family[T] {
+	f := &family[T]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]*T{},
+		create: create,
+	}
+	// metrics without labels are always exposed, starting at zero
+	if len(labels) == 0 {
+		f.get(nil)
+	}
+	return f
+}
+
+// value is a float that can be updated concurrently
+type value struct {
+	mutex sync.Mutex
+	value float64
+}
+
+func (v *value) add(delta float64) {
+	v.mutex.Lock()
+	v.value += delta
+	v.mutex.Unlock()
+}
+
+func (v *value) set(val float64) {
+	v.mutex.Lock()
+	v.value = val
+	v.mutex.Unlock()
+}
+
+func (v *value) load() float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.value
+}
+
+// Counter only goes up, e.g. handled requests
+type Counter struct {
+	*family[value]
+}
+
+func newCounter(name, help string, labels []string) *Counter {
+	return &Counter{newFamily(name, help, labels, func() *value { return &value{} })}
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.get(labelValues).add(1)
+}
+
+// Add adds a non negative delta to the series of the label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.get(labelValues).add(delta)
+}
+
+// Value returns the current value of the series of the label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.get(labelValues).load()
+}
+
+func (c *Counter) Collect(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.each(func(pairs []string, series *value) {
+		writeSample(w, c.name, series.load(), pairs...)
+	})
+}
+
+// Gauge goes up and down, e.g. active connections
+type Gauge struct {
+	*family[value]
+}
+
+func newGauge(name, help string, labels []string) *Gauge {
+	return &Gauge{newFamily(name, help, labels, func() *value { return &value{} })}
+}
+
+func (g *Gauge) Set(val float64, labelValues ...string) {
+	g.get(labelValues).set(val)
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.get(labelValues).add(1)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.get(labelValues).add(-1)
+}
+
+// Value returns the current value of the series of the label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.get(labelValues).load()
+}
+
+func (g *Gauge) Collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	g.each(func(pairs []string, series *value) {
+		writeSample(w, g.name, series.load(), pairs...)
+	})
+}
+
+// buckets counts observations per upper bound, the last bucket is +Inf
+type buckets struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (b *buckets) observe(val float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	i := sort.SearchFloat64s(b.bounds, val)
+	b.counts[i]++
+	b.sum += val
+	b.count++
+}
+
+// Histogram samples observations into buckets, e.g. request durations in seconds
+type Histogram struct {
+	*family[buckets]
+}
+
+func newHistogram(name, help string, bounds []float64, labels []string) *Histogram {
+	if bounds == nil {
+		bounds = DefaultBuckets
+	}
+	bounds = append([]float64{}, bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{newFamily(name, help, labels, func() *buckets {
+		return &buckets{
+			bounds: bounds,
+			counts: make([]uint64, len(bounds)+1),
+		}
+	})}
+}
+
+// Observe adds a value to the series of the label values
+func (h *Histogram) Observe(val float64, labelValues ...string) {
+	h.get(labelValues).observe(val)
+}
+
+// Count returns the number of observations of the series of the label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	series := h.get(labelValues)
+	series.mutex.Lock()
+	defer series.mutex.Unlock()
+	return series.count
+}
+
+func (h *Histogram) Collect(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.each(func(pairs []string, series *buckets) {
+		series.mutex.Lock()
+		counts := append([]uint64{}, series.counts...)
+		sum, count := series.sum, series.count
+		series.mutex.Unlock()
+
+		cumulative := uint64(0)
+		for i, bound := range series.bounds {
+			cumulative += counts[i]
+			writeSample(w, h.name+"_bucket", float64(cumulative), append(pairs, "le", formatValue(bound))...)
+		}
+		writeSample(w, h.name+"_bucket", float64(count), append(pairs, "le", formatValue(math.Inf(1)))...)
+		writeSample(w, h.name+"_sum", sum, pairs...)
+		writeSample(w, h.name+"_count", float64(count), pairs...)
+	})
+}
+
+// Func exposes a value computed at scrape time
+type Func struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+// NewGaugeFunc creates a gauge reading its value from fn, it is not registered
+func NewGaugeFunc(name, help string, fn func() float64) *Func {
+	return &Func{name: name, help: help, kind: "gauge", value: fn}
+}
+
+// NewCounterFunc creates a counter reading its value from fn, it is not registered
+func NewCounterFunc(name, help string, fn func() float64) *Func {
+	return &Func{name: name, help: help, kind: "counter", value: fn}
+}
+
+func (f *Func) Collect(w io.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	writeSample(w, f.name, f.value())
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/gotils/config"
+	"golang.org/x/crypto/ssh"
+)
+
+// backendEnv configures a database server for TestBackends, e.g.
+// CINNAMON_TEST_DB_TYPE=mysql CINNAMON_TEST_DB_PORT=3306 go test ./internal/models/
+const backendEnv = "CINNAMON_TEST_DB_"
+
+// newBackendDB opens the server configured by the backendEnv variables and migrates it from
+// scratch, its tables are dropped before and after the test, so it has to be a scratch database.
+func newBackendDB(t *testing.T, dbType string) *dbconnect.DB {
+	options := config.NewWithInitialValues(defaultOptions)
+	options.Set("DB/TYPE", dbType, true)
+	for _, setting := range []string{"HOST", "PORT", "USERNAME", "PASSWORD", "NAME", "SSLMODE", "CHARSET", "TIMEZONE"} {
+		if value, ok := os.LookupEnv(backendEnv + setting); ok {
+			options.Set("DB/"+setting, value, true)
+		}
+	}
+	db, err := dbconnect.NewDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := dbconnect.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Down(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := migrator.Down(context.Background(), 0); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	if _, err := migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestBackends runs the same checks against SQLite and the configured database server
+func TestBackends(t *testing.T) {
+	t.Run("sqlite3", func(t *testing.T) {
+		db, _ := newSqliteDB(t)
+		testBackend(t, db)
+	})
+	if dbType := os.Getenv(backendEnv + "TYPE"); dbType != "" && dbType != "sqlite3" {
+		t.Run(dbType, func(t *testing.T) {
+			testBackend(t, newBackendDB(t, dbType))
+		})
+	}
+}
+
+func testBackend(t *testing.T, db *dbconnect.DB) {
+	testCtx := context.Background()
+	userDB, _ := NewUserDB(db)
+	keyDB, _ := NewKeyDB(db)
+	roleDB, _ := NewRoleDB(db)
+	historyDB, _ := NewHistoryDB(db)
+
+	for table, expected := range map[string]bool{"users": true, "schema_migrations": true, "unknown": false} {
+		if exists, err := db.CheckTableExists(table); err != nil || exists != expected {
+			t.Errorf("Expected table %s to exist %t, got %t (%v)", table, expected, exists, err)
+		}
+	}
+
+	// users
+	hash, err := HashPassword("testpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if err := userDB.Register(testCtx, NewUser(name, strings.ToUpper(name), name+"@example.net"), hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := userDB.Register(testCtx, NewUser("alice", "", "other@example.net"), hash); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("Expected ErrUserAlreadyExists, got %v", err)
+	}
+	if user, err := userDB.Authenticate(testCtx, "alice", "testpassword"); err != nil || user.GetID() == 0 || user.GetUsername() != "alice" || user.GetEmail() != "alice@example.net" {
+		t.Errorf("Expected alice to log in, got %v (%v)", user, err)
+	}
+	if names := strings.Join(collectUsers(t, userDB, UserQuery{Page: Page{Limit: 2}}), ","); names != "alice,bob,carol" {
+		t.Errorf("Expected alice,bob,carol over two pages, got %s", names)
+	}
+	if names := strings.Join(collectUsers(t, userDB, UserQuery{UsernamePrefix: "b", Page: Page{Descending: true}}), ","); names != "bob" {
+		t.Errorf("Expected bob by prefix, got %s", names)
+	}
+
+	alice, err := userDB.GetByUsername(testCtx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := NewUser("alice", "Al", "al@example.net")
+	updated.ID = alice.GetID()
+	if err := userDB.Update(testCtx, updated); err != nil {
+		t.Errorf("Expected the update to pass, got %v", err)
+	}
+	if user, err := userDB.GetByEmail(testCtx, "al@example.net"); err != nil || user.GetNickname() != "Al" {
+		t.Errorf("Expected the updated user, got %v (%v)", user, err)
+	}
+
+	bob, _ := userDB.GetByUsername(testCtx, "bob")
+	if err := userDB.DisableUser(testCtx, bob.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDB.Authenticate(testCtx, "bob", "testpassword"); err == nil {
+		t.Error("Expected the disabled user not to log in")
+	}
+
+	// keys
+	if _, err := keyDB.GetHostKey(testCtx); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound before the host key is set, got %v", err)
+	}
+	hostKey := []byte(strings.Repeat("private key ", 200))
+	if err := keyDB.SetHostKey(testCtx, hostKey); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := keyDB.GetHostKey(testCtx); err != nil || string(stored) != string(hostKey) {
+		t.Errorf("Expected the host key back, got %d bytes (%v)", len(stored), err)
+	}
+	keys := []ssh.PublicKey{}
+	for i := 0; i < 2; i++ {
+		publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		key, _ := ssh.NewPublicKey(publicKey)
+		if err := keyDB.AddNamedKnownHost(testCtx, "alice", fmt.Sprintf("key %d", i), key); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := keyDB.AddKnownHost(testCtx, "carol", keys[0]); err == nil {
+		t.Error("Expected a key to be added once")
+	}
+	if known, err := keyDB.CheckKnownHost(testCtx, "alice", keys[1]); err != nil || !known {
+		t.Errorf("Expected the key of alice to be known, got %t (%v)", known, err)
+	}
+	page, err := keyDB.ListKeys(testCtx, KeyQuery{UserID: alice.GetID(), Page: Page{Limit: 1}})
+	if err != nil || len(page.Keys) != 1 || page.Next == "" {
+		t.Fatalf("Expected a first page of keys, got %v (%v)", page, err)
+	}
+	if page, err = keyDB.ListKeys(testCtx, KeyQuery{UserID: alice.GetID(), Page: Page{Limit: 1, Cursor: page.Next}}); err != nil || len(page.Keys) != 1 || page.Next != "" {
+		t.Errorf("Expected the last page of keys, got %v (%v)", page, err)
+	}
+	if err := keyDB.RemoveKnownHost(testCtx, "alice", ssh.FingerprintSHA256(keys[0])); err != nil {
+		t.Errorf("Expected the key to be removed, got %v", err)
+	}
+	if err := keyDB.RemoveKnownHost(testCtx, "alice", ssh.FingerprintSHA256(keys[1])); !errors.Is(err, ErrLastKey) {
+		t.Errorf("Expected ErrLastKey for the last key, got %v", err)
+	}
+
+	// roles
+	if roles, err := roleDB.GetRoles(testCtx); err != nil || len(roles) != 2 {
+		t.Errorf("Expected the default roles, got %v (%v)", roles, err)
+	}
+	if err := roleDB.GrantRole(testCtx, "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(collectUsers(t, userDB, UserQuery{Role: "admin"}), ","); names != "alice" {
+		t.Errorf("Expected alice as admin, got %s", names)
+	}
+	if err := roleDB.SetUserRole(testCtx, "alice", "user"); err != nil {
+		t.Error(err)
+	}
+	if roles, err := roleDB.GetUserRoles(testCtx, "alice"); err != nil || len(roles) != 1 || roles[0].Name != "user" {
+		t.Errorf("Expected the admin role to be replaced, got %v (%v)", roles, err)
+	}
+	if err := roleDB.RevokeRole(testCtx, "alice", "user"); err != nil {
+		t.Error(err)
+	}
+
+	// history
+	for i := 0; i < 5; i++ {
+		if err := historyDB.AddLine(testCtx, "alice", fmt.Sprintf("line %d", i), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines, err := historyDB.GetLines(testCtx, "alice", 2); err != nil || len(lines) != 2 || lines[0].Line != "line 3" {
+		t.Errorf("Expected the newest two lines, got %v (%v)", lines, err)
+	}
+	if lines, err := historyDB.GetLines(testCtx, "alice", 0); err != nil || len(lines) != 3 {
+		t.Errorf("Expected three lines kept, got %v (%v)", lines, err)
+	}
+
+	// purging
+	carol, _ := userDB.GetByUsername(testCtx, "carol")
+	if err := userDB.DeleteUser(testCtx, carol.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := userDB.PurgeDeleted(testCtx, time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Errorf("Expected carol to be purged, got %d (%v)", purged, err)
+	}
+}
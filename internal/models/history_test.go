@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/gotils/config"
+)
+
+func TestHistoryDB(t *testing.T) {
+	options := config.NewWithInitialValues(defaultOptions)
+	db, mock, err := dbconnect.NewDBMock(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyDB, err := NewHistoryDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCtx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO command_history \\(username,line\\) VALUES \\(\\?,\\?\\)").WithArgs("alice", "echo hi").WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectQuery("SELECT id FROM command_history WHERE username = \\? ORDER BY id DESC LIMIT 1 OFFSET 1").WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec("DELETE FROM command_history WHERE \\(username = \\? AND id < \\?\\)").WithArgs("alice", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := historyDB.AddLine(testCtx, "alice", "echo hi", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, line, created_at FROM command_history WHERE username = \\? ORDER BY id DESC LIMIT 2").WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "line", "created_at"}).AddRow(3, "echo hi", now).AddRow(2, "echo before", now))
+	mock.ExpectCommit()
+	entries, err := historyDB.GetLines(testCtx, "alice", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Line != "echo before" || entries[1].Line != "echo hi" {
+		t.Errorf("Expected oldest line first, got %+v", entries)
+	}
+
+	if err := historyDB.AddLine(testCtx, "", "echo hi", 0); err != ErrInvalidUsername {
+		t.Errorf("Expected ErrInvalidUsername, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+)
+
+// tablespec:
+// Tablename: command_history
+// Columns:
+// 		id: INTEGER PRIMARY KEY
+// 		username: TEXT NOT NULL
+// 		line: TEXT NOT NULL
+// 		created_at: TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+
+type HistoryDB interface {
+	// AddLine stores a command line of the user, only the newest keep lines are kept (0 keeps all)
+	AddLine(ctx context.Context, username, line string, keep int) error
+	// GetLines returns the newest lines of the user, oldest first (0 returns all)
+	GetLines(ctx context.Context, username string, limit int) ([]HistoryEntry, error)
+	// ClearLines removes the history of the user
+	ClearLines(ctx context.Context, username string) error
+}
+
+// HistoryEntry is a command line entered by a user
+type HistoryEntry struct {
+	ID        uint
+	Line      string
+	CreatedAt time.Time
+}
+
+const history_TABLENAME = "command_history"
+
+var ErrInvalidUsername = errors.New("invalid username")
+
+type HistoryDBImpl struct {
+	*dbconnect.DB
+}
+
+func NewHistoryDB(db *dbconnect.DB) (HistoryDB, error) {
+	return &HistoryDBImpl{db}, nil
+}
+
+func (db *HistoryDBImpl) AddLine(ctx context.Context, username, line string, keep int) error {
+	if username == "" {
+		return ErrInvalidUsername
+	}
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		res, err := db.NewBuilder().
+			Insert(history_TABLENAME).
+			Columns("username", "line").
+			Values(username, line).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows != 1 {
+			return errors.New("could not insert history line")
+		}
+		if keep <= 0 {
+			return nil
+		}
+
+		// drop everything older than the oldest line kept
+		var oldest uint
+		newest := db.NewBuilder().
+			Select("id").
+			From(history_TABLENAME).
+			Where(squirrel.Eq{"username": username}).
+			OrderBy("id DESC")
+		err = db.Limit(newest, 1, uint64(keep-1)).RunWith(tx).QueryRow().Scan(&oldest)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		_, err = db.NewBuilder().
+			Delete(history_TABLENAME).
+			Where(squirrel.And{squirrel.Eq{"username": username}, squirrel.Lt{"id": oldest}}).
+			RunWith(tx).Exec()
+		return err
+	}, &sql.TxOptions{
+		ReadOnly: false,
+	})
+}
+
+func (db *HistoryDBImpl) GetLines(ctx context.Context, username string, limit int) (entries []HistoryEntry, err error) {
+	entries = []HistoryEntry{}
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		query := db.NewBuilder().
+			Select("id", "line", "created_at").
+			From(history_TABLENAME).
+			Where(squirrel.Eq{"username": username}).
+			OrderBy("id DESC")
+		if limit > 0 {
+			query = db.Limit(query, uint64(limit), 0)
+		}
+		rows, err := query.RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := HistoryEntry{}
+			if err := rows.Scan(&entry.ID, &entry.Line, &entry.CreatedAt); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return rows.Err()
+	}, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadCommitted,
+	})
+	// newest were selected first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return
+}
+
+func (db *HistoryDBImpl) ClearLines(ctx context.Context, username string) error {
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		_, err := db.NewBuilder().
+			Delete(history_TABLENAME).
+			Where(squirrel.Eq{"username": username}).
+			RunWith(tx).Exec()
+		return err
+	}, &sql.TxOptions{
+		ReadOnly: false,
+	})
+}
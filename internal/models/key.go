@@ -8,10 +8,14 @@ import (
 type Key interface {
 	// GetID returns the key's ID.
 	GetID() uint
+	// GetUserID returns the ID of the user owning the key, 0 for the host key.
+	GetUserID() uint
 	// GetIdentifier returns the key's identifier.
 	GetIdentifier() string
 	// GetKey returns the key's key.
 	GetKey() string
+	// GetName returns the name the owner gave the key, empty if unnamed.
+	GetName() string
 	// GetCreatedAt returns the key's creation time.
 	GetCreatedAt() time.Time
 	// GetUpdatedAt returns the key's last update time.
@@ -22,8 +26,10 @@ type Key interface {
 
 type KeyImpl struct {
 	ID         uint
+	UserID     uint
 	Identifier string
 	Key        string
+	Name       string
 	created_at time.Time
 	updated_at time.Time
 	deleted_at sql.NullTime
@@ -40,6 +46,10 @@ func (k *KeyImpl) GetID() uint {
 	return k.ID
 }
 
+func (k *KeyImpl) GetUserID() uint {
+	return k.UserID
+}
+
 func (k *KeyImpl) GetIdentifier() string {
 	return k.Identifier
 }
@@ -48,6 +58,10 @@ func (k *KeyImpl) GetKey() string {
 	return k.Key
 }
 
+func (k *KeyImpl) GetName() string {
+	return k.Name
+}
+
 func (k *KeyImpl) GetCreatedAt() time.Time {
 	return k.created_at
 }
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyOwnership(t *testing.T) {
+	db, conn := newSqliteDB(t)
+	userDB, _ := NewUserDB(db)
+	keyDB, err := NewKeyDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCtx := context.Background()
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(publicKey)
+
+	if err := keyDB.AddKnownHost(testCtx, "alice", key); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected keys of unknown users to be rejected, got %v", err)
+	}
+	if err := userDB.Register(testCtx, NewUser("alice", "", "alice@example.net"), "hash"); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := userDB.GetByUsername(testCtx, "alice")
+	if err := keyDB.AddKnownHost(testCtx, "alice", key); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := keyDB.GetKnownHosts(testCtx, "alice"); err != nil || len(keys) != 1 || keys[0].GetUserID() != alice.GetID() {
+		t.Errorf("Expected the key to belong to alice, got %v (%v)", keys, err)
+	}
+	if page, err := keyDB.ListKeys(testCtx, KeyQuery{UserID: alice.GetID()}); err != nil || len(page.Keys) != 1 {
+		t.Errorf("Expected the key listed by owner, got %v (%v)", page.Keys, err)
+	}
+
+	check := func(expected bool, state string) {
+		t.Helper()
+		if ok, err := keyDB.CheckKnownHost(testCtx, "alice", key); ok != expected {
+			t.Errorf("Expected the key to be accepted %t for a %s user, got %v", expected, state, err)
+		}
+	}
+	check(true, "active")
+	userDB.DisableUser(testCtx, alice.GetID())
+	check(false, "disabled")
+	userDB.EnableUser(testCtx, alice.GetID())
+	userDB.DeleteUser(testCtx, alice.GetID())
+	check(false, "deleted")
+
+	// a key stored under the name of a user without the link does not log in
+	if _, err := conn.Exec("UPDATE sshkeys SET user_id = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	userDB.RestoreUser(testCtx, alice.GetID())
+	check(false, "unlinked")
+	if _, err := keyDB.CheckKnownHost(testCtx, "alice", key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound without linked keys, got %v", err)
+	}
+
+	db.Close()
+	if ok, err := keyDB.CheckKnownHost(testCtx, "alice", key); ok || err == nil {
+		t.Errorf("Expected the failed transaction to be reported, got %t (%v)", ok, err)
+	}
+}
+
+func TestRemoveLastKeyConcurrently(t *testing.T) {
+	db, _ := newSqliteDB(t)
+	userDB, _ := NewUserDB(db)
+	keyDB, _ := NewKeyDB(db)
+	testCtx := context.Background()
+	if err := userDB.Register(testCtx, NewUser("alice", "", "alice@example.net"), "hash"); err != nil {
+		t.Fatal(err)
+	}
+	fingerprints := []string{}
+	for i := 0; i < 2; i++ {
+		publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		key, _ := ssh.NewPublicKey(publicKey)
+		if err := keyDB.AddKnownHost(testCtx, "alice", key); err != nil {
+			t.Fatal(err)
+		}
+		fingerprints = append(fingerprints, ssh.FingerprintSHA256(key))
+	}
+
+	// two sessions remove one of the last two keys each, one of them has to fail
+	errs := make(chan error, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		go func(fingerprint string) {
+			errs <- keyDB.RemoveKnownHost(testCtx, "alice", fingerprint)
+		}(fingerprint)
+	}
+	removed := 0
+	for range fingerprints {
+		if err := <-errs; err == nil {
+			removed++
+		} else if !errors.Is(err, ErrLastKey) {
+			t.Errorf("Expected ErrLastKey, got %v", err)
+		}
+	}
+	if keys, err := keyDB.GetKnownHosts(testCtx, "alice"); err != nil || removed != 1 || len(keys) != 1 {
+		t.Errorf("Expected one key to be removed and one left, got %d removed and %d left (%v)", removed, len(keys), err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/Masterminds/squirrel"
@@ -16,8 +17,10 @@ import (
 // Tablename: keys
 // Columns:
 // 		id: INTEGER PRIMARY KEY
-// 		identifier: TEXT NOT NULL UNIQUE
-// 		key: TEXT NOT NULL
+// 		user_id: INTEGER REFERENCES users (id), NULL for the host key
+// 		identifier: TEXT NOT NULL, the username of the owner
+// 		keystring: TEXT NOT NULL UNIQUE
+// 		name: TEXT
 // 		created_at: TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 // 		updated_at: TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 // 		deleted_at: TIMESTAMP
@@ -29,14 +32,31 @@ type KeyDB interface {
 	GetHostKey(ctx context.Context) (pemBytes []byte, err error)
 	// adds a new known host to the database
 	AddKnownHost(ctx context.Context, hostIdentifier string, key ssh.PublicKey) error
+	// adds a new known host with a name for the key, e.g. the comment of the authorized_keys line
+	AddNamedKnownHost(ctx context.Context, hostIdentifier, name string, key ssh.PublicKey) error
 	// checks if the given host is known
 	CheckKnownHost(ctx context.Context, hostIdentifier string, key ssh.PublicKey) (bool, error)
+	// returns all keys known for the given host
+	GetKnownHosts(ctx context.Context, hostIdentifier string) ([]Key, error)
+	// returns a page of the known keys matching the query
+	ListKeys(ctx context.Context, query KeyQuery) (KeyPage, error)
+	// removes the key with the given SHA256 fingerprint from the host, ErrLastKey for its only key
+	RemoveKnownHost(ctx context.Context, hostIdentifier string, fingerprint string) error
+	// renames the key with the given SHA256 fingerprint of the host
+	RenameKnownHost(ctx context.Context, hostIdentifier, fingerprint, name string) error
 }
 
 const key_TABLENAME = "sshkeys"
 
+// keyColumns are selected by the key listings, in the order scanKey expects
+var keyColumns = []string{"sshkeys.id", "sshkeys.user_id", "sshkeys.identifier", "sshkeys.keystring", "sshkeys.name", "sshkeys.created_at", "sshkeys.updated_at"}
+
+// keyOwnerJoin adds the owner of the keys, the host key has none
+const keyOwnerJoin = "users ON users.id = sshkeys.user_id"
+
 var (
 	ErrKeyNotFound           = errors.New("no key found")
+	ErrLastKey               = errors.New("cannot remove the last key")
 	ErrInvalidHostIdentifier = errors.New("invalid host identifier")
 	ErrHostAlreadyKnown      = errors.New("host already known")
 	ErrTableNotFound         = errors.New("table not found")
@@ -131,8 +151,9 @@ func (db *KeyDBImpl) SetHostKey(ctx context.Context, pemBytes []byte) error {
 	})
 }
 
+// GetHostKey returns the stored host key, ErrKeyNotFound if there is none
 func (db *KeyDBImpl) GetHostKey(ctx context.Context) (pemString []byte, err error) {
-	db.Transaction(ctx, func(tx *sql.Tx) error {
+	txErr := db.Transaction(ctx, func(tx *sql.Tx) error {
 		pemString = []byte{}
 		err = db.NewBuilder().
 			Select("keystring").
@@ -150,16 +171,42 @@ func (db *KeyDBImpl) GetHostKey(ctx context.Context) (pemString []byte, err erro
 		ReadOnly:  true,
 		Isolation: sql.LevelReadCommitted,
 	})
-	return []byte(pemString), nil
+	if txErr != nil {
+		return nil, txErr
+	} else if err != nil {
+		return nil, err
+	}
+	return pemString, nil
+}
+
+func (db *KeyDBImpl) AddKnownHost(ctx context.Context, hostIdentifier string, key ssh.PublicKey) error {
+	return db.addKey(ctx, hostIdentifier, sql.NullString{}, key)
+}
+
+func (db *KeyDBImpl) AddNamedKnownHost(ctx context.Context, hostIdentifier, name string, key ssh.PublicKey) error {
+	return db.addKey(ctx, hostIdentifier, sql.NullString{String: name, Valid: true}, key)
 }
 
-func (db *KeyDBImpl) AddKnownHost(ctx context.Context, hostIdentifier string, key ssh.PublicKey) (err error) {
+// addKey stores a key for the user named hostIdentifier, ErrUserNotFound if there is no such user
+func (db *KeyDBImpl) addKey(ctx context.Context, hostIdentifier string, name sql.NullString, key ssh.PublicKey) error {
 	keyString := strings.Trim(string(ssh.MarshalAuthorizedKey(key)), "\n")
 	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		var userID uint
+		err := db.NewBuilder().
+			Select("id").
+			From(user_TABLENAME).
+			Where(squirrel.Eq{"username": hostIdentifier, "deleted_at": nil}).
+			RunWith(tx).QueryRow().Scan(&userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, hostIdentifier)
+		} else if err != nil {
+			return err
+		}
+
 		res, err := db.NewBuilder().
 			Insert(key_TABLENAME).
-			Columns("identifier", "keystring").
-			Values(hostIdentifier, keyString).
+			Columns("user_id", "identifier", "keystring", "name").
+			Values(userID, hostIdentifier, keyString, name).
 			RunWith(tx).Exec()
 		if err != nil {
 			return err
@@ -168,42 +215,242 @@ func (db *KeyDBImpl) AddKnownHost(ctx context.Context, hostIdentifier string, ke
 		} else if rows != 1 {
 			return errors.New("could not insert key")
 		}
-
 		return nil
 	}, &sql.TxOptions{
 		ReadOnly: false,
 	})
 }
 
+// CheckKnownHost reports if key belongs to the user, ErrKeyNotFound if the user has no keys
 func (db *KeyDBImpl) CheckKnownHost(ctx context.Context, hostIdentifier string, key ssh.PublicKey) (ok bool, err error) {
-	db.Transaction(ctx, func(tx *sql.Tx) error {
-		var keyString string
-
-		err = db.NewBuilder().
-			Select("keystring").
+	// why no key matched, ErrKeyNotFound without keys or the error of a key that can not be parsed
+	var keyErr error
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		// users may have several keys, any of them is accepted while the owner may log in
+		rows, err := db.NewBuilder().
+			Select("sshkeys.keystring").
 			From(key_TABLENAME).
-			Where(squirrel.Eq{"identifier": hostIdentifier}).
-			RunWith(tx).QueryRow().Scan(&keyString)
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			Join(keyOwnerJoin).
+			Where(squirrel.Eq{"users.username": hostIdentifier, "users.deleted_at": nil, "users.disabled_at": nil}).
+			RunWith(tx).Query()
+		if err != nil {
 			return err
-		} else if errors.Is(err, sql.ErrNoRows) {
-			err = ErrKeyNotFound
-			return nil
 		}
-		parsedKeyString, _, _, _, parseErr := ssh.ParseAuthorizedKey([]byte(keyString))
-		if parseErr != nil {
-			err = parseErr
-			return nil
+		defer rows.Close()
+		found := false
+		for rows.Next() {
+			found = true
+			var keyString string
+			if err := rows.Scan(&keyString); err != nil {
+				return err
+			}
+			parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+			if err != nil {
+				keyErr = err
+				continue
+			}
+			if comparePublickeys(key, parsedKey) {
+				ok = true
+				return nil
+			}
 		}
-		ok = comparePublickeys(key, parsedKeyString)
-		return nil
+		if !found {
+			keyErr = ErrKeyNotFound
+		}
+		return rows.Err()
 	}, &sql.TxOptions{
 		ReadOnly:  true,
 		Isolation: sql.LevelReadCommitted,
 	})
-	return
+	if err != nil {
+		return false, err
+	} else if !ok {
+		return false, keyErr
+	}
+	return true, nil
 }
 
 func comparePublickeys(key1, key2 ssh.PublicKey) bool {
 	return bytes.Equal(ssh.MarshalAuthorizedKey(key1), ssh.MarshalAuthorizedKey(key2))
 }
+
+func (db *KeyDBImpl) GetKnownHosts(ctx context.Context, hostIdentifier string) (keys []Key, err error) {
+	keys = []Key{}
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := db.NewBuilder().
+			Select(keyColumns...).
+			From(key_TABLENAME).
+			Join(keyOwnerJoin).
+			Where(squirrel.Eq{"users.username": hostIdentifier}).
+			OrderBy("sshkeys.id").
+			RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			key, err := scanKey(rows)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	}, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadCommitted,
+	})
+	return
+}
+
+// scanKey reads a row selected with keyColumns
+func scanKey(row squirrel.RowScanner) (*KeyImpl, error) {
+	key := &KeyImpl{}
+	var userID sql.NullInt64
+	var name sql.NullString
+	if err := row.Scan(&key.ID, &userID, &key.Identifier, &key.Key, &name, &key.created_at, &key.updated_at); err != nil {
+		return nil, err
+	}
+	key.UserID = uint(userID.Int64)
+	key.Name = name.String
+	return key, nil
+}
+
+func (db *KeyDBImpl) ListKeys(ctx context.Context, query KeyQuery) (page KeyPage, err error) {
+	page.Keys = []Key{}
+	column, ok := keySortColumns[query.Sort]
+	if !ok {
+		return page, fmt.Errorf("%w: %s", ErrInvalidSort, query.Sort)
+	}
+	// the host key shares the table, its keystring is the private key
+	builder := db.NewBuilder().Select(keyColumns...).From(key_TABLENAME).Where(squirrel.NotEq{"identifier": "localhost"})
+	if query.UserID != 0 {
+		builder = builder.Where(squirrel.Eq{"user_id": query.UserID})
+	}
+	if query.Identifier != "" {
+		builder = builder.Where(squirrel.Eq{"identifier": query.Identifier})
+	}
+	if query.IdentifierPrefix != "" {
+		builder = builder.Where(likePrefix("identifier", query.IdentifierPrefix))
+	}
+	builder, err = query.Page.apply(db.DB, createdBetween(builder, query.CreatedAfter, query.CreatedBefore), column)
+	if err != nil {
+		return page, err
+	}
+
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := builder.RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			key, err := scanKey(rows)
+			if err != nil {
+				return err
+			}
+			page.Keys = append(page.Keys, key)
+		}
+		return rows.Err()
+	}, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadCommitted,
+	})
+	if size := int(query.Page.size()); err == nil && len(page.Keys) > size {
+		page.Keys = page.Keys[:size]
+		last := page.Keys[size-1]
+		value := ""
+		if column == "identifier" {
+			value = last.GetIdentifier()
+		}
+		page.Next = encodeCursor(value, last.GetID())
+	}
+	return
+}
+
+// RemoveKnownHost removes a key of the user, ErrLastKey if it is the only one left. The keys are
+// counted in the same serializable transaction, so concurrent removals can not take both last keys.
+func (db *KeyDBImpl) RemoveKnownHost(ctx context.Context, hostIdentifier string, fingerprint string) error {
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := db.NewBuilder().
+			Select(keyColumns...).
+			From(key_TABLENAME).
+			Join(keyOwnerJoin).
+			Where(squirrel.Eq{"users.username": hostIdentifier}).
+			RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var keyID uint
+		count := 0
+		for rows.Next() {
+			key, err := scanKey(rows)
+			if err != nil {
+				return err
+			}
+			count++
+			parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.GetKey()))
+			if err == nil && ssh.FingerprintSHA256(parsedKey) == fingerprint {
+				keyID = key.GetID()
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if keyID == 0 {
+			return ErrKeyNotFound
+		} else if count == 1 {
+			return ErrLastKey
+		}
+
+		res, err := db.NewBuilder().
+			Delete(key_TABLENAME).
+			Where(squirrel.Eq{"id": keyID}).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows != 1 {
+			return ErrKeyNotFound
+		}
+		return nil
+	}, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	})
+}
+
+func (db *KeyDBImpl) RenameKnownHost(ctx context.Context, hostIdentifier, fingerprint, name string) error {
+	keys, err := db.GetKnownHosts(ctx, hostIdentifier)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.GetKey()))
+		if err != nil || ssh.FingerprintSHA256(parsedKey) != fingerprint {
+			continue
+		}
+		return db.Transaction(ctx, func(tx *sql.Tx) error {
+			res, err := db.NewBuilder().
+				Update(key_TABLENAME).
+				Set("name", name).
+				Set("updated_at", squirrel.Expr("CURRENT_TIMESTAMP")).
+				Where(squirrel.Eq{"id": key.GetID()}).
+				RunWith(tx).Exec()
+			if err != nil {
+				return err
+			} else if rows, err := res.RowsAffected(); err != nil {
+				return err
+			} else if rows != 1 {
+				return ErrKeyNotFound
+			}
+			return nil
+		}, &sql.TxOptions{
+			ReadOnly: false,
+		})
+	}
+	return ErrKeyNotFound
+}
@@ -2,6 +2,10 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -29,3 +33,47 @@ func CheckPasswordHash(password, hash string) bool {
 var (
 	ErrInvalidPassword = errors.New("invalid password")
 )
+
+// bcrypt ignores everything after the first 72 bytes
+const maxPasswordLength = 72
+
+var ErrWeakPassword = errors.New("password does not meet the policy")
+
+// PasswordPolicy describes the passwords users may choose
+type PasswordPolicy struct {
+	MinLength int
+	// MinClasses is the number of character classes needed out of
+	// lower case, upper case, digits and other characters
+	MinClasses int
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 12, MinClasses: 3}
+
+// Check tells why password is not allowed for the user, nil if it is
+func (p PasswordPolicy) Check(username, password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("%w: at least %d characters needed", ErrWeakPassword, p.MinLength)
+	} else if len(password) > maxPasswordLength {
+		return fmt.Errorf("%w: at most %d bytes allowed", ErrWeakPassword, maxPasswordLength)
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return fmt.Errorf("%w: contains the username", ErrWeakPassword)
+	}
+	var lower, upper, digit, other int
+	for _, char := range password {
+		switch {
+		case unicode.IsLower(char):
+			lower = 1
+		case unicode.IsUpper(char):
+			upper = 1
+		case unicode.IsDigit(char):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	if classes := lower + upper + digit + other; classes < p.MinClasses {
+		return fmt.Errorf("%w: %d of lower case, upper case, digits and other characters needed", ErrWeakPassword, p.MinClasses)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+)
+
+const (
+	// DefaultPageSize is used by queries without a limit
+	DefaultPageSize = 50
+	// MaxPageSize caps the limit of a query
+	MaxPageSize = 1000
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidSort   = errors.New("invalid sort")
+)
+
+// DeletedFilter selects rows by their deleted_at column
+type DeletedFilter int
+
+const (
+	ExcludeDeleted DeletedFilter = iota
+	IncludeDeleted
+	OnlyDeleted
+)
+
+func (f DeletedFilter) where(column string) squirrel.Sqlizer {
+	switch f {
+	case IncludeDeleted:
+		return nil
+	case OnlyDeleted:
+		return squirrel.NotEq{column: nil}
+	}
+	return squirrel.Eq{column: nil}
+}
+
+// DisabledFilter selects users by their disabled_at column, the zero value matches all
+type DisabledFilter int
+
+const (
+	AnyDisabled DisabledFilter = iota
+	OnlyEnabled
+	OnlyDisabled
+)
+
+func (f DisabledFilter) where(column string) squirrel.Sqlizer {
+	switch f {
+	case OnlyEnabled:
+		return squirrel.Eq{column: nil}
+	case OnlyDisabled:
+		return squirrel.NotEq{column: nil}
+	}
+	return nil
+}
+
+// Page selects a slice of the sorted results, the zero value is the first page in ascending order.
+// Cursor is the Next cursor of the previous page, it is only valid for the same filters and sort.
+type Page struct {
+	Limit      int
+	Cursor     string
+	Descending bool
+}
+
+// cursor marks the last row of a page by its sort value and id
+type cursor struct {
+	Value string `json:"v,omitempty"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(value string, id uint) string {
+	raw, _ := json.Marshal(cursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (p Page) size() uint64 {
+	if p.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return uint64(min(p.Limit, MaxPageSize))
+}
+
+// apply adds the position after the cursor, the order and the limit to the query.
+// Rows are sorted by column and then by id, one row more than the page is selected
+// so the caller knows if a next page exists.
+func (p Page) apply(db *dbconnect.DB, query squirrel.SelectBuilder, column string) (squirrel.SelectBuilder, error) {
+	direction, after := " ASC", func(column string, value interface{}) squirrel.Sqlizer { return squirrel.Gt{column: value} }
+	if p.Descending {
+		direction, after = " DESC", func(column string, value interface{}) squirrel.Sqlizer { return squirrel.Lt{column: value} }
+	}
+	if p.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+		last := cursor{}
+		if err != nil || json.Unmarshal(raw, &last) != nil || last.ID == 0 {
+			return query, ErrInvalidCursor
+		}
+		if column == "id" {
+			query = query.Where(after("id", last.ID))
+		} else {
+			query = query.Where(squirrel.Or{
+				after(column, last.Value),
+				squirrel.And{squirrel.Eq{column: last.Value}, after("id", last.ID)},
+			})
+		}
+	}
+	if column != "id" {
+		query = query.OrderBy(column + direction)
+	}
+	return db.Limit(query.OrderBy("id"+direction), p.size()+1, 0), nil
+}
+
+// likePrefix matches values starting with prefix, wildcards in it are escaped, including the
+// character classes of SQL Server. The escape character is not a backslash, as MySQL would read
+// that as a string escape.
+func likePrefix(column, prefix string) squirrel.Sqlizer {
+	escaped := strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`, `[`, `![`).Replace(prefix)
+	return squirrel.Expr(column+` LIKE ? ESCAPE '!'`, escaped+"%")
+}
+
+// createdBetween limits the creation time, zero times are not limited
+func createdBetween(query squirrel.SelectBuilder, after, before time.Time) squirrel.SelectBuilder {
+	if !after.IsZero() {
+		query = query.Where(squirrel.GtOrEq{"created_at": after.UTC()})
+	}
+	if !before.IsZero() {
+		query = query.Where(squirrel.Lt{"created_at": before.UTC()})
+	}
+	return query
+}
+
+// UserSort is the order of listed users, ties are broken by the id
+type UserSort string
+
+const (
+	SortUsersByUsername UserSort = "username"
+	SortUsersByEmail    UserSort = "email"
+	// SortUsersByCreated keeps the order of registration, ids grow with it
+	SortUsersByCreated UserSort = "created"
+)
+
+var userSortColumns = map[UserSort]string{
+	"":                  "username",
+	SortUsersByUsername: "username",
+	SortUsersByEmail:    "email",
+	SortUsersByCreated:  "id",
+}
+
+// UserQuery filters, sorts and pages users, empty filters match every user.
+// The zero value lists the first page of users not deleted by username.
+type UserQuery struct {
+	Username       string
+	UsernamePrefix string
+	Email          string
+	// Role only matches users granted the role with this name
+	Role string
+	// CreatedAfter is inclusive, CreatedBefore exclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Deleted       DeletedFilter
+	Disabled      DisabledFilter
+	Sort          UserSort
+	Page
+}
+
+// UserPage is a page of users, Next is empty on the last page
+type UserPage struct {
+	Users []User
+	Next  string
+}
+
+// KeySort is the order of listed keys, ties are broken by the id
+type KeySort string
+
+const (
+	SortKeysByIdentifier KeySort = "identifier"
+	// SortKeysByCreated keeps the order in which keys were added, ids grow with it
+	SortKeysByCreated KeySort = "created"
+)
+
+var keySortColumns = map[KeySort]string{
+	"":                   "identifier",
+	SortKeysByIdentifier: "identifier",
+	SortKeysByCreated:    "id",
+}
+
+// KeyQuery filters, sorts and pages the known keys, the host key is never listed
+type KeyQuery struct {
+	// UserID only matches the keys owned by the user
+	UserID           uint
+	Identifier       string
+	IdentifierPrefix string
+	// CreatedAfter is inclusive, CreatedBefore exclusive
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Sort          KeySort
+	Page
+}
+
+// KeyPage is a page of keys, Next is empty on the last page
+type KeyPage struct {
+	Keys []Key
+	Next string
+}
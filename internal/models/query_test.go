@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// collectUsers follows the cursors of the query and returns the usernames of all pages
+func collectUsers(t *testing.T, userDB UserDB, query UserQuery) []string {
+	names := []string{}
+	for pages := 0; pages < 10; pages++ {
+		page, err := userDB.ListUsers(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, user := range page.Users {
+			names = append(names, user.GetUsername())
+		}
+		if page.Next == "" {
+			return names
+		}
+		query.Cursor = page.Next
+	}
+	t.Fatal("Expected the pages to end")
+	return nil
+}
+
+func TestListUsers(t *testing.T) {
+	userDB, conn := newSqliteUserDB(t)
+	testCtx := context.Background()
+	for _, name := range []string{"dave", "alice", "al_x", "bob", "alfred", "carol"} {
+		if err := userDB.Register(testCtx, NewUser(name, "", name+"@example.net"), "hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the admin role is created by the migrations
+	if _, err := conn.Exec("INSERT INTO user_roles (username, role_id) SELECT grants.column1, roles.id FROM roles, (VALUES ('bob'), ('carol')) AS grants WHERE roles.name = 'admin'"); err != nil {
+		t.Fatal(err)
+	}
+	carol, _ := userDB.GetByUsername(testCtx, "carol")
+	if err := userDB.DeleteUser(testCtx, carol.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	dave, _ := userDB.GetByUsername(testCtx, "dave")
+	if err := userDB.DisableUser(testCtx, dave.GetID()); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		query    UserQuery
+		expected string
+	}{
+		{"pages by username", UserQuery{Page: Page{Limit: 2}}, "al_x,alfred,alice,bob,dave"},
+		{"descending", UserQuery{Page: Page{Limit: 2, Descending: true}}, "dave,bob,alice,alfred,al_x"},
+		{"by creation", UserQuery{Sort: SortUsersByCreated, Page: Page{Limit: 4}}, "dave,alice,al_x,bob,alfred"},
+		{"by email", UserQuery{Sort: SortUsersByEmail, Deleted: IncludeDeleted, Page: Page{Limit: 3}}, "al_x,alfred,alice,bob,carol,dave"},
+		{"prefix", UserQuery{UsernamePrefix: "al"}, "al_x,alfred,alice"},
+		{"escaped prefix", UserQuery{UsernamePrefix: "al_"}, "al_x"},
+		{"email", UserQuery{Email: "bob@example.net"}, "bob"},
+		{"role", UserQuery{Role: "admin", Deleted: IncludeDeleted}, "bob,carol"},
+		{"deleted", UserQuery{Deleted: OnlyDeleted}, "carol"},
+		{"disabled", UserQuery{Disabled: OnlyDisabled}, "dave"},
+		{"enabled", UserQuery{Disabled: OnlyEnabled, UsernamePrefix: "b"}, "bob"},
+		{"created later", UserQuery{CreatedAfter: time.Now().Add(time.Hour)}, ""},
+		{"created earlier", UserQuery{CreatedBefore: time.Now().Add(time.Hour), UsernamePrefix: "d"}, "dave"},
+	}
+	for _, c := range cases {
+		if names := strings.Join(collectUsers(t, userDB, c.query), ","); names != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.name, c.expected, names)
+		}
+	}
+
+	if _, err := userDB.ListUsers(testCtx, UserQuery{Page: Page{Cursor: "not a cursor"}}); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+	if _, err := userDB.ListUsers(testCtx, UserQuery{Sort: "password"}); !errors.Is(err, ErrInvalidSort) {
+		t.Errorf("Expected ErrInvalidSort, got %v", err)
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	sql, args, err := likePrefix("username", "a[b_%!").ToSql()
+	if err != nil || sql != "username LIKE ? ESCAPE '!'" || len(args) != 1 || args[0] != "a![b!_!%!!%" {
+		t.Errorf("Expected all wildcards to be escaped, got %s %v (%v)", sql, args, err)
+	}
+
+	// escaping [ still matches it literally where it is no wildcard
+	userDB, _ := newSqliteUserDB(t)
+	for _, name := range []string{"a[b]", "ab"} {
+		if err := userDB.Register(context.Background(), NewUser(name, "", name+"@example.net"), "hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := strings.Join(collectUsers(t, userDB, UserQuery{UsernamePrefix: "a[b"}), ","); names != "a[b]" {
+		t.Errorf("Expected a[b] by prefix, got %s", names)
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	db, _ := newSqliteDB(t)
+	keyDB, err := NewKeyDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userDB, _ := NewUserDB(db)
+	testCtx := context.Background()
+	if err := keyDB.SetHostKey(testCtx, []byte("private")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := userDB.Register(testCtx, NewUser(name, "", name+"@example.net"), "hash"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, identifier := range []string{"bob", "alice", "bob", "carol", "alice"} {
+		publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		key, _ := ssh.NewPublicKey(publicKey)
+		if err := keyDB.AddNamedKnownHost(testCtx, identifier, fmt.Sprintf("key %d", i), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query := KeyQuery{Page: Page{Limit: 2}}
+	listed := []string{}
+	for {
+		page, err := keyDB.ListKeys(testCtx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range page.Keys {
+			listed = append(listed, key.GetIdentifier()+":"+key.GetName())
+		}
+		if page.Next == "" {
+			break
+		}
+		query.Cursor = page.Next
+	}
+	if expected := "alice:key 1,alice:key 4,bob:key 0,bob:key 2,carol:key 3"; strings.Join(listed, ",") != expected {
+		t.Errorf("Expected %s without the host key, got %s", expected, strings.Join(listed, ","))
+	}
+
+	page, err := keyDB.ListKeys(testCtx, KeyQuery{IdentifierPrefix: "b", Sort: SortKeysByCreated, Page: Page{Descending: true}})
+	if err != nil || len(page.Keys) != 2 || page.Keys[0].GetName() != "key 2" || page.Next != "" {
+		t.Errorf("Expected the keys of bob newest first, got %v (%v)", page.Keys, err)
+	}
+}
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+	"github.com/myLogic207/gotils/config"
+)
+
+func TestRoleDB(t *testing.T) {
+	options := config.NewWithInitialValues(defaultOptions)
+	db, mock, err := dbconnect.NewDBMock(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleDB, err := NewRoleDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCtx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM roles WHERE name = \\?").WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_roles WHERE role_id = \\? AND username = \\?").WithArgs(1, "alice").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO user_roles \\(username,role_id\\) VALUES \\(\\?,\\?\\)").WithArgs("alice", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := roleDB.GrantRole(testCtx, "alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM roles WHERE name = \\?").WithArgs("unknown").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+	if err := roleDB.GrantRole(testCtx, "alice", "unknown"); err != ErrRoleNotFound {
+		t.Errorf("Expected ErrRoleNotFound, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT roles.id, roles.name, roles.description, role_permissions.permission FROM roles LEFT JOIN role_permissions ON role_permissions.role_id = roles.id JOIN user_roles ON user_roles.role_id = roles.id WHERE user_roles.username = \\?").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "permission"}).
+			AddRow(2, "user", "default", "shell").
+			AddRow(1, "admin", nil, "*").
+			AddRow(2, "user", "default", "channel.session"))
+	mock.ExpectCommit()
+	roles, err := roleDB.GetUserRoles(testCtx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roles) != 2 || roles[0].Name != "admin" || len(roles[1].Permissions) != 2 || roles[1].Permissions[0] != "channel.session" {
+		t.Errorf("Expected roles grouped with sorted permissions, got %+v", roles)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM roles WHERE name = \\?").WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("DELETE FROM user_roles WHERE role_id = \\? AND username = \\?").WithArgs(1, "bob").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := roleDB.RevokeRole(testCtx, "bob", "admin"); err != ErrRoleNotGranted {
+		t.Errorf("Expected ErrRoleNotGranted, got %v", err)
+	}
+
+	// the other roles are revoked and the role granted in one transaction
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM roles WHERE name = \\?").WithArgs("user").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectExec("DELETE FROM user_roles WHERE username = \\? AND role_id <> \\?").WithArgs("alice", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM user_roles WHERE role_id = \\? AND username = \\?").WithArgs(2, "alice").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("INSERT INTO user_roles \\(username,role_id\\) VALUES \\(\\?,\\?\\)").WithArgs("alice", 2).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	if err := roleDB.SetUserRole(testCtx, "alice", "user"); err != nil {
+		t.Error(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
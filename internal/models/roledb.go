@@ -0,0 +1,251 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/myLogic207/cinnamon/internal/dbconnect"
+)
+
+// tablespec:
+// Tablename: roles
+// Columns:
+// 		id: INTEGER PRIMARY KEY
+// 		name: TEXT NOT NULL UNIQUE
+// 		description: TEXT
+// 		created_at: TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+// Tablename: role_permissions
+// Columns:
+// 		role_id: INTEGER NOT NULL REFERENCES roles (id)
+// 		permission: TEXT NOT NULL
+// Tablename: user_roles
+// Columns:
+// 		username: TEXT NOT NULL
+// 		role_id: INTEGER NOT NULL REFERENCES roles (id)
+// 		created_at: TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+
+type RoleDB interface {
+	// GetRoles returns all roles with their permissions
+	GetRoles(ctx context.Context) ([]Role, error)
+	// GetRole returns the role with the given name
+	GetRole(ctx context.Context, name string) (Role, error)
+	// GetUserRoles returns the roles granted to the user
+	GetUserRoles(ctx context.Context, username string) ([]Role, error)
+	// GrantRole grants the role to the user
+	GrantRole(ctx context.Context, username, role string) error
+	// RevokeRole takes the role from the user
+	RevokeRole(ctx context.Context, username, role string) error
+	// SetUserRole replaces the roles granted to the user with the role
+	SetUserRole(ctx context.Context, username, role string) error
+}
+
+// Role is a named set of permissions
+type Role struct {
+	ID          uint
+	Name        string
+	Description string
+	Permissions []string
+}
+
+const (
+	role_TABLENAME           = "roles"
+	rolePermission_TABLENAME = "role_permissions"
+	userRole_TABLENAME       = "user_roles"
+)
+
+var (
+	ErrRoleNotFound       = errors.New("no role found")
+	ErrRoleAlreadyGranted = errors.New("role already granted")
+	ErrRoleNotGranted     = errors.New("role not granted")
+)
+
+type RoleDBImpl struct {
+	*dbconnect.DB
+}
+
+func NewRoleDB(db *dbconnect.DB) (RoleDB, error) {
+	return &RoleDBImpl{db}, nil
+}
+
+// selectRoles selects the roles with one row per permission
+func (db *RoleDBImpl) selectRoles() squirrel.SelectBuilder {
+	return db.NewBuilder().
+		Select("roles.id", "roles.name", "roles.description", "role_permissions.permission").
+		From(role_TABLENAME).
+		LeftJoin(rolePermission_TABLENAME + " ON role_permissions.role_id = roles.id")
+}
+
+func (db *RoleDBImpl) queryRoles(ctx context.Context, query squirrel.SelectBuilder) (roles []Role, err error) {
+	roles = []Role{}
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := query.RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		byID := map[uint]*Role{}
+		for rows.Next() {
+			var id uint
+			var name string
+			var description, permission sql.NullString
+			if err := rows.Scan(&id, &name, &description, &permission); err != nil {
+				return err
+			}
+			role, ok := byID[id]
+			if !ok {
+				role = &Role{ID: id, Name: name, Description: description.String, Permissions: []string{}}
+				byID[id] = role
+			}
+			if permission.Valid {
+				role.Permissions = append(role.Permissions, permission.String)
+			}
+		}
+		for _, role := range byID {
+			sort.Strings(role.Permissions)
+			roles = append(roles, *role)
+		}
+		sort.Slice(roles, func(i, j int) bool {
+			return roles[i].Name < roles[j].Name
+		})
+		return rows.Err()
+	}, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadCommitted,
+	})
+	return
+}
+
+func (db *RoleDBImpl) GetRoles(ctx context.Context) ([]Role, error) {
+	return db.queryRoles(ctx, db.selectRoles())
+}
+
+func (db *RoleDBImpl) GetRole(ctx context.Context, name string) (Role, error) {
+	roles, err := db.queryRoles(ctx, db.selectRoles().Where(squirrel.Eq{"roles.name": name}))
+	if err != nil {
+		return Role{}, err
+	} else if len(roles) == 0 {
+		return Role{}, ErrRoleNotFound
+	}
+	return roles[0], nil
+}
+
+func (db *RoleDBImpl) GetUserRoles(ctx context.Context, username string) ([]Role, error) {
+	return db.queryRoles(ctx, db.selectRoles().
+		Join(userRole_TABLENAME+" ON user_roles.role_id = roles.id").
+		Where(squirrel.Eq{"user_roles.username": username}))
+}
+
+// roleID looks up the id of a role inside a transaction
+func (db *RoleDBImpl) roleID(tx *sql.Tx, name string) (uint, error) {
+	var id uint
+	err := db.NewBuilder().
+		Select("id").
+		From(role_TABLENAME).
+		Where(squirrel.Eq{"name": name}).
+		RunWith(tx).QueryRow().Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrRoleNotFound
+	}
+	return id, err
+}
+
+func (db *RoleDBImpl) GrantRole(ctx context.Context, username, role string) error {
+	if username == "" {
+		return ErrInvalidUsername
+	}
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		id, err := db.roleID(tx, role)
+		if err != nil {
+			return err
+		}
+		var granted int
+		err = db.NewBuilder().
+			Select("COUNT(*)").
+			From(userRole_TABLENAME).
+			Where(squirrel.Eq{"username": username, "role_id": id}).
+			RunWith(tx).QueryRow().Scan(&granted)
+		if err != nil {
+			return err
+		} else if granted > 0 {
+			return ErrRoleAlreadyGranted
+		}
+		res, err := db.NewBuilder().
+			Insert(userRole_TABLENAME).
+			Columns("username", "role_id").
+			Values(username, id).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows != 1 {
+			return errors.New("could not grant role")
+		}
+		return nil
+	}, &sql.TxOptions{
+		ReadOnly: false,
+	})
+}
+
+func (db *RoleDBImpl) RevokeRole(ctx context.Context, username, role string) error {
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		id, err := db.roleID(tx, role)
+		if err != nil {
+			return err
+		}
+		res, err := db.NewBuilder().
+			Delete(userRole_TABLENAME).
+			Where(squirrel.Eq{"username": username, "role_id": id}).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrRoleNotGranted
+		}
+		return nil
+	}, &sql.TxOptions{
+		ReadOnly: false,
+	})
+}
+
+func (db *RoleDBImpl) SetUserRole(ctx context.Context, username, role string) error {
+	if username == "" {
+		return ErrInvalidUsername
+	}
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		id, err := db.roleID(tx, role)
+		if err != nil {
+			return err
+		}
+		_, err = db.NewBuilder().
+			Delete(userRole_TABLENAME).
+			Where(squirrel.Eq{"username": username}).
+			Where(squirrel.NotEq{"role_id": id}).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		}
+		var granted int
+		err = db.NewBuilder().
+			Select("COUNT(*)").
+			From(userRole_TABLENAME).
+			Where(squirrel.Eq{"username": username, "role_id": id}).
+			RunWith(tx).QueryRow().Scan(&granted)
+		if err != nil || granted > 0 {
+			return err
+		}
+		_, err = db.NewBuilder().
+			Insert(userRole_TABLENAME).
+			Columns("username", "role_id").
+			Values(username, id).
+			RunWith(tx).Exec()
+		return err
+	}, &sql.TxOptions{
+		ReadOnly: false,
+	})
+}
@@ -21,18 +21,21 @@ type User interface {
 	GetUpdatedAt() time.Time
 	// IsDeleted returns true if the user is deleted.
 	IsDeleted() bool
+	// IsDisabled returns true if the user may not log in.
+	IsDisabled() bool
 	// String returns a string representation of the user.
 	String() string
 }
 
 type UserImpl struct {
-	ID         uint
-	Username   string
-	Nickname   sql.NullString
-	Email      string
-	created_at time.Time
-	updated_at time.Time
-	deleted_at sql.NullTime
+	ID          uint
+	Username    string
+	Nickname    sql.NullString
+	Email       string
+	created_at  time.Time
+	updated_at  time.Time
+	disabled_at sql.NullTime
+	deleted_at  sql.NullTime
 }
 
 func NewUser(username, nickname string, email string) *UserImpl {
@@ -89,3 +92,7 @@ func (u *UserImpl) IsDeleted() bool {
 	// no check because if field is valid, user had to be deleted
 	return u.deleted_at.Valid
 }
+
+func (u *UserImpl) IsDisabled() bool {
+	return u.disabled_at.Valid
+}
@@ -3,7 +3,12 @@ package models
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/myLogic207/cinnamon/internal/dbconnect"
@@ -35,6 +40,17 @@ var defaultOptions = map[string]interface{}{
 	},
 }
 
+const (
+	queryUserExists = "SELECT id FROM users WHERE \\(username = \\? OR email = \\?\\)"
+	queryUserPass   = "SELECT users.id, .*, hashes.pw_hash FROM hashes JOIN users ON users.id = hashes.user_id WHERE username = \\?"
+)
+
+// userPassRows returns the row Authenticate selects for a user with the password hash
+func userPassRows(id uint, username, email, hash string) *sqlmock.Rows {
+	return sqlmock.NewRows(append(slices.Clone(userColumns), "pw_hash")).
+		AddRow(id, username, username, email, time.Now(), time.Now(), nil, nil, hash)
+}
+
 func TestUserAuth(t *testing.T) {
 	options := config.NewWithInitialValues(defaultOptions)
 	db, mock, err := dbconnect.NewDBMock(options)
@@ -56,7 +72,7 @@ func TestUserAuth(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT id FROM users WHERE username = ?").WithArgs(username).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(queryUserExists).WithArgs(username, useremail).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO users").WithArgs(username, username, useremail).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectQuery("SELECT id FROM users WHERE username = ?").WithArgs(username).WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(1))
 	mock.ExpectExec("INSERT INTO hashes").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
@@ -65,18 +81,17 @@ func TestUserAuth(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// queryUserPass := "SELECT \\* FROM hashes"
-	queryUserPass := "SELECT pw_hash FROM hashes JOIN users ON users.id = hashes.user_id WHERE username = ?"
-	hashrow := sqlmock.NewRows([]string{"pw_hash"}).AddRow(passwordHash)
 	mock.ExpectBegin()
-	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(hashrow)
+	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(userPassRows(1, username, useremail, passwordHash))
 	mock.ExpectExec("UPDATE users").WithArgs(sqlmock.AnyArg(), username).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
-	if _, err := userDB.Authenticate(testCtx, username, password); err != nil {
+	if user, err := userDB.Authenticate(testCtx, username, password); err != nil {
 		t.Fatal(err)
+	} else if user.GetID() != 1 || user.GetUsername() != username || user.GetEmail() != useremail {
+		t.Errorf("Expected the authenticated user, got %+v", user)
 	}
 	mock.ExpectBegin()
-	mock.ExpectQuery(queryUserPass).WithArgs(sqlmock.AnyArg()).WillReturnRows(hashrow)
+	mock.ExpectQuery(queryUserPass).WithArgs(sqlmock.AnyArg()).WillReturnRows(userPassRows(1, username, useremail, passwordHash))
 	mock.ExpectRollback()
 	if _, err := userDB.Authenticate(testCtx, username, "wrongpassword"); err == nil {
 		t.Fatal("expected error")
@@ -111,7 +126,7 @@ func TestUpdatePassword(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT id FROM users WHERE username = ?").WithArgs(username).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(queryUserExists).WithArgs(username, useremail).WillReturnError(sql.ErrNoRows)
 	mock.ExpectExec("INSERT INTO users").WithArgs(username, username, useremail).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectQuery("SELECT id FROM users WHERE username = ?").WithArgs(username).WillReturnRows(sqlmock.NewRows([]string{"ID"}).AddRow(1))
 	mock.ExpectExec("INSERT INTO hashes").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
@@ -121,11 +136,8 @@ func TestUpdatePassword(t *testing.T) {
 	}
 
 	// check login with old password
-	queryUserPass := "SELECT pw_hash FROM hashes JOIN users ON users.id = hashes.user_id WHERE username = ?"
-	hashrow := sqlmock.NewRows([]string{"pw_hash"}).AddRow(passwordHash)
-
 	mock.ExpectBegin()
-	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(hashrow)
+	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(userPassRows(1, username, useremail, passwordHash))
 	mock.ExpectExec("UPDATE users").WithArgs(sqlmock.AnyArg(), username).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	if _, err := userDB.Authenticate(testCtx, username, password); err != nil {
@@ -137,7 +149,6 @@ func TestUpdatePassword(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	newHashrow := sqlmock.NewRows([]string{"pw_hash"}).AddRow(newPasswordHash)
 
 	mock.ExpectBegin()
 	mock.ExpectExec("UPDATE hashes").WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
@@ -148,7 +159,7 @@ func TestUpdatePassword(t *testing.T) {
 
 	// check login with new password
 	mock.ExpectBegin()
-	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(newHashrow)
+	mock.ExpectQuery(queryUserPass).WithArgs(username).WillReturnRows(userPassRows(1, username, useremail, newPasswordHash))
 	mock.ExpectExec("UPDATE users").WithArgs(sqlmock.AnyArg(), username).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	if _, err := userDB.Authenticate(testCtx, username, newPassword); err != nil {
@@ -156,3 +167,190 @@ func TestUpdatePassword(t *testing.T) {
 	}
 
 }
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MinClasses: 3}
+	cases := []struct {
+		password string
+		valid    bool
+	}{
+		{"Sh0rt!", false},
+		{"alllowercaseletters", false},
+		{"Mixed Case Words", true},
+		{"Contains alice 1", false},
+		{"Numbers 1234 and UPPER", true},
+		{strings.Repeat("Aa1", 25), false},
+	}
+	for _, c := range cases {
+		if err := policy.Check("alice", c.password); (err == nil) != c.valid {
+			t.Errorf("Checking %q: expected valid %t, got %v", c.password, c.valid, err)
+		} else if err != nil && !errors.Is(err, ErrWeakPassword) {
+			t.Errorf("Expected ErrWeakPassword, got %v", err)
+		}
+	}
+}
+
+func newSqliteUserDB(t *testing.T) (UserDB, *sql.DB) {
+	db, conn := newSqliteDB(t)
+	userDB, err := NewUserDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userDB, conn
+}
+
+// newSqliteDB opens a migrated database in a temporary folder
+func newSqliteDB(t *testing.T) (*dbconnect.DB, *sql.DB) {
+	options := config.NewWithInitialValues(defaultOptions)
+	options.Set("DB/SQLITE/PATH", filepath.Join(t.TempDir(), "cinnamon.db"), true)
+	db, err := dbconnect.NewDB(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := dbconnect.NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	return db, db.DB
+}
+
+func TestUserSoftDelete(t *testing.T) {
+	userDB, conn := newSqliteUserDB(t)
+	testCtx := context.Background()
+	hash, err := HashPassword("testpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []*UserImpl{NewUser("alice", "Alice", "alice@example.net"), NewUser("bob", "Bob", "bob@example.net")} {
+		if err := userDB.Register(testCtx, user, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := userDB.Register(testCtx, NewUser("alice", "", "other@example.net"), hash); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("Expected ErrUserAlreadyExists for a taken username, got %v", err)
+	}
+	if err := userDB.Register(testCtx, NewUser("carol", "", "bob@example.net"), hash); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("Expected ErrUserAlreadyExists for a taken email, got %v", err)
+	}
+
+	alice, err := userDB.GetByUsername(testCtx, "alice")
+	if err != nil || alice.GetNickname() != "Alice" || alice.GetCreatedAt().IsZero() || alice.IsDeleted() {
+		t.Fatalf("Expected alice, got %v (%v)", alice, err)
+	}
+	if user, err := userDB.GetByEmail(testCtx, "bob@example.net"); err != nil || user.GetUsername() != "bob" {
+		t.Errorf("Expected bob by email, got %v (%v)", user, err)
+	}
+	if _, err := userDB.GetByUsername(testCtx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	updated := NewUser("alice", "Al", "al@example.net")
+	updated.ID = alice.GetID()
+	if err := userDB.Update(testCtx, updated); err != nil {
+		t.Fatal(err)
+	}
+	if user, _ := userDB.GetByEmail(testCtx, "al@example.net"); user == nil || user.GetNickname() != "Al" {
+		t.Errorf("Expected the update to be stored, got %v", user)
+	}
+	updated.Email = "bob@example.net"
+	if err := userDB.Update(testCtx, updated); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("Expected ErrUserAlreadyExists for a taken email, got %v", err)
+	}
+
+	if err := userDB.DeleteUser(testCtx, alice.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := userDB.DeleteUser(testCtx, alice.GetID()); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected deleting twice to fail, got %v", err)
+	}
+	if _, err := userDB.GetByUsername(testCtx, "alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected deleted users to be excluded, got %v", err)
+	}
+	if _, err := userDB.Authenticate(testCtx, "alice", "testpassword"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected deleted users not to log in, got %v", err)
+	}
+	if page, err := userDB.ListUsers(testCtx, UserQuery{}); err != nil || len(page.Users) != 1 || page.Users[0].GetUsername() != "bob" {
+		t.Errorf("Expected only bob, got %v (%v)", page.Users, err)
+	}
+	if page, err := userDB.ListUsers(testCtx, UserQuery{Deleted: OnlyDeleted}); err != nil || len(page.Users) != 1 || !page.Users[0].IsDeleted() {
+		t.Errorf("Expected alice to be listed as deleted, got %v (%v)", page.Users, err)
+	}
+	if user, err := userDB.GetUser(testCtx, UserQuery{Username: "alice", Deleted: IncludeDeleted}); err != nil || !user.IsDeleted() {
+		t.Errorf("Expected GetUser to find deleted users, got %v (%v)", user, err)
+	}
+
+	if err := userDB.RestoreUser(testCtx, alice.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDB.Authenticate(testCtx, "alice", "testpassword"); err != nil {
+		t.Errorf("Expected restored user to log in, got %v", err)
+	}
+	if err := userDB.DisableUser(testCtx, alice.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userDB.Authenticate(testCtx, "alice", "testpassword"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected disabled users not to log in, got %v", err)
+	}
+
+	if _, err := conn.Exec("INSERT INTO command_history (username, line) VALUES ('alice', 'ls')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := userDB.DeleteUser(testCtx, alice.GetID()); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := userDB.PurgeDeleted(testCtx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Errorf("Expected users within the retention to be kept, purged %d (%v)", purged, err)
+	}
+	if purged, err := userDB.PurgeDeleted(testCtx, time.Now().Add(time.Second)); err != nil || purged != 1 {
+		t.Errorf("Expected alice to be purged, purged %d (%v)", purged, err)
+	}
+	if _, err := userDB.GetUser(testCtx, UserQuery{Username: "alice", Deleted: IncludeDeleted}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected purged users to be gone, got %v", err)
+	}
+	var left int
+	if err := conn.QueryRow("SELECT (SELECT COUNT(*) FROM hashes) + (SELECT COUNT(*) FROM command_history)").Scan(&left); err != nil || left != 1 {
+		t.Errorf("Expected only the hash of bob to be left, got %d (%v)", left, err)
+	}
+}
+
+func TestUserNotFound(t *testing.T) {
+	db, mock, err := dbconnect.NewDBMock(config.NewWithInitialValues(defaultOptions))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userDB, err := NewUserDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCtx := context.Background()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id, username, nickname, email, created_at, updated_at, disabled_at, deleted_at FROM users WHERE deleted_at IS NULL AND email = \\? ORDER BY username ASC, id ASC LIMIT 2").
+		WithArgs("nobody@example.net").WillReturnRows(sqlmock.NewRows(userColumns))
+	mock.ExpectCommit()
+	if _, err := userDB.GetByEmail(testCtx, "nobody@example.net"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE users SET deleted_at = \\?, updated_at = \\? WHERE id = \\? AND deleted_at IS NULL").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 7).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+	if err := userDB.DeleteUser(testCtx, 7); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(queryUserExists).WithArgs("alice", "alice@example.net").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectRollback()
+	if err := userDB.Register(testCtx, NewUser("alice", "", "alice@example.net"), "hash"); !errors.Is(err, ErrUserAlreadyExists) {
+		t.Errorf("Expected ErrUserAlreadyExists, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
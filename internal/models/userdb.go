@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Masterminds/squirrel"
@@ -13,20 +14,28 @@ import (
 type UserDB interface {
 	// Register registers a new user in the database.
 	Register(ctx context.Context, user User, password string) error
-	// GetAll retrieves all users from the database.
-	GetAll(ctx context.Context) ([]User, error)
-	// GetUser retrieves a user from the database by its ID.
-	GetUser(ctx context.Context, where map[string]interface{}, limit int) (User, error)
-	// GetByUsername retrieves a user from the database by its username.
+	// ListUsers retrieves a page of the users matching the query.
+	ListUsers(ctx context.Context, query UserQuery) (UserPage, error)
+	// GetUser retrieves the first user matching the query, the page of the query is ignored.
+	GetUser(ctx context.Context, query UserQuery) (User, error)
+	// GetByUsername retrieves a user that is not deleted by its username.
 	GetByUsername(ctx context.Context, username string) (User, error)
-	// GetByEmail retrieves a user from the database by its email.
+	// GetByEmail retrieves a user that is not deleted by its email.
 	GetByEmail(ctx context.Context, email string) (User, error)
-	// Update updates a user in the database.
+	// Update updates the nickname and email of a user in the database.
 	Update(ctx context.Context, user User) error
 	// UpdatePassword updates a user's password in the database.
 	UpdatePassword(ctx context.Context, user User, password string) error
-	// DeleteUser deletes a user from the database.
+	// DeleteUser marks a user as deleted, it is kept until PurgeDeleted removes it.
 	DeleteUser(ctx context.Context, id uint) error
+	// RestoreUser restores a deleted user.
+	RestoreUser(ctx context.Context, id uint) error
+	// PurgeDeleted removes users deleted before the given time with their passwords, keys, roles and history.
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	// DisableUser keeps a user from logging in until EnableUser is called.
+	DisableUser(ctx context.Context, id uint) error
+	// EnableUser lets a disabled user log in again.
+	EnableUser(ctx context.Context, id uint) error
 	// Authenticate authenticates a user by its username and password.
 	Authenticate(ctx context.Context, username, password string) (User, error)
 }
@@ -36,6 +45,9 @@ const (
 	userPassword_TABLENAME = "hashes"
 )
 
+// userColumns are selected by every user query, in the order scanUser expects
+var userColumns = []string{"id", "username", "nickname", "email", "created_at", "updated_at", "disabled_at", "deleted_at"}
+
 var (
 	ErrUserNotFound      = errors.New("no user found")
 	ErrUserAlreadyExists = errors.New("user already exists")
@@ -50,22 +62,28 @@ func NewUserDB(db *dbconnect.DB) (UserDB, error) {
 	return &UserDBImpl{db}, nil
 }
 
+// scanUser reads a row selected with userColumns, extra columns selected after them are scanned into extra
+func scanUser(row squirrel.RowScanner, extra ...interface{}) (*UserImpl, error) {
+	user := &UserImpl{}
+	dest := []interface{}{&user.ID, &user.Username, &user.Nickname, &user.Email, &user.created_at, &user.updated_at, &user.disabled_at, &user.deleted_at}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
 func (db *UserDBImpl) Register(ctx context.Context, user User, passwordHash string) error {
 	return db.Transaction(ctx, func(tx *sql.Tx) error {
-		// check if user already exists
+		// usernames and emails stay taken while a deleted user can be restored
 		var id uint
-		query, args, err := db.NewBuilder().
+		err := db.NewBuilder().
 			Select("id").
 			From(user_TABLENAME).
-			Where(squirrel.Eq{"username": user.GetUsername()}).ToSql()
-		if err != nil {
-			return err
-		}
-		if err := tx.QueryRow(query, args...).Scan(&id); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return err
-		}
-
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			Where(squirrel.Or{squirrel.Eq{"username": user.GetUsername()}, squirrel.Eq{"email": user.GetEmail()}}).
+			RunWith(tx).QueryRow().Scan(&id)
+		if err == nil {
+			return ErrUserAlreadyExists
+		} else if !errors.Is(err, sql.ErrNoRows) {
 			return err
 		}
 
@@ -73,7 +91,7 @@ func (db *UserDBImpl) Register(ctx context.Context, user User, passwordHash stri
 		res, err := db.NewBuilder().
 			Insert(user_TABLENAME).
 			Columns("username", "nickname", "email").
-			Values(user.GetUsername(), user.GetUsername(), user.GetEmail()).
+			Values(user.GetUsername(), user.GetNickname(), user.GetEmail()).
 			RunWith(tx).Exec()
 		if err != nil {
 			return err
@@ -113,101 +131,127 @@ func (db *UserDBImpl) Register(ctx context.Context, user User, passwordHash stri
 	})
 }
 
-func (db *UserDBImpl) GetAll(ctx context.Context) (users []User, err error) {
-	users = []User{}
+func (db *UserDBImpl) ListUsers(ctx context.Context, query UserQuery) (page UserPage, err error) {
+	page.Users = []User{}
+	column, ok := userSortColumns[query.Sort]
+	if !ok {
+		return page, fmt.Errorf("%w: %s", ErrInvalidSort, query.Sort)
+	}
+	builder := db.NewBuilder().Select(userColumns...).From(user_TABLENAME)
+	if deleted := query.Deleted.where("deleted_at"); deleted != nil {
+		builder = builder.Where(deleted)
+	}
+	if disabled := query.Disabled.where("disabled_at"); disabled != nil {
+		builder = builder.Where(disabled)
+	}
+	if query.Username != "" {
+		builder = builder.Where(squirrel.Eq{"username": query.Username})
+	}
+	if query.UsernamePrefix != "" {
+		builder = builder.Where(likePrefix("username", query.UsernamePrefix))
+	}
+	if query.Email != "" {
+		builder = builder.Where(squirrel.Eq{"email": query.Email})
+	}
+	if query.Role != "" {
+		builder = builder.Where("username IN (SELECT user_roles.username FROM user_roles JOIN roles ON roles.id = user_roles.role_id WHERE roles.name = ?)", query.Role)
+	}
+	builder, err = query.Page.apply(db.DB, createdBetween(builder, query.CreatedAfter, query.CreatedBefore), column)
+	if err != nil {
+		return page, err
+	}
+
 	err = db.Transaction(ctx, func(tx *sql.Tx) error {
-		rawUser, err := db.NewBuilder().Select("id, username, nickname, email, created_at").From(user_TABLENAME).RunWith(tx).Query()
+		rawUser, err := builder.RunWith(tx).Query()
 		if err != nil {
 			return err
 		}
 		defer rawUser.Close()
 		for rawUser.Next() {
-			id := uint(0)
-			username := ""
-			nickname := sql.NullString{}
-			email := ""
-			created_at := time.Time{}
-			deleted_at := sql.NullTime{}
-			if err := rawUser.Scan(&id, &username, &nickname, &email, &created_at, &deleted_at); err != nil {
+			user, err := scanUser(rawUser)
+			if err != nil {
 				return err
 			}
-			user := &UserImpl{
-				ID:         id,
-				Username:   username,
-				Nickname:   nickname,
-				Email:      email,
-				created_at: created_at,
-				deleted_at: deleted_at,
-			}
-			users = append(users, user)
+			page.Users = append(page.Users, user)
 		}
-		return nil
+		return rawUser.Err()
 	}, &sql.TxOptions{
 		Isolation: sql.LevelReadCommitted,
 		ReadOnly:  true,
 	})
+	if size := int(query.Page.size()); err == nil && len(page.Users) > size {
+		page.Users = page.Users[:size]
+		last := page.Users[size-1]
+		page.Next = encodeCursor(userSortValue(last, column), last.GetID())
+	}
 	return
 }
 
-func (db *UserDBImpl) GetUser(ctx context.Context, where map[string]interface{}, limit int) (user User, err error) {
-	err = db.Transaction(ctx, func(tx *sql.Tx) error {
-		// get user
-		id := uint(0)
-		username := ""
-		nickname := sql.NullString{}
-		email := ""
-		created_at := time.Time{}
-		deleted_at := sql.NullTime{}
-
-		err := db.NewBuilder().Select("id, username, nickname, email, created_at").From(user_TABLENAME).Where(where).Limit(uint64(limit)).RunWith(tx).QueryRow().Scan()
-		if err != nil {
-			return err
-		}
+// userSortValue returns the value of the sort column for a cursor
+func userSortValue(user User, column string) string {
+	switch column {
+	case "username":
+		return user.GetUsername()
+	case "email":
+		return user.GetEmail()
+	}
+	return ""
+}
 
-		user = &UserImpl{
-			ID:         id,
-			Username:   username,
-			Nickname:   nickname,
-			Email:      email,
-			created_at: created_at,
-			deleted_at: deleted_at,
-		}
+func (db *UserDBImpl) GetUser(ctx context.Context, query UserQuery) (User, error) {
+	query.Page = Page{Limit: 1}
+	page, err := db.ListUsers(ctx, query)
+	if err != nil {
+		return nil, err
+	} else if len(page.Users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return page.Users[0], nil
+}
 
-		return nil
-	}, &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
-		ReadOnly:  true,
-	})
-	return
+func (db *UserDBImpl) GetByUsername(ctx context.Context, username string) (User, error) {
+	return db.GetUser(ctx, UserQuery{Username: username})
 }
 
-func (db *UserDBImpl) GetByUsername(ctx context.Context, username string) (user User, err error) {
-	user = &UserImpl{}
-	err = db.Transaction(ctx, func(tx *sql.Tx) error {
-		return nil
-	}, &sql.TxOptions{
-		Isolation: sql.LevelReadCommitted,
-		ReadOnly:  true,
-	})
-	return
+func (db *UserDBImpl) GetByEmail(ctx context.Context, email string) (User, error) {
+	return db.GetUser(ctx, UserQuery{Email: email})
 }
 
-func (db *UserDBImpl) GetByEmail(ctx context.Context, email string) (user User, err error) {
-	user = &UserImpl{}
-	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+func (db *UserDBImpl) Update(ctx context.Context, user User) error {
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		// another user holding the email would violate the unique constraint
+		var id uint
+		err := db.NewBuilder().
+			Select("id").
+			From(user_TABLENAME).
+			Where(squirrel.Eq{"email": user.GetEmail()}).
+			Where(squirrel.NotEq{"id": user.GetID()}).
+			RunWith(tx).QueryRow().Scan(&id)
+		if err == nil {
+			return ErrUserAlreadyExists
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		result, err := db.NewBuilder().
+			Update(user_TABLENAME).
+			Set("nickname", user.GetNickname()).
+			Set("email", user.GetEmail()).
+			Set("updated_at", time.Now().UTC()).
+			Where(squirrel.Eq{"id": user.GetID(), "deleted_at": nil}).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows != 1 {
+			return ErrUserNotFound
+		}
 		return nil
 	}, &sql.TxOptions{
 		Isolation: sql.LevelReadCommitted,
-		ReadOnly:  true,
+		ReadOnly:  false,
 	})
-	return
-}
-
-func (db *UserDBImpl) Update(ctx context.Context, user User) (err error) {
-	err = db.Transaction(ctx, func(tx *sql.Tx) error {
-		return nil
-	}, &sql.TxOptions{})
-	return
 }
 
 func (db *UserDBImpl) UpdatePassword(ctx context.Context, user User, passwordHash string) error {
@@ -235,29 +279,124 @@ func (db *UserDBImpl) UpdatePassword(ctx context.Context, user User, passwordHas
 }
 
 func (db *UserDBImpl) DeleteUser(ctx context.Context, id uint) error {
-	err := db.Transaction(ctx, func(tx *sql.Tx) error {
+	return db.setTimestamp(ctx, id, "deleted_at", time.Now().UTC())
+}
+
+func (db *UserDBImpl) RestoreUser(ctx context.Context, id uint) error {
+	return db.setTimestamp(ctx, id, "deleted_at", nil)
+}
+
+func (db *UserDBImpl) DisableUser(ctx context.Context, id uint) error {
+	return db.setTimestamp(ctx, id, "disabled_at", time.Now().UTC())
+}
+
+func (db *UserDBImpl) EnableUser(ctx context.Context, id uint) error {
+	return db.setTimestamp(ctx, id, "disabled_at", nil)
+}
+
+// setTimestamp sets or clears a state column of a user, value is nil to clear it.
+// Only users in the opposite state match, so deleting twice returns ErrUserNotFound.
+func (db *UserDBImpl) setTimestamp(ctx context.Context, id uint, column string, value interface{}) error {
+	var state squirrel.Sqlizer = squirrel.NotEq{column: nil}
+	if value != nil {
+		state = squirrel.Eq{column: nil}
+	}
+	return db.Transaction(ctx, func(tx *sql.Tx) error {
+		result, err := db.NewBuilder().
+			Update(user_TABLENAME).
+			Set(column, value).
+			Set("updated_at", time.Now().UTC()).
+			Where(squirrel.Eq{"id": id}).
+			Where(state).
+			RunWith(tx).Exec()
+		if err != nil {
+			return err
+		} else if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows != 1 {
+			return ErrUserNotFound
+		}
 		return nil
 	}, &sql.TxOptions{
 		Isolation: sql.LevelReadCommitted,
 		ReadOnly:  false,
 	})
-	return err
+}
+
+func (db *UserDBImpl) PurgeDeleted(ctx context.Context, before time.Time) (purged int64, err error) {
+	err = db.Transaction(ctx, func(tx *sql.Tx) error {
+		rows, err := db.NewBuilder().
+			Select("id", "username").
+			From(user_TABLENAME).
+			Where(squirrel.NotEq{"deleted_at": nil}).
+			Where(squirrel.Lt{"deleted_at": before.UTC()}).
+			RunWith(tx).Query()
+		if err != nil {
+			return err
+		}
+		ids, usernames := []uint{}, []string{}
+		for rows.Next() {
+			var id uint
+			var username string
+			if err := rows.Scan(&id, &username); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, usernames = append(ids, id), append(usernames, username)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(ids) == 0 {
+			return err
+		}
+
+		// rows referencing the users go first
+		for _, references := range []struct {
+			table string
+			where squirrel.Sqlizer
+		}{
+			{userPassword_TABLENAME, squirrel.Eq{"user_id": ids}},
+			// keys stored before they were linked to users only name them
+			{key_TABLENAME, squirrel.Or{squirrel.Eq{"user_id": ids}, squirrel.Eq{"identifier": usernames}}},
+			{userRole_TABLENAME, squirrel.Eq{"username": usernames}},
+			{history_TABLENAME, squirrel.Eq{"username": usernames}},
+		} {
+			if _, err := db.NewBuilder().Delete(references.table).Where(references.where).RunWith(tx).Exec(); err != nil {
+				return err
+			}
+		}
+		result, err := db.NewBuilder().Delete(user_TABLENAME).Where(squirrel.Eq{"id": ids}).RunWith(tx).Exec()
+		if err != nil {
+			return err
+		}
+		purged, err = result.RowsAffected()
+		return err
+	}, &sql.TxOptions{
+		Isolation: sql.LevelReadCommitted,
+		ReadOnly:  false,
+	})
+	return
 }
 
 func (db *UserDBImpl) Authenticate(ctx context.Context, username, password string) (User, error) {
-	user := &UserImpl{}
+	var user *UserImpl
 	passwordHash := ""
+	columns := make([]string, 0, len(userColumns)+1)
+	for _, column := range userColumns {
+		columns = append(columns, user_TABLENAME+"."+column)
+	}
 
-	err := db.Transaction(ctx, func(tx *sql.Tx) error {
-		// get password hash
-		err := db.NewBuilder().
-			// Select("*").
-			Select("pw_hash").
+	err := db.Transaction(ctx, func(tx *sql.Tx) (err error) {
+		// get the user with the password hash, deleted and disabled users cannot log in
+		user, err = scanUser(db.NewBuilder().
+			Select(append(columns, "hashes.pw_hash")...).
 			From(userPassword_TABLENAME).
 			Join("users ON users.id = hashes.user_id").
 			Where(squirrel.Eq{"username": username}).
-			RunWith(tx).QueryRow().Scan(&passwordHash)
-		if err != nil {
+			Where(squirrel.Eq{"users.deleted_at": nil, "users.disabled_at": nil}).
+			RunWith(tx).QueryRow(), &passwordHash)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		} else if err != nil {
 			return err
 		}
 
@@ -284,6 +423,8 @@ func (db *UserDBImpl) Authenticate(ctx context.Context, username, password strin
 		Isolation: sql.LevelReadCommitted,
 		ReadOnly:  false,
 	})
-
-	return user, err
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
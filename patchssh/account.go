@@ -0,0 +1,216 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+)
+
+const profileUsage = "usage: profile [show | set nickname <nickname> | set email <address>]"
+
+// SetUserDB lets users manage their account from the shell and makes key logins
+// check the user account, call it before Serve
+func (s *SocketServer) SetUserDB(db models.UserDB) {
+	if db == nil {
+		return
+	}
+	s.userDB = db
+	s.loginManager.SetUserDB(db)
+	s.passwordPolicy = s.PasswordPolicy()
+}
+
+// PasswordPolicy returns the policy of the PASSWORD settings, passwords set elsewhere should follow it too
+func (s *SocketServer) PasswordPolicy() models.PasswordPolicy {
+	minLength, _ := s.config.GetInt("PASSWORD/MINLENGTH")
+	minClasses, _ := s.config.GetInt("PASSWORD/MINCLASSES")
+	return models.PasswordPolicy{MinLength: minLength, MinClasses: minClasses}
+}
+
+// whoamiCommand prints the user of the session, with -v the details of the login
+func whoamiCommand() ui.Definition {
+	definition := ui.Definition{
+		Name:  "whoami",
+		Short: "Print your user name",
+		Flags: []ui.Flag{{Name: 'v', Help: "show roles, permissions and the login details"}},
+	}
+	definition.Run = func(ctx context.Context, args []string, stdio ui.IO) error {
+		flags, operands, err := definition.ParseArgs(args)
+		if err != nil {
+			return err
+		} else if len(operands) > 0 {
+			return fmt.Errorf("%w, %s", ui.ErrUsage, definition.Usage())
+		}
+		if !flags.Has('v') {
+			_, err := fmt.Fprintln(stdio.Stdout, stdio.User.User)
+			return err
+		}
+		_, err = stdio.Stdout.Write(formatIdentity(stdio.User))
+		return err
+	}
+	return definition
+}
+
+func formatIdentity(user ui.Identity) []byte {
+	permissions := strings.Join(user.Permissions, ",")
+	if user.Admin {
+		permissions = ui.PermissionAll
+	}
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "User:\t%s\n", user.User)
+	fmt.Fprintf(writer, "Roles:\t%s\n", strings.Join(user.Roles, ","))
+	fmt.Fprintf(writer, "Permissions:\t%s\n", permissions)
+	fmt.Fprintf(writer, "Key:\t%s\n", user.Fingerprint)
+	fmt.Fprintf(writer, "Address:\t%s\n", user.RemoteAddr)
+	fmt.Fprintf(writer, "Session:\t%s\n", user.SessionID)
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+// profileCommand shows the account of the user and changes its nickname or email
+func profileCommand(db models.UserDB) ui.Definition {
+	return ui.Definition{
+		Name:        "profile",
+		Short:       "Show or change your nickname and email",
+		Args:        "[show | set nickname <nickname> | set email <address>]",
+		Permissions: []string{PermissionAccount},
+		Run: func(ctx context.Context, args []string, stdio ui.IO) error {
+			output, err := profile(ctx, db, stdio.User.User, args)
+			if len(output) > 0 {
+				if _, writeErr := stdio.Stdout.Write(append(output, '\n')); writeErr != nil && err == nil {
+					err = writeErr
+				}
+			}
+			return err
+		},
+		Complete: func(ctx context.Context, user ui.Identity, args []string, word string) []string {
+			if len(args) == 0 {
+				return []string{"show", "set"}
+			} else if len(args) == 1 && args[0] == "set" {
+				return []string{"nickname", "email"}
+			}
+			return nil
+		},
+	}
+}
+
+func profile(ctx context.Context, db models.UserDB, username string, args []string) ([]byte, error) {
+	account, err := db.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || (args[0] == "show" && len(args) == 1) {
+		return bytes.TrimSuffix(formatProfile(account), []byte("\n")), nil
+	} else if args[0] != "set" || len(args) < 3 {
+		return nil, fmt.Errorf("%w, %s", ui.ErrUsage, profileUsage)
+	}
+	nickname, email := account.GetNickname(), account.GetEmail()
+	value := strings.Join(args[2:], " ")
+	switch args[1] {
+	case "nickname":
+		nickname = value
+	case "email":
+		address, err := mail.ParseAddress(value)
+		if err != nil || address.Name != "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidEmail, value)
+		}
+		email = address.Address
+	default:
+		return nil, fmt.Errorf("%w, %s", ui.ErrUsage, profileUsage)
+	}
+	updated := models.NewUser(account.GetUsername(), nickname, email)
+	updated.ID = account.GetID()
+	if err := db.Update(ctx, updated); err != nil {
+		return nil, err
+	}
+	audit.Record(ctx, audit.Event{
+		Type:    audit.EventProfileChanged,
+		Details: map[string]string{"field": args[1]},
+	})
+	return []byte(fmt.Sprintf("%s changed to %s", args[1], value)), nil
+}
+
+func formatProfile(user models.User) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "Username:\t%s\n", user.GetUsername())
+	fmt.Fprintf(writer, "Nickname:\t%s\n", user.GetNickname())
+	fmt.Fprintf(writer, "Email:\t%s\n", user.GetEmail())
+	if !user.GetCreatedAt().IsZero() {
+		fmt.Fprintf(writer, "Created:\t%s\n", user.GetCreatedAt().Format("2006-01-02 15:04"))
+	}
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+// passwdCommand changes the password of the user, the passwords are read without echo
+func passwdCommand(db models.UserDB, policy models.PasswordPolicy) ui.Definition {
+	return ui.Definition{
+		Name:        "passwd",
+		Short:       "Change your password",
+		Long:        fmt.Sprintf("Asks for the current and the new password. New passwords need at least %d characters of %d classes out of lower case, upper case, digits and other characters.", policy.MinLength, policy.MinClasses),
+		Permissions: []string{PermissionAccount},
+		Run: func(ctx context.Context, args []string, stdio ui.IO) error {
+			if len(args) > 0 {
+				return fmt.Errorf("%w, usage: passwd", ui.ErrUsage)
+			} else if stdio.ReadPassword == nil || stdio.Piped {
+				return fmt.Errorf("%w: passwd", ErrNoTerminal)
+			}
+			username := stdio.User.User
+			current, err := stdio.ReadPassword("Current password: ")
+			if err != nil {
+				return err
+			}
+			_, err = db.Authenticate(ctx, username, current)
+			if errors.Is(err, models.ErrUserNotFound) || errors.Is(err, models.ErrInvalidPassword) {
+				audit.Record(ctx, audit.Event{
+					Type:    audit.EventPasswordChanged,
+					Details: map[string]string{"result": "invalid_password"},
+				})
+				return models.ErrInvalidPassword
+			} else if err != nil {
+				return err
+			}
+			password, err := stdio.ReadPassword("New password: ")
+			if err != nil {
+				return err
+			}
+			if password == current {
+				return fmt.Errorf("%w: same as the current password", models.ErrWeakPassword)
+			} else if err := policy.Check(username, password); err != nil {
+				return err
+			}
+			repeated, err := stdio.ReadPassword("Repeat new password: ")
+			if err != nil {
+				return err
+			} else if repeated != password {
+				return ErrPasswordMismatch
+			}
+			hash, err := models.HashPassword(password)
+			if err != nil {
+				return err
+			}
+			user, err := db.GetByUsername(ctx, username)
+			if err != nil {
+				return err
+			}
+			if err := db.UpdatePassword(ctx, user, hash); err != nil {
+				return err
+			}
+			audit.Record(ctx, audit.Event{
+				Type:    audit.EventPasswordChanged,
+				Details: map[string]string{"result": "success"},
+			})
+			_, err = fmt.Fprintln(stdio.Stdout, "password changed")
+			return err
+		},
+	}
+}
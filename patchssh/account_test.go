@@ -0,0 +1,226 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/recording"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"golang.org/x/crypto/ssh"
+)
+
+type testUserDB struct {
+	models.UserDB
+	users     map[string]*testUser
+	passwords map[string]string
+	// roles are the granted role names by username, used by the role filter
+	roles map[string][]string
+}
+
+// testUser keeps the state the model only sets when reading from the database
+type testUser struct {
+	*models.UserImpl
+	disabled bool
+	deleted  bool
+}
+
+func (u *testUser) IsDisabled() bool { return u.disabled }
+
+func (u *testUser) IsDeleted() bool { return u.deleted }
+
+func newTestUserDB(users ...*models.UserImpl) *testUserDB {
+	db := &testUserDB{users: map[string]*testUser{}, passwords: map[string]string{}}
+	for i, user := range users {
+		user.ID = uint(i + 1)
+		db.users[user.Username] = &testUser{UserImpl: user}
+	}
+	return db
+}
+
+func (db *testUserDB) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	user, ok := db.users[username]
+	if !ok {
+		return nil, models.ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (db *testUserDB) Update(ctx context.Context, user models.User) error {
+	updated := db.users[user.GetUsername()]
+	updated.UserImpl = models.NewUser(user.GetUsername(), user.GetNickname(), user.GetEmail())
+	updated.ID = user.GetID()
+	return nil
+}
+
+func (db *testUserDB) Authenticate(ctx context.Context, username, password string) (models.User, error) {
+	if db.passwords[username] != password {
+		return nil, models.ErrInvalidPassword
+	}
+	return &models.UserImpl{}, nil
+}
+
+func (db *testUserDB) UpdatePassword(ctx context.Context, user models.User, hash string) error {
+	db.passwords[user.GetUsername()] = hash
+	return nil
+}
+
+// answers returns a ReadPassword reading the given lines
+func answers(lines ...string) func(string) (string, error) {
+	return func(prompt string) (string, error) {
+		if len(lines) == 0 {
+			return "", errors.New("no more input")
+		}
+		line := lines[0]
+		lines = lines[1:]
+		return line, nil
+	}
+}
+
+func TestAccountCommands(t *testing.T) {
+	db := newTestUserDB(models.NewUser("alice", "alice", "alice@example.com"))
+	db.passwords["alice"] = "Old password 1"
+	identity := ui.Identity{User: "alice", Roles: []string{"user"}, Permissions: []string{PermissionAccount}}
+	shell := ui.NewShellWrapper(TESTSERVER.logger)
+	shell.Register(whoamiCommand())
+	shell.Register(profileCommand(db))
+	shell.Register(passwdCommand(db, models.DefaultPasswordPolicy))
+	shell.SetIdentity(identity)
+
+	if out, err := shell.Execute(context.TODO(), "whoami"); err != nil || string(out) != "alice" {
+		t.Errorf("Expected user name, got %q (%v)", out, err)
+	}
+	if out, err := shell.Execute(context.TODO(), "whoami -v"); err != nil || !strings.Contains(string(out), "Roles:        user") {
+		t.Errorf("Expected login details, got %q (%v)", out, err)
+	}
+	if _, err := shell.Execute(context.TODO(), "profile set email not-an-address"); !errors.Is(err, ErrInvalidEmail) {
+		t.Errorf("Expected ErrInvalidEmail, got %v", err)
+	}
+	if _, err := shell.Execute(context.TODO(), "profile set nickname Alice Liddell"); err != nil || db.users["alice"].GetNickname() != "Alice Liddell" {
+		t.Errorf("Expected nickname to change, got %v", err)
+	}
+	if out, err := shell.Execute(context.TODO(), "profile"); err != nil || !strings.Contains(string(out), "Alice Liddell") {
+		t.Errorf("Expected profile, got %q (%v)", out, err)
+	}
+
+	passwd := func(lines ...string) error {
+		return shell.Run(context.TODO(), "passwd", ui.IO{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}, ReadPassword: answers(lines...)})
+	}
+	if _, err := shell.Execute(context.TODO(), "passwd"); !errors.Is(err, ErrNoTerminal) {
+		t.Errorf("Expected ErrNoTerminal, got %v", err)
+	}
+	if err := passwd("wrong"); !errors.Is(err, models.ErrInvalidPassword) {
+		t.Errorf("Expected ErrInvalidPassword, got %v", err)
+	}
+	if err := passwd("Old password 1", "short"); !errors.Is(err, models.ErrWeakPassword) {
+		t.Errorf("Expected ErrWeakPassword, got %v", err)
+	}
+	if err := passwd("Old password 1", "New password 2", "New password 3"); !errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Expected ErrPasswordMismatch, got %v", err)
+	}
+	if err := passwd("Old password 1", "New password 2", "New password 2"); err != nil {
+		t.Fatal(err)
+	}
+	if !models.CheckPasswordHash("New password 2", db.passwords["alice"]) {
+		t.Error("Expected the new password to be stored hashed")
+	}
+}
+
+// pipeChannel is a session channel fed by the test, the output is kept for waitOutput
+type pipeChannel struct {
+	ssh.Channel
+	input  *io.PipeReader
+	mutex  sync.Mutex
+	output bytes.Buffer
+}
+
+func (c *pipeChannel) Read(data []byte) (int, error) { return c.input.Read(data) }
+func (c *pipeChannel) Write(data []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.output.Write(data)
+}
+func (c *pipeChannel) Stderr() io.ReadWriter { return &bytes.Buffer{} }
+func (c *pipeChannel) Close() error          { return nil }
+
+func (c *pipeChannel) waitOutput(t *testing.T, expected string) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mutex.Lock()
+		found := strings.Contains(c.output.String(), expected)
+		c.mutex.Unlock()
+		if found {
+			return
+		}
+	}
+	t.Fatalf("Expected %q in the terminal output", expected)
+}
+
+func TestPasswdNotRecorded(t *testing.T) {
+	db := newTestUserDB(models.NewUser("alice", "alice", "alice@example.com"))
+	db.passwords["alice"] = "Old password 1"
+	shell := ui.NewShellWrapper(TESTSERVER.logger)
+	shell.Register(passwdCommand(db, models.DefaultPasswordPolicy))
+	shell.SetIdentity(ui.Identity{User: "alice", Permissions: []string{PermissionAccount}})
+	store, err := recording.NewStore(t.TempDir(), 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := store.Start("alice", "abc", 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, writer := io.Pipe()
+	channel := &pipeChannel{input: reader}
+	terminal := ui.NewTerminalWrapper(TESTSERVER.logger, channel, shell)
+	terminal.Record(recorder)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		terminal.Do(context.TODO())
+	}()
+
+	io.WriteString(writer, "passwd\r")
+	for _, step := range [][2]string{
+		{"Current password: ", "Old password 1\r"},
+		{"New password: ", "New password 2\r"},
+		{"Repeat new password: ", "New password 2\r"},
+		// keys typed while a password is read are not recorded, so exit waits for passwd
+		{"password changed", "exit\r"},
+	} {
+		channel.waitOutput(t, step[0])
+		io.WriteString(writer, step[1])
+	}
+	<-done
+	writer.Close()
+	if !models.CheckPasswordHash("New password 2", db.passwords["alice"]) {
+		t.Fatal("Expected the password to change")
+	}
+
+	infos, _ := store.List("alice")
+	file, err := store.Open(infos[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	_, events, err := recording.Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := ""
+	for _, event := range events {
+		if event.Kind == "i" {
+			input += event.Data
+		}
+	}
+	if input != "passwd\rexit\r" {
+		t.Errorf("Expected only the command lines to be recorded, got %q", input)
+	}
+}
@@ -20,6 +20,9 @@ var ErrKeyNotSupported = errors.New("key type not supported")
 // ErrAuthFailed indicates a generic authentication failure.
 var ErrAuthFailed = errors.New("authentication failed")
 
+// ErrUserDisabled indicates that the user may not log in until enabled again.
+var ErrUserDisabled = errors.New("user is disabled")
+
 // ErrAuthFailedReason provides additional context for authentication failure.
 type ErrAuthFailedReason struct {
 	reason error
@@ -38,11 +41,32 @@ func (e ErrAuthFailedReason) Unwrap() error {
 // AuthManager manages SSH authentication.
 type AuthManager struct {
 	models.KeyDB
+	userDB models.UserDB
 }
 
 // NewAuthManager creates a new AuthManager instance.
 func NewAuthManager(keyDB models.KeyDB) *AuthManager {
-	return &AuthManager{keyDB}
+	return &AuthManager{KeyDB: keyDB}
+}
+
+// SetUserDB makes key logins resolve the user first, unknown, disabled and deleted users are rejected.
+func (km *AuthManager) SetUserDB(userDB models.UserDB) {
+	km.userDB = userDB
+}
+
+// checkUser returns why the user may not log in, nil without a user database.
+func (km *AuthManager) checkUser(ctx context.Context, username string) error {
+	if km.userDB == nil {
+		return nil
+	}
+	// deleted users are not found
+	user, err := km.userDB.GetByUsername(ctx, username)
+	if err != nil {
+		return err
+	} else if user.IsDisabled() {
+		return ErrUserDisabled
+	}
+	return nil
 }
 
 // guestLogin returns guest user permissions if the user is "guest".
@@ -67,7 +91,12 @@ func (km *AuthManager) PublicKeyCallback(c ssh.ConnMetadata, pubKey ssh.PublicKe
 		return nil, ErrKeyNotSupported
 	}
 
-	if ok, err := km.CheckKnownHost(context.Background(), c.User(), pubKey); err != nil {
+	ctx := context.Background()
+	if err := km.checkUser(ctx, c.User()); err != nil {
+		return nil, ErrAuthFailedReason{err}
+	}
+
+	if ok, err := km.CheckKnownHost(ctx, c.User(), pubKey); err != nil {
 		return nil, ErrAuthFailedReason{err}
 	} else if !ok {
 		return nil, ErrAuthFailed
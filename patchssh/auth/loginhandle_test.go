@@ -4,11 +4,11 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
-	"database/sql"
 	"errors"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/myLogic207/cinnamon/internal/dbconnect"
@@ -72,6 +72,9 @@ var defaultOptions = map[string]interface{}{
 	},
 }
 
+// queryUserKeys loads the keys of a user that may log in
+const queryUserKeys = "SELECT sshkeys.keystring FROM sshkeys JOIN users ON users.id = sshkeys.user_id WHERE users.deleted_at IS NULL AND users.disabled_at IS NULL AND users.username = \\?"
+
 func TestPublicKeyCallback(t *testing.T) {
 	testCtx := context.Background()
 	options := config.NewWithInitialValues(defaultOptions)
@@ -91,7 +94,7 @@ func TestPublicKeyCallback(t *testing.T) {
 	key, _ := ssh.NewPublicKey(testPubKey)
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("known").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(queryUserKeys).WithArgs("known").WillReturnRows(sqlmock.NewRows([]string{"keystring"}))
 	mock.ExpectCommit()
 	// test before add aka unknown key
 	if perms, err := manager.PublicKeyCallback(TestConnMetadata{user: "known"}, key); err == nil {
@@ -102,7 +105,8 @@ func TestPublicKeyCallback(t *testing.T) {
 
 	pubKey := strings.Trim(string(ssh.MarshalAuthorizedKey(key)), "\n")
 	mock.ExpectBegin()
-	mock.ExpectExec("INSERT INTO sshkeys").WithArgs("known", pubKey).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT id FROM users WHERE").WithArgs("known").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO sshkeys").WithArgs(1, "known", pubKey, nil).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	// add key
 	if err := manager.AddKnownHost(testCtx, "known", key); err != nil {
@@ -110,7 +114,7 @@ func TestPublicKeyCallback(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("known").WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(string(ssh.MarshalAuthorizedKey(key))))
+	mock.ExpectQuery(queryUserKeys).WithArgs("known").WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(string(ssh.MarshalAuthorizedKey(key))))
 	mock.ExpectCommit()
 	// test after add aka known key
 	if perms, err := manager.PublicKeyCallback(TestConnMetadata{user: "known"}, key); err != nil {
@@ -120,7 +124,7 @@ func TestPublicKeyCallback(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("unknown").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(queryUserKeys).WithArgs("unknown").WillReturnRows(sqlmock.NewRows([]string{"keystring"}))
 	mock.ExpectCommit()
 	// Test unknown user
 	_, err = manager.PublicKeyCallback(TestConnMetadata{user: "unknown"}, key)
@@ -128,3 +132,67 @@ func TestPublicKeyCallback(t *testing.T) {
 		t.Errorf("Expected error of type ErrAuthFailedReason, got %v", err)
 	}
 }
+
+type testUserDB struct {
+	models.UserDB
+	users map[string]*models.UserImpl
+}
+
+func (db *testUserDB) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	user, ok := db.users[username]
+	if !ok {
+		return nil, models.ErrUserNotFound
+	}
+	return user, nil
+}
+
+// acceptingKeyDB knows every key, so only the user decides the login
+type acceptingKeyDB struct {
+	models.KeyDB
+}
+
+func (db acceptingKeyDB) CheckKnownHost(ctx context.Context, identifier string, key ssh.PublicKey) (bool, error) {
+	return true, nil
+}
+
+func TestPublicKeyCallbackUserState(t *testing.T) {
+	options := config.NewWithInitialValues(defaultOptions)
+	db, mock, err := dbconnect.NewDBMock(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userDB, err := models.NewUserDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewAuthManager(acceptingKeyDB{})
+	manager.SetUserDB(userDB)
+	testPubKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	key, _ := ssh.NewPublicKey(testPubKey)
+
+	columns := []string{"id", "username", "nickname", "email", "created_at", "updated_at", "disabled_at", "deleted_at"}
+	cases := []struct {
+		user     string
+		rows     *sqlmock.Rows
+		expected error
+	}{
+		{"active", sqlmock.NewRows(columns).AddRow(1, "active", nil, "a@example.net", time.Now(), time.Now(), nil, nil), nil},
+		{"disabled", sqlmock.NewRows(columns).AddRow(2, "disabled", nil, "d@example.net", time.Now(), time.Now(), time.Now(), nil), ErrUserDisabled},
+		// deleted users are excluded by the query
+		{"deleted", sqlmock.NewRows(columns), models.ErrUserNotFound},
+	}
+	for _, c := range cases {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT (.+) FROM users WHERE deleted_at IS NULL AND username = \\?").WithArgs(c.user).WillReturnRows(c.rows)
+		mock.ExpectCommit()
+		perms, err := manager.PublicKeyCallback(TestConnMetadata{user: c.user}, key)
+		if c.expected == nil && (err != nil || perms == nil) {
+			t.Errorf("Expected %s to log in, got %v", c.user, err)
+		} else if c.expected != nil && (!errors.Is(err, ErrAuthFailed) || !strings.Contains(err.Error(), c.expected.Error())) {
+			t.Errorf("Expected %s to be rejected with %v, got %v", c.user, c.expected, err)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,132 @@
+package patchssh
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefix of ban targets naming a user instead of an address
+	banUserPrefix = "user:"
+	// disconnect reason for banned addresses, see RFC 4253 section 11.1
+	disconnectHostNotAllowed uint32 = 1
+)
+
+// Ban blocks an address, a network or a user from connecting
+type Ban struct {
+	// Target is an ip, a CIDR or "user:<name>"
+	Target    string    `json:"target"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is zero for permanent bans
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && now.After(b.ExpiresAt)
+}
+
+// BanList holds the bans of a server, expired bans are ignored
+type BanList struct {
+	mutex sync.RWMutex
+	bans  map[string]Ban
+}
+
+func NewBanList() *BanList {
+	return &BanList{
+		bans: map[string]Ban{},
+	}
+}
+
+// Add bans the target, a duration of 0 bans permanently. An existing ban of the target is replaced.
+func (b *BanList) Add(target, reason string, duration time.Duration) (Ban, error) {
+	target = strings.TrimSpace(target)
+	if !strings.HasPrefix(target, banUserPrefix) {
+		if ip := net.ParseIP(target); ip != nil {
+			target = ip.String()
+		} else if _, network, err := net.ParseCIDR(target); err == nil {
+			target = network.String()
+		} else {
+			return Ban{}, ErrInvalidBanTarget
+		}
+	} else if target == banUserPrefix {
+		return Ban{}, ErrInvalidBanTarget
+	}
+
+	ban := Ban{
+		Target:    target,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if duration > 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(duration)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.bans[target] = ban
+	return ban, nil
+}
+
+// Remove lifts the ban of the target
+func (b *BanList) Remove(target string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.bans[target]; !ok {
+		return ErrBanNotFound
+	}
+	delete(b.bans, target)
+	return nil
+}
+
+// List returns all active bans, ordered by target
+func (b *BanList) List() []Ban {
+	now := time.Now()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	bans := []Ban{}
+	for _, ban := range b.bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Target < bans[j].Target
+	})
+	return bans
+}
+
+// bannedAddr returns the ban matching the address of a connection
+func (b *BanList) bannedAddr(addr net.Addr) (Ban, bool) {
+	ip := net.ParseIP(addrIP(addr))
+	if ip == nil {
+		return Ban{}, false
+	}
+	now := time.Now()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for target, ban := range b.bans {
+		if strings.HasPrefix(target, banUserPrefix) || ban.expired(now) {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(target); err == nil && network.Contains(ip) {
+			return ban, true
+		} else if target == ip.String() {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// bannedUser returns the ban of a user
+func (b *BanList) bannedUser(user string) (Ban, bool) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	ban, ok := b.bans[banUserPrefix+user]
+	if !ok || ban.expired(time.Now()) {
+		return Ban{}, false
+	}
+	return ban, true
+}
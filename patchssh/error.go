@@ -6,10 +6,35 @@ import (
 )
 
 var (
-	ErrWorkerPoolInit        = errors.New("error initializing worker pool")
-	ErrWorkerPoolAlreadyInit = errors.New("worker pool already initialized")
-	ErrMissingDBConn         = errors.New("missing database connection")
-	ErrSSHConfig             = errors.New("error loading ssh config")
+	ErrWorkerPoolInit         = errors.New("error initializing worker pool")
+	ErrWorkerPoolAlreadyInit  = errors.New("worker pool already initialized")
+	ErrMissingDBConn          = errors.New("missing database connection")
+	ErrSSHConfig              = errors.New("error loading ssh config")
+	ErrListener               = errors.New("listener failed")
+	ErrInvalidListenAddr      = errors.New("invalid listen address")
+	ErrUnknownNetwork         = errors.New("unknown network")
+	ErrMissingPort            = errors.New("missing port")
+	ErrNotASocket             = errors.New("path exists and is not a socket")
+	ErrNoSystemdSockets       = errors.New("no sockets passed by systemd")
+	ErrProxyHeader            = errors.New("error reading proxy protocol header")
+	ErrProxyHeaderMissing     = errors.New("missing proxy protocol header")
+	ErrProxyHeaderInvalid     = errors.New("invalid proxy protocol header")
+	ErrBanned                 = errors.New("banned")
+	ErrBanNotFound            = errors.New("ban not found")
+	ErrInvalidBanTarget       = errors.New("ban target must be an ip, a CIDR or user:<name>")
+	ErrTooManyConnections     = errors.New("too many connections")
+	ErrTooManyConnectionsIP   = errors.New("too many connections from this address")
+	ErrTooManyConnectionsUser = errors.New("too many connections for this user")
+	ErrKeyExists              = errors.New("key already added")
+	ErrNoAgent                = errors.New("no agent forwarded")
+	ErrInvalidSignature       = errors.New("invalid ssh signature")
+	ErrKeyNotProven           = errors.New("possession of the key not proven")
+	ErrPasswordMismatch       = errors.New("passwords do not match")
+	ErrInvalidEmail           = errors.New("invalid email address")
+	ErrNoTerminal             = errors.New("command needs a terminal")
+	ErrInvalidUsername        = errors.New("invalid username")
+	ErrSelfAction             = errors.New("admins cannot do this to themselves")
+	ErrNoRoleDB               = errors.New("roles are not enabled")
 )
 
 type ErrSSHConfigReason struct {
@@ -35,3 +60,55 @@ func (e ErrInitWorkerPoolReason) Error() string {
 func (e ErrInitWorkerPoolReason) Unwrap() error {
 	return ErrWorkerPoolInit
 }
+
+type ErrListenerReason struct {
+	reason error
+}
+
+func (e ErrListenerReason) Error() string {
+	return fmt.Sprintf("listener failed: %s", e.reason.Error())
+}
+
+func (e ErrListenerReason) Unwrap() error {
+	return ErrListener
+}
+
+type ErrListenAddrReason struct {
+	addr   string
+	reason error
+}
+
+func (e ErrListenAddrReason) Error() string {
+	return fmt.Sprintf("invalid listen address '%s': %s", e.addr, e.reason.Error())
+}
+
+func (e ErrListenAddrReason) Unwrap() error {
+	return ErrInvalidListenAddr
+}
+
+type ErrProxyHeaderReason struct {
+	reason error
+}
+
+func (e ErrProxyHeaderReason) Error() string {
+	return fmt.Sprintf("error reading proxy protocol header: %s", e.reason.Error())
+}
+
+func (e ErrProxyHeaderReason) Unwrap() error {
+	return ErrProxyHeader
+}
+
+type ErrBannedReason struct {
+	reason string
+}
+
+func (e ErrBannedReason) Error() string {
+	if e.reason == "" {
+		return "banned"
+	}
+	return fmt.Sprintf("banned: %s", e.reason)
+}
+
+func (e ErrBannedReason) Unwrap() error {
+	return ErrBanned
+}
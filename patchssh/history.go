@@ -0,0 +1,49 @@
+package patchssh
+
+import (
+	"context"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+)
+
+// historyStore keeps the shell history of users in the database
+type historyStore struct {
+	db models.HistoryDB
+	// size is the number of lines kept per user, maxLine the longest line stored
+	size    int
+	maxLine int
+}
+
+func (h *historyStore) Add(ctx context.Context, user, line string) error {
+	if h.maxLine > 0 && len(line) > h.maxLine {
+		return nil
+	}
+	return h.db.AddLine(ctx, user, line, h.size)
+}
+
+func (h *historyStore) Lines(ctx context.Context, user string, limit int) ([]ui.HistoryLine, error) {
+	entries, err := h.db.GetLines(ctx, user, limit)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]ui.HistoryLine, len(entries))
+	for i, entry := range entries {
+		lines[i] = ui.HistoryLine{Line: entry.Line, Time: entry.CreatedAt}
+	}
+	return lines, nil
+}
+
+func (h *historyStore) Clear(ctx context.Context, user string) error {
+	return h.db.ClearLines(ctx, user)
+}
+
+// SetHistoryDB keeps the shell history of users in db if HISTORY/ACTIVE is set, call it before Serve
+func (s *SocketServer) SetHistoryDB(db models.HistoryDB) {
+	if active, _ := s.config.GetBool("HISTORY/ACTIVE"); !active || db == nil {
+		return
+	}
+	size, _ := s.config.GetInt("HISTORY/SIZE")
+	maxLine, _ := s.config.GetInt("HISTORY/MAXLINE")
+	s.history = &historyStore{db: db, size: size, maxLine: maxLine}
+}
@@ -0,0 +1,119 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"github.com/myLogic207/gotils/config"
+	"golang.org/x/crypto/ssh"
+)
+
+type testHistoryDB struct {
+	mutex sync.Mutex
+	lines map[string][]string
+}
+
+func (db *testHistoryDB) AddLine(ctx context.Context, username, line string, keep int) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.lines[username] = append(db.lines[username], line)
+	return nil
+}
+
+func (db *testHistoryDB) GetLines(ctx context.Context, username string, limit int) ([]models.HistoryEntry, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	entries := []models.HistoryEntry{}
+	for _, line := range db.lines[username] {
+		entries = append(entries, models.HistoryEntry{Line: line, CreatedAt: time.Now()})
+	}
+	return entries, nil
+}
+
+func (db *testHistoryDB) ClearLines(ctx context.Context, username string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	delete(db.lines, username)
+	return nil
+}
+
+// guestShell runs the lines in a guest terminal and returns the output once expected is shown
+func guestShell(t *testing.T, address string, expected string, lines ...string) string {
+	t.Helper()
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "guest",
+		Auth:            []ssh.AuthMethod{ssh.Password("")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	// errors of the shell are written to stderr
+	output, writer := io.Pipe()
+	session.Stdout, session.Stderr = writer, writer
+	stdin, _ := session.StdinPipe()
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		io.WriteString(stdin, line+"\r")
+	}
+
+	timer := time.AfterFunc(5*time.Second, func() { writer.Close() })
+	defer timer.Stop()
+	buffer := bytes.Buffer{}
+	chunk := make([]byte, 256)
+	for !strings.Contains(buffer.String(), expected) {
+		n, err := output.Read(chunk)
+		buffer.Write(chunk[:n])
+		if err != nil {
+			t.Fatalf("Expected %q in the guest terminal, got %q (%v)", expected, buffer.String(), err)
+		}
+	}
+	return buffer.String()
+}
+
+func TestGuestHistory(t *testing.T) {
+	serverConf := config.NewWithInitialValues(testServerConf)
+	if err := serverConf.Set("PORT", 22225, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverConf.Set("HISTORY/ACTIVE", true, true); err != nil {
+		t.Fatal(err)
+	}
+	historyDB := &testHistoryDB{lines: map[string][]string{}}
+	server, err := newTestServer(testKeyDB, serverConf, func(server *SocketServer) {
+		server.SetHistoryDB(historyDB)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	guestShell(t, "127.0.0.1:22225", "top secret", "echo top secret")
+	output := guestShell(t, "127.0.0.1:22225", ui.ErrCommandNotFound.Error(), "history")
+	if strings.Contains(output, "top secret") {
+		t.Errorf("Expected the second guest not to see the first one, got %q", output)
+	}
+	historyDB.mutex.Lock()
+	defer historyDB.mutex.Unlock()
+	if len(historyDB.lines) != 0 {
+		t.Errorf("Expected no history for guests, got %v", historyDB.lines)
+	}
+}
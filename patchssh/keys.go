@@ -0,0 +1,255 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/auth"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const keysUsage = "usage: keys [list | add <authorized_keys line> | remove <fingerprint> | rename <fingerprint> <name>]"
+
+// keysNamespace separates signatures of key challenges from signatures made for other purposes
+const keysNamespace = "cinnamon-keys"
+
+const (
+	// challengeSize is the number of random bytes signed to prove possession of a key
+	challengeSize = 32
+	// maxSignatureSize limits the pasted signature
+	maxSignatureSize = 16 * 1024
+	// keyEOT ends the input on Ctrl-D
+	keyEOT = 0x04
+)
+
+// agentOpener opens the agent forwarded by the client, ErrNoAgent if there is none
+type agentOpener func(ctx context.Context) (agent.Agent, io.Closer, error)
+
+// keysCommand lets users manage the keys they log in with. New keys are only accepted
+// after the user proved to hold the private key, the last key cannot be removed.
+func keysCommand(db models.KeyDB, openAgent agentOpener) ui.Definition {
+	return ui.Definition{
+		Name:  "keys",
+		Short: "List, add, remove and rename your login keys",
+		Long: "New keys have to sign a challenge, either through the forwarded agent (ssh -A) or by pasting a signature made with ssh-keygen -Y sign. " +
+			"The key used for the current login is marked with *. The last key cannot be removed.",
+		Args:        "[list | add <authorized_keys line> | remove <fingerprint> | rename <fingerprint> <name>]",
+		Permissions: []string{PermissionKeys},
+		Run: func(ctx context.Context, args []string, stdio ui.IO) error {
+			user := stdio.User.User
+			if len(args) == 0 || (args[0] == "list" && len(args) == 1) {
+				keys, err := db.GetKnownHosts(ctx, user)
+				if err != nil {
+					return err
+				}
+				_, err = stdio.Stdout.Write(formatKeys(keys, stdio.User.Fingerprint))
+				return err
+			}
+			switch {
+			case args[0] == "add" && len(args) > 1:
+				return addKey(ctx, db, openAgent, strings.Join(args[1:], " "), stdio)
+			case args[0] == "remove" && len(args) == 2:
+				return removeKey(ctx, db, args[1], stdio)
+			case args[0] == "rename" && len(args) > 2:
+				name := strings.Join(args[2:], " ")
+				if err := db.RenameKnownHost(ctx, user, args[1], name); err != nil {
+					return err
+				}
+				_, err := fmt.Fprintf(stdio.Stdout, "key %s renamed to %s\n", args[1], name)
+				return err
+			}
+			return fmt.Errorf("%w, %s", ui.ErrUsage, keysUsage)
+		},
+		Complete: func(ctx context.Context, user ui.Identity, args []string, word string) []string {
+			if len(args) == 0 {
+				return []string{"list", "add", "remove", "rename"}
+			} else if len(args) != 1 || (args[0] != "remove" && args[0] != "rename") {
+				return nil
+			}
+			keys, err := db.GetKnownHosts(ctx, user.User)
+			if err != nil {
+				return nil
+			}
+			fingerprints := []string{}
+			for _, key := range keys {
+				if parsed, err := parseKey(key); err == nil {
+					fingerprints = append(fingerprints, ssh.FingerprintSHA256(parsed))
+				}
+			}
+			return fingerprints
+		},
+	}
+}
+
+func addKey(ctx context.Context, db models.KeyDB, openAgent agentOpener, line string, stdio ui.IO) error {
+	user := stdio.User.User
+	key, name, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(auth.SupportedKeyTypes, key.Type()) {
+		return fmt.Errorf("%w: %s", auth.ErrKeyNotSupported, key.Type())
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	keys, err := db.GetKnownHosts(ctx, user)
+	if err != nil {
+		return err
+	}
+	if _, ok := findKey(keys, fingerprint); ok {
+		return fmt.Errorf("%w: %s", ErrKeyExists, fingerprint)
+	}
+	proof, err := proveKey(ctx, key, openAgent, stdio)
+	if err != nil {
+		return err
+	}
+	if err := db.AddNamedKnownHost(ctx, user, name, key); err != nil {
+		return err
+	}
+	audit.Record(ctx, audit.Event{
+		Type:        audit.EventKeyAdded,
+		Fingerprint: fingerprint,
+		Details: map[string]string{
+			"username": user,
+			"proof":    proof,
+		},
+	})
+	_, err = fmt.Fprintf(stdio.Stdout, "key %s added\n", fingerprint)
+	return err
+}
+
+func removeKey(ctx context.Context, db models.KeyDB, fingerprint string, stdio ui.IO) error {
+	user := stdio.User.User
+	// the database refuses to remove the last key, concurrent sessions can not race past it
+	if err := db.RemoveKnownHost(ctx, user, fingerprint); errors.Is(err, models.ErrKeyNotFound) {
+		return fmt.Errorf("%w: %s", err, fingerprint)
+	} else if err != nil {
+		return err
+	}
+	audit.Record(ctx, audit.Event{
+		Type:        audit.EventKeyRemoved,
+		Fingerprint: fingerprint,
+		Details:     map[string]string{"username": user},
+	})
+	_, err := fmt.Fprintf(stdio.Stdout, "key %s removed\n", fingerprint)
+	return err
+}
+
+// proveKey has the user sign a random challenge with key, through the forwarded agent if it holds
+// the key and by pasting a signature otherwise. It returns how the key was proven.
+func proveKey(ctx context.Context, key ssh.PublicKey, openAgent agentOpener, stdio ui.IO) (string, error) {
+	challenge := make([]byte, challengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	if openAgent != nil {
+		keyAgent, closer, err := openAgent(ctx)
+		if err != nil && !errors.Is(err, ErrNoAgent) {
+			return "", err
+		} else if err == nil {
+			signature, signErr := keyAgent.Sign(key, challenge)
+			closer.Close()
+			if signErr == nil {
+				if err := key.Verify(challenge, signature); err != nil {
+					return "", fmt.Errorf("%w: %s", ErrKeyNotProven, err.Error())
+				}
+				return "agent", nil
+			}
+			fmt.Fprintln(stdio.Stdout, "The forwarded agent cannot sign with the key.")
+		}
+	}
+	if stdio.Stdin == nil || stdio.Piped {
+		return "", fmt.Errorf("%w, forward an agent holding the key or run the command in a terminal", ErrKeyNotProven)
+	}
+	message := hex.EncodeToString(challenge)
+	fmt.Fprintf(stdio.Stdout, "Sign the challenge with the new key and paste the signature:\n  echo %s | ssh-keygen -Y sign -n %s -f <private key file>\n", message, keysNamespace)
+	armored, err := readSignature(stdio.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotProven, err.Error())
+	}
+	// echo ends the challenge with a newline
+	if err := verifySSHSignature(armored, key, keysNamespace, []byte(message+"\n")); err != nil {
+		return "", err
+	}
+	return "signature", nil
+}
+
+// readSignature reads the terminal input up to the end of an armored signature. The terminal
+// sends carriage returns, input before the armor is ignored.
+func readSignature(stdin io.Reader) ([]byte, error) {
+	armored := &bytes.Buffer{}
+	line := []byte{}
+	char := make([]byte, 1)
+	for read := 0; read < maxSignatureSize; read++ {
+		if _, err := io.ReadFull(stdin, char); err != nil {
+			return nil, err
+		}
+		switch char[0] {
+		case '\r', '\n':
+			trimmed := bytes.TrimSpace(line)
+			line = line[:0]
+			if armored.Len() == 0 && !bytes.HasPrefix(trimmed, []byte("-----BEGIN ")) {
+				continue
+			}
+			armored.Write(trimmed)
+			armored.WriteByte('\n')
+			if bytes.HasPrefix(trimmed, []byte("-----END ")) {
+				return armored.Bytes(), nil
+			}
+		case keyEOT:
+			return nil, io.ErrUnexpectedEOF
+		default:
+			line = append(line, char[0])
+		}
+	}
+	return nil, errors.New("signature too long")
+}
+
+func parseKey(key models.Key) (ssh.PublicKey, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.GetKey()))
+	return parsed, err
+}
+
+// findKey returns the key with the SHA256 fingerprint
+func findKey(keys []models.Key, fingerprint string) (models.Key, bool) {
+	for _, key := range keys {
+		if parsed, err := parseKey(key); err == nil && ssh.FingerprintSHA256(parsed) == fingerprint {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func formatKeys(keys []models.Key, current string) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "\tFINGERPRINT\tTYPE\tNAME\tADDED")
+	for _, key := range keys {
+		parsed, err := parseKey(key)
+		if err != nil {
+			continue
+		}
+		fingerprint, marker := ssh.FingerprintSHA256(parsed), ""
+		if fingerprint == current {
+			marker = "*"
+		}
+		added := ""
+		if !key.GetCreatedAt().IsZero() {
+			added = key.GetCreatedAt().Format("2006-01-02")
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", marker, fingerprint, parsed.Type(), key.GetName(), added)
+	}
+	writer.Flush()
+	return buffer.Bytes()
+}
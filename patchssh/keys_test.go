@@ -0,0 +1,169 @@
+package patchssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type testUserKeyDB struct {
+	models.KeyDB
+	keys map[string][]models.Key
+}
+
+func (db *testUserKeyDB) GetKnownHosts(ctx context.Context, identifier string) ([]models.Key, error) {
+	return db.keys[identifier], nil
+}
+
+func (db *testUserKeyDB) AddNamedKnownHost(ctx context.Context, identifier, name string, key ssh.PublicKey) error {
+	db.keys[identifier] = append(db.keys[identifier], &models.KeyImpl{Identifier: identifier, Key: string(ssh.MarshalAuthorizedKey(key)), Name: name})
+	return nil
+}
+
+func (db *testUserKeyDB) RemoveKnownHost(ctx context.Context, identifier, fingerprint string) error {
+	for i, key := range db.keys[identifier] {
+		if parsed, _ := parseKey(key); ssh.FingerprintSHA256(parsed) != fingerprint {
+			continue
+		} else if len(db.keys[identifier]) == 1 {
+			return models.ErrLastKey
+		}
+		db.keys[identifier] = append(db.keys[identifier][:i], db.keys[identifier][i+1:]...)
+		return nil
+	}
+	return models.ErrKeyNotFound
+}
+
+func (db *testUserKeyDB) RenameKnownHost(ctx context.Context, identifier, fingerprint, name string) error {
+	key, ok := findKey(db.keys[identifier], fingerprint)
+	if !ok {
+		return models.ErrKeyNotFound
+	}
+	key.(*models.KeyImpl).Name = name
+	return nil
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// signSSHSignature creates an armored signature like ssh-keygen -Y sign
+func signSSHSignature(t *testing.T, signer ssh.Signer, namespace string, message []byte) []byte {
+	digest := sha512.Sum512(message)
+	signed := sshSignedData{Namespace: namespace, HashAlgorithm: "sha512", Hash: digest[:]}
+	copy(signed.Magic[:], sshSignatureMagic)
+	signature, err := signer.Sign(rand.Reader, ssh.Marshal(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := sshSignature{
+		Version:       sshSignatureVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(signature),
+	}
+	copy(blob.Magic[:], sshSignatureMagic)
+	return pem.EncodeToMemory(&pem.Block{Type: sshSignatureType, Bytes: ssh.Marshal(blob)})
+}
+
+// runKeysCommand runs the command as alice, answer gets the output up to the challenge and returns the input
+func runKeysCommand(command ui.Definition, args []string, answer func(challenge string) []byte) (string, error) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- command.Run(context.TODO(), args, ui.IO{
+			Stdin:  stdinReader,
+			Stdout: stdoutWriter,
+			Stderr: io.Discard,
+			User:   ui.Identity{User: "alice"},
+		})
+		stdoutWriter.Close()
+	}()
+	output := &strings.Builder{}
+	scanner := bufio.NewScanner(stdoutReader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		output.WriteString(line + "\n")
+		if challenge, ok := strings.CutPrefix(strings.TrimSpace(line), "echo "); ok && answer != nil {
+			input := answer(strings.Fields(challenge)[0])
+			go stdinWriter.Write(bytes.ReplaceAll(input, []byte("\n"), []byte("\r")))
+		}
+	}
+	return output.String(), <-done
+}
+
+func TestKeysCommand(t *testing.T) {
+	login := newTestSigner(t)
+	db := &testUserKeyDB{keys: map[string][]models.Key{}}
+	db.AddNamedKnownHost(context.TODO(), "alice", "laptop", login.PublicKey())
+	keyring := agent.NewKeyring()
+	openAgent := func(ctx context.Context) (agent.Agent, io.Closer, error) {
+		return keyring, io.NopCloser(nil), nil
+	}
+	command := keysCommand(db, openAgent)
+
+	// the agent does not hold the key, the user pastes a signature
+	pasted := newTestSigner(t)
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pasted.PublicKey()))) + " desktop"
+	out, err := runKeysCommand(command, []string{"add", line}, func(challenge string) []byte {
+		return signSSHSignature(t, pasted, keysNamespace, []byte(challenge+"\n"))
+	})
+	if err != nil || !strings.Contains(out, "cannot sign") || len(db.keys["alice"]) != 2 || db.keys["alice"][1].GetName() != "desktop" {
+		t.Fatalf("Expected pasted signature to prove the key, got %s (%v)", out, err)
+	}
+	if _, err := runKeysCommand(command, []string{"add", line}, nil); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+
+	other := newTestSigner(t)
+	if _, err := runKeysCommand(command, []string{"add", string(ssh.MarshalAuthorizedKey(other.PublicKey()))}, func(challenge string) []byte {
+		return signSSHSignature(t, newTestSigner(t), keysNamespace, []byte(challenge+"\n"))
+	}); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected a signature of another key to be rejected, got %v", err)
+	}
+
+	// the agent proves the key without asking the user
+	agentKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	if err := keyring.Add(agent.AddedKey{PrivateKey: agentKey}); err != nil {
+		t.Fatal(err)
+	}
+	agentSigner, _ := ssh.NewSignerFromKey(agentKey)
+	if out, err := runKeysCommand(command, []string{"add", string(ssh.MarshalAuthorizedKey(agentSigner.PublicKey()))}, nil); err != nil || len(db.keys["alice"]) != 3 {
+		t.Fatalf("Expected agent to prove the key, got %s (%v)", out, err)
+	}
+
+	fingerprint := ssh.FingerprintSHA256(pasted.PublicKey())
+	if _, err := runKeysCommand(command, []string{"rename", fingerprint, "old", "desktop"}, nil); err != nil || db.keys["alice"][1].GetName() != "old desktop" {
+		t.Errorf("Expected key to be renamed, got %v", err)
+	}
+	for _, signer := range []ssh.Signer{pasted, agentSigner} {
+		if _, err := runKeysCommand(command, []string{"remove", ssh.FingerprintSHA256(signer.PublicKey())}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := runKeysCommand(command, []string{"remove", ssh.FingerprintSHA256(login.PublicKey())}, nil); !errors.Is(err, models.ErrLastKey) {
+		t.Errorf("Expected ErrLastKey, got %v", err)
+	}
+	if out, err := runKeysCommand(command, nil, nil); err != nil || !strings.Contains(out, "laptop") {
+		t.Errorf("Expected the remaining key to be listed, got %s (%v)", out, err)
+	}
+}
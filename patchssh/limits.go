@@ -0,0 +1,141 @@
+package patchssh
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// disconnect reason codes, see RFC 4253 section 11.1
+const (
+	disconnectTooManyConnections uint32 = 12
+)
+
+// disconnectMsg mirrors the unexported message of x/crypto/ssh so it can be
+// sent before the key exchange, where no ssh.Conn exists yet
+type disconnectMsg struct {
+	Reason   uint32 `sshtype:"1"`
+	Message  string
+	Language string
+}
+
+// connLimiter tracks concurrent connections globally, per remote ip and per
+// authenticated user. A limit of 0 disables the respective check.
+type connLimiter struct {
+	mutex      sync.Mutex
+	maxTotal   int
+	maxPerIP   int
+	maxPerUser int
+	total      int
+	perIP      map[string]int
+	perUser    map[string]int
+}
+
+func newConnLimiter(maxTotal, maxPerIP, maxPerUser int) *connLimiter {
+	return &connLimiter{
+		maxTotal:   maxTotal,
+		maxPerIP:   maxPerIP,
+		maxPerUser: maxPerUser,
+		perIP:      map[string]int{},
+		perUser:    map[string]int{},
+	}
+}
+
+// acquireConn reserves a slot for a freshly accepted connection
+func (l *connLimiter) acquireConn(addr net.Addr) error {
+	ip := addrIP(addr)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return ErrTooManyConnections
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return ErrTooManyConnectionsIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+func (l *connLimiter) releaseConn(addr net.Addr) {
+	ip := addrIP(addr)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// acquireUser reserves a slot for an authenticated user
+func (l *connLimiter) acquireUser(user string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.maxPerUser > 0 && l.perUser[user] >= l.maxPerUser {
+		return ErrTooManyConnectionsUser
+	}
+	l.perUser[user]++
+	return nil
+}
+
+func (l *connLimiter) releaseUser(user string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.perUser[user]--; l.perUser[user] <= 0 {
+		delete(l.perUser, user)
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.IPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sendDisconnect performs the version exchange on a raw connection and sends an
+// unencrypted disconnect message, as allowed before the first key exchange
+func sendDisconnect(conn net.Conn, serverVersion string, reason uint32, message string) error {
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(serverVersion + "\r\n")); err != nil {
+		return err
+	}
+	// consume the client version, so closing does not reset the connection early
+	reader := bufio.NewReaderSize(conn, 256)
+	if _, err := reader.ReadSlice('\n'); err != nil {
+		return err
+	}
+
+	payload := ssh.Marshal(&disconnectMsg{
+		Reason:  reason,
+		Message: message,
+	})
+	// without a cipher the block size is 8 and at least 4 bytes of padding are required
+	padding := 8 - (5+len(payload))%8
+	if padding < 4 {
+		padding += 8
+	}
+	packet := make([]byte, 5+len(payload)+padding)
+	binary.BigEndian.PutUint32(packet, uint32(1+len(payload)+padding))
+	packet[4] = byte(padding)
+	copy(packet[5:], payload)
+	if _, err := rand.Read(packet[5+len(payload):]); err != nil {
+		return err
+	}
+	_, err := conn.Write(packet)
+	return err
+}
@@ -0,0 +1,182 @@
+package patchssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// first file descriptor passed by systemd socket activation
+	systemdFirstFD = 3
+)
+
+// listenAddr is a parsed entry of the LISTENERS config
+// supported forms are:
+//
+//	tcp://127.0.0.1:2222, tcp4://0.0.0.0:2222, tcp6://[::1]:2222
+//	unix:///run/cinnamon.sock?mode=0660
+//	systemd:// (all passed sockets) or systemd://<name> (sockets with FileDescriptorName)
+type listenAddr struct {
+	network string
+	address string
+	mode    os.FileMode
+}
+
+func (a listenAddr) String() string {
+	return a.network + "://" + a.address
+}
+
+func parseListenAddr(raw string) (listenAddr, error) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return listenAddr{}, ErrListenAddrReason{raw, err}
+	}
+	addr := listenAddr{network: parsed.Scheme}
+	switch parsed.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		if parsed.Port() == "" {
+			return listenAddr{}, ErrListenAddrReason{raw, ErrMissingPort}
+		}
+		addr.address = parsed.Host
+	case "unix":
+		addr.address = parsed.Path
+		addr.mode = 0660
+		if rawMode := parsed.Query().Get("mode"); rawMode != "" {
+			mode, err := strconv.ParseUint(rawMode, 8, 32)
+			if err != nil {
+				return listenAddr{}, ErrListenAddrReason{raw, err}
+			}
+			addr.mode = os.FileMode(mode)
+		}
+	case "systemd":
+		addr.address = parsed.Host
+	default:
+		return listenAddr{}, ErrListenAddrReason{raw, ErrUnknownNetwork}
+	}
+	return addr, nil
+}
+
+// listenAddrs resolves the configured listen addresses, falling back to ADDRESS and PORT
+func (s *SocketServer) listenAddrs() ([]listenAddr, error) {
+	raw, err := s.config.Get("LISTENERS")
+	if err != nil {
+		addr, _ := s.config.GetString("ADDRESS")
+		port, _ := s.config.GetInt("PORT")
+		return []listenAddr{{
+			network: "tcp",
+			address: net.JoinHostPort(addr, strconv.Itoa(port)),
+		}}, nil
+	}
+
+	var entries []string
+	switch list := raw.(type) {
+	case string:
+		entries = strings.Split(list, ",")
+	case []string:
+		entries = list
+	case []interface{}:
+		for _, entry := range list {
+			entries = append(entries, fmt.Sprint(entry))
+		}
+	default:
+		return nil, ErrListenAddrReason{fmt.Sprint(raw), ErrUnknownNetwork}
+	}
+
+	addrs := []listenAddr{}
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		addr, err := parseListenAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+func (s *SocketServer) listen(ctx context.Context, addr listenAddr, keepAlive time.Duration) ([]net.Listener, error) {
+	switch addr.network {
+	case "unix":
+		return listenUnix(ctx, addr)
+	case "systemd":
+		return systemdListeners(addr.address)
+	}
+	listenConfig := net.ListenConfig{
+		KeepAlive: keepAlive,
+		Control:   nil,
+	}
+	listener, err := listenConfig.Listen(ctx, addr.network, addr.address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+func listenUnix(ctx context.Context, addr listenAddr) ([]net.Listener, error) {
+	// remove a stale socket left by an unclean exit, but never a regular file
+	if stat, err := os.Lstat(addr.address); err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, ErrListenAddrReason{addr.String(), ErrNotASocket}
+		}
+		if err := os.Remove(addr.address); err != nil {
+			return nil, err
+		}
+	}
+	listenConfig := net.ListenConfig{}
+	listener, err := listenConfig.Listen(ctx, "unix", addr.address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(addr.address, addr.mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// filtered by their FileDescriptorName if name is set
+func systemdListeners(name string) ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, ErrNoSystemdSockets
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, ErrNoSystemdSockets
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := []net.Listener{}
+	for i := 0; i < count; i++ {
+		fd := systemdFirstFD + i
+		fdName := ""
+		if i < len(names) {
+			fdName = names[i]
+		}
+		if name != "" && fdName != name {
+			continue
+		}
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "systemd:"+fdName)
+		listener, err := net.FileListener(file)
+		// FileListener duplicates the descriptor
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, ErrNoSystemdSockets
+	}
+	return listeners, nil
+}
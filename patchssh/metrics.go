@@ -0,0 +1,31 @@
+package patchssh
+
+import "github.com/myLogic207/cinnamon/internal/metrics"
+
+// results of accepted connections
+const (
+	connResultAccepted   = "accepted"
+	connResultBanned     = "banned"
+	connResultLimited    = "limited"
+	connResultProxyError = "proxy_error"
+)
+
+var (
+	connectionsTotal  = metrics.NewCounter("cinnamon_connections_total", "Connections accepted on the listeners, by result.", "result")
+	connectionsActive = metrics.NewGauge("cinnamon_connections_active", "Connections currently handled.")
+	handshakeDuration = metrics.NewHistogram("cinnamon_handshake_duration_seconds", "Duration of ssh handshakes including authentication, by result.", nil, "result")
+	authAttempts      = metrics.NewCounter("cinnamon_auth_attempts_total", "Authentication attempts, by method and result.", "method", "result")
+	sessionsActive    = metrics.NewGauge("cinnamon_sessions_active", "Session channels currently open.")
+	channelsOpened    = metrics.NewCounter("cinnamon_channels_opened_total", "Channels requested by clients, by type and result. Unsupported types are counted as unknown.", "type", "result")
+	workersTotal      = metrics.NewGauge("cinnamon_workers", "Size of the connection worker pool.")
+	workersBusy       = metrics.NewGauge("cinnamon_workers_busy", "Workers currently handling a connection.")
+	workersQueued     = metrics.NewGauge("cinnamon_workers_queued", "Connections waiting for a free worker.")
+)
+
+// resultLabel turns an error into a success or failure label
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,187 @@
+package patchssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// longest possible v1 header, including CRLF
+	proxyV1MaxLength = 107
+	proxyV2HeaderLen = 16
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyConn replaces the remote address of a connection with the one announced
+// in its PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyTrust decides which upstreams may send a PROXY protocol header
+type proxyTrust struct {
+	networks []*net.IPNet
+	unix     bool
+}
+
+// parseProxyTrust reads a comma separated list of CIDRs, "unix" trusts unix socket peers
+func parseProxyTrust(raw string) (*proxyTrust, error) {
+	trust := &proxyTrust{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		} else if entry == "unix" {
+			trust.unix = true
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		trust.networks = append(trust.networks, network)
+	}
+	return trust, nil
+}
+
+func (t *proxyTrust) trusts(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return t.unix
+	}
+	ip := net.ParseIP(addrIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY protocol header from conn.
+// Headers without an address (UNKNOWN, LOCAL, unsupported families) keep the
+// address of the connection.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReaderSize(conn, 256)
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, ErrProxyHeaderReason{err}
+	}
+
+	var remote net.Addr
+	if bytes.Equal(signature, proxyV2Signature) {
+		remote, err = readProxyV2(reader)
+	} else if bytes.HasPrefix(signature, proxyV1Prefix) {
+		remote, err = readProxyV1(reader)
+	} else {
+		err = ErrProxyHeaderMissing
+	}
+	if err != nil {
+		return nil, ErrProxyHeaderReason{err}
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{
+		Conn:   conn,
+		reader: reader,
+		remote: remote,
+	}, nil
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <srcport> <dstport>\r\n"
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrProxyHeaderInvalid
+		}
+		char, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, char)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeaderInvalid
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeaderInvalid
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header, only TCP over IPv4 and IPv6 carry an address
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0F
+	if version != 2 || command > 1 {
+		return nil, ErrProxyHeaderInvalid
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, e.g. health checks of the load balancer
+	if command == 0 {
+		return nil, nil
+	}
+
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrProxyHeaderInvalid
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrProxyHeaderInvalid
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,186 @@
+package patchssh
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"golang.org/x/crypto/ssh"
+)
+
+// permissions checked by the server, commands declare their own
+const (
+	PermissionShell        = "shell"
+	PermissionForwardTCP   = "forward.tcpip"
+	PermissionForwardLocal = "forward.streamlocal"
+	PermissionForwardAgent = "forward.agent"
+	PermissionForwardX11   = "forward.x11"
+	PermissionRoles        = "roles"
+	PermissionKeys         = "keys"
+	PermissionAccount      = "account"
+	PermissionUsers        = "users"
+	// followed by the channel type or subsystem name
+	permissionChannel   = "channel."
+	permissionSubsystem = "subsystem."
+)
+
+// permissions of everyone while no role database is set, forwarding and the management
+// of keys and account as permitted by the login
+var legacyPermissions = []string{PermissionShell, permissionChannel + "session"}
+
+// session requests that need a permission, subsystems are checked by name
+var requestPermissions = map[string]string{
+	"shell":          PermissionShell,
+	"exec":           PermissionShell,
+	"pty-req":        PermissionShell,
+	agentRequestType: PermissionForwardAgent,
+	"x11-req":        PermissionForwardX11,
+}
+
+// global requests that need a permission
+var globalRequestPermissions = map[string]string{
+	"tcpip-forward":                          PermissionForwardTCP,
+	"cancel-tcpip-forward":                   PermissionForwardTCP,
+	"streamlocal-forward@openssh.com":        PermissionForwardLocal,
+	"cancel-streamlocal-forward@openssh.com": PermissionForwardLocal,
+}
+
+// SetRoleDB loads the roles of users from db at login if RBAC/ACTIVE is set, call it before Serve
+func (s *SocketServer) SetRoleDB(db models.RoleDB) {
+	if active, _ := s.config.GetBool("RBAC/ACTIVE"); !active || db == nil {
+		return
+	}
+	s.roleDB = db
+}
+
+// loadPermissions resolves the roles and permissions of a user during authentication,
+// guests are no users and only get GUESTROLE or a shell without it
+func (s *SocketServer) loadPermissions(ctx context.Context, user string, perms *ssh.Permissions) ([]string, []string, error) {
+	guest := perms.CriticalOptions[extensionFingerprint] == ""
+	if s.roleDB == nil {
+		permissions := slices.Clone(legacyPermissions)
+		if perms.Extensions[extensionAgentForwarding] == "true" {
+			permissions = append(permissions, PermissionForwardAgent)
+		}
+		if perms.Extensions[extensionX11Forwarding] == "true" {
+			permissions = append(permissions, PermissionForwardX11)
+		}
+		// guests have no keys or account to manage
+		if !guest {
+			permissions = append(permissions, PermissionKeys, PermissionAccount)
+		}
+		return nil, permissions, nil
+	}
+	roles := []models.Role{}
+	defaultRole, _ := s.config.GetString("RBAC/DEFAULTROLE")
+	if guest {
+		defaultRole, _ = s.config.GetString("RBAC/GUESTROLE")
+		if defaultRole == "" {
+			return nil, slices.Clone(legacyPermissions), nil
+		}
+	} else {
+		userRoles, err := s.roleDB.GetUserRoles(ctx, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		roles = userRoles
+	}
+	if len(roles) == 0 {
+		role, err := s.roleDB.GetRole(ctx, defaultRole)
+		if err == nil {
+			roles = append(roles, role)
+		} else if err != models.ErrRoleNotFound {
+			return nil, nil, err
+		}
+	}
+	names, permissions := []string{}, []string{}
+	for _, role := range roles {
+		names = append(names, role.Name)
+		for _, permission := range role.Permissions {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return names, permissions, nil
+}
+
+// splitList parses a comma separated extension
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
+
+// identity is the user of the connection with the permissions loaded at login
+func (cw *connTaskWrapper) identity() ui.Identity {
+	cw.infoMutex.Lock()
+	defer cw.infoMutex.Unlock()
+	return ui.Identity{
+		User:        cw.user,
+		SessionID:   cw.sessionID,
+		Admin:       cw.admin,
+		Roles:       cw.roles,
+		Permissions: cw.permissions,
+	}
+}
+
+// permit checks a permission of the user, denials are audited
+func (cw *connTaskWrapper) permit(ctx context.Context, permission, target string) bool {
+	identity := cw.identity()
+	if identity.Can(permission) {
+		return true
+	}
+	cw.logger.Warn(ctx, "Denied %s to '%s', missing permission %s", target, identity.User, permission)
+	audit.Record(ctx, audit.Event{
+		Type: audit.EventAccessDenied,
+		Details: map[string]string{
+			"permission": permission,
+			"target":     target,
+		},
+	})
+	return false
+}
+
+// handleGlobalRequests answers the requests outside of channels, e.g. remote port forwarding
+func (cw *connTaskWrapper) handleGlobalRequests(ctx context.Context, requests <-chan *ssh.Request) {
+	for request := range requests {
+		if permission, ok := globalRequestPermissions[request.Type]; ok && !cw.permit(ctx, permission, request.Type) {
+			request.Reply(false, nil)
+			continue
+		}
+		handler, ok := cw.GlobalRequestHandlers[request.Type]
+		if !ok {
+			if request.WantReply {
+				request.Reply(false, nil)
+			}
+			continue
+		}
+		handler(ctx, request)
+	}
+}
+
+// SubsystemRequestHandler starts a registered subsystem the user is permitted to use
+func (cw *connTaskWrapper) SubsystemRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
+	payload := struct{ Name string }{}
+	if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+		request.Reply(false, nil)
+		return
+	}
+	handler, ok := cw.SubsystemHandlers[payload.Name]
+	if !ok || !cw.permit(ctx, permissionSubsystem+payload.Name, "subsystem "+payload.Name) {
+		request.Reply(false, nil)
+		return
+	}
+	request.Reply(true, nil)
+	go func() {
+		defer channel.Close()
+		if err := handler(ctx, channel, payload.Name); err != nil {
+			cw.logger.Error(ctx, "Error in subsystem %s: %s", payload.Name, err.Error())
+		}
+	}()
+}
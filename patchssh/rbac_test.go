@@ -0,0 +1,157 @@
+package patchssh
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"github.com/myLogic207/gotils/config"
+	"golang.org/x/crypto/ssh"
+)
+
+type testRoleDB struct {
+	models.RoleDB
+	roles  map[string]models.Role
+	grants map[string][]string
+}
+
+func (db *testRoleDB) GetRoles(ctx context.Context) ([]models.Role, error) {
+	roles := []models.Role{}
+	for _, role := range db.roles {
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+func (db *testRoleDB) GetRole(ctx context.Context, name string) (models.Role, error) {
+	role, ok := db.roles[name]
+	if !ok {
+		return models.Role{}, models.ErrRoleNotFound
+	}
+	return role, nil
+}
+
+func (db *testRoleDB) GetUserRoles(ctx context.Context, username string) ([]models.Role, error) {
+	roles := []models.Role{}
+	for _, name := range db.grants[username] {
+		roles = append(roles, db.roles[name])
+	}
+	return roles, nil
+}
+
+func (db *testRoleDB) GrantRole(ctx context.Context, username, role string) error {
+	if _, ok := db.roles[role]; !ok {
+		return models.ErrRoleNotFound
+	}
+	db.grants[username] = append(db.grants[username], role)
+	return nil
+}
+
+func newTestRoleDB() *testRoleDB {
+	return &testRoleDB{
+		roles: map[string]models.Role{
+			"user":   {Name: "user", Permissions: []string{PermissionShell, "channel.*"}},
+			"viewer": {Name: "viewer", Permissions: []string{"channel.session"}},
+		},
+		grants: map[string][]string{},
+	}
+}
+
+func TestRBAC(t *testing.T) {
+	serverConf := config.NewWithInitialValues(testServerConf)
+	if err := serverConf.Set("PORT", 22224, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverConf.Set("RBAC/ACTIVE", true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := serverConf.Set("RBAC/GUESTROLE", "viewer", true); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newTestServer(testKeyDB, serverConf, func(server *SocketServer) {
+		server.SetRoleDB(newTestRoleDB())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:22224", &ssh.ClientConfig{
+		User:            "guest",
+		Auth:            []ssh.AuthMethod{ssh.Password("")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Expected session channel to be permitted, got %v", err)
+	}
+	if err := session.Shell(); err == nil {
+		t.Error("Expected shell to be denied without the shell permission")
+	}
+	if _, err := client.Listen("tcp", "127.0.0.1:0"); err == nil {
+		t.Error("Expected remote forwarding to be denied")
+	}
+	if _, _, err := client.OpenChannel("direct-tcpip", nil); err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("Expected channel type to be denied, got %v", err)
+	}
+}
+
+func TestLoadPermissions(t *testing.T) {
+	server := &SocketServer{config: config.NewWithInitialValues(defaultServerConfig)}
+	perms := &ssh.Permissions{Extensions: map[string]string{extensionAgentForwarding: "true"}}
+	_, permissions, err := server.loadPermissions(context.TODO(), "alice", perms)
+	if err != nil || !(ui.Identity{Permissions: permissions}).Can(PermissionForwardAgent) {
+		t.Errorf("Expected legacy permissions to follow the login, got %v (%v)", permissions, err)
+	}
+
+	server.roleDB = newTestRoleDB()
+	perms.CriticalOptions = map[string]string{extensionFingerprint: "SHA256:alice"}
+	roles, permissions, err := server.loadPermissions(context.TODO(), "alice", perms)
+	if err != nil || len(roles) != 1 || roles[0] != "user" {
+		t.Fatalf("Expected the default role, got %v (%v)", roles, err)
+	}
+	identity := ui.Identity{Permissions: permissions}
+	if !identity.Can("channel.direct-tcpip") || identity.Can(PermissionForwardAgent) {
+		t.Errorf("Expected the permissions of the default role, got %v", permissions)
+	}
+
+	// guests never get the default role
+	guest := &ssh.Permissions{Extensions: map[string]string{extensionFingerprint: "guest"}}
+	roles, permissions, err = server.loadPermissions(context.TODO(), "guest", guest)
+	identity = ui.Identity{Permissions: permissions}
+	if err != nil || len(roles) != 0 || !identity.Can(PermissionShell) || identity.Can("channel.direct-tcpip") || identity.Can(PermissionAccount) {
+		t.Errorf("Expected guests to only get a shell, got %v %v (%v)", roles, permissions, err)
+	}
+	server.config.Set("RBAC/GUESTROLE", "viewer", true)
+	roles, permissions, err = server.loadPermissions(context.TODO(), "guest", guest)
+	if err != nil || len(roles) != 1 || roles[0] != "viewer" || (ui.Identity{Permissions: permissions}).Can(PermissionShell) {
+		t.Errorf("Expected the guest role, got %v %v (%v)", roles, permissions, err)
+	}
+}
+
+func TestRolesCommand(t *testing.T) {
+	db := newTestRoleDB()
+	shell := ui.NewShellWrapper(TESTSERVER.logger)
+	shell.Register(rolesCommand(db))
+	if _, err := shell.Execute(context.TODO(), "roles grant alice viewer"); err == nil {
+		t.Error("Expected roles to need a permission")
+	}
+	shell.SetIdentity(ui.Identity{Permissions: []string{PermissionRoles}})
+	out, err := shell.Execute(context.TODO(), "roles grant alice viewer")
+	if err != nil || len(db.grants["alice"]) != 1 {
+		t.Errorf("Expected role to be granted, got %s (%v)", out, err)
+	}
+	out, err = shell.Execute(context.TODO(), "roles show alice")
+	if err != nil || !strings.Contains(string(out), "viewer") {
+		t.Errorf("Expected granted role, got %s (%v)", out, err)
+	}
+	if candidates := shell.Complete(context.TODO(), "roles grant bob v"); len(candidates) != 1 || candidates[0] != "viewer" {
+		t.Errorf("Expected role completion, got %v", candidates)
+	}
+}
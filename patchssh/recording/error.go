@@ -0,0 +1,10 @@
+package recording
+
+import "errors"
+
+var (
+	ErrOptedOut          = errors.New("user opted out of recording")
+	ErrRecordingNotFound = errors.New("recording not found")
+	ErrInvalidName       = errors.New("invalid recording name")
+	ErrInvalidRecording  = errors.New("invalid recording")
+)
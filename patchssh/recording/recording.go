@@ -0,0 +1,328 @@
+// Package recording stores interactive sessions as asciicast v2 files,
+// see https://docs.asciinema.org/manual/asciicast/v2/
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	asciicastVersion = 2
+	fileExtension    = ".cast"
+	// separates the start time, user and session in file names
+	nameSeparator = "_"
+	timeLayout    = "20060102T150405Z"
+	// session ids are shortened in file names, the title keeps the full id
+	sessionIDLength = 12
+)
+
+// Header is the first line of an asciicast v2 file
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Recorder appends the terminal events of one session, it is safe for concurrent use
+type Recorder struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	start  time.Time
+	closed bool
+	// inputPaused counts the open PauseInput calls, input is dropped while it is set
+	inputPaused int
+}
+
+// Input records data sent by the user
+func (r *Recorder) Input(data []byte) error {
+	return r.event("i", data)
+}
+
+// PauseInput drops the input until ResumeInput is called, e.g. while a password is typed
+func (r *Recorder) PauseInput() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.inputPaused++
+}
+
+// ResumeInput records the input again after PauseInput
+func (r *Recorder) ResumeInput() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.inputPaused > 0 {
+		r.inputPaused--
+	}
+}
+
+// Output records data sent to the user
+func (r *Recorder) Output(data []byte) error {
+	return r.event("o", data)
+}
+
+func (r *Recorder) event(kind string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return os.ErrClosed
+	}
+	if kind == "i" && r.inputPaused > 0 {
+		return nil
+	}
+	line, err := json.Marshal([]interface{}{time.Since(r.start).Seconds(), kind, string(data)})
+	if err != nil {
+		return err
+	}
+	if _, err := r.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// keep the file readable while the session is running
+	return r.writer.Flush()
+}
+
+// Close finishes the recording, later events are dropped
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if err := r.writer.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// Info describes a stored recording
+type Info struct {
+	Name      string
+	User      string
+	StartedAt time.Time
+	Size      int64
+}
+
+// Store keeps the recordings in a folder and enforces the retention limits
+type Store struct {
+	dir string
+	// recordings older than retention are removed, 0 keeps them
+	retention time.Duration
+	// the oldest recordings are removed while the folder is larger, 0 disables the limit
+	maxBytes int64
+	optOut   map[string]bool
+}
+
+// NewStore creates the folder if needed, optOut lists users that are never recorded
+func NewStore(dir string, retention time.Duration, maxBytes int64, optOut []string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	store := &Store{
+		dir:       dir,
+		retention: retention,
+		maxBytes:  maxBytes,
+		optOut:    map[string]bool{},
+	}
+	for _, user := range optOut {
+		if user = strings.TrimSpace(user); user != "" {
+			store.optOut[user] = true
+		}
+	}
+	return store, nil
+}
+
+// Records tells if sessions of the user are recorded
+func (s *Store) Records(user string) bool {
+	return !s.optOut[user]
+}
+
+// Start creates a recording for a session, ErrOptedOut if the user is not recorded
+func (s *Store) Start(user, sessionID string, width, height int) (*Recorder, error) {
+	if !s.Records(user) {
+		return nil, ErrOptedOut
+	}
+	if _, err := s.Prune(time.Now()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	session := sanitize(sessionID)
+	if len(session) > sessionIDLength {
+		session = session[:sessionIDLength]
+	}
+	name := strings.Join([]string{start.UTC().Format(timeLayout), sanitize(user), session}, nameSeparator)
+	file, err := os.OpenFile(filepath.Join(s.dir, name+fileExtension), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	// a connection may open several terminals within a second
+	for i := 2; errors.Is(err, os.ErrExist) && i < 100; i++ {
+		file, err = os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("%s-%d%s", name, i, fileExtension)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(Header{
+		Version:   asciicastVersion,
+		Width:     width,
+		Height:    height,
+		Timestamp: start.Unix(),
+		Title:     fmt.Sprintf("%s (session %s)", user, sessionID),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	writer.Write(append(header, '\n'))
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Recorder{
+		file:   file,
+		writer: writer,
+		start:  start,
+	}, nil
+}
+
+// sanitize keeps names usable as a file name component
+func sanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '-'
+	}, value)
+}
+
+// List returns the recordings ordered by start time, only those of user if it is set
+func (s *Store) List(user string) ([]Info, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := []Info{}
+	for _, entry := range entries {
+		info, ok := parseName(entry.Name())
+		if !ok || entry.IsDir() || (user != "" && info.User != sanitize(user)) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		info.Size = stat.Size()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].StartedAt.Equal(infos[j].StartedAt) {
+			return infos[i].Name < infos[j].Name
+		}
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos, nil
+}
+
+func parseName(fileName string) (Info, bool) {
+	name, ok := strings.CutSuffix(fileName, fileExtension)
+	if !ok {
+		return Info{}, false
+	}
+	parts := strings.SplitN(name, nameSeparator, 3)
+	if len(parts) != 3 {
+		return Info{}, false
+	}
+	startedAt, err := time.Parse(timeLayout, parts[0])
+	if err != nil {
+		return Info{}, false
+	}
+	return Info{Name: name, User: parts[1], StartedAt: startedAt}, true
+}
+
+// Open returns the raw asciicast file of a recording
+func (s *Store) Open(name string) (io.ReadCloser, error) {
+	if _, ok := parseName(name + fileExtension); !ok || strings.ContainsAny(name, `/\`) {
+		return nil, ErrInvalidName
+	}
+	file, err := os.Open(filepath.Join(s.dir, name+fileExtension))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrRecordingNotFound
+	}
+	return file, err
+}
+
+// Prune removes recordings past the retention and the oldest ones above the size limit
+func (s *Store) Prune(now time.Time) (int, error) {
+	infos, err := s.List("")
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, info := range infos {
+		total += info.Size
+	}
+	removed := 0
+	for _, info := range infos {
+		expired := s.retention > 0 && now.Sub(info.StartedAt) > s.retention
+		tooLarge := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !tooLarge {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, info.Name+fileExtension)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		total -= info.Size
+		removed++
+	}
+	return removed, nil
+}
+
+// Event is a single line of the recording after the header
+type Event struct {
+	Time float64
+	Kind string
+	Data string
+}
+
+// Read parses an asciicast v2 file
+func Read(reader io.Reader) (Header, []Event, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	header := Header{}
+	if !scanner.Scan() {
+		return header, nil, ErrInvalidRecording
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != asciicastVersion {
+		return header, nil, ErrInvalidRecording
+	}
+	events := []Event{}
+	for scanner.Scan() {
+		raw := []interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			return header, events, ErrInvalidRecording
+		}
+		elapsed, okTime := raw[0].(float64)
+		kind, okKind := raw[1].(string)
+		data, okData := raw[2].(string)
+		if !okTime || !okKind || !okData {
+			return header, events, ErrInvalidRecording
+		}
+		events = append(events, Event{Time: elapsed, Kind: kind, Data: data})
+	}
+	return header, events, scanner.Err()
+}
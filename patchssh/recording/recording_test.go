@@ -0,0 +1,94 @@
+package recording
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndRead(t *testing.T) {
+	store, err := NewStore(t.TempDir(), 0, 0, []string{"bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Start("bob", "abc", 80, 24); !errors.Is(err, ErrOptedOut) {
+		t.Errorf("Expected ErrOptedOut, got %v", err)
+	}
+
+	recorder, err := store.Start("alice", "0123456789abcdef", 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Input([]byte("echo hi\r"))
+	recorder.PauseInput()
+	recorder.Input([]byte("secret\r"))
+	recorder.ResumeInput()
+	recorder.Output([]byte("echo: hi\r\n"))
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Output([]byte("late")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected events after close to fail, got %v", err)
+	}
+	// a second terminal of the same session gets its own file
+	second, err := store.Start("alice", "0123456789abcdef", 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	infos, err := store.List("alice")
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Expected 2 recordings, got %v (%v)", infos, err)
+	}
+	if infos, _ := store.List("carol"); len(infos) != 0 {
+		t.Errorf("Expected no recordings of carol, got %v", infos)
+	}
+
+	file, err := store.Open(infos[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	header, events, err := Read(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != 2 || header.Width != 80 || len(events) != 2 {
+		t.Fatalf("Unexpected recording %+v %+v", header, events)
+	}
+	if events[0].Kind != "i" || events[1].Kind != "o" || events[1].Data != "echo: hi\r\n" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	if _, err := store.Open("../" + infos[0].Name); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Expected ErrInvalidName, got %v", err)
+	}
+	if _, err := store.Open("20000101T000000Z_alice_gone"); !errors.Is(err, ErrRecordingNotFound) {
+		t.Errorf("Expected ErrRecordingNotFound, got %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20200101T000000Z_alice_a", "20200102T000000Z_alice_b", "20200103T000000Z_bob_c"} {
+		if err := os.WriteFile(filepath.Join(dir, name+fileExtension), make([]byte, 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)
+
+	store, _ := NewStore(dir, 48*time.Hour, 0, nil)
+	if removed, err := store.Prune(now); err != nil || removed != 1 {
+		t.Errorf("Expected 1 expired recording to be removed, got %d (%v)", removed, err)
+	}
+	store, _ = NewStore(dir, 0, 150, nil)
+	if removed, err := store.Prune(now); err != nil || removed != 1 {
+		t.Errorf("Expected the oldest recording to be removed, got %d (%v)", removed, err)
+	}
+	if infos, _ := store.List(""); len(infos) != 1 || infos[0].User != "bob" {
+		t.Errorf("Expected only the newest recording left, got %v", infos)
+	}
+}
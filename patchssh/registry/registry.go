@@ -0,0 +1,131 @@
+// Package registry keeps track of the active connections of a server.
+package registry
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrConnNotFound indicates that no active connection has the given ID.
+var ErrConnNotFound = errors.New("connection not found")
+
+// Info is a snapshot of an active connection.
+type Info struct {
+	ID            uint64    `json:"id"`
+	User          string    `json:"user"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ClientVersion string    `json:"client_version"`
+	AuthMethod    string    `json:"auth_method"`
+	StartedAt     time.Time `json:"started_at"`
+	BytesIn       uint64    `json:"bytes_in"`
+	BytesOut      uint64    `json:"bytes_out"`
+	// Channels lists the types of the open channels, e.g. "session"
+	Channels []string `json:"channels"`
+}
+
+// Conn is a connection that can be managed by the registry.
+type Conn interface {
+	// Info returns the current state of the connection.
+	Info() Info
+	// Notify writes a message to every terminal of the connection.
+	Notify(ctx context.Context, message string)
+	// Kick notifies the user with the reason and closes the connection.
+	Kick(ctx context.Context, reason string)
+	// Done is closed once the connection has ended.
+	Done() <-chan struct{}
+}
+
+// Registry holds all active connections by ID.
+type Registry struct {
+	mutex  sync.RWMutex
+	nextID uint64
+	conns  map[uint64]Conn
+}
+
+// New creates an empty Registry.
+func New() *Registry {
+	return &Registry{
+		conns: map[uint64]Conn{},
+	}
+}
+
+// Add registers a connection and returns its ID.
+func (r *Registry) Add(conn Conn) uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.nextID++
+	r.conns[r.nextID] = conn
+	return r.nextID
+}
+
+// Remove unregisters the connection with the given ID.
+func (r *Registry) Remove(id uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.conns, id)
+}
+
+// Conns returns all active connections.
+func (r *Registry) Conns() []Conn {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conns := make([]Conn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// List returns a snapshot of all active connections, ordered by ID.
+func (r *Registry) List() []Info {
+	infos := []Info{}
+	for _, conn := range r.Conns() {
+		infos = append(infos, conn.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Get returns a snapshot of the connection with the given ID.
+func (r *Registry) Get(id uint64) (Info, error) {
+	conn, err := r.get(id)
+	if err != nil {
+		return Info{}, err
+	}
+	return conn.Info(), nil
+}
+
+// Message writes a message to the terminals of the connection with the given ID.
+func (r *Registry) Message(ctx context.Context, id uint64, message string) error {
+	conn, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	conn.Notify(ctx, message)
+	return nil
+}
+
+// Kick disconnects the connection with the given ID.
+func (r *Registry) Kick(ctx context.Context, id uint64, reason string) error {
+	conn, err := r.get(id)
+	if err != nil {
+		return err
+	}
+	conn.Kick(ctx, reason)
+	return nil
+}
+
+func (r *Registry) get(id uint64) (Conn, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conn, ok := r.conns[id]
+	if !ok {
+		return nil, ErrConnNotFound
+	}
+	return conn, nil
+}
@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type testConn struct {
+	info     Info
+	messages []string
+	kicked   string
+	done     chan struct{}
+}
+
+func (c *testConn) Info() Info {
+	return c.info
+}
+
+func (c *testConn) Notify(ctx context.Context, message string) {
+	c.messages = append(c.messages, message)
+}
+
+func (c *testConn) Kick(ctx context.Context, reason string) {
+	c.kicked = reason
+}
+
+func (c *testConn) Done() <-chan struct{} {
+	return c.done
+}
+
+func TestRegistry(t *testing.T) {
+	testCtx := context.Background()
+	reg := New()
+	first := &testConn{info: Info{User: "alice"}}
+	second := &testConn{info: Info{User: "bob"}}
+	first.info.ID = reg.Add(first)
+	second.info.ID = reg.Add(second)
+
+	if infos := reg.List(); len(infos) != 2 || infos[0].User != "alice" || infos[1].User != "bob" {
+		t.Fatalf("Expected alice and bob ordered by id, got %+v", infos)
+	}
+	if info, err := reg.Get(second.info.ID); err != nil || info.User != "bob" {
+		t.Errorf("Expected bob, got %+v (%v)", info, err)
+	}
+
+	if err := reg.Message(testCtx, first.info.ID, "hello"); err != nil {
+		t.Fatal(err)
+	} else if len(first.messages) != 1 || first.messages[0] != "hello" {
+		t.Errorf("Expected message to be delivered, got %v", first.messages)
+	}
+	if err := reg.Kick(testCtx, second.info.ID, "bye"); err != nil {
+		t.Fatal(err)
+	} else if second.kicked != "bye" {
+		t.Errorf("Expected connection to be kicked, got %q", second.kicked)
+	}
+
+	reg.Remove(second.info.ID)
+	if _, err := reg.Get(second.info.ID); !errors.Is(err, ErrConnNotFound) {
+		t.Errorf("Expected ErrConnNotFound, got %v", err)
+	}
+	if err := reg.Kick(testCtx, 42, "bye"); !errors.Is(err, ErrConnNotFound) {
+		t.Errorf("Expected ErrConnNotFound, got %v", err)
+	}
+}
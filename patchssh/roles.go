@@ -0,0 +1,94 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+)
+
+const rolesUsage = "usage: roles [list | show <user> | grant <user> <role> | revoke <user> <role>]"
+
+// rolesCommand lets admins inspect roles and grant them to or revoke them from users
+func rolesCommand(db models.RoleDB) ui.Definition {
+	return ui.Definition{
+		Name:        "roles",
+		Short:       "List roles, grant and revoke them",
+		Long:        "Roles are loaded at login, changes apply to new connections of the user. Users without roles get the default role.",
+		Args:        "[list | show <user> | grant <user> <role> | revoke <user> <role>]",
+		Permissions: []string{PermissionRoles},
+		Run: ui.Buffered(func(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+			if len(args) == 0 || (args[0] == "list" && len(args) == 1) {
+				roles, err := db.GetRoles(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return formatRoles(roles), nil
+			}
+			switch {
+			case args[0] == "show" && len(args) == 2:
+				roles, err := db.GetUserRoles(ctx, args[1])
+				if err != nil {
+					return nil, err
+				}
+				return formatRoles(roles), nil
+			case args[0] == "grant" && len(args) == 3:
+				if err := db.GrantRole(ctx, args[1], args[2]); err != nil {
+					return nil, err
+				}
+				recordRoleChange(ctx, "role_granted", args[1], args[2])
+				return []byte(fmt.Sprintf("role %s granted to %s", args[2], args[1])), nil
+			case args[0] == "revoke" && len(args) == 3:
+				if err := db.RevokeRole(ctx, args[1], args[2]); err != nil {
+					return nil, err
+				}
+				recordRoleChange(ctx, "role_revoked", args[1], args[2])
+				return []byte(fmt.Sprintf("role %s revoked from %s", args[2], args[1])), nil
+			}
+			return nil, fmt.Errorf("%w, %s", ui.ErrUsage, rolesUsage)
+		}),
+		Complete: func(ctx context.Context, user ui.Identity, args []string, word string) []string {
+			if len(args) == 0 {
+				return []string{"list", "show", "grant", "revoke"}
+			} else if len(args) != 2 || (args[0] != "grant" && args[0] != "revoke") {
+				return nil
+			}
+			roles, err := db.GetRoles(ctx)
+			if err != nil {
+				return nil
+			}
+			names := []string{}
+			for _, role := range roles {
+				names = append(names, role.Name)
+			}
+			return names
+		},
+	}
+}
+
+func recordRoleChange(ctx context.Context, action, user, role string) {
+	audit.Record(ctx, audit.Event{
+		Type: audit.EventAdminAction,
+		Details: map[string]string{
+			"action": action,
+			"user":   user,
+			"role":   role,
+		},
+	})
+}
+
+func formatRoles(roles []models.Role) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ROLE\tPERMISSIONS\tDESCRIPTION")
+	for _, role := range roles {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", role.Name, strings.Join(role.Permissions, ","), role.Description)
+	}
+	writer.Flush()
+	return buffer.Bytes()
+}
@@ -5,13 +5,18 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
-	"fmt"
 	"net"
+	"strings"
+	"sync"
 
+	"github.com/myLogic207/cinnamon/internal/audit"
 	"github.com/myLogic207/cinnamon/internal/models"
 	"github.com/myLogic207/cinnamon/patchssh/auth"
+	"github.com/myLogic207/cinnamon/patchssh/recording"
+	"github.com/myLogic207/cinnamon/patchssh/registry"
 	"github.com/myLogic207/cinnamon/patchssh/ui"
 	"github.com/myLogic207/gotils/config"
 	log "github.com/myLogic207/gotils/logger"
@@ -27,12 +32,61 @@ var defaultServerConfig = map[string]interface{}{
 	},
 	"ADDRESS": "127.0.0.1",
 	"PORT":    8080,
+	// if LISTENERS is present, it replaces ADDRESS and PORT, either a list or comma separated
+	// e.g. "tcp://[::]:2222, unix:///run/cinnamon.sock?mode=0660, systemd://"
+	// "LISTENERS": "",
+	// comma separated usernames allowed to manage sessions from the shell
+	// "ADMINS": "",
 	"WORKERS": 100,
 	"TIMEOUT": "5s",
 	// if key is not present, default key is used or new key is generated
 	// "HOSTKEY":           "",
 	"MAXAUTHTRIES":  3,
 	"SERVERVERSION": "SSH-2.0-patchssh",
+	// concurrent connection caps, 0 disables a cap
+	// CONNECTIONS falls back to and is capped at WORKERS, as every connection occupies a worker
+	"LIMITS": map[string]interface{}{
+		"CONNECTIONS": 0,
+		"PERIP":       0,
+		"PERUSER":     0,
+	},
+	// interactive sessions are recorded as asciicast v2 files in FOLDER,
+	// RETENTION removes old recordings, MAXSIZE caps the folder in MiB (0 disables the cap)
+	"RECORDING": map[string]interface{}{
+		"ACTIVE":    false,
+		"FOLDER":    "recordings",
+		"RETENTION": "720h",
+		"MAXSIZE":   0,
+		// comma separated usernames whose sessions are never recorded
+		// "OPTOUT": "",
+	},
+	// shell history kept in the database across sessions, SIZE lines per user,
+	// lines longer than MAXLINE characters are not stored
+	"HISTORY": map[string]interface{}{
+		"ACTIVE":  false,
+		"SIZE":    1000,
+		"MAXLINE": 1024,
+	},
+	// role based access with the roles stored in the database, users without roles get DEFAULTROLE,
+	// guests get GUESTROLE or only a shell without it,
+	// while inactive everyone may open a shell and ADMINS manage the server
+	"RBAC": map[string]interface{}{
+		"ACTIVE":      false,
+		"DEFAULTROLE": "user",
+		// "GUESTROLE": "",
+	},
+	// passwords users choose with passwd, MINCLASSES out of lower case, upper case,
+	// digits and other characters
+	"PASSWORD": map[string]interface{}{
+		"MINLENGTH":  12,
+		"MINCLASSES": 3,
+	},
+	// trusted upstreams must send a PROXY protocol v1 or v2 header,
+	// TRUSTED is a comma separated list of CIDRs, "unix" trusts unix socket peers
+	"PROXYPROTOCOL": map[string]interface{}{
+		"ACTIVE":  false,
+		"TRUSTED": "127.0.0.1/32, ::1/128",
+	},
 }
 
 type SocketServer struct {
@@ -40,8 +94,25 @@ type SocketServer struct {
 	config       config.Config
 	sshConfig    *ssh.ServerConfig
 	loginManager *auth.AuthManager
-	listener     net.Listener
+	listeners    []net.Listener
 	workerPool   *workers.WorkerPool
+	limiter      *connLimiter
+	proxyTrust   *proxyTrust
+	bans         *BanList
+	recordings   *recording.Store
+	history      ui.History
+	roleDB       models.RoleDB
+	// userDB is nil until SetUserDB, users then manage their account from the shell
+	userDB         models.UserDB
+	passwordPolicy models.PasswordPolicy
+	// active connections, drained on shutdown
+	registry  *registry.Registry
+	closeOnce sync.Once
+	// closed once the server stopped accepting, err holds the cause
+	done     chan struct{}
+	stopOnce sync.Once
+	errMutex sync.Mutex
+	err      error
 }
 
 func NewServer(serverOptions config.Config, keyDB models.KeyDB) (*SocketServer, error) {
@@ -63,27 +134,75 @@ func NewServer(serverOptions config.Config, keyDB models.KeyDB) (*SocketServer,
 		return nil, err
 	}
 
+	// connections above the pool size would wait for a worker before the handshake
+	workerCount, _ := cnf.GetInt("WORKERS")
+	maxConns, _ := cnf.GetInt("LIMITS/CONNECTIONS")
+	if maxConns > workerCount {
+		logger.Warn(context.Background(), "LIMITS/CONNECTIONS %d is capped at the %d WORKERS", maxConns, workerCount)
+		maxConns = workerCount
+	} else if maxConns <= 0 {
+		maxConns = workerCount
+	}
+	maxPerIP, _ := cnf.GetInt("LIMITS/PERIP")
+	maxPerUser, _ := cnf.GetInt("LIMITS/PERUSER")
+
+	var trust *proxyTrust
+	if active, _ := cnf.GetBool("PROXYPROTOCOL/ACTIVE"); active {
+		trusted, _ := cnf.GetString("PROXYPROTOCOL/TRUSTED")
+		if trust, err = parseProxyTrust(trusted); err != nil {
+			return nil, err
+		}
+	}
+
+	var recordings *recording.Store
+	if active, _ := cnf.GetBool("RECORDING/ACTIVE"); active {
+		folder, _ := cnf.GetString("RECORDING/FOLDER")
+		retention, _ := cnf.GetDuration("RECORDING/RETENTION")
+		maxSize, _ := cnf.GetInt("RECORDING/MAXSIZE")
+		optOut, _ := cnf.GetString("RECORDING/OPTOUT")
+		recordings, err = recording.NewStore(folder, retention, int64(maxSize)<<20, strings.Split(optOut, ","))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	server := &SocketServer{
 		config:       cnf,
 		logger:       logger,
 		loginManager: auth.NewAuthManager(keyDB),
+		limiter:      newConnLimiter(maxConns, maxPerIP, maxPerUser),
+		proxyTrust:   trust,
+		bans:         NewBanList(),
+		recordings:   recordings,
+		registry:     registry.New(),
+		done:         make(chan struct{}),
 	}
 
 	return server, nil
 }
 
+// ensureHostKey returns the host key, HOSTKEY replaces the stored key,
+// without it the stored key is used and a new one is generated on the first start
 func (s *SocketServer) ensureHostKey(ctx context.Context) ([]byte, error) {
+	// get current key from db
+	dbKey, err := s.loginManager.GetHostKey(ctx)
+	if err != nil && !errors.Is(err, models.ErrKeyNotFound) {
+		return nil, err
+	}
+
 	// get key from config
 	pemBytes := []byte{}
-	configSet := false
-	if keyString, err := s.config.GetString("HOSTKEY"); err == nil {
-		configSet = true
+	source := "config"
+	if keyString, configErr := s.config.GetString("HOSTKEY"); configErr == nil {
 		rawPemBytes, _ := pem.Decode([]byte(keyString))
 		if rawPemBytes != nil {
 			pemBytes = pem.EncodeToMemory(rawPemBytes)
 		}
+	} else if err == nil {
+		// key not set in config, keep the stored key
+		return dbKey, nil
 	} else {
-		// key not set in config, generate new key
+		// no key anywhere, generate new key
 		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 		if err != nil {
 			return nil, err
@@ -93,21 +212,24 @@ func (s *SocketServer) ensureHostKey(ctx context.Context) ([]byte, error) {
 			return nil, err
 		}
 		pemBytes = pem.EncodeToMemory(pemKey)
+		source = "generated"
 	}
 
-	// get current key from db
-	dbKey, err := s.loginManager.GetHostKey(ctx)
-	if err != nil && !errors.Is(err, models.ErrKeyNotFound) {
+	if bytes.Equal(dbKey, pemBytes) {
+		return pemBytes, nil
+	}
+	// key not set in db or not equal with config, write key to db
+	if err := s.loginManager.SetHostKey(ctx, pemBytes); err != nil {
 		return nil, err
 	}
-
-	if errors.Is(err, models.ErrKeyNotFound) || (configSet && err == nil && !bytes.Equal(dbKey, pemBytes)) {
-		// key not set in db write key to db
-		// or key in db, and not equal with config
-		if err := s.loginManager.SetHostKey(ctx, pemBytes); err != nil {
-			return nil, err
-		}
+	event := audit.Event{
+		Type:    audit.EventHostKeyChanged,
+		Details: map[string]string{"source": source},
 	}
+	if signer, err := ssh.ParsePrivateKey(pemBytes); err == nil {
+		event.Fingerprint = ssh.FingerprintSHA256(signer.PublicKey())
+	}
+	audit.Record(ctx, event)
 
 	return pemBytes, nil
 }
@@ -116,15 +238,28 @@ func (s *SocketServer) loadSSHConfig(ctx context.Context) error {
 	maxTries, _ := s.config.GetInt("MAXAUTHTRIES")
 	version, _ := s.config.GetString("SERVERVERSION")
 	sshConfig := &ssh.ServerConfig{
-		NoClientAuth:         false,
-		MaxAuthTries:         maxTries,
-		ServerVersion:        version,
-		AuthLogCallback:      s.AuthLogCallback,
-		PublicKeyCallback:    s.loginManager.PublicKeyCallback,
-		NoClientAuthCallback: s.loginManager.NoAuthCallback,
-		PasswordCallback:     s.loginManager.PasswordAuth,
+		NoClientAuth:    false,
+		MaxAuthTries:    maxTries,
+		ServerVersion:   version,
+		AuthLogCallback: s.AuthLogCallback,
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := s.loginManager.PublicKeyCallback(conn, key)
+			if err != nil {
+				// only this callback knows the key, the other methods are audited in AuthLogCallback
+				recordLoginFailed(conn, "publickey", ssh.FingerprintSHA256(key), err)
+			}
+			return s.decoratePermissions(conn, "publickey", perms, err)
+		},
+		NoClientAuthCallback: func(conn ssh.ConnMetadata) (*ssh.Permissions, error) {
+			perms, err := s.loginManager.NoAuthCallback(conn)
+			return s.decoratePermissions(conn, "none", perms, err)
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := s.loginManager.PasswordAuth(conn, password)
+			return s.decoratePermissions(conn, "password", perms, err)
+		},
 		// KeyboardInteractiveCallback: s.loginManager.KeyboardInteractiveAuth,
-		BannerCallback: ui.Banner,
+		BannerCallback: s.BannerCallback,
 		PublicKeyAuthAlgorithms: []string{
 			ssh.KeyAlgoED25519,
 			ssh.KeyAlgoRSA,
@@ -147,6 +282,11 @@ func (s *SocketServer) loadSSHConfig(ctx context.Context) error {
 }
 
 func (s *SocketServer) AuthLogCallback(conn ssh.ConnMetadata, method string, err error) {
+	authAttempts.Inc(method, resultLabel(err))
+	// clients probe with "none" before offering real credentials
+	if err != nil && method != "none" && method != "publickey" {
+		recordLoginFailed(conn, method, "", err)
+	}
 	if err == nil {
 		s.logger.Info(context.Background(), "Connection from '%s' using '%s'", conn.RemoteAddr().String(), method)
 	} else {
@@ -154,23 +294,94 @@ func (s *SocketServer) AuthLogCallback(conn ssh.ConnMetadata, method string, err
 	}
 }
 
-func (s *SocketServer) initListener(ctx context.Context) error {
-	addr, _ := s.config.GetString("ADDRESS")
-	port, _ := s.config.GetInt("PORT")
-	address := fmt.Sprintf("%s:%d", addr, port)
-	timeout, _ := s.config.GetDuration("TIMEOUT")
-	listenConfig := net.ListenConfig{
-		KeepAlive: timeout - (timeout / 10),
-		Control:   nil,
+func recordLoginFailed(conn ssh.ConnMetadata, method, fingerprint string, err error) {
+	audit.Record(context.Background(), audit.Event{
+		Type:        audit.EventLoginFailed,
+		User:        conn.User(),
+		Fingerprint: fingerprint,
+		RemoteAddr:  conn.RemoteAddr().String(),
+		SessionID:   hex.EncodeToString(conn.SessionID()),
+		Details: map[string]string{
+			"method": method,
+			"reason": err.Error(),
+		},
+	})
+}
+
+// decoratePermissions records how the user authenticated, their roles and permissions and if they are an admin
+func (s *SocketServer) decoratePermissions(conn ssh.ConnMetadata, method string, perms *ssh.Permissions, err error) (*ssh.Permissions, error) {
+	if err != nil || perms == nil {
+		return perms, err
+	}
+	if perms.Extensions == nil {
+		perms.Extensions = map[string]string{}
 	}
-	listener, err := listenConfig.Listen(ctx, "tcp", address)
+	perms.Extensions[extensionAuthMethod] = method
+	roles, permissions, err := s.loadPermissions(context.Background(), conn.User(), perms)
+	if err != nil {
+		// without permissions the user could do nothing, so the login fails
+		s.logger.Error(context.Background(), "Error loading roles of '%s': %s", conn.User(), err.Error())
+		return nil, auth.ErrAuthFailed
+	}
+	perms.Extensions[extensionRoles] = strings.Join(roles, ",")
+	perms.Extensions[extensionPermissions] = strings.Join(permissions, ",")
+
+	identity := ui.Identity{Permissions: permissions}
+	admins, _ := s.config.GetString("ADMINS")
+	for _, admin := range strings.Split(admins, ",") {
+		if strings.TrimSpace(admin) == conn.User() {
+			identity.Admin = true
+		}
+	}
+	if identity.Admin || identity.Can(ui.PermissionAll) {
+		perms.Extensions[extensionAdmin] = "true"
+	}
+	// forwarding follows the permissions, whatever the login allowed
+	delete(perms.Extensions, extensionAgentForwarding)
+	delete(perms.Extensions, extensionX11Forwarding)
+	if identity.Can(PermissionForwardAgent) {
+		perms.Extensions[extensionAgentForwarding] = "true"
+	}
+	if identity.Can(PermissionForwardX11) {
+		perms.Extensions[extensionX11Forwarding] = "true"
+	}
+	return perms, nil
+}
+
+// Registry gives access to the active connections of the server
+func (s *SocketServer) Registry() *registry.Registry {
+	return s.registry
+}
+
+// Bans gives access to the bans of the server
+func (s *SocketServer) Bans() *BanList {
+	return s.bans
+}
+
+// BannerCallback greets every user alike, bans and limits are only revealed after authentication
+func (s *SocketServer) BannerCallback(conn ssh.ConnMetadata) string {
+	return ui.Banner(conn)
+}
+
+func (s *SocketServer) initListeners(ctx context.Context) error {
+	addrs, err := s.listenAddrs()
 	if err != nil {
 		return err
 	}
-	s.logger.Info(ctx, "Listening on %s", address)
-	s.listener = listener
+	timeout, _ := s.config.GetDuration("TIMEOUT")
+	keepAlive := timeout - (timeout / 10)
+	for _, addr := range addrs {
+		listeners, err := s.listen(ctx, addr, keepAlive)
+		if err != nil {
+			s.closeListener()
+			return err
+		}
+		for _, listener := range listeners {
+			s.logger.Info(ctx, "Listening on %s://%s", listener.Addr().Network(), listener.Addr().String())
+		}
+		s.listeners = append(s.listeners, listeners...)
+	}
 	return nil
-
 }
 
 func (s *SocketServer) initWorkerPool(ctx context.Context) error {
@@ -192,11 +403,13 @@ func (s *SocketServer) initWorkerPool(ctx context.Context) error {
 		return err
 	}
 	s.workerPool = pool
+	workersTotal.Set(float64(poolSize))
 	s.logger.Info(ctx, "Worker pool initialized")
 	return nil
 }
 
-// serve starts accepting connections on the socket, is non blocking, reports startup errors directly and is non blocking
+// Serve starts accepting connections on the socket. It is non blocking and reports
+// startup errors directly, later failures are reported through Done and Err.
 func (s *SocketServer) Serve(ctx context.Context) error {
 	if err := s.loadSSHConfig(ctx); err != nil {
 		s.logger.Error(ctx, err.Error())
@@ -206,58 +419,210 @@ func (s *SocketServer) Serve(ctx context.Context) error {
 	if err := s.initWorkerPool(ctx); err != nil {
 		return ErrInitWorkerPoolReason{err}
 	}
-	if err := s.initListener(ctx); err != nil {
+	if err := s.initListeners(ctx); err != nil {
 		return err
 	}
 
 	connChan := make(chan net.Conn)
 	go s.handleConnectionsLoop(ctx, connChan)
-	// handle errors and context cancel
-	quitChan := make(chan error)
+	// handle context cancel
 	go func() {
-		<-ctx.Done()
+		select {
+		case <-s.done:
+			return
+		case <-ctx.Done():
+		}
 		s.logger.Info(ctx, "Server stopping")
 		err := ctx.Err()
 		if err != nil && err != context.Canceled {
 			s.logger.Error(ctx, "reason: %s", err.Error())
+			s.stop(err)
+		} else {
+			s.stop(nil)
 		}
-		if err := s.listener.Close(); err != nil {
-			s.logger.Error(ctx, err.Error())
-		}
-		if err := <-quitChan; err != nil && !errors.Is(err, net.ErrClosed) {
-			s.logger.Error(ctx, err.Error())
-		}
-		s.workerPool = nil
 	}()
 	s.logger.Info(ctx, "Server started")
-	go func() {
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil && !errors.Is(err, net.ErrClosed) {
-				s.logger.Error(ctx, err.Error())
-				quitChan <- err
-				return
-			} else if errors.Is(err, net.ErrClosed) {
-				s.logger.Debug(ctx, "Listener closed")
-				return
-			}
-			connChan <- conn
-		}
-	}()
+	for _, listener := range s.listeners {
+		go s.acceptLoop(ctx, listener, connChan)
+	}
 
 	return nil
 }
 
+// ListenAndServe starts the server and blocks until it stops.
+// Returns nil when stopped by ctx or Shutdown and the first fatal error otherwise.
+func (s *SocketServer) ListenAndServe(ctx context.Context) error {
+	if err := s.Serve(ctx); err != nil {
+		return err
+	}
+	<-s.Done()
+	return s.Err()
+}
+
+// Done returns a channel that is closed once the server stopped accepting connections
+func (s *SocketServer) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that stopped the server, nil while running or after a clean stop
+func (s *SocketServer) Err() error {
+	s.errMutex.Lock()
+	defer s.errMutex.Unlock()
+	return s.err
+}
+
+// stop records the reason the server stopped and closes the listener, only the first call has an effect
+func (s *SocketServer) stop(reason error) {
+	s.stopOnce.Do(func() {
+		s.errMutex.Lock()
+		s.err = reason
+		s.errMutex.Unlock()
+		if err := s.closeListener(); err != nil && !errors.Is(err, net.ErrClosed) {
+			s.logger.Error(context.Background(), err.Error())
+		}
+		close(s.done)
+	})
+}
+
+func (s *SocketServer) acceptLoop(ctx context.Context, listener net.Listener, connChan chan<- net.Conn) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			s.logger.Debug(ctx, "Listener closed")
+			s.stop(nil)
+			return
+		} else if err != nil {
+			s.logger.Error(ctx, err.Error())
+			s.stop(ErrListenerReason{err})
+			return
+		}
+		select {
+		case connChan <- conn:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
 func (s *SocketServer) handleConnectionsLoop(ctx context.Context, connChan <-chan net.Conn) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-s.done:
+			return
 		case conn := <-connChan:
-			s.logger.Debug(ctx, "New connection from %s", conn.RemoteAddr().String())
-			wrapper := NewConnTaskWrapper(conn, s.sshConfig, s.logger)
-			s.workerPool.Add(ctx, wrapper)
-			s.logger.Debug(ctx, "Connection added to worker pool")
+			go s.handleConnection(ctx, conn)
+		}
+	}
+}
+
+func (s *SocketServer) handleConnection(ctx context.Context, conn net.Conn) {
+	if s.proxyTrust != nil && s.proxyTrust.trusts(conn.RemoteAddr()) {
+		timeout, _ := s.config.GetDuration("TIMEOUT")
+		proxied, err := readProxyHeader(conn, timeout)
+		if err != nil {
+			s.logger.Warn(ctx, "Dropping connection from %s: %s", conn.RemoteAddr().String(), err.Error())
+			connectionsTotal.Inc(connResultProxyError)
+			conn.Close()
+			return
 		}
+		s.logger.Debug(ctx, "Connection from %s proxied for %s", conn.RemoteAddr().String(), proxied.RemoteAddr().String())
+		conn = proxied
+	}
+
+	s.logger.Debug(ctx, "New connection from %s", conn.RemoteAddr().String())
+	if ban, ok := s.bans.bannedAddr(conn.RemoteAddr()); ok {
+		s.logger.Warn(ctx, "Rejecting banned connection from %s", conn.RemoteAddr().String())
+		connectionsTotal.Inc(connResultBanned)
+		s.rejectConnection(ctx, conn, disconnectHostNotAllowed, ErrBannedReason{ban.Reason})
+		return
+	}
+	if err := s.limiter.acquireConn(conn.RemoteAddr()); err != nil {
+		s.logger.Warn(ctx, "Rejecting connection from %s: %s", conn.RemoteAddr().String(), err.Error())
+		connectionsTotal.Inc(connResultLimited)
+		s.rejectConnection(ctx, conn, disconnectTooManyConnections, err)
+		return
+	}
+	wrapper := NewConnTaskWrapper(conn, s.sshConfig, s.logger)
+	wrapper.limiter = s.limiter
+	wrapper.bans = s.bans
+	wrapper.recordings = s.recordings
+	wrapper.history = s.history
+	wrapper.roleDB = s.roleDB
+	wrapper.keyDB = s.loginManager.KeyDB
+	wrapper.userDB = s.userDB
+	wrapper.passwordPolicy = s.passwordPolicy
+	wrapper.onClose = s.untrackConn
+	s.trackConn(wrapper)
+	connectionsTotal.Inc(connResultAccepted)
+	workersQueued.Inc()
+	s.workerPool.Add(ctx, wrapper)
+	s.logger.Debug(ctx, "Connection added to worker pool")
+}
+
+// rejectConnection sends a disconnect message with the reason to the client and closes the connection
+func (s *SocketServer) rejectConnection(ctx context.Context, conn net.Conn, code uint32, reason error) {
+	version, _ := s.config.GetString("SERVERVERSION")
+	if err := sendDisconnect(conn, version, code, reason.Error()); err != nil {
+		s.logger.Debug(ctx, "Error sending disconnect to %s: %s", conn.RemoteAddr().String(), err.Error())
+	}
+	if err := conn.Close(); err != nil {
+		s.logger.Error(ctx, err.Error())
+	}
+}
+
+func (s *SocketServer) trackConn(cw *connTaskWrapper) {
+	cw.registry = s.registry
+	cw.id = s.registry.Add(cw)
+	connectionsActive.Inc()
+}
+
+func (s *SocketServer) untrackConn(cw *connTaskWrapper) {
+	s.registry.Remove(cw.id)
+	connectionsActive.Dec()
+}
+
+func (s *SocketServer) closeListener() (err error) {
+	s.closeOnce.Do(func() {
+		for _, listener := range s.listeners {
+			if closeErr := listener.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return
+}
+
+// Shutdown stops accepting connections, notifies all open terminals and waits for
+// the sessions to end. Once ctx is done, the remaining connections are closed.
+// Returns the number of connections that had to be closed forcefully.
+func (s *SocketServer) Shutdown(ctx context.Context) (int, error) {
+	s.logger.Info(ctx, "Server shutting down")
+	if err := s.closeListener(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return 0, err
+	}
+	s.stop(nil)
+
+	conns := s.registry.Conns()
+	for _, conn := range conns {
+		conn.Notify(ctx, "Server is shutting down, please finish your session")
+	}
+	s.logger.Info(ctx, "Waiting for %d connections to finish", len(conns))
+
+	cutOff := 0
+	for _, conn := range conns {
+		select {
+		case <-conn.Done():
+		case <-ctx.Done():
+			conn.Kick(ctx, "server shutdown")
+			cutOff++
+		}
+	}
+	if cutOff > 0 {
+		s.logger.Warn(ctx, "Closed %d connections forcefully", cutOff)
 	}
+	s.logger.Info(ctx, "Server shut down")
+	return cutOff, nil
 }
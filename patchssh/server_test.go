@@ -1,14 +1,21 @@
 package patchssh
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
 	"database/sql"
 	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/myLogic207/cinnamon/internal/dbconnect"
@@ -54,6 +61,7 @@ var testServerConf = map[string]interface{}{
 const USERNAME = "testuser"
 
 var dbMock sqlmock.Sqlmock
+var testKeyDB models.KeyDB
 var pubKey string
 
 func TestMain(m *testing.M) {
@@ -67,13 +75,15 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		panic(err)
 	}
+	testKeyDB = kdb
 	initServer(kdb)
 
 	sshPubkey := initClient()
 	pubKey = strings.Trim(string(ssh.MarshalAuthorizedKey(sshPubkey)), "\n")
 	testCtx := context.TODO()
 	mock.ExpectBegin()
-	mock.ExpectExec("INSERT INTO sshkeys").WithArgs(USERNAME, pubKey).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT id FROM users WHERE").WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO sshkeys").WithArgs(1, USERNAME, pubKey, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 	if err := kdb.AddKnownHost(testCtx, USERNAME, sshPubkey); err != nil {
 		panic(err)
@@ -81,20 +91,35 @@ func TestMain(m *testing.M) {
 	m.Run()
 }
 
+// queryUserKeys loads the keys of a user that may log in
+const queryUserKeys = "SELECT sshkeys.keystring FROM sshkeys JOIN users ON users.id = sshkeys.user_id WHERE users.deleted_at IS NULL AND users.disabled_at IS NULL AND users.username = \\?"
+
 func initServer(kdb models.KeyDB) {
+	testServer, err := newTestServer(kdb, config.NewWithInitialValues(testServerConf))
+	if err != nil {
+		panic(err)
+	}
+	TESTSERVER = testServer
+}
+
+// newTestServer starts a server with a fresh host key, expecting it to be stored in the db,
+// setup runs before the server starts
+func newTestServer(kdb models.KeyDB, serverConf config.Config, setup ...func(*SocketServer)) (*SocketServer, error) {
 	_, hostPrivKey, _ := ed25519.GenerateKey(rand.Reader)
 	privPemBlock, err := ssh.MarshalPrivateKey(crypto.PrivateKey(hostPrivKey), "test")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	privPemString := string(pem.EncodeToMemory(privPemBlock))
-	testServerConf := config.NewWithInitialValues(testServerConf)
-	if err := testServerConf.Set("HOSTKEY", privPemString, true); err != nil {
-		panic(err)
+	if err := serverConf.Set("HOSTKEY", privPemString, true); err != nil {
+		return nil, err
 	}
-	testServer, err := NewServer(testServerConf, kdb)
+	testServer, err := NewServer(serverConf, kdb)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	for _, setupFunc := range setup {
+		setupFunc(testServer)
 	}
 	testCtx := context.TODO()
 	dbMock.ExpectBegin()
@@ -105,9 +130,9 @@ func initServer(kdb models.KeyDB) {
 	dbMock.ExpectExec("INSERT INTO sshkeys").WithArgs("localhost", string(privPemString)).WillReturnResult(sqlmock.NewResult(1, 1))
 	dbMock.ExpectCommit()
 	if err := testServer.Serve(testCtx); err != nil {
-		panic(err)
+		return nil, err
 	}
-	TESTSERVER = testServer
+	return testServer, nil
 }
 
 func initClient() ssh.PublicKey {
@@ -143,11 +168,379 @@ func initClient() ssh.PublicKey {
 
 func TestServerConnect(t *testing.T) {
 	dbMock.ExpectBegin()
-	dbMock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(pubKey))
+	dbMock.ExpectQuery(queryUserKeys).WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(pubKey))
 	dbMock.ExpectCommit()
 
+	accepted := connectionsTotal.Value(connResultAccepted)
+	logins := authAttempts.Value("publickey", "success")
 	_, err := ssh.Dial("tcp", "127.0.0.1:22222", TESTCLIENTCONFIG)
 	if err != nil {
 		panic(err)
 	}
+	if connectionsTotal.Value(connResultAccepted) != accepted+1 || authAttempts.Value("publickey", "success") != logins+1 {
+		t.Errorf("Expected the connection and login to be counted")
+	}
+}
+
+func TestEnsureHostKey(t *testing.T) {
+	db, mock, err := dbconnect.NewDBMock(config.NewWithInitialValues(keyDBconf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	kdb, _ := models.NewKeyDB(db)
+	server, err := NewServer(config.NewWithInitialValues(testServerConf), kdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCtx := context.TODO()
+
+	// without HOSTKEY the stored key is kept, e.g. one set by the admin api
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("localhost").WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow("stored key"))
+	mock.ExpectCommit()
+	if key, err := server.ensureHostKey(testCtx); err != nil || string(key) != "stored key" {
+		t.Errorf("Expected the stored key, got %q (%v)", key, err)
+	}
+
+	// a key is generated and stored on the first start
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("localhost").WillReturnError(sql.ErrNoRows)
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT keystring FROM sshkeys WHERE identifier = ?").WithArgs("localhost").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("INSERT INTO sshkeys").WithArgs("localhost", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	key, err := server.ensureHostKey(testCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssh.ParsePrivateKey(key); err != nil {
+		t.Errorf("Expected a generated key, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	limiter := newConnLimiter(2, 1, 1)
+	first := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	second := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1}
+	third := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1}
+
+	if err := limiter.acquireConn(first); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if err := limiter.acquireConn(first); !errors.Is(err, ErrTooManyConnectionsIP) {
+		t.Errorf("Expected ErrTooManyConnectionsIP, got %v", err)
+	}
+	if err := limiter.acquireConn(second); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if err := limiter.acquireConn(third); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("Expected ErrTooManyConnections, got %v", err)
+	}
+	limiter.releaseConn(first)
+	if err := limiter.acquireConn(third); err != nil {
+		t.Errorf("Expected nil error after release, got %v", err)
+	}
+
+	if err := limiter.acquireUser(USERNAME); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	if err := limiter.acquireUser(USERNAME); !errors.Is(err, ErrTooManyConnectionsUser) {
+		t.Errorf("Expected ErrTooManyConnectionsUser, got %v", err)
+	}
+	limiter.releaseUser(USERNAME)
+	if err := limiter.acquireUser(USERNAME); err != nil {
+		t.Errorf("Expected nil error after release, got %v", err)
+	}
+
+	// every connection occupies a worker, so the cap never exceeds WORKERS
+	for connections, expected := range map[int]int{0: 3, 2: 2, 10: 3} {
+		serverConf := config.NewWithInitialValues(testServerConf)
+		if err := serverConf.Set("LIMITS/CONNECTIONS", connections, true); err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewServer(serverConf, testKeyDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.limiter.maxTotal != expected {
+			t.Errorf("Expected CONNECTIONS %d to allow %d connections, got %d", connections, expected, server.limiter.maxTotal)
+		}
+	}
+}
+
+func TestRefuseBannedUser(t *testing.T) {
+	if _, err := TESTSERVER.Bans().Add("user:"+USERNAME, "testing", 0); err != nil {
+		t.Fatal(err)
+	}
+	defer TESTSERVER.Bans().Remove("user:" + USERNAME)
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery(queryUserKeys).WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(pubKey))
+	dbMock.ExpectCommit()
+
+	banner := ""
+	clientConfig := *TESTCLIENTCONFIG
+	clientConfig.BannerCallback = func(message string) error {
+		banner = message
+		return nil
+	}
+	client, err := ssh.Dial("tcp", "127.0.0.1:22222", &clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if strings.Contains(banner, "banned") {
+		t.Errorf("Expected the ban to be hidden before authentication, got %q", banner)
+	}
+	if _, err := client.NewSession(); err == nil || !strings.Contains(err.Error(), "testing") {
+		t.Errorf("Expected the ban reason after authentication, got %v", err)
+	}
+}
+
+func TestRejectConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		TESTSERVER.rejectConnection(context.TODO(), conn, disconnectTooManyConnections, ErrTooManyConnections)
+	}()
+
+	_, err = ssh.Dial("tcp", listener.Addr().String(), TESTCLIENTCONFIG)
+	if err == nil || !strings.Contains(err.Error(), ErrTooManyConnections.Error()) {
+		t.Errorf("Expected disconnect with reason, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	serverConf := config.NewWithInitialValues(testServerConf)
+	if err := serverConf.Set("PORT", 22223, true); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newTestServer(testKeyDB, serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbMock.ExpectBegin()
+	dbMock.ExpectQuery(queryUserKeys).WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(pubKey))
+	dbMock.ExpectCommit()
+	client, err := ssh.Dial("tcp", "127.0.0.1:22223", TESTCLIENTCONFIG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keep stdin open, otherwise the terminal reads EOF and ends the session
+	if _, err := session.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	// the order openssh clients use
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.WindowChange(40, 120); err != nil {
+		t.Fatal(err)
+	}
+
+	noticeChan := make(chan bool)
+	go func() {
+		buffer := bytes.Buffer{}
+		chunk := make([]byte, 256)
+		for {
+			n, err := stdout.Read(chunk)
+			buffer.Write(chunk[:n])
+			if strings.Contains(buffer.String(), "shutting down") {
+				noticeChan <- true
+				return
+			} else if err != nil {
+				noticeChan <- false
+				return
+			}
+		}
+	}()
+
+	infos := server.Registry().List()
+	if len(infos) != 1 {
+		t.Fatalf("Expected 1 registered connection, got %d", len(infos))
+	}
+	if infos[0].User != USERNAME || infos[0].AuthMethod != "publickey" || infos[0].BytesIn == 0 {
+		t.Errorf("Expected publickey connection of %s with traffic, got %+v", USERNAME, infos[0])
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.TODO(), 200*time.Millisecond)
+	defer cancel()
+	cutOff, err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cutOff != 1 {
+		t.Errorf("Expected 1 connection to be cut off, got %d", cutOff)
+	}
+	if !<-noticeChan {
+		t.Error("Expected shutdown notice on terminal")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:22223"); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+	<-server.Done()
+	if err := server.Err(); err != nil {
+		t.Errorf("Expected nil error after shutdown, got %v", err)
+	}
+}
+
+type failingListener struct {
+	net.Listener
+}
+
+func (failingListener) Accept() (net.Conn, error) {
+	return nil, errors.New("accept failed")
+}
+
+func (failingListener) Close() error {
+	return nil
+}
+
+func TestAcceptFailure(t *testing.T) {
+	server, err := NewServer(config.NewWithInitialValues(testServerConf), testKeyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listeners = []net.Listener{failingListener{}}
+	go server.acceptLoop(context.TODO(), server.listeners[0], make(chan net.Conn))
+
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected server to stop after accept failure")
+	}
+	if err := server.Err(); !errors.Is(err, ErrListener) {
+		t.Errorf("Expected ErrListener, got %v", err)
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	valid := map[string]listenAddr{
+		"tcp://127.0.0.1:2222":           {network: "tcp", address: "127.0.0.1:2222"},
+		" tcp6://[::1]:2222 ":            {network: "tcp6", address: "[::1]:2222"},
+		"unix:///tmp/cin.sock":           {network: "unix", address: "/tmp/cin.sock", mode: 0660},
+		"unix:///tmp/cin.sock?mode=0600": {network: "unix", address: "/tmp/cin.sock", mode: 0600},
+		"systemd://":                     {network: "systemd"},
+		"systemd://ssh":                  {network: "systemd", address: "ssh"},
+	}
+	for raw, expected := range valid {
+		addr, err := parseListenAddr(raw)
+		if err != nil {
+			t.Errorf("Expected nil error for %s, got %v", raw, err)
+		} else if addr != expected {
+			t.Errorf("Expected %+v for %s, got %+v", expected, raw, addr)
+		}
+	}
+
+	for _, raw := range []string{"udp://127.0.0.1:2222", "tcp://127.0.0.1", "unix:///tmp/cin.sock?mode=abc"} {
+		if _, err := parseListenAddr(raw); !errors.Is(err, ErrInvalidListenAddr) {
+			t.Errorf("Expected ErrInvalidListenAddr for %s, got %v", raw, err)
+		}
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "cinnamon.sock")
+	serverConf := config.NewWithInitialValues(testServerConf)
+	if err := serverConf.Set("LISTENERS", "tcp://127.0.0.1:22224, unix://"+socketPath+"?mode=0600", true); err != nil {
+		t.Fatal(err)
+	}
+	server, err := newTestServer(testKeyDB, serverConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.TODO())
+
+	if stat, err := os.Stat(socketPath); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", stat.Mode().Perm())
+	}
+
+	for _, network := range []string{"tcp", "unix"} {
+		address := "127.0.0.1:22224"
+		if network == "unix" {
+			address = socketPath
+		}
+		dbMock.ExpectBegin()
+		dbMock.ExpectQuery(queryUserKeys).WithArgs(USERNAME).WillReturnRows(sqlmock.NewRows([]string{"keystring"}).AddRow(pubKey))
+		dbMock.ExpectCommit()
+		client, err := ssh.Dial(network, address, TESTCLIENTCONFIG)
+		if err != nil {
+			t.Fatalf("Failed to connect via %s: %v", network, err)
+		}
+		client.Close()
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0x00, 0x0C, 10, 0, 0, 7, 10, 0, 0, 1, 0xC3, 0x50, 0x08, 0xAE)
+	headers := map[string][]byte{
+		"203.0.113.9:41000": []byte("PROXY TCP4 203.0.113.9 10.0.0.1 41000 2222\r\n"),
+		"[2001:db8::1]:443": []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 2222\r\n"),
+		"10.0.0.7:50000":    v2,
+	}
+	for expected, header := range headers {
+		server, client := net.Pipe()
+		go func() {
+			client.Write(append(header, []byte("SSH-2.0-test\r\n")...))
+		}()
+		conn, err := readProxyHeader(server, time.Second)
+		if err != nil {
+			t.Fatalf("Expected nil error for %s, got %v", expected, err)
+		}
+		if conn.RemoteAddr().String() != expected {
+			t.Errorf("Expected remote address %s, got %s", expected, conn.RemoteAddr().String())
+		}
+		rest := make([]byte, 14)
+		if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != "SSH-2.0-test\r\n" {
+			t.Errorf("Expected payload after header, got %q (%v)", rest, err)
+		}
+		server.Close()
+		client.Close()
+	}
+
+	server, client := net.Pipe()
+	go client.Write([]byte("SSH-2.0-test\r\n"))
+	if _, err := readProxyHeader(server, time.Second); !errors.Is(err, ErrProxyHeader) {
+		t.Errorf("Expected ErrProxyHeader without header, got %v", err)
+	}
+	server.Close()
+	client.Close()
+
+	trust, err := parseProxyTrust("10.0.0.0/8, unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !trust.trusts(&net.TCPAddr{IP: net.IPv4(10, 1, 2, 3)}) || !trust.trusts(&net.UnixAddr{Name: "@"}) {
+		t.Error("Expected trusted upstreams to be trusted")
+	}
+	if trust.trusts(&net.TCPAddr{IP: net.IPv4(192, 168, 0, 1)}) {
+		t.Error("Expected untrusted upstream not to be trusted")
+	}
 }
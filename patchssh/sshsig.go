@@ -0,0 +1,84 @@
+package patchssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// armored signatures as written by ssh-keygen -Y sign, see PROTOCOL.sshsig of openssh
+const (
+	sshSignatureType    = "SSH SIGNATURE"
+	sshSignatureMagic   = "SSHSIG"
+	sshSignatureVersion = 1
+)
+
+// sshSignature is the blob inside the armor
+type sshSignature struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is what the key actually signs
+type sshSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifySSHSignature checks an armored signature of message made by key for namespace
+func verifySSHSignature(armored []byte, key ssh.PublicKey, namespace string, message []byte) error {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != sshSignatureType {
+		return fmt.Errorf("%w: missing %s armor", ErrInvalidSignature, sshSignatureType)
+	}
+	sig := sshSignature{}
+	if err := ssh.Unmarshal(block.Bytes, &sig); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	if string(sig.Magic[:]) != sshSignatureMagic || sig.Version != sshSignatureVersion {
+		return fmt.Errorf("%w: unsupported format", ErrInvalidSignature)
+	}
+	if sig.Namespace != namespace {
+		return fmt.Errorf("%w: namespace %q, expected %q", ErrInvalidSignature, sig.Namespace, namespace)
+	}
+	if !bytes.Equal(sig.PublicKey, key.Marshal()) {
+		return fmt.Errorf("%w: made by another key", ErrInvalidSignature)
+	}
+	var digest hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		digest = sha256.New()
+	case "sha512":
+		digest = sha512.New()
+	default:
+		return fmt.Errorf("%w: unsupported hash %s", ErrInvalidSignature, sig.HashAlgorithm)
+	}
+	digest.Write(message)
+	signed := sshSignedData{
+		Namespace:     sig.Namespace,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          digest.Sum(nil),
+	}
+	copy(signed.Magic[:], sshSignatureMagic)
+	signature := &ssh.Signature{}
+	if err := ssh.Unmarshal(sig.Signature, signature); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	if err := key.Verify(ssh.Marshal(signed), signature); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidSignature, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+var (
+	ErrInvalidCommand   = errors.New("invalid command definition")
+	ErrCommandExists    = errors.New("command already registered")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+const helpUsage = "usage: help [command]"
+
+// Flag describes a single letter flag of a command
+type Flag struct {
+	Name rune
+	// Value names the argument of the flag, empty for switches
+	Value string
+	Help  string
+}
+
+// Definition describes a command for the registry, its help and usage are generated from it
+type Definition struct {
+	Name    string
+	Aliases []string
+	// Short is the one line summary shown by help, Long the text shown by help <command>
+	Short string
+	Long  string
+	Flags []Flag
+	// Args describes the operands after the flags, e.g. "<pattern>"
+	Args string
+	// Permissions are required to run the command, admins have all of them
+	Permissions []string
+	Run         StreamCommand
+	// Complete suggests arguments on tab, flags are completed from Flags
+	Complete CompleteFunc
+}
+
+// Usage returns the usage line of the command
+func (d Definition) Usage() string {
+	builder := &strings.Builder{}
+	builder.WriteString("usage: " + d.Name)
+	for _, flag := range d.Flags {
+		if flag.Value != "" {
+			fmt.Fprintf(builder, " [-%c <%s>]", flag.Name, flag.Value)
+		} else {
+			fmt.Fprintf(builder, " [-%c]", flag.Name)
+		}
+	}
+	if d.Args != "" {
+		builder.WriteString(" " + d.Args)
+	}
+	return builder.String()
+}
+
+// Flags are parsed command flags, switches map to an empty string
+type Flags map[rune]string
+
+// Has tells if the flag was given
+func (f Flags) Has(name rune) bool {
+	_, ok := f[name]
+	return ok
+}
+
+// ParseArgs splits the flags of the definition from the operands, unknown flags are a usage error
+func (d Definition) ParseArgs(args []string) (Flags, []string, error) {
+	allowed, withValue := "", ""
+	for _, flag := range d.Flags {
+		if flag.Value != "" {
+			withValue += string(flag.Name)
+		} else {
+			allowed += string(flag.Name)
+		}
+	}
+	flags, operands, ok := parseFlags(args, allowed, withValue)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w, %s", ErrUsage, d.Usage())
+	}
+	return flags, operands, nil
+}
+
+// PermissionAll grants every permission, "group.*" grants every permission starting with "group."
+const PermissionAll = "*"
+
+// Can tells if the identity holds the permission
+func (i Identity) Can(permission string) bool {
+	if i.Admin {
+		return true
+	}
+	return slices.ContainsFunc(i.Permissions, func(granted string) bool {
+		if granted == permission || granted == PermissionAll {
+			return true
+		}
+		group, ok := strings.CutSuffix(granted, "*")
+		return ok && strings.HasSuffix(group, ".") && strings.HasPrefix(permission, group)
+	})
+}
+
+// allowed tells if the identity holds every permission the command requires
+func (d Definition) allowed(identity Identity) bool {
+	for _, permission := range d.Permissions {
+		if !identity.Can(permission) {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry holds command definitions by name and alias
+type Registry struct {
+	mutex    sync.RWMutex
+	commands map[string]Definition
+	aliases  map[string]string
+}
+
+// Commands is the registry every new shell starts with, packages add their commands with Register
+var Commands = NewRegistry()
+
+func init() {
+	for _, definition := range builtins() {
+		if err := Commands.Register(definition); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: map[string]Definition{},
+		aliases:  map[string]string{},
+	}
+}
+
+// Register makes a command available in every shell created afterwards
+func Register(definition Definition) error {
+	return Commands.Register(definition)
+}
+
+// Register adds a command, names and aliases have to be unique
+func (r *Registry) Register(definition Definition) error {
+	if definition.Name == "" || definition.Run == nil {
+		return ErrInvalidCommand
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, name := range append([]string{definition.Name}, definition.Aliases...) {
+		if r.exists(name) {
+			return fmt.Errorf("%w: %s", ErrCommandExists, name)
+		}
+	}
+	r.set(definition)
+	return nil
+}
+
+func (r *Registry) exists(name string) bool {
+	_, command := r.commands[name]
+	_, alias := r.aliases[name]
+	return command || alias
+}
+
+// set adds or replaces a command, the caller holds the lock
+func (r *Registry) set(definition Definition) {
+	if old, ok := r.commands[definition.Name]; ok {
+		for _, alias := range old.Aliases {
+			delete(r.aliases, alias)
+		}
+	}
+	r.commands[definition.Name] = definition
+	for _, alias := range definition.Aliases {
+		r.aliases[alias] = definition.Name
+	}
+}
+
+// Lookup finds a command by name or alias
+func (r *Registry) Lookup(name string) (Definition, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if target, ok := r.aliases[name]; ok {
+		name = target
+	}
+	definition, ok := r.commands[name]
+	return definition, ok
+}
+
+// List returns all commands sorted by name
+func (r *Registry) List() []Definition {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	definitions := make([]Definition, 0, len(r.commands))
+	for _, definition := range r.commands {
+		definitions = append(definitions, definition)
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Name < definitions[j].Name
+	})
+	return definitions
+}
+
+// Clone copies the registry, commands added to the copy stay local to it
+func (r *Registry) Clone() *Registry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	clone := NewRegistry()
+	for _, definition := range r.commands {
+		clone.set(definition)
+	}
+	return clone
+}
+
+func builtins() []Definition {
+	return []Definition{
+		{
+			Name:  "echo",
+			Short: "Print the arguments",
+			Args:  "[text...]",
+			Run:   Buffered(echo),
+		},
+		grepCommand(),
+		headCommand(),
+		tailCommand(),
+		wcCommand(),
+		sortCommand(),
+	}
+}
+
+// helpCommand describes the commands of registry the user is allowed to run
+func helpCommand(registry *Registry) Definition {
+	return Definition{
+		Name:    "help",
+		Aliases: []string{"?"},
+		Short:   "Show the available commands or the help of a command",
+		Args:    "[command]",
+		Complete: func(ctx context.Context, user Identity, args []string, word string) []string {
+			if len(args) > 0 {
+				return nil
+			}
+			names := []string{}
+			for _, definition := range registry.List() {
+				if definition.allowed(user) {
+					names = append(names, definition.Name)
+				}
+			}
+			return names
+		},
+		Run: func(ctx context.Context, args []string, stdio IO) error {
+			if len(args) > 1 {
+				return fmt.Errorf("%w, %s", ErrUsage, helpUsage)
+			}
+			if len(args) == 0 {
+				_, err := stdio.Stdout.Write(formatHelp(registry.List(), stdio.User))
+				return err
+			}
+			definition, ok := registry.Lookup(args[0])
+			if !ok || !definition.allowed(stdio.User) {
+				return fmt.Errorf("%w: %s", ErrCommandNotFound, args[0])
+			}
+			_, err := stdio.Stdout.Write(formatCommandHelp(definition))
+			return err
+		},
+	}
+}
+
+func formatHelp(definitions []Definition, identity Identity) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	for _, definition := range definitions {
+		if definition.allowed(identity) {
+			fmt.Fprintf(writer, "%s\t%s\n", definition.Name, definition.Short)
+		}
+	}
+	writer.Flush()
+	buffer.WriteString("Run 'help <command>' for details.\n")
+	return buffer.Bytes()
+}
+
+func formatCommandHelp(definition Definition) []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(definition.Usage() + "\n")
+	if definition.Short != "" {
+		buffer.WriteString("\n" + definition.Short + "\n")
+	}
+	if definition.Long != "" {
+		buffer.WriteString("\n" + definition.Long + "\n")
+	}
+	if len(definition.Aliases) > 0 {
+		buffer.WriteString("\nAliases: " + strings.Join(definition.Aliases, ", ") + "\n")
+	}
+	if len(definition.Flags) > 0 {
+		buffer.WriteString("\nFlags:\n")
+		writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+		for _, flag := range definition.Flags {
+			name := "-" + string(flag.Name)
+			if flag.Value != "" {
+				name += " <" + flag.Value + ">"
+			}
+			fmt.Fprintf(writer, "  %s\t%s\n", name, flag.Help)
+		}
+		writer.Flush()
+	}
+	return buffer.Bytes()
+}
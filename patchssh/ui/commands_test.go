@@ -0,0 +1,156 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	hello := Definition{
+		Name:    "hello",
+		Aliases: []string{"hi"},
+		Short:   "Greet someone",
+		Run: func(ctx context.Context, args []string, stdio IO) error {
+			_, err := io.WriteString(stdio.Stdout, "hello\n")
+			return err
+		},
+	}
+	if err := registry.Register(hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(Definition{Name: "hi", Run: hello.Run}); !errors.Is(err, ErrCommandExists) {
+		t.Errorf("Expected alias to be taken, got %v", err)
+	}
+	if err := registry.Register(Definition{Name: "empty"}); !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("Expected ErrInvalidCommand, got %v", err)
+	}
+	if definition, ok := registry.Lookup("hi"); !ok || definition.Name != "hello" {
+		t.Errorf("Expected alias to resolve, got %+v", definition)
+	}
+
+	clone := registry.Clone()
+	clone.Register(Definition{Name: "local", Run: hello.Run})
+	if _, ok := registry.Lookup("local"); ok {
+		t.Error("Expected the clone to stay separate")
+	}
+}
+
+func TestHelp(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.Register(Definition{
+		Name:        "secret",
+		Short:       "Admins only",
+		Permissions: []string{"secrets"},
+		Run:         Buffered(echo),
+	})
+
+	out, err := shell.Execute(context.TODO(), "help")
+	if err != nil || !strings.Contains(string(out), "grep") || strings.Contains(string(out), "secret") {
+		t.Errorf("Expected the allowed commands, got %s (%v)", out, err)
+	}
+	out, err = shell.Execute(context.TODO(), "help head")
+	if err != nil || !strings.Contains(string(out), "usage: head [-n <lines>]") || !strings.Contains(string(out), "-n <lines>  number of lines") {
+		t.Errorf("Expected usage and flags, got %s (%v)", out, err)
+	}
+	if _, err := shell.Execute(context.TODO(), "help secret"); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Expected hidden command, got %v", err)
+	}
+	if _, err := shell.Execute(context.TODO(), "secret"); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Expected ErrPermissionDenied, got %v", err)
+	}
+
+	shell.SetIdentity(Identity{Permissions: []string{"secrets"}})
+	if out, err := shell.Execute(context.TODO(), "secret ok"); err != nil || string(out) != "echo: ok" {
+		t.Errorf("Expected permitted command to run, got %q (%v)", out, err)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	definition := Definition{
+		Name:  "list",
+		Flags: []Flag{{Name: 'a'}, {Name: 'n', Value: "count"}},
+		Args:  "[filter]",
+	}
+	if usage := definition.Usage(); usage != "usage: list [-a] [-n <count>] [filter]" {
+		t.Errorf("Unexpected usage %q", usage)
+	}
+	flags, operands, err := definition.ParseArgs([]string{"-a", "-n5", "bob"})
+	if err != nil || !flags.Has('a') || flags['n'] != "5" || len(operands) != 1 || operands[0] != "bob" {
+		t.Errorf("Unexpected parse result %v %v (%v)", flags, operands, err)
+	}
+	if _, _, err := definition.ParseArgs([]string{"-x"}); !errors.Is(err, ErrUsage) {
+		t.Errorf("Expected ErrUsage, got %v", err)
+	}
+}
+
+func TestFilterUsage(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	// the usage errors show the usage line of the registered flags
+	for _, line := range []string{"grep", "grep -x a", "head -n x", "tail a", "wc -z", "sort -x"} {
+		name := strings.Fields(line)[0]
+		definition, _ := Commands.Lookup(name)
+		if _, err := shell.Execute(context.TODO(), line); !errors.Is(err, ErrUsage) || !strings.HasSuffix(err.Error(), definition.Usage()) {
+			t.Errorf("%s: expected %s, got %v", line, definition.Usage(), err)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.Register(Definition{
+		Name:        "secret",
+		Permissions: []string{"secrets"},
+		Run:         Buffered(echo),
+	})
+	shell.Register(Definition{
+		Name:     "color",
+		Run:      Buffered(echo),
+		Complete: CompleteWords("red", "green", "grey"),
+	})
+	cases := []struct {
+		line     string
+		expected []string
+	}{
+		{"gr", []string{"grep"}},
+		{"s", []string{"sort"}},
+		{"echo a | hea", []string{"head"}},
+		{"grep -", []string{"-F", "-c", "-i", "-v"}},
+		{"color gr", []string{"green", "grey"}},
+		{"color red ", []string{}},
+		{"help sec", []string{}},
+		{"secret ", nil},
+	}
+	for _, c := range cases {
+		candidates := shell.Complete(context.TODO(), c.line)
+		if strings.Join(candidates, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("Completing %q: expected %v, got %v", c.line, c.expected, candidates)
+		}
+	}
+}
+
+func TestCompleteCallback(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.Register(Definition{
+		Name:     "color",
+		Run:      Buffered(echo),
+		Complete: CompleteWords("green", "grey"),
+	})
+	tw := &TerminalWrapper{}
+	callback := tw.completeCallback(context.TODO(), shell)
+	if line, pos, ok := callback("gre x", 3, keyTab); !ok || line != "grep  x" || pos != 5 {
+		t.Errorf("Expected single candidate to be inserted, got %q %d", line, pos)
+	}
+	if line, pos, ok := callback("color g", 7, keyTab); !ok || line != "color gre" || pos != 9 {
+		t.Errorf("Expected common prefix, got %q %d", line, pos)
+	}
+	if _, _, ok := callback("color gre", 9, keyTab); ok {
+		t.Error("Expected no change without progress")
+	}
+	if _, _, ok := callback("gre", 3, 'x'); ok {
+		t.Error("Expected other keys to be ignored")
+	}
+}
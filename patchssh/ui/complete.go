@@ -0,0 +1,116 @@
+package ui
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// keyTab triggers the completion
+const keyTab = '\t'
+
+// Completer suggests words for the last word of a command line
+type Completer interface {
+	Complete(ctx context.Context, line string) []string
+}
+
+// CompleteFunc returns candidates for word, args are the words before it without the command name.
+// Candidates not starting with word are dropped by the shell.
+type CompleteFunc func(ctx context.Context, user Identity, args []string, word string) []string
+
+// CompleteWords completes the first argument from a fixed set, e.g. subcommands
+func CompleteWords(words ...string) CompleteFunc {
+	return func(ctx context.Context, user Identity, args []string, word string) []string {
+		if len(args) > 0 {
+			return nil
+		}
+		return words
+	}
+}
+
+// Complete returns the candidates for the last word of line, command names for the first word
+// of each command and the candidates of the command otherwise.
+func (sw *ShellWrapper) Complete(ctx context.Context, line string) []string {
+	// only the command after the last operator matters
+	if i := strings.LastIndexAny(line, "|;&"); i >= 0 {
+		line = line[i+1:]
+	}
+	words := strings.Fields(line)
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		word, words = words[len(words)-1], words[:len(words)-1]
+	}
+
+	candidates := []string{}
+	if len(words) == 0 {
+		for _, definition := range sw.commands.List() {
+			if definition.allowed(sw.identity) {
+				candidates = append(candidates, definition.Name)
+			}
+		}
+	} else {
+		definition, ok := sw.commands.Lookup(words[0])
+		if !ok || !definition.allowed(sw.identity) {
+			return nil
+		}
+		if strings.HasPrefix(word, "-") {
+			for _, flag := range definition.Flags {
+				candidates = append(candidates, "-"+string(flag.Name))
+			}
+		} else if definition.Complete != nil {
+			candidates = definition.Complete(ctx, sw.identity, words[1:], word)
+		}
+	}
+	matches := []string{}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// completeCallback completes the word before the cursor on tab. A single candidate is inserted,
+// several are completed up to their common prefix and listed on the next tab.
+func (tw *TerminalWrapper) completeCallback(ctx context.Context, completer Completer) func(string, int, rune) (string, int, bool) {
+	return func(line string, pos int, key rune) (string, int, bool) {
+		if key != keyTab {
+			return "", 0, false
+		}
+		prefix := line[:pos]
+		candidates := completer.Complete(ctx, prefix)
+		if len(candidates) == 0 {
+			return "", 0, false
+		}
+		start := strings.LastIndexAny(prefix, " |;&") + 1
+		word := prefix[start:]
+		completion := candidates[0]
+		if len(candidates) == 1 {
+			completion += " "
+		} else {
+			completion = commonPrefix(candidates)
+		}
+		if completion == word {
+			// no progress, show the options above the prompt once the terminal is unlocked
+			if tw.lastCompletion == prefix {
+				go tw.Notify(strings.Join(candidates, "  "))
+			}
+			tw.lastCompletion = prefix
+			return "", 0, false
+		}
+		tw.lastCompletion = ""
+		newLine := prefix[:start] + completion + line[pos:]
+		return newLine, start + len(completion), true
+	}
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,250 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lines shown by head and tail without -n
+const defaultFilterLines = 10
+
+// inputLines splits the output of the previous command, which may end lines with \r\n
+func inputLines(stdin []byte) []string {
+	text := strings.ReplaceAll(string(stdin), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(text, "\n")
+}
+
+func outputLines(lines []string) []byte {
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n"))
+}
+
+// parseFlags splits single letter flags from the operands, "-n 5" and "-n5" set values
+func parseFlags(args []string, allowed string, withValue string) (map[rune]string, []string, bool) {
+	flags := map[rune]string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return flags, args[i+1:], true
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			return flags, args[i:], true
+		}
+		for j, flag := range arg[1:] {
+			if strings.ContainsRune(withValue, flag) {
+				value := arg[j+2:]
+				if value == "" {
+					if i+1 >= len(args) {
+						return nil, nil, false
+					}
+					i++
+					value = args[i]
+				}
+				flags[flag] = value
+				break
+			}
+			if !strings.ContainsRune(allowed, flag) {
+				return nil, nil, false
+			}
+			flags[flag] = ""
+		}
+	}
+	return flags, []string{}, true
+}
+
+// filterCommand wraps a filter of the piped input, the flags and operands are parsed with the
+// definition, so the usage and help come from the same flags
+func filterCommand(definition Definition, filter func(flags Flags, operands []string, stdin []byte) ([]byte, error)) Definition {
+	definition.Run = Buffered(func(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+		flags, operands, err := definition.ParseArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return filter(flags, operands, stdin)
+	})
+	return definition
+}
+
+func grepCommand() Definition {
+	definition := Definition{
+		Name:  "grep",
+		Short: "Keep the lines matching a pattern",
+		Long:  "Reads the piped input and prints the lines matching the regular expression. Fails if no line matched, unless lines are counted.",
+		Flags: []Flag{
+			{Name: 'i', Help: "ignore case"},
+			{Name: 'v', Help: "keep the lines not matching"},
+			{Name: 'c', Help: "print the number of matching lines"},
+			{Name: 'F', Help: "match the pattern as plain text"},
+		},
+		Args: "<pattern>",
+	}
+	return filterCommand(definition, func(flags Flags, operands []string, stdin []byte) ([]byte, error) {
+		if len(operands) != 1 {
+			return nil, fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+		}
+		return grep(flags, operands[0], stdin)
+	})
+}
+
+// grep keeps the lines matching a regular expression, it fails if no line matched
+func grep(flags Flags, pattern string, stdin []byte) ([]byte, error) {
+	if flags.Has('F') {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if flags.Has('i') {
+		pattern = "(?i)" + pattern
+	}
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", ErrUsage, err.Error())
+	}
+	matches := []string{}
+	for _, line := range inputLines(stdin) {
+		if expression.MatchString(line) != flags.Has('v') {
+			matches = append(matches, line)
+		}
+	}
+	if flags.Has('c') {
+		return []byte(strconv.Itoa(len(matches))), nil
+	}
+	if len(matches) == 0 {
+		return nil, ErrNoMatch
+	}
+	return outputLines(matches), nil
+}
+
+// lineFilterCommand defines head and tail, keep gets the lines and the number to keep
+func lineFilterCommand(name, short string, keep func(lines []string, count int) []string) Definition {
+	definition := Definition{
+		Name:  name,
+		Short: short,
+		Flags: []Flag{{Name: 'n', Value: "lines", Help: fmt.Sprintf("number of lines, %d by default", defaultFilterLines)}},
+	}
+	return filterCommand(definition, func(flags Flags, operands []string, stdin []byte) ([]byte, error) {
+		count := defaultFilterLines
+		if flags.Has('n') {
+			var err error
+			if count, err = strconv.Atoi(flags['n']); err != nil || count < 0 {
+				return nil, fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+			}
+		}
+		if len(operands) != 0 {
+			return nil, fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+		}
+		lines := inputLines(stdin)
+		if count < len(lines) {
+			lines = keep(lines, count)
+		}
+		return outputLines(lines), nil
+	})
+}
+
+func headCommand() Definition {
+	return lineFilterCommand("head", "Keep the first lines", func(lines []string, count int) []string {
+		return lines[:count]
+	})
+}
+
+func tailCommand() Definition {
+	return lineFilterCommand("tail", "Keep the last lines", func(lines []string, count int) []string {
+		return lines[len(lines)-count:]
+	})
+}
+
+func wcCommand() Definition {
+	definition := Definition{
+		Name:  "wc",
+		Short: "Count lines, words and bytes",
+		Flags: []Flag{
+			{Name: 'l', Help: "count lines"},
+			{Name: 'w', Help: "count words"},
+			{Name: 'c', Help: "count bytes"},
+		},
+	}
+	return filterCommand(definition, func(flags Flags, operands []string, stdin []byte) ([]byte, error) {
+		if len(operands) != 0 {
+			return nil, fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+		}
+		return wc(flags, stdin), nil
+	})
+}
+
+// wc counts lines, words and bytes, all of them without flags
+func wc(flags Flags, stdin []byte) []byte {
+	all := len(flags) == 0
+	counts := []string{}
+	if all || flags.Has('l') {
+		counts = append(counts, strconv.Itoa(len(inputLines(stdin))))
+	}
+	if all || flags.Has('w') {
+		counts = append(counts, strconv.Itoa(len(bytes.Fields(stdin))))
+	}
+	if all || flags.Has('c') {
+		counts = append(counts, strconv.Itoa(len(stdin)))
+	}
+	return []byte(strings.Join(counts, " "))
+}
+
+func sortCommand() Definition {
+	definition := Definition{
+		Name:  "sort",
+		Short: "Sort lines",
+		Flags: []Flag{
+			{Name: 'r', Help: "reverse the order"},
+			{Name: 'n', Help: "compare leading numbers"},
+			{Name: 'u', Help: "drop duplicate lines"},
+		},
+	}
+	return filterCommand(definition, func(flags Flags, operands []string, stdin []byte) ([]byte, error) {
+		if len(operands) != 0 {
+			return nil, fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+		}
+		return sortLines(flags, stdin), nil
+	})
+}
+
+// sortLines orders lines lexically or by their leading number
+func sortLines(flags Flags, stdin []byte) []byte {
+	lines := inputLines(stdin)
+	less := func(i, j int) bool { return lines[i] < lines[j] }
+	if flags.Has('n') {
+		less = func(i, j int) bool { return leadingNumber(lines[i]) < leadingNumber(lines[j]) }
+	}
+	if flags.Has('r') {
+		forward := less
+		less = func(i, j int) bool { return forward(j, i) }
+	}
+	sort.SliceStable(lines, less)
+	if flags.Has('u') {
+		unique := []string{}
+		for i, line := range lines {
+			if i == 0 || line != lines[i-1] {
+				unique = append(unique, line)
+			}
+		}
+		lines = unique
+	}
+	return outputLines(lines)
+}
+
+// leadingNumber reads the number a line starts with, 0 if there is none
+func leadingNumber(line string) float64 {
+	line = strings.TrimSpace(line)
+	end := 0
+	for end < len(line) && (line[end] >= '0' && line[end] <= '9' || line[end] == '.' || (end == 0 && line[end] == '-')) {
+		end++
+	}
+	number, _ := strconv.ParseFloat(line[:end], 64)
+	return number
+}
@@ -0,0 +1,106 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// terminalHistorySize is the number of lines the terminal keeps for the arrow keys
+	terminalHistorySize = 100
+	// defaultHistoryLines is the number of lines shown by the history command
+	defaultHistoryLines = 20
+)
+
+// History keeps the command lines of users beyond their sessions
+type History interface {
+	Add(ctx context.Context, user, line string) error
+	// Lines returns the newest lines of the user, oldest first
+	Lines(ctx context.Context, user string, limit int) ([]HistoryLine, error)
+	Clear(ctx context.Context, user string) error
+}
+
+// HistoryLine is a command line entered by a user
+type HistoryLine struct {
+	Line string
+	Time time.Time
+}
+
+// UseHistory loads the history of user into the terminal and stores new lines in it, call it before Do
+func (tw *TerminalWrapper) UseHistory(ctx context.Context, history History, user string) error {
+	tw.history, tw.historyUser = history, user
+	lines, err := history.Lines(ctx, user, terminalHistorySize)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	// the terminal only fills its history from read lines, so they are entered unseen
+	preload := &bytes.Buffer{}
+	for _, line := range lines {
+		preload.WriteString(line.Line + "\r")
+	}
+	tw.mutex.Lock()
+	tw.preload = preload
+	tw.mutex.Unlock()
+	defer func() {
+		tw.mutex.Lock()
+		tw.preload = nil
+		tw.mutex.Unlock()
+	}()
+	for range lines {
+		if _, err := tw.terminal.ReadLine(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistoryCommand shows and clears the persisted command history of the user
+func HistoryCommand(history History) Definition {
+	definition := Definition{
+		Name:  "history",
+		Short: "Show or clear your command history",
+		Long:  "Shows the newest lines of your command history, it is kept across sessions. Clearing it takes effect in new sessions.",
+		Flags: []Flag{
+			{Name: 'n', Value: "lines", Help: fmt.Sprintf("number of lines, %d by default", defaultHistoryLines)},
+			{Name: 'c', Help: "clear the history"},
+		},
+	}
+	definition.Run = func(ctx context.Context, args []string, stdio IO) error {
+		flags, operands, err := definition.ParseArgs(args)
+		if err != nil {
+			return err
+		} else if len(operands) > 0 {
+			return fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+		}
+		if flags.Has('c') {
+			if err := history.Clear(ctx, stdio.User.User); err != nil {
+				return err
+			}
+			_, err := fmt.Fprintln(stdio.Stdout, "history cleared")
+			return err
+		}
+		limit := defaultHistoryLines
+		if flags.Has('n') {
+			if limit, err = strconv.Atoi(flags['n']); err != nil || limit < 1 {
+				return fmt.Errorf("%w, %s", ErrUsage, definition.Usage())
+			}
+		}
+		lines, err := history.Lines(ctx, stdio.User.User, limit)
+		if err != nil {
+			return err
+		}
+		writer := tabwriter.NewWriter(stdio.Stdout, 0, 4, 2, ' ', 0)
+		for i, line := range lines {
+			fmt.Fprintf(writer, "%d\t%s\t%s\n", i+1, line.Time.Local().Format("2006-01-02 15:04:05"), line.Line)
+		}
+		return writer.Flush()
+	}
+	return definition
+}
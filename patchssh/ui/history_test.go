@@ -0,0 +1,88 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testHistory struct {
+	lines []HistoryLine
+}
+
+func (h *testHistory) Add(ctx context.Context, user, line string) error {
+	h.lines = append(h.lines, HistoryLine{Line: line, Time: time.Now()})
+	return nil
+}
+
+func (h *testHistory) Lines(ctx context.Context, user string, limit int) ([]HistoryLine, error) {
+	if limit > 0 && len(h.lines) > limit {
+		return h.lines[len(h.lines)-limit:], nil
+	}
+	return h.lines, nil
+}
+
+func (h *testHistory) Clear(ctx context.Context, user string) error {
+	h.lines = nil
+	return nil
+}
+
+// testChannel is a session channel writing into a buffer
+type testChannel struct {
+	ssh.Channel
+	output bytes.Buffer
+}
+
+func (c *testChannel) Read(data []byte) (int, error)  { return 0, io.EOF }
+func (c *testChannel) Write(data []byte) (int, error) { return c.output.Write(data) }
+func (c *testChannel) Stderr() io.ReadWriter          { return &c.output }
+func (c *testChannel) Close() error                   { return nil }
+
+func TestUseHistory(t *testing.T) {
+	history := &testHistory{}
+	history.Add(context.TODO(), "alice", "echo a")
+	history.Add(context.TODO(), "alice", "echo b")
+	channel := &testChannel{}
+	terminal := NewTerminalWrapper(TESTSHELL.logger, channel, TESTSHELL)
+	if err := terminal.UseHistory(context.TODO(), history, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if channel.output.Len() != 0 {
+		t.Errorf("Expected the history to load unseen, got %q", channel.output.String())
+	}
+	// arrow up twice
+	terminal.input.Write([]byte("\x1b[A\x1b[A\r"))
+	line, err := terminal.terminal.ReadLine()
+	if err != nil || line != "echo a" {
+		t.Errorf("Expected the loaded history, got %q (%v)", line, err)
+	}
+}
+
+func TestHistoryCommand(t *testing.T) {
+	history := &testHistory{}
+	for _, line := range []string{"echo 1", "echo 2", "echo 3"} {
+		history.Add(context.TODO(), "alice", line)
+	}
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.SetIdentity(Identity{User: "alice"})
+	shell.Register(HistoryCommand(history))
+
+	out, err := shell.Execute(context.TODO(), "history -n 2")
+	if err != nil || strings.Contains(string(out), "echo 1") || !strings.Contains(string(out), "echo 3") {
+		t.Errorf("Expected the newest lines, got %s (%v)", out, err)
+	}
+	for _, limit := range []string{"0", "-1", "all"} {
+		if _, err := shell.Execute(context.TODO(), "history -n "+limit); !errors.Is(err, ErrUsage) {
+			t.Errorf("Expected ErrUsage for -n %s, got %v", limit, err)
+		}
+	}
+	if _, err := shell.Execute(context.TODO(), "history -c"); err != nil || len(history.lines) != 0 {
+		t.Errorf("Expected history to be cleared, got %v (%v)", history.lines, err)
+	}
+}
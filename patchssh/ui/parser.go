@@ -0,0 +1,293 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operator joins a command to the one before it
+type Operator int
+
+const (
+	// OpNone starts a command line
+	OpNone Operator = iota
+	// OpSequence runs the command regardless of the previous result, ";"
+	OpSequence
+	// OpAnd runs the command if the previous one succeeded, "&&"
+	OpAnd
+	// OpOr runs the command if the previous one failed, "||"
+	OpOr
+)
+
+func (o Operator) String() string {
+	switch o {
+	case OpSequence:
+		return ";"
+	case OpAnd:
+		return "&&"
+	case OpOr:
+		return "||"
+	}
+	return ""
+}
+
+// SimpleCommand is a command name with its arguments, after quote removal and expansion
+type SimpleCommand struct {
+	Args []string
+}
+
+// Pipeline is a list of commands joined by "|", each reading the output of the one before
+type Pipeline struct {
+	Commands []SimpleCommand
+	// Op is the operator in front of the pipeline
+	Op Operator
+}
+
+// SyntaxError describes where a command line could not be parsed, Column starts at 1
+type SyntaxError struct {
+	Column  int
+	Message string
+}
+
+func (e SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at column %d: %s", e.Column, e.Message)
+}
+
+func (e SyntaxError) Unwrap() error {
+	return ErrSyntax
+}
+
+// Parse splits a command line into commands, like a POSIX shell does:
+// words are separated by blanks, single quotes keep everything literal, double quotes
+// allow $VAR and \ escapes of $ " \ `, outside of quotes \ escapes any character.
+// $VAR and ${VAR} are replaced by lookup, the result is not split into further words.
+// Commands are joined into pipelines by "|", pipelines are joined by ";", "&&" and "||".
+// Background jobs and unquoted redirections with "<" or ">" are syntax errors.
+func Parse(line string, lookup func(string) string) ([]Pipeline, error) {
+	p := &parser{input: []rune(line), lookup: lookup}
+	return p.parse()
+}
+
+type parser struct {
+	input     []rune
+	pos       int
+	lookup    func(string) string
+	pipelines []Pipeline
+	pipeline  Pipeline
+	current   SimpleCommand
+	// word collects the current word, quoted tells if it must be kept when empty
+	word    strings.Builder
+	inWord  bool
+	quoted  bool
+	lastOp  Operator
+	lastPos int
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return SyntaxError{Column: pos + 1, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parse() ([]Pipeline, error) {
+	for p.pos < len(p.input) {
+		char := p.input[p.pos]
+		switch {
+		case char == ' ' || char == '\t':
+			p.endWord()
+			p.pos++
+		case char == ';':
+			if err := p.endCommand(OpSequence, 1); err != nil {
+				return nil, err
+			}
+		case char == '|' && (p.pos+1 >= len(p.input) || p.input[p.pos+1] != '|'):
+			if err := p.pipe(); err != nil {
+				return nil, err
+			}
+		case char == '&' || char == '|':
+			if p.pos+1 >= len(p.input) || p.input[p.pos+1] != char {
+				return nil, p.errorf(p.pos, "background jobs are not supported")
+			}
+			op := OpAnd
+			if char == '|' {
+				op = OpOr
+			}
+			if err := p.endCommand(op, 2); err != nil {
+				return nil, err
+			}
+		case char == '>' || char == '<':
+			return nil, p.errorf(p.pos, "redirection is not supported")
+		case char == '\'':
+			if err := p.singleQuoted(); err != nil {
+				return nil, err
+			}
+		case char == '"':
+			if err := p.doubleQuoted(); err != nil {
+				return nil, err
+			}
+		case char == '\\':
+			if p.pos+1 >= len(p.input) {
+				return nil, p.errorf(p.pos, "unexpected end of line after '\\'")
+			}
+			p.write(string(p.input[p.pos+1]))
+			p.quoted = true
+			p.pos += 2
+		case char == '$':
+			if err := p.expand(); err != nil {
+				return nil, err
+			}
+		default:
+			p.write(string(char))
+			p.pos++
+		}
+	}
+	p.endWord()
+	if len(p.current.Args) > 0 {
+		p.pipeline.Commands = append(p.pipeline.Commands, p.current)
+		p.pipelines = append(p.pipelines, p.pipeline)
+	} else if len(p.pipeline.Commands) > 0 {
+		return nil, p.errorf(p.lastPos, "missing command after '|'")
+	} else if p.lastOp == OpAnd || p.lastOp == OpOr {
+		return nil, p.errorf(p.lastPos, "missing command after '%s'", p.lastOp)
+	}
+	return p.pipelines, nil
+}
+
+func (p *parser) write(value string) {
+	p.word.WriteString(value)
+	p.inWord = true
+}
+
+func (p *parser) endWord() {
+	// unquoted words that expanded to nothing are dropped
+	if p.inWord && (p.word.Len() > 0 || p.quoted) {
+		p.current.Args = append(p.current.Args, p.word.String())
+	}
+	p.word.Reset()
+	p.inWord = false
+	p.quoted = false
+}
+
+// pipe ends the current command, the next one reads its output
+func (p *parser) pipe() error {
+	p.endWord()
+	if len(p.current.Args) == 0 {
+		return p.errorf(p.pos, "unexpected '|'")
+	}
+	p.pipeline.Commands = append(p.pipeline.Commands, p.current)
+	p.current = SimpleCommand{}
+	p.lastPos = p.pos
+	p.pos++
+	return nil
+}
+
+// endCommand ends the current pipeline, the next one is joined by op
+func (p *parser) endCommand(op Operator, length int) error {
+	p.endWord()
+	if len(p.current.Args) == 0 {
+		return p.errorf(p.pos, "unexpected '%s'", op)
+	}
+	p.pipeline.Commands = append(p.pipeline.Commands, p.current)
+	p.pipelines = append(p.pipelines, p.pipeline)
+	p.pipeline = Pipeline{Op: op}
+	p.current = SimpleCommand{}
+	p.lastOp = op
+	p.lastPos = p.pos
+	p.pos += length
+	return nil
+}
+
+func (p *parser) singleQuoted() error {
+	start := p.pos
+	end := p.pos + 1
+	for end < len(p.input) && p.input[end] != '\'' {
+		end++
+	}
+	if end >= len(p.input) {
+		return p.errorf(start, "unterminated single quote")
+	}
+	p.write(string(p.input[start+1 : end]))
+	p.quoted = true
+	p.pos = end + 1
+	return nil
+}
+
+func (p *parser) doubleQuoted() error {
+	start := p.pos
+	p.pos++
+	p.inWord = true
+	p.quoted = true
+	for p.pos < len(p.input) {
+		char := p.input[p.pos]
+		switch {
+		case char == '"':
+			p.pos++
+			return nil
+		case char == '\\' && p.pos+1 < len(p.input) && strings.ContainsRune("$\"\\`", p.input[p.pos+1]):
+			p.write(string(p.input[p.pos+1]))
+			p.pos += 2
+		case char == '$':
+			if err := p.expand(); err != nil {
+				return err
+			}
+		default:
+			p.write(string(char))
+			p.pos++
+		}
+	}
+	return p.errorf(start, "unterminated double quote")
+}
+
+// expand replaces $NAME or ${NAME} at the current position, a lone $ stays literal
+func (p *parser) expand() error {
+	start := p.pos
+	p.pos++
+	if p.pos < len(p.input) && p.input[p.pos] == '{' {
+		end := p.pos + 1
+		for end < len(p.input) && p.input[end] != '}' {
+			end++
+		}
+		if end >= len(p.input) {
+			return p.errorf(start, "unterminated '${'")
+		}
+		name := string(p.input[p.pos+1 : end])
+		if !validName(name) {
+			return p.errorf(start, "bad substitution '${%s}'", name)
+		}
+		p.write(p.value(name))
+		p.pos = end + 1
+		return nil
+	}
+	end := p.pos
+	for end < len(p.input) && isNameRune(p.input[end], end == p.pos) {
+		end++
+	}
+	if end == p.pos {
+		p.write("$")
+		return nil
+	}
+	p.write(p.value(string(p.input[p.pos:end])))
+	p.pos = end
+	return nil
+}
+
+func (p *parser) value(name string) string {
+	if p.lookup == nil {
+		return ""
+	}
+	return p.lookup(name)
+}
+
+func isNameRune(r rune, first bool) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || (!first && r >= '0' && r <= '9')
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !isNameRune(r, i == 0) {
+			return false
+		}
+	}
+	return true
+}
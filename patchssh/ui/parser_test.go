@@ -0,0 +1,110 @@
+package ui
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// pipe builds a pipeline without operator from the arguments of its commands
+func pipe(commands ...[]string) Pipeline {
+	pipeline := Pipeline{}
+	for _, args := range commands {
+		pipeline.Commands = append(pipeline.Commands, SimpleCommand{Args: args})
+	}
+	return pipeline
+}
+
+func TestParse(t *testing.T) {
+	env := map[string]string{"USER": "alice", "GREETING": "hello  world"}
+	lookup := func(name string) string { return env[name] }
+	cases := []struct {
+		line     string
+		expected []Pipeline
+	}{
+		{"echo a  b", []Pipeline{pipe([]string{"echo", "a", "b"})}},
+		{`echo "a  b"`, []Pipeline{pipe([]string{"echo", "a  b"})}},
+		{`echo 'a "$USER" \n'`, []Pipeline{pipe([]string{"echo", `a "$USER" \n`})}},
+		{`echo "$USER's \"quote\" \n"`, []Pipeline{pipe([]string{"echo", `alice's "quote" \n`})}},
+		{`echo a\ b \$USER`, []Pipeline{pipe([]string{"echo", "a b", "$USER"})}},
+		{"echo $GREETING ${USER}x $UNSET", []Pipeline{pipe([]string{"echo", "hello  world", "alicex"})}},
+		{`echo "a > b" '<' \>`, []Pipeline{pipe([]string{"echo", "a > b", "<", ">"})}},
+		{`echo "" $ 5$`, []Pipeline{pipe([]string{"echo", "", "$", "5$"})}},
+		{"a; b && c || d;", []Pipeline{
+			pipe([]string{"a"}),
+			{Commands: []SimpleCommand{{Args: []string{"b"}}}, Op: OpSequence},
+			{Commands: []SimpleCommand{{Args: []string{"c"}}}, Op: OpAnd},
+			{Commands: []SimpleCommand{{Args: []string{"d"}}}, Op: OpOr},
+		}},
+		{"a;b&&c", []Pipeline{
+			pipe([]string{"a"}),
+			{Commands: []SimpleCommand{{Args: []string{"b"}}}, Op: OpSequence},
+			{Commands: []SimpleCommand{{Args: []string{"c"}}}, Op: OpAnd},
+		}},
+		{"a | b -x|c || d", []Pipeline{
+			pipe([]string{"a"}, []string{"b", "-x"}, []string{"c"}),
+			{Commands: []SimpleCommand{{Args: []string{"d"}}}, Op: OpOr},
+		}},
+		{"   ", nil},
+	}
+	for _, c := range cases {
+		commands, err := Parse(c.line, lookup)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.line, err)
+		} else if !reflect.DeepEqual(commands, c.expected) {
+			t.Errorf("%q: expected %+v, got %+v", c.line, c.expected, commands)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		line   string
+		column int
+	}{
+		{`echo 'abc`, 6},
+		{`echo "abc`, 6},
+		{`echo abc\`, 9},
+		{`echo ${USER`, 6},
+		{`echo ${1x}`, 6},
+		{`; echo`, 1},
+		{`echo && && echo`, 9},
+		{`echo &&`, 6},
+		{`echo & echo`, 6},
+		{`| echo`, 1},
+		{`echo |`, 6},
+		{`echo | | echo`, 8},
+		{`echo | && echo`, 8},
+		{`echo a > b`, 8},
+		{`echo a>>b`, 7},
+		{`sort < file`, 6},
+	}
+	for _, c := range cases {
+		_, err := Parse(c.line, nil)
+		syntaxErr := SyntaxError{}
+		if !errors.As(err, &syntaxErr) || !errors.Is(err, ErrSyntax) {
+			t.Errorf("%q: expected a syntax error, got %v", c.line, err)
+		} else if syntaxErr.Column != c.column {
+			t.Errorf("%q: expected column %d, got %d (%v)", c.line, c.column, syntaxErr.Column, err)
+		}
+	}
+}
+
+func TestExecuteChain(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.SetEnv("USER", "alice")
+
+	out, err := shell.Execute(context.TODO(), `echo "$USER"  &&  echo b`)
+	if err != nil || string(out) != "echo: alice\r\necho: b" {
+		t.Errorf("Expected both outputs, got %q (%v)", out, err)
+	}
+	out, err = shell.Execute(context.TODO(), "missing && echo skipped || echo fallback")
+	if !errors.Is(err, ErrCommandNotFound) || string(out) != "echo: fallback" {
+		t.Errorf("Expected the fallback after the failure, got %q (%v)", out, err)
+	}
+	out, err = shell.Execute(context.TODO(), "echo a || echo skipped; echo c")
+	if err != nil || string(out) != "echo: a\r\necho: c" {
+		t.Errorf("Expected the sequence to continue, got %q (%v)", out, err)
+	}
+}
@@ -0,0 +1,60 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrNotConfirmed = errors.New("not confirmed")
+
+// maxAnswer limits the input read for a confirmation
+const maxAnswer = 64
+
+const (
+	// keyEOT is sent by terminals on Ctrl-D
+	keyEOT = 0x04
+	// terminals send either on backspace
+	keyBackspace = 0x08
+	keyDelete    = 0x7f
+)
+
+// Confirm asks a yes or no question on the terminal, anything but y or yes is a no.
+// The answer is echoed as the terminal input reaches commands raw.
+func Confirm(stdio IO, question string) (bool, error) {
+	if stdio.Stdin == nil || stdio.Piped {
+		return false, fmt.Errorf("%w: no terminal to ask '%s'", ErrNotConfirmed, question)
+	}
+	if _, err := fmt.Fprintf(stdio.Stdout, "%s [y/N] ", question); err != nil {
+		return false, err
+	}
+	answer := []byte{}
+	char := make([]byte, 1)
+	for len(answer) < maxAnswer {
+		if _, err := io.ReadFull(stdio.Stdin, char); err != nil {
+			return false, err
+		}
+		if char[0] == '\r' || char[0] == '\n' {
+			break
+		} else if char[0] == keyEOT {
+			return false, io.ErrUnexpectedEOF
+		} else if char[0] == keyBackspace || char[0] == keyDelete {
+			if len(answer) > 0 {
+				answer = answer[:len(answer)-1]
+				io.WriteString(stdio.Stdout, "\b \b")
+			}
+			continue
+		}
+		answer = append(answer, char[0])
+		stdio.Stdout.Write(char)
+	}
+	if _, err := io.WriteString(stdio.Stdout, "\n"); err != nil {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(string(answer))) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,168 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/myLogic207/cinnamon/patchssh/recording"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	recordingsUsage = "usage: recordings [list [user] | play <name>]"
+	// PermissionRecordings allows listing and replaying the recorded sessions of all users
+	PermissionRecordings = "recordings"
+)
+
+// recordedChannel tees everything passing the channel into a recording
+type recordedChannel struct {
+	ssh.Channel
+	recorder *recording.Recorder
+}
+
+func (c *recordedChannel) Read(data []byte) (int, error) {
+	n, err := c.Channel.Read(data)
+	c.recorder.Input(data[:n])
+	return n, err
+}
+
+func (c *recordedChannel) Write(data []byte) (int, error) {
+	n, err := c.Channel.Write(data)
+	c.recorder.Output(data[:n])
+	return n, err
+}
+
+func (c *recordedChannel) Stderr() io.ReadWriter {
+	return &recordedStderr{c.Channel.Stderr(), c.recorder}
+}
+
+type recordedStderr struct {
+	io.ReadWriter
+	recorder *recording.Recorder
+}
+
+func (s *recordedStderr) Write(data []byte) (int, error) {
+	n, err := s.ReadWriter.Write(data)
+	s.recorder.Output(data[:n])
+	return n, err
+}
+
+// Record tees the terminal into recorder until the terminal finishes, call it before Do
+func (tw *TerminalWrapper) Record(recorder *recording.Recorder) {
+	tw.userChannel = &recordedChannel{tw.userChannel, recorder}
+	tw.recorder = recorder
+}
+
+// readPassword reads a line without echo, the typed keys are left out of the recording
+func (tw *TerminalWrapper) readPassword(prompt string) (string, error) {
+	if tw.recorder != nil {
+		tw.recorder.PauseInput()
+		defer tw.recorder.ResumeInput()
+	}
+	return tw.terminal.ReadPassword(prompt)
+}
+
+// maxReplayPause caps the idle time between replayed events
+const maxReplayPause = 2 * time.Second
+
+// RecordingsCommand lets admins list recorded sessions and replay their output in real time
+func RecordingsCommand(store *recording.Store) Definition {
+	return Definition{
+		Name:        "recordings",
+		Short:       "List and replay recorded sessions",
+		Long:        "Replays the output of a recording in real time, pauses are shortened to 2 seconds. Ctrl-C stops the replay.",
+		Args:        "[list [user] | play <name>]",
+		Permissions: []string{PermissionRecordings},
+		Run:         recordingsCommand(store),
+		Complete: func(ctx context.Context, user Identity, args []string, word string) []string {
+			if len(args) == 0 {
+				return []string{"list", "play"}
+			} else if len(args) > 1 {
+				return nil
+			}
+			infos, err := store.List("")
+			if err != nil {
+				return nil
+			}
+			seen := map[string]bool{}
+			candidates := []string{}
+			for _, info := range infos {
+				candidate := info.Name
+				if args[0] == "list" {
+					candidate = info.User
+				}
+				if !seen[candidate] {
+					seen[candidate] = true
+					candidates = append(candidates, candidate)
+				}
+			}
+			return candidates
+		},
+	}
+}
+
+func recordingsCommand(store *recording.Store) StreamCommand {
+	return func(ctx context.Context, args []string, stdio IO) error {
+		if len(args) == 0 || args[0] == "list" {
+			user := ""
+			if len(args) > 1 {
+				user = args[1]
+			}
+			infos, err := store.List(user)
+			if err != nil {
+				return err
+			}
+			_, err = stdio.Stdout.Write(formatRecordings(infos))
+			return err
+		}
+		if args[0] != "play" || len(args) != 2 {
+			return fmt.Errorf("%w, %s", ErrUsage, recordingsUsage)
+		}
+		file, err := store.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, events, err := recording.Read(file)
+		if err != nil {
+			return err
+		}
+		elapsed := 0.0
+		for _, event := range events {
+			if event.Kind != "o" {
+				continue
+			}
+			pause := time.Duration((event.Time - elapsed) * float64(time.Second))
+			elapsed = event.Time
+			if pause > maxReplayPause {
+				pause = maxReplayPause
+			}
+			if pause > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(pause):
+				}
+			}
+			if _, err := io.WriteString(stdio.Stdout, event.Data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func formatRecordings(infos []recording.Info) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tUSER\tSTARTED\tSIZE")
+	for _, info := range infos {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\n", info.Name, info.User, info.StartedAt.Local().Format("2006-01-02 15:04:05"), info.Size)
+	}
+	writer.Flush()
+	return buffer.Bytes()
+}
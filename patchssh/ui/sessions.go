@@ -0,0 +1,135 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/patchssh/registry"
+)
+
+const (
+	sessionsUsage = "usage: sessions [list | show <id> | msg <id> <message> | kick <id> [reason]]"
+	// PermissionSessions allows managing the connections of all users
+	PermissionSessions = "sessions"
+)
+
+// SessionsCommand lets admins list, inspect, message and disconnect active connections
+func SessionsCommand(sessions *registry.Registry) Definition {
+	return Definition{
+		Name:        "sessions",
+		Short:       "List, inspect, message and disconnect active connections",
+		Long:        "Without arguments the active connections are listed, 'kick' tells the user the reason and closes the connection.",
+		Args:        "[list | show <id> | msg <id> <message> | kick <id> [reason]]",
+		Permissions: []string{PermissionSessions},
+		Run:         Buffered(sessionsCommand(sessions)),
+		Complete: func(ctx context.Context, user Identity, args []string, word string) []string {
+			switch {
+			case len(args) == 0:
+				return []string{"list", "show", "msg", "kick"}
+			case len(args) == 1 && args[0] != "list":
+				ids := []string{}
+				for _, info := range sessions.List() {
+					ids = append(ids, strconv.FormatUint(info.ID, 10))
+				}
+				return ids
+			}
+			return nil
+		},
+	}
+}
+
+func sessionsCommand(sessions *registry.Registry) Command {
+	return func(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+		if len(args) == 0 || args[0] == "list" {
+			return formatSessions(sessions.List()), nil
+		}
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%w, %s", ErrUsage, sessionsUsage)
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w, invalid id '%s'", ErrUsage, args[1])
+		}
+
+		switch args[0] {
+		case "show":
+			info, err := sessions.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			return formatSession(info), nil
+		case "msg":
+			if len(args) < 3 {
+				return nil, fmt.Errorf("%w, %s", ErrUsage, sessionsUsage)
+			}
+			if err := sessions.Message(ctx, id, "Message from admin: "+strings.Join(args[2:], " ")); err != nil {
+				return nil, err
+			}
+			recordSessionAction(ctx, "session_messaged", args[1], "message", strings.Join(args[2:], " "))
+			return []byte(fmt.Sprintf("message sent to session %d", id)), nil
+		case "kick":
+			reason := "kicked by admin"
+			if len(args) > 2 {
+				reason = strings.Join(args[2:], " ")
+			}
+			if err := sessions.Kick(ctx, id, reason); err != nil {
+				return nil, err
+			}
+			recordSessionAction(ctx, "session_kicked", args[1], "reason", reason)
+			return []byte(fmt.Sprintf("session %d disconnected", id)), nil
+		}
+		return nil, fmt.Errorf("%w, %s", ErrUsage, sessionsUsage)
+	}
+}
+
+func recordSessionAction(ctx context.Context, action, id, key, value string) {
+	audit.Record(ctx, audit.Event{
+		Type: audit.EventAdminAction,
+		Details: map[string]string{
+			"action":  action,
+			"session": id,
+			key:       value,
+		},
+	})
+}
+
+func formatSessions(infos []registry.Info) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tUSER\tREMOTE\tAUTH\tSINCE\tIN\tOUT\tCHANNELS")
+	for _, info := range infos {
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			info.ID, info.User, info.RemoteAddr, info.AuthMethod,
+			time.Since(info.StartedAt).Round(time.Second), info.BytesIn, info.BytesOut,
+			strings.Join(info.Channels, ","))
+	}
+	writer.Flush()
+	return terminalLines(buffer.Bytes())
+}
+
+func formatSession(info registry.Info) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "ID:\t%d\n", info.ID)
+	fmt.Fprintf(writer, "User:\t%s\n", info.User)
+	fmt.Fprintf(writer, "Remote:\t%s\n", info.RemoteAddr)
+	fmt.Fprintf(writer, "Client:\t%s\n", info.ClientVersion)
+	fmt.Fprintf(writer, "Auth:\t%s\n", info.AuthMethod)
+	fmt.Fprintf(writer, "Started:\t%s\n", info.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(writer, "Bytes in/out:\t%d/%d\n", info.BytesIn, info.BytesOut)
+	fmt.Fprintf(writer, "Channels:\t%s\n", strings.Join(info.Channels, ", "))
+	writer.Flush()
+	return terminalLines(buffer.Bytes())
+}
+
+// terminalLines converts line endings for raw terminals and drops the trailing newline
+func terminalLines(raw []byte) []byte {
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
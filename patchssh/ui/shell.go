@@ -1,43 +1,235 @@
 package ui
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"strings"
+	"sync"
 
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/metrics"
 	log "github.com/myLogic207/gotils/logger"
 )
 
+// unknown commands share one label, clients choose their names
+var commandsTotal = metrics.NewCounter("cinnamon_commands_total", "Shell commands executed, by command and result.", "command", "result")
+
 var (
 	ErrCommandNotFound = errors.New("command not found")
+	ErrUsage           = errors.New("invalid usage")
+	ErrSyntax          = errors.New("syntax error")
+	ErrNoMatch         = errors.New("no match")
 )
 
+// Command is a shell command, it receives the arguments without the command name
+// and the output of the previous command of a pipeline as stdin, nil if there is none
+type Command func(ctx context.Context, args []string, stdin []byte) ([]byte, error)
+
 type ShellWrapper struct {
-	logger        log.Logger
-	knownCommands map[string]func(context.Context, []string) ([]byte, error)
+	logger   log.Logger
+	commands *Registry
+	// identity of the user, passed to every command
+	identity Identity
+	// env holds the session variables used for $VAR expansion
+	envMutex sync.RWMutex
+	env      map[string]string
 }
 
 func NewShellWrapper(logger log.Logger) *ShellWrapper {
-	commands := map[string]func(context.Context, []string) ([]byte, error){
-		"echo": echo,
-	}
+	commands := Commands.Clone()
+	commands.set(helpCommand(commands))
 	return &ShellWrapper{
-		logger:        logger,
-		knownCommands: commands,
+		logger:   logger,
+		commands: commands,
+		env:      map[string]string{},
+	}
+}
+
+// SetIdentity sets the user the commands run for
+func (sw *ShellWrapper) SetIdentity(identity Identity) {
+	sw.identity = identity
+}
+
+// SetEnv sets a session variable
+func (sw *ShellWrapper) SetEnv(name, value string) {
+	sw.envMutex.Lock()
+	defer sw.envMutex.Unlock()
+	sw.env[name] = value
+}
+
+// Getenv returns a session variable, empty if it is not set
+func (sw *ShellWrapper) Getenv(name string) string {
+	sw.envMutex.RLock()
+	defer sw.envMutex.RUnlock()
+	return sw.env[name]
+}
+
+func (sw *ShellWrapper) environ() map[string]string {
+	sw.envMutex.RLock()
+	defer sw.envMutex.RUnlock()
+	env := make(map[string]string, len(sw.env))
+	for name, value := range sw.env {
+		env[name] = value
+	}
+	return env
+}
+
+// Execute runs the command line without a terminal and returns the output of all
+// commands with \r\n line endings, together with the errors of the commands that failed.
+func (sw *ShellWrapper) Execute(ctx context.Context, line string) ([]byte, error) {
+	stdout := &bytes.Buffer{}
+	err := sw.Run(ctx, line, IO{
+		Stdin:  bytes.NewReader(nil),
+		Stdout: stdout,
+		Stderr: io.Discard,
+	})
+	if stdout.Len() == 0 {
+		return nil, err
+	}
+	output := bytes.ReplaceAll(stdout.Bytes(), []byte("\r\n"), []byte("\n"))
+	return terminalLines(output), err
+}
+
+// Run parses the command line and runs its pipelines in order, joined errors of the
+// commands that failed are returned. stdio provides the streams and terminal size,
+// the environment and identity are set by the shell.
+func (sw *ShellWrapper) Run(ctx context.Context, line string, stdio IO) error {
+	sw.logger.Debug(ctx, "Executing command: %s", line)
+	pipelines, err := Parse(line, sw.Getenv)
+	if err != nil {
+		recordCommand(ctx, line, err)
+		return err
+	}
+	stdio.Env = sw.environ()
+	stdio.User = sw.identity
+
+	errs := []error{}
+	var last error
+	for _, pipeline := range pipelines {
+		if ctx.Err() != nil {
+			break
+		}
+		if (pipeline.Op == OpAnd && last != nil) || (pipeline.Op == OpOr && last == nil) {
+			continue
+		}
+		err := sw.runPipeline(ctx, pipeline, stdio)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		last = err
+	}
+	if len(errs) == 1 {
+		return errs[0]
 	}
+	return errors.Join(errs...)
 }
 
-func (sw *ShellWrapper) Execute(ctx context.Context, command string) ([]byte, error) {
-	// check if command is known
-	sw.logger.Debug(ctx, "Executing command: %s", command)
-	parts := strings.Split(command, " ")
-	if cmd, ok := sw.knownCommands[parts[0]]; ok {
-		return cmd(ctx, parts[1:])
+// runPipeline runs the commands of a pipeline concurrently, each reading the output of the
+// one before. The pipeline fails if any of its commands fails, except for commands whose
+// output was no longer read.
+func (sw *ShellWrapper) runPipeline(ctx context.Context, pipeline Pipeline, stdio IO) error {
+	count := len(pipeline.Commands)
+	errs := make([]error, count)
+	wait := sync.WaitGroup{}
+	stdin, piped := stdio.Stdin, stdio.Piped
+	for i, command := range pipeline.Commands {
+		commandIO := stdio
+		commandIO.Stdin, commandIO.Piped = stdin, piped
+		var reader *io.PipeReader
+		var writer *io.PipeWriter
+		if i < count-1 {
+			reader, writer = io.Pipe()
+			commandIO.Stdout = writer
+			stdin, piped = reader, true
+		}
+		input, _ := commandIO.Stdin.(*io.PipeReader)
+
+		wait.Add(1)
+		go func(i int, args []string, commandIO IO) {
+			defer wait.Done()
+			errs[i] = sw.run(ctx, args, commandIO)
+			if writer != nil {
+				writer.Close()
+			}
+			// stop the previous command from writing output nobody reads
+			if input != nil {
+				input.CloseWithError(io.ErrClosedPipe)
+			}
+		}(i, command.Args, commandIO)
+	}
+	wait.Wait()
+
+	failed := []error{}
+	for i, err := range errs {
+		if err == nil || (i < count-1 && errors.Is(err, io.ErrClosedPipe)) {
+			continue
+		}
+		failed = append(failed, err)
+	}
+	if len(failed) == 1 {
+		return failed[0]
+	}
+	return errors.Join(failed...)
+}
+
+func (sw *ShellWrapper) run(ctx context.Context, args []string, stdio IO) error {
+	definition, ok := sw.commands.Lookup(args[0])
+	if !ok {
+		commandsTotal.Inc("unknown", "not_found")
+		recordCommand(ctx, strings.Join(args, " "), ErrCommandNotFound)
+		return ErrCommandNotFound
+	}
+	if !definition.allowed(stdio.User) {
+		commandsTotal.Inc(definition.Name, "denied")
+		recordCommand(ctx, strings.Join(args, " "), ErrPermissionDenied)
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, args[0])
+	}
+	err := definition.Run(ctx, args[1:], stdio)
+	if err != nil {
+		commandsTotal.Inc(definition.Name, "failure")
 	} else {
-		return nil, ErrCommandNotFound
+		commandsTotal.Inc(definition.Name, "success")
 	}
+	recordCommand(ctx, strings.Join(args, " "), err)
+	return err
+}
+
+func recordCommand(ctx context.Context, command string, err error) {
+	event := audit.Event{
+		Type:    audit.EventCommand,
+		Details: map[string]string{"command": command},
+	}
+	if err != nil {
+		event.Details["error"] = err.Error()
+	}
+	audit.Record(ctx, event)
+}
+
+// Register makes an additional command available in this shell only
+func (sw *ShellWrapper) Register(definition Definition) error {
+	return sw.commands.Register(definition)
+}
+
+// Commands returns the registry of the shell
+func (sw *ShellWrapper) Commands() *Registry {
+	return sw.commands
+}
+
+// AddCommand makes an additional buffered command available in the shell, replacing commands of the same name
+func (sw *ShellWrapper) AddCommand(name string, command Command) {
+	sw.AddStreamCommand(name, Buffered(command))
+}
+
+// AddStreamCommand makes an additional streaming command available in the shell, replacing commands of the same name
+func (sw *ShellWrapper) AddStreamCommand(name string, command StreamCommand) {
+	sw.commands.mutex.Lock()
+	defer sw.commands.mutex.Unlock()
+	sw.commands.set(Definition{Name: name, Run: command})
 }
 
-func echo(ctx context.Context, args []string) ([]byte, error) {
+func echo(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
 	return []byte("echo: " + strings.Join(args, " ")), nil
 }
@@ -3,8 +3,12 @@ package ui
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/myLogic207/cinnamon/patchssh/recording"
+	"github.com/myLogic207/cinnamon/patchssh/registry"
 	"github.com/myLogic207/gotils/config"
 	log "github.com/myLogic207/gotils/logger"
 )
@@ -44,3 +48,110 @@ func TestStderr(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+type testConn struct {
+	info   registry.Info
+	kicked bool
+}
+
+func (c *testConn) Info() registry.Info                        { return c.info }
+func (c *testConn) Notify(ctx context.Context, message string) {}
+func (c *testConn) Kick(ctx context.Context, reason string)    { c.kicked = true }
+func (c *testConn) Done() <-chan struct{}                      { return nil }
+
+func TestSessionsCommand(t *testing.T) {
+	sessions := registry.New()
+	conn := &testConn{info: registry.Info{User: "alice", RemoteAddr: "127.0.0.1:4242", StartedAt: time.Now()}}
+	conn.info.ID = sessions.Add(conn)
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.SetIdentity(Identity{Admin: true})
+	shell.Register(SessionsCommand(sessions))
+
+	out, err := shell.Execute(context.TODO(), "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "alice") || !strings.Contains(string(out), "127.0.0.1:4242") {
+		t.Errorf("Expected session in listing, got %s", out)
+	}
+	if _, err := shell.Execute(context.TODO(), "sessions kick 1"); err != nil {
+		t.Fatal(err)
+	} else if !conn.kicked {
+		t.Error("Expected session to be kicked")
+	}
+	if _, err := shell.Execute(context.TODO(), "sessions show 99"); !errors.Is(err, registry.ErrConnNotFound) {
+		t.Errorf("Expected ErrConnNotFound, got %v", err)
+	}
+	if _, err := shell.Execute(context.TODO(), "sessions kick abc"); !errors.Is(err, ErrUsage) {
+		t.Errorf("Expected ErrUsage, got %v", err)
+	}
+}
+
+func TestRecordingsCommand(t *testing.T) {
+	store, err := recording.NewStore(t.TempDir(), 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder, err := store.Start("alice", "abc", 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Input([]byte("echo hi\r"))
+	recorder.Output([]byte("echo: hi\r\n"))
+	recorder.Close()
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.SetIdentity(Identity{Admin: true})
+	shell.Register(RecordingsCommand(store))
+
+	out, err := shell.Execute(context.TODO(), "recordings list alice")
+	if err != nil || !strings.Contains(string(out), "alice") {
+		t.Fatalf("Expected recording in listing, got %s (%v)", out, err)
+	}
+	infos, _ := store.List("alice")
+	out, err = shell.Execute(context.TODO(), "recordings play "+infos[0].Name)
+	if err != nil || string(out) != "echo: hi" {
+		t.Errorf("Expected the recorded output, got %q (%v)", out, err)
+	}
+	if _, err := shell.Execute(context.TODO(), "recordings play"); !errors.Is(err, ErrUsage) {
+		t.Errorf("Expected ErrUsage, got %v", err)
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.AddCommand("lines", func(ctx context.Context, args []string, stdin []byte) ([]byte, error) {
+		return []byte("10 bob\r\n2 alice\r\n3 Carol\r\n2 alice"), nil
+	})
+	cases := []struct {
+		line     string
+		expected string
+	}{
+		{"lines | grep alice", "2 alice\r\n2 alice"},
+		{"lines | grep -i -v CAROL | grep -c a", "2"},
+		{"lines | grep -F '.'", ""},
+		{"lines | head -n 2", "10 bob\r\n2 alice"},
+		{"lines | tail -n1", "2 alice"},
+		{"lines | wc -l", "4"},
+		{"lines | sort", "10 bob\r\n2 alice\r\n2 alice\r\n3 Carol"},
+		{"lines | sort -n -u", "2 alice\r\n3 Carol\r\n10 bob"},
+		{"lines | sort -rn | head -n 1", "10 bob"},
+	}
+	for _, c := range cases {
+		out, err := shell.Execute(context.TODO(), c.line)
+		if c.expected == "" {
+			if !errors.Is(err, ErrNoMatch) {
+				t.Errorf("%q: expected ErrNoMatch, got %q (%v)", c.line, out, err)
+			}
+			continue
+		}
+		if err != nil || string(out) != c.expected {
+			t.Errorf("%q: expected %q, got %q (%v)", c.line, c.expected, out, err)
+		}
+	}
+	if _, err := shell.Execute(context.TODO(), "lines | head -n x"); !errors.Is(err, ErrUsage) {
+		t.Errorf("Expected ErrUsage, got %v", err)
+	}
+	if out, err := shell.Execute(context.TODO(), "lines | grep nobody || echo none"); !errors.Is(err, ErrNoMatch) || string(out) != "echo: none" {
+		t.Errorf("Expected the fallback after no match, got %q (%v)", out, err)
+	}
+}
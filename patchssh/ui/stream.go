@@ -0,0 +1,210 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// Identity is the authenticated user a shell runs for
+type Identity struct {
+	User        string
+	Fingerprint string
+	RemoteAddr  string
+	SessionID   string
+	// Admin grants every permission
+	Admin       bool
+	Roles       []string
+	Permissions []string
+}
+
+// IO is what a streaming command reads from and writes to
+type IO struct {
+	// Stdin is the terminal input or the output of the previous command in a pipeline
+	Stdin io.Reader
+	// Piped tells if Stdin is the output of another command
+	Piped  bool
+	Stdout io.Writer
+	Stderr io.Writer
+	// terminal size in columns and rows, 0 without a terminal
+	Width  int
+	Height int
+	// Env is a copy of the session variables
+	Env  map[string]string
+	User Identity
+	// ReadPassword reads a line without echo, nil without a terminal
+	ReadPassword func(prompt string) (string, error)
+}
+
+// StreamCommand is a shell command working on streams. It receives the arguments without
+// the command name and has to return once ctx is done, which happens on Ctrl-C.
+type StreamCommand func(ctx context.Context, args []string, stdio IO) error
+
+// StreamShell runs command lines on streams, shells without it are used through UserShell
+type StreamShell interface {
+	Run(ctx context.Context, line string, stdio IO) error
+}
+
+// Buffered adapts a Command to a StreamCommand. Stdin is only read if it is piped,
+// the output is written at once and ends with a newline.
+func Buffered(command Command) StreamCommand {
+	return func(ctx context.Context, args []string, stdio IO) error {
+		var stdin []byte
+		if stdio.Piped && stdio.Stdin != nil {
+			var err error
+			if stdin, err = io.ReadAll(stdio.Stdin); err != nil {
+				return err
+			}
+		}
+		output, err := command(ctx, args, stdin)
+		if len(output) > 0 {
+			if !bytes.HasSuffix(output, []byte("\n")) {
+				output = append(output, '\n')
+			}
+			if _, writeErr := stdio.Stdout.Write(output); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}
+		return err
+	}
+}
+
+// maxInputBuffer is the amount of typed ahead input kept for commands and the prompt
+const maxInputBuffer = 64 * 1024
+
+// inputBuffer queues the terminal input, reads can be interrupted by a context
+type inputBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+	err    error
+	// readable is signalled when data was added or the buffer closed, writable when space was freed
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newInputBuffer() *inputBuffer {
+	return &inputBuffer{
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func signal(notify chan struct{}) {
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// Write blocks while the buffer is full, so a flood of input slows down the reader
+func (b *inputBuffer) Write(data []byte) (int, error) {
+	written := 0
+	for {
+		b.mutex.Lock()
+		if b.err != nil {
+			b.mutex.Unlock()
+			return written, b.err
+		}
+		space := maxInputBuffer - b.buffer.Len()
+		chunk := data[written:]
+		if len(chunk) > space {
+			chunk = chunk[:space]
+		}
+		b.buffer.Write(chunk)
+		written += len(chunk)
+		b.mutex.Unlock()
+		if len(chunk) > 0 {
+			signal(b.readable)
+		}
+		if written == len(data) {
+			return written, nil
+		}
+		<-b.writable
+	}
+}
+
+// CloseWithError makes reads return err once the buffered data is consumed
+func (b *inputBuffer) CloseWithError(err error) {
+	b.mutex.Lock()
+	b.err = err
+	b.mutex.Unlock()
+	signal(b.readable)
+	signal(b.writable)
+}
+
+func (b *inputBuffer) Read(data []byte) (int, error) {
+	return b.ReadContext(context.Background(), data)
+}
+
+// ReadContext blocks until data is available, the buffer is closed or ctx is done
+func (b *inputBuffer) ReadContext(ctx context.Context, data []byte) (int, error) {
+	for {
+		b.mutex.Lock()
+		if b.buffer.Len() > 0 {
+			n, _ := b.buffer.Read(data)
+			b.mutex.Unlock()
+			signal(b.writable)
+			return n, nil
+		}
+		err := b.err
+		b.mutex.Unlock()
+		if err != nil {
+			// keep waking other readers
+			signal(b.readable)
+			return 0, err
+		}
+		select {
+		case <-b.readable:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// contextReader reads from the input until ctx is done
+type contextReader struct {
+	ctx   context.Context
+	input *inputBuffer
+}
+
+func (r *contextReader) Read(data []byte) (int, error) {
+	return r.input.ReadContext(r.ctx, data)
+}
+
+// crlfWriter turns \n into \r\n for raw terminals, existing \r\n are kept
+type crlfWriter struct {
+	writer io.Writer
+	// last is the last byte written, to end the output with a newline
+	mutex sync.Mutex
+	last  byte
+}
+
+func (w *crlfWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	converted := make([]byte, 0, len(data)+8)
+	for _, char := range data {
+		if char == '\n' && w.last != '\r' {
+			converted = append(converted, '\r')
+		}
+		converted = append(converted, char)
+		w.last = char
+	}
+	if _, err := w.writer.Write(converted); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// endLine writes a newline if the output did not end with one
+func (w *crlfWriter) endLine() error {
+	w.mutex.Lock()
+	last := w.last
+	w.mutex.Unlock()
+	if last == 0 || last == '\n' {
+		return nil
+	}
+	_, err := w.Write([]byte("\n"))
+	return err
+}
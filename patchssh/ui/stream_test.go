@@ -0,0 +1,117 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamCommand(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.SetIdentity(Identity{User: "alice"})
+	shell.AddStreamCommand("upper", func(ctx context.Context, args []string, stdio IO) error {
+		data, err := io.ReadAll(stdio.Stdin)
+		if err != nil {
+			return err
+		}
+		_, err = stdio.Stdout.Write(bytes.ToUpper(data))
+		return err
+	})
+	shell.AddStreamCommand("whoami", func(ctx context.Context, args []string, stdio IO) error {
+		_, err := io.WriteString(stdio.Stdout, stdio.User.User+"\n")
+		return err
+	})
+
+	stdout := &bytes.Buffer{}
+	err := shell.Run(context.TODO(), "upper | grep -c LINE", IO{
+		Stdin:  strings.NewReader("first line\nsecond line\n"),
+		Stdout: stdout,
+		Stderr: io.Discard,
+	})
+	if err != nil || stdout.String() != "2\n" {
+		t.Errorf("Expected the typed input to be counted, got %q (%v)", stdout.String(), err)
+	}
+
+	out, err := shell.Execute(context.TODO(), "whoami")
+	if err != nil || string(out) != "alice" {
+		t.Errorf("Expected the identity, got %q (%v)", out, err)
+	}
+}
+
+func TestPipelineClosedEarly(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	// yes only stops once nobody reads its output
+	shell.AddStreamCommand("yes", func(ctx context.Context, args []string, stdio IO) error {
+		for {
+			if _, err := io.WriteString(stdio.Stdout, "y\n"); err != nil {
+				return err
+			}
+		}
+	})
+	shell.AddStreamCommand("first", func(ctx context.Context, args []string, stdio IO) error {
+		line := make([]byte, 2)
+		if _, err := io.ReadFull(stdio.Stdin, line); err != nil {
+			return err
+		}
+		_, err := stdio.Stdout.Write(line)
+		return err
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		out, err := shell.Execute(context.TODO(), "yes | first")
+		if err != nil || string(out) != "y" {
+			t.Errorf("Expected one line, got %q (%v)", out, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Pipeline did not finish after its last command")
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	shell := NewShellWrapper(TESTSHELL.logger)
+	shell.AddStreamCommand("wait", func(ctx context.Context, args []string, stdio IO) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-time.After(10 * time.Millisecond)
+		cancel()
+	}()
+	err := shell.Run(ctx, "wait; echo skipped", IO{Stdin: strings.NewReader(""), Stdout: io.Discard, Stderr: io.Discard})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the command to be canceled, got %v", err)
+	}
+}
+
+func TestInputBuffer(t *testing.T) {
+	input := newInputBuffer()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := input.ReadContext(ctx, make([]byte, 1)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected read to be interrupted, got %v", err)
+	}
+	input.Write([]byte("ls\r"))
+	input.CloseWithError(io.EOF)
+	data, err := io.ReadAll(input)
+	if err != nil || string(data) != "ls\r" {
+		t.Errorf("Expected the buffered input before EOF, got %q (%v)", data, err)
+	}
+
+	output := &bytes.Buffer{}
+	writer := &crlfWriter{writer: output}
+	writer.Write([]byte("a\nb\r\nc"))
+	writer.endLine()
+	if output.String() != "a\r\nb\r\nc\r\n" {
+		t.Errorf("Expected terminal line endings, got %q", output.String())
+	}
+}
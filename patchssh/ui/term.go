@@ -1,17 +1,23 @@
 package ui
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
+	"github.com/myLogic207/cinnamon/patchssh/recording"
 	log "github.com/myLogic207/gotils/logger"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
 
+// keyInterrupt is sent by terminals on Ctrl-C
+const keyInterrupt = 0x03
+
 type UserShell interface {
 	Execute(context.Context, string) ([]byte, error)
 }
@@ -21,14 +27,74 @@ type TerminalWrapper struct {
 	userChannel   ssh.Channel
 	systemChannel UserShell
 	terminal      *term.Terminal
+	// input queues what the user typed, the terminal and running commands read from it
+	input *inputBuffer
+	// recorder is set while the terminal is recorded
+	recorder *recording.Recorder
+	// history stores the lines entered by historyUser, nil if it is not kept
+	history     History
+	historyUser string
+	// mutex guards the size and the running command
+	mutex  sync.Mutex
+	width  int
+	height int
+	// cmdCtx is done once the running command is interrupted, nil while at the prompt
+	cmdCtx    context.Context
+	cmdCancel context.CancelFunc
+	// preload is read instead of the input while the history is loaded
+	preload *bytes.Buffer
+	// completions are listed on the second tab without progress
+	lastCompletion string
 }
 
 func NewTerminalWrapper(logger log.Logger, userChannel ssh.Channel, system UserShell) *TerminalWrapper {
-	return &TerminalWrapper{
+	tw := &TerminalWrapper{
 		logger:        logger,
 		userChannel:   userChannel,
 		systemChannel: system,
+		input:         newInputBuffer(),
+		width:         80,
+		height:        24,
+	}
+	tw.terminal = term.NewTerminal(&terminalConn{tw}, "> ")
+	tw.terminal.SetSize(tw.width, tw.height)
+	return tw
+}
+
+// terminalConn connects the terminal to the input buffer and the current channel
+type terminalConn struct {
+	tw *TerminalWrapper
+}
+
+func (c *terminalConn) Read(data []byte) (int, error) {
+	c.tw.mutex.Lock()
+	ctx, preload := c.tw.cmdCtx, c.tw.preload
+	c.tw.mutex.Unlock()
+	if preload != nil {
+		return preload.Read(data)
 	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return c.tw.input.ReadContext(ctx, data)
+}
+
+func (c *terminalConn) Write(data []byte) (int, error) {
+	c.tw.mutex.Lock()
+	preloading := c.tw.preload != nil
+	c.tw.mutex.Unlock()
+	if preloading {
+		return len(data), nil
+	}
+	return c.tw.userChannel.Write(data)
+}
+
+// SetSize updates the terminal size, e.g. after the client window changed
+func (tw *TerminalWrapper) SetSize(width, height int) error {
+	tw.mutex.Lock()
+	tw.width, tw.height = width, height
+	tw.mutex.Unlock()
+	return tw.terminal.SetSize(width, height)
 }
 
 func (tw *TerminalWrapper) Do(ctx context.Context) error {
@@ -40,16 +106,55 @@ func (tw *TerminalWrapper) Do(ctx context.Context) error {
 		if err := tw.userChannel.Close(); err != nil {
 			tw.logger.Error(ctx, "Error closing channel: %s", err.Error())
 		}
+		if tw.recorder != nil {
+			if err := tw.recorder.Close(); err != nil {
+				tw.logger.Error(ctx, "Error closing recording: %s", err.Error())
+			}
+		}
 	}()
-	tw.terminal = term.NewTerminal(tw.userChannel, "> ")
-	tw.terminal.SetSize(80, 24)
 	tw.logger.Debug(ctx, "User shell started")
+	if completer, ok := tw.systemChannel.(Completer); ok {
+		tw.terminal.AutoCompleteCallback = tw.completeCallback(ctx, completer)
+	}
+	go tw.pump(tw.userChannel)
 	if err := tw.defaultLoop(ctx); err != nil {
 		tw.logger.Error(ctx, "Error in default loop: %s", err.Error())
 	}
 	return nil
 }
 
+// pump moves the channel input into the input buffer, Ctrl-C interrupts a running command
+func (tw *TerminalWrapper) pump(channel io.Reader) {
+	data := make([]byte, 1024)
+	for {
+		n, err := channel.Read(data)
+		chunk := data[:n]
+		tw.mutex.Lock()
+		cancel := tw.cmdCancel
+		tw.mutex.Unlock()
+		if cancel != nil {
+			filtered := chunk[:0]
+			for _, char := range chunk {
+				if char == keyInterrupt {
+					cancel()
+					continue
+				}
+				filtered = append(filtered, char)
+			}
+			chunk = filtered
+		}
+		if len(chunk) > 0 {
+			if _, err := tw.input.Write(chunk); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			tw.input.CloseWithError(io.EOF)
+			return
+		}
+	}
+}
+
 func (tw *TerminalWrapper) defaultLoop(ctx context.Context) error {
 	for {
 		select {
@@ -69,16 +174,75 @@ func (tw *TerminalWrapper) defaultLoop(ctx context.Context) error {
 			}
 
 			tw.logger.Debug(ctx, "Terminal input: %s", line)
-			if result, err := tw.systemChannel.Execute(ctx, line); err != nil {
-				tw.sendError(ctx, err)
-			} else if result != nil {
+			if tw.history != nil {
+				if err := tw.history.Add(ctx, tw.historyUser, line); err != nil {
+					tw.logger.Error(ctx, "Error storing history: %s", err.Error())
+				}
+			}
+			if shell, ok := tw.systemChannel.(StreamShell); ok {
+				tw.run(ctx, shell, line)
+				continue
+			}
+			// chained commands may produce output and fail
+			result, err := tw.systemChannel.Execute(ctx, line)
+			if result != nil {
 				tw.sendResult(ctx, result)
 			}
+			if err != nil {
+				tw.sendError(ctx, err)
+			}
+
+		}
+	}
+}
+
+// run streams a command line to the terminal until it finishes or is interrupted
+func (tw *TerminalWrapper) run(ctx context.Context, shell StreamShell, line string) {
+	cmdCtx, cancel := context.WithCancel(ctx)
+	tw.mutex.Lock()
+	tw.cmdCtx, tw.cmdCancel = cmdCtx, cancel
+	width, height := tw.width, tw.height
+	tw.mutex.Unlock()
+	defer func() {
+		tw.mutex.Lock()
+		tw.cmdCtx, tw.cmdCancel = nil, nil
+		tw.mutex.Unlock()
+		cancel()
+	}()
 
+	stdout := &crlfWriter{writer: tw.userChannel}
+	stderr := &crlfWriter{writer: tw.userChannel.Stderr()}
+	err := shell.Run(cmdCtx, line, IO{
+		Stdin:        &contextReader{cmdCtx, tw.input},
+		Stdout:       stdout,
+		Stderr:       stderr,
+		Width:        width,
+		Height:       height,
+		ReadPassword: tw.readPassword,
+	})
+	if err := stdout.endLine(); err != nil {
+		tw.logger.Error(ctx, "Error writing to channel: %s", err.Error())
+	}
+	if err := stderr.endLine(); err != nil {
+		tw.logger.Error(ctx, "Error writing to stderr: %s", err.Error())
+	}
+	if cmdCtx.Err() != nil && ctx.Err() == nil {
+		if _, err := tw.userChannel.Write([]byte("^C\r\n")); err != nil {
+			tw.logger.Error(ctx, "Error writing to channel: %s", err.Error())
 		}
+		return
+	}
+	if err != nil {
+		tw.sendError(ctx, err)
 	}
 }
 
+// Notify writes a message to the terminal without disturbing the line being edited
+func (tw *TerminalWrapper) Notify(message string) error {
+	_, err := tw.terminal.Write([]byte(message + "\r\n"))
+	return err
+}
+
 func (tw *TerminalWrapper) sendResult(ctx context.Context, result []byte) {
 	// check if ends with newline
 	if _, err := tw.userChannel.Write(result); err != nil {
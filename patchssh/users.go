@@ -0,0 +1,409 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+	"golang.org/x/crypto/ssh"
+)
+
+const usersUsage = "usage: user [list [prefix | email] | show <user> | add <user> <email> [nickname] | disable <user> | enable <user> | delete <user> | restore <user> | set-role <user> <role>]"
+
+const (
+	// defaultUsersPage is the number of users listed per page
+	defaultUsersPage = 20
+	// maxUserCompletions limits the usernames offered by tab completion
+	maxUserCompletions = 50
+)
+
+// user states shown by user list and accepted by -s
+const (
+	userStateActive   = "active"
+	userStateDisabled = "disabled"
+	userStateDeleted  = "deleted"
+	userStateAll      = "all"
+)
+
+// identifiers that cannot be users, the host key is stored as localhost
+var reservedUsernames = []string{"guest", "localhost"}
+
+// usersCommand lets admins manage the accounts, destructive actions ask for confirmation unless -y is given
+func usersCommand(db models.UserDB, roleDB models.RoleDB, keyDB models.KeyDB, policy models.PasswordPolicy) ui.Definition {
+	definition := ui.Definition{
+		Name:  "user",
+		Short: "Manage user accounts",
+		Long: "list shows the users whose name starts with the prefix or with the email in pages, deleted users only with -s deleted or -s all. " +
+			"add asks for the initial password. disable, delete and set-role ask for confirmation. " +
+			"Disabled and deleted users cannot log in, deleted users can be restored until they are purged. " +
+			"Flags may come anywhere before --.",
+		Flags: []ui.Flag{
+			{Name: 's', Value: "state", Help: "list users in the state, active, disabled, deleted or all"},
+			{Name: 'r', Value: "role", Help: "list users with the role"},
+			{Name: 'n', Value: "count", Help: fmt.Sprintf("users per page, %d by default", defaultUsersPage)},
+			{Name: 'c', Value: "cursor", Help: "continue the listing at the cursor printed below a page"},
+			{Name: 'y', Help: "do not ask for confirmation"},
+		},
+		Args:        "[list [prefix | email] | show <user> | add <user> <email> [nickname] | disable <user> | enable <user> | delete <user> | restore <user> | set-role <user> <role>]",
+		Permissions: []string{PermissionUsers},
+	}
+	users := &userManager{db: db, roleDB: roleDB, keyDB: keyDB, policy: policy}
+	definition.Run = func(ctx context.Context, args []string, stdio ui.IO) error {
+		flags, operands, err := parseUserArgs(definition, args)
+		if err != nil {
+			return err
+		}
+		if len(operands) == 0 {
+			operands = []string{"list"}
+		}
+		return users.run(ctx, operands[0], operands[1:], flags, stdio)
+	}
+	definition.Complete = func(ctx context.Context, user ui.Identity, args []string, word string) []string {
+		if len(args) == 0 {
+			return []string{"list", "show", "add", "disable", "enable", "delete", "restore", "set-role"}
+		} else if len(args) == 1 && args[0] != "list" && args[0] != "add" {
+			names := []string{}
+			query := models.UserQuery{UsernamePrefix: word, Deleted: models.IncludeDeleted, Page: models.Page{Limit: maxUserCompletions}}
+			if page, err := db.ListUsers(ctx, query); err == nil {
+				for _, account := range page.Users {
+					names = append(names, account.GetUsername())
+				}
+			}
+			return names
+		} else if len(args) == 2 && args[0] == "set-role" && roleDB != nil {
+			names := []string{}
+			if roles, err := roleDB.GetRoles(ctx); err == nil {
+				for _, role := range roles {
+					names = append(names, role.Name)
+				}
+			}
+			return names
+		}
+		return nil
+	}
+	return definition
+}
+
+// parseUserArgs lets flags come before, between and after the operands until --, as ParseArgs
+// stops at the first operand the arguments after it are parsed again
+func parseUserArgs(definition ui.Definition, args []string) (ui.Flags, []string, error) {
+	operands := []string{}
+	if end := slices.Index(args, "--"); end >= 0 {
+		operands = append(operands, args[end+1:]...)
+		args = args[:end]
+	}
+	flags, interleaved := ui.Flags{}, []string{}
+	for {
+		parsed, rest, err := definition.ParseArgs(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		for name, value := range parsed {
+			flags[name] = value
+		}
+		if len(rest) == 0 {
+			return flags, append(interleaved, operands...), nil
+		}
+		interleaved = append(interleaved, rest[0])
+		args = rest[1:]
+	}
+}
+
+// userManager runs the subcommands of the user command, roleDB and keyDB may be nil
+type userManager struct {
+	db     models.UserDB
+	roleDB models.RoleDB
+	keyDB  models.KeyDB
+	policy models.PasswordPolicy
+}
+
+func (m *userManager) run(ctx context.Context, subcommand string, args []string, flags ui.Flags, stdio ui.IO) error {
+	switch {
+	case subcommand == "list" && len(args) <= 1:
+		filter := ""
+		if len(args) == 1 {
+			filter = args[0]
+		}
+		return m.list(ctx, filter, flags, stdio)
+	case subcommand == "show" && len(args) == 1:
+		return m.show(ctx, args[0], stdio)
+	case subcommand == "add" && len(args) >= 2:
+		return m.add(ctx, args[0], args[1], strings.Join(args[2:], " "), stdio)
+	case subcommand == "enable" && len(args) == 1:
+		return m.setState(ctx, args[0], "user_enabled", "", flags, stdio, m.db.EnableUser)
+	case subcommand == "disable" && len(args) == 1:
+		return m.setState(ctx, args[0], "user_disabled", "Disable", flags, stdio, m.db.DisableUser)
+	case subcommand == "delete" && len(args) == 1:
+		return m.setState(ctx, args[0], "user_deleted", "Delete", flags, stdio, m.db.DeleteUser)
+	case subcommand == "restore" && len(args) == 1:
+		return m.setState(ctx, args[0], "user_restored", "", flags, stdio, m.db.RestoreUser)
+	case subcommand == "set-role" && len(args) == 2:
+		return m.setRole(ctx, args[0], args[1], flags, stdio)
+	}
+	return fmt.Errorf("%w, %s", ui.ErrUsage, usersUsage)
+}
+
+// lookup finds a user by name, deleted users included
+func (m *userManager) lookup(ctx context.Context, username string) (models.User, error) {
+	user, err := m.db.GetUser(ctx, models.UserQuery{Username: username, Deleted: models.IncludeDeleted})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, username)
+	}
+	return user, nil
+}
+
+func userState(user models.User) string {
+	if user.IsDeleted() {
+		return userStateDeleted
+	} else if user.IsDisabled() {
+		return userStateDisabled
+	}
+	return userStateActive
+}
+
+// userRoles returns the names of the roles granted to the user, nil without a role database
+func (m *userManager) userRoles(ctx context.Context, username string) ([]string, error) {
+	if m.roleDB == nil {
+		return nil, nil
+	}
+	roles, err := m.roleDB.GetUserRoles(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	return names, nil
+}
+
+// userStateFilters maps the states accepted by -s to the query filters
+var userStateFilters = map[string]struct {
+	deleted  models.DeletedFilter
+	disabled models.DisabledFilter
+}{
+	"":                {models.ExcludeDeleted, models.AnyDisabled},
+	userStateActive:   {models.ExcludeDeleted, models.OnlyEnabled},
+	userStateDisabled: {models.ExcludeDeleted, models.OnlyDisabled},
+	userStateDeleted:  {models.OnlyDeleted, models.AnyDisabled},
+	userStateAll:      {models.IncludeDeleted, models.AnyDisabled},
+}
+
+func (m *userManager) list(ctx context.Context, filter string, flags ui.Flags, stdio ui.IO) error {
+	state, ok := userStateFilters[flags['s']]
+	if !ok {
+		return fmt.Errorf("%w: unknown state %s", ui.ErrUsage, flags['s'])
+	} else if flags.Has('r') && m.roleDB == nil {
+		return ErrNoRoleDB
+	}
+	query := models.UserQuery{
+		Role:     flags['r'],
+		Deleted:  state.deleted,
+		Disabled: state.disabled,
+		Page:     models.Page{Limit: defaultUsersPage, Cursor: flags['c']},
+	}
+	if value, ok := flags['n']; ok {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return fmt.Errorf("%w: -n needs a positive number", ui.ErrUsage)
+		}
+		query.Limit = number
+	}
+	if strings.Contains(filter, "@") {
+		query.Email = filter
+	} else {
+		query.UsernamePrefix = filter
+	}
+
+	page, err := m.db.ListUsers(ctx, query)
+	if errors.Is(err, models.ErrInvalidCursor) {
+		return fmt.Errorf("%w: %s", ui.ErrUsage, err)
+	} else if err != nil {
+		return err
+	}
+	rows := []userRow{}
+	for _, user := range page.Users {
+		roles, err := m.userRoles(ctx, user.GetUsername())
+		if err != nil {
+			return err
+		}
+		rows = append(rows, userRow{user: user, state: userState(user), roles: roles})
+	}
+	_, err = stdio.Stdout.Write(formatUsers(rows, page.Next))
+	return err
+}
+
+func (m *userManager) show(ctx context.Context, username string, stdio ui.IO) error {
+	user, err := m.lookup(ctx, username)
+	if err != nil {
+		return err
+	}
+	roles, err := m.userRoles(ctx, username)
+	if err != nil {
+		return err
+	}
+	buffer := &bytes.Buffer{}
+	buffer.Write(formatProfile(user))
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(writer, "State:\t%s\n", userState(user))
+	if roles != nil {
+		fmt.Fprintf(writer, "Roles:\t%s\n", strings.Join(roles, ","))
+	}
+	if m.keyDB != nil {
+		keys, err := m.keyDB.GetKnownHosts(ctx, username)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if parsed, err := parseKey(key); err == nil {
+				fmt.Fprintf(writer, "Key:\t%s %s\n", ssh.FingerprintSHA256(parsed), key.GetName())
+			}
+		}
+	}
+	writer.Flush()
+	_, err = stdio.Stdout.Write(buffer.Bytes())
+	return err
+}
+
+func (m *userManager) add(ctx context.Context, username, email, nickname string, stdio ui.IO) error {
+	if strings.ContainsAny(username, " ,:") || slices.Contains(reservedUsernames, username) {
+		return fmt.Errorf("%w: %s", ErrInvalidUsername, username)
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Name != "" {
+		return fmt.Errorf("%w: %s", ErrInvalidEmail, email)
+	}
+	if stdio.ReadPassword == nil || stdio.Piped {
+		return fmt.Errorf("%w: user add asks for the password", ErrNoTerminal)
+	}
+	password, err := stdio.ReadPassword("Password for " + username + ": ")
+	if err != nil {
+		return err
+	} else if err := m.policy.Check(username, password); err != nil {
+		return err
+	}
+	repeated, err := stdio.ReadPassword("Repeat password: ")
+	if err != nil {
+		return err
+	} else if repeated != password {
+		return ErrPasswordMismatch
+	}
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if nickname == "" {
+		nickname = username
+	}
+	if err := m.db.Register(ctx, models.NewUser(username, nickname, address.Address), hash); err != nil {
+		return err
+	}
+	recordUserChange(ctx, "user_created", username, nil)
+	_, err = fmt.Fprintf(stdio.Stdout, "user %s added\n", username)
+	return err
+}
+
+// setState changes the state of a user with change, asking before it with question if it is set
+func (m *userManager) setState(ctx context.Context, username, action, question string, flags ui.Flags, stdio ui.IO, change func(context.Context, uint) error) error {
+	if username == stdio.User.User && question != "" {
+		return fmt.Errorf("%w: %s", ErrSelfAction, strings.ToLower(question))
+	}
+	user, err := m.lookup(ctx, username)
+	if err != nil {
+		return err
+	}
+	if question != "" && !flags.Has('y') {
+		if ok, err := ui.Confirm(stdio, fmt.Sprintf("%s user %s?", question, username)); err != nil {
+			return err
+		} else if !ok {
+			return ui.ErrNotConfirmed
+		}
+	}
+	if err := change(ctx, user.GetID()); err != nil {
+		return err
+	}
+	recordUserChange(ctx, action, username, nil)
+	_, err = fmt.Fprintf(stdio.Stdout, "user %s %s\n", username, strings.TrimPrefix(action, "user_"))
+	return err
+}
+
+// setRole replaces the roles of a user with role
+func (m *userManager) setRole(ctx context.Context, username, role string, flags ui.Flags, stdio ui.IO) error {
+	if m.roleDB == nil {
+		return ErrNoRoleDB
+	} else if username == stdio.User.User {
+		return fmt.Errorf("%w: change your roles", ErrSelfAction)
+	}
+	if _, err := m.lookup(ctx, username); err != nil {
+		return err
+	}
+	if _, err := m.roleDB.GetRole(ctx, role); err != nil {
+		return err
+	}
+	roles, err := m.userRoles(ctx, username)
+	if err != nil {
+		return err
+	}
+	if !flags.Has('y') {
+		question := fmt.Sprintf("Replace the roles %s of %s with %s?", strings.Join(roles, ","), username, role)
+		if ok, err := ui.Confirm(stdio, question); err != nil {
+			return err
+		} else if !ok {
+			return ui.ErrNotConfirmed
+		}
+	}
+	if err := m.roleDB.SetUserRole(ctx, username, role); err != nil {
+		return err
+	}
+	recordUserChange(ctx, "user_role_set", username, map[string]string{"role": role})
+	_, err = fmt.Fprintf(stdio.Stdout, "user %s has the role %s\n", username, role)
+	return err
+}
+
+func recordUserChange(ctx context.Context, action, user string, details map[string]string) {
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["action"] = action
+	details["user"] = user
+	audit.Record(ctx, audit.Event{
+		Type:    audit.EventAdminAction,
+		Details: details,
+	})
+}
+
+type userRow struct {
+	user  models.User
+	state string
+	roles []string
+}
+
+// formatUsers prints the users as a table, next is the cursor of the following page
+func formatUsers(rows []userRow, next string) []byte {
+	buffer := &bytes.Buffer{}
+	writer := tabwriter.NewWriter(buffer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "USERNAME\tNICKNAME\tEMAIL\tROLES\tSTATE\tCREATED")
+	for _, row := range rows {
+		created := ""
+		if !row.user.GetCreatedAt().IsZero() {
+			created = row.user.GetCreatedAt().Format("2006-01-02")
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", row.user.GetUsername(), row.user.GetNickname(), row.user.GetEmail(), strings.Join(row.roles, ","), row.state, created)
+	}
+	writer.Flush()
+	if next != "" {
+		fmt.Fprintf(buffer, "%d users, more with -c %s\n", len(rows), next)
+	} else {
+		fmt.Fprintf(buffer, "%d users\n", len(rows))
+	}
+	return buffer.Bytes()
+}
@@ -0,0 +1,194 @@
+package patchssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/ui"
+)
+
+// ListUsers sorts by username, the cursor is the last username of the previous page
+func (db *testUserDB) ListUsers(ctx context.Context, query models.UserQuery) (models.UserPage, error) {
+	names := []string{}
+	for name, user := range db.users {
+		if (query.Username != "" && name != query.Username) ||
+			!strings.HasPrefix(name, query.UsernamePrefix) ||
+			(query.Email != "" && user.GetEmail() != query.Email) ||
+			(query.Role != "" && !slices.Contains(db.roles[name], query.Role)) ||
+			(query.Deleted == models.ExcludeDeleted && user.deleted) ||
+			(query.Deleted == models.OnlyDeleted && !user.deleted) ||
+			(query.Disabled == models.OnlyEnabled && user.disabled) ||
+			(query.Disabled == models.OnlyDisabled && !user.disabled) ||
+			(query.Cursor != "" && name <= query.Cursor) {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	page := models.UserPage{Users: []models.User{}}
+	for _, name := range names {
+		if query.Limit > 0 && len(page.Users) == query.Limit {
+			page.Next = page.Users[len(page.Users)-1].GetUsername()
+			break
+		}
+		page.Users = append(page.Users, db.users[name])
+	}
+	return page, nil
+}
+
+func (db *testUserDB) GetUser(ctx context.Context, query models.UserQuery) (models.User, error) {
+	page, _ := db.ListUsers(ctx, query)
+	if len(page.Users) == 0 {
+		return nil, models.ErrUserNotFound
+	}
+	return page.Users[0], nil
+}
+
+func (db *testUserDB) Register(ctx context.Context, user models.User, hash string) error {
+	if _, ok := db.users[user.GetUsername()]; ok {
+		return models.ErrUserAlreadyExists
+	}
+	created := models.NewUser(user.GetUsername(), user.GetNickname(), user.GetEmail())
+	created.ID = uint(len(db.users) + 1)
+	db.users[user.GetUsername()] = &testUser{UserImpl: created}
+	db.passwords[user.GetUsername()] = hash
+	return nil
+}
+
+// byID changes the state of the user with the id
+func (db *testUserDB) byID(id uint, change func(*testUser)) error {
+	for _, user := range db.users {
+		if user.ID == id {
+			change(user)
+			return nil
+		}
+	}
+	return models.ErrUserNotFound
+}
+
+func (db *testUserDB) DisableUser(ctx context.Context, id uint) error {
+	return db.byID(id, func(user *testUser) { user.disabled = true })
+}
+
+func (db *testUserDB) EnableUser(ctx context.Context, id uint) error {
+	return db.byID(id, func(user *testUser) { user.disabled = false })
+}
+
+func (db *testUserDB) DeleteUser(ctx context.Context, id uint) error {
+	return db.byID(id, func(user *testUser) { user.deleted = true })
+}
+
+func (db *testUserDB) RestoreUser(ctx context.Context, id uint) error {
+	return db.byID(id, func(user *testUser) { user.deleted = false })
+}
+
+func (db *testRoleDB) RevokeRole(ctx context.Context, username, role string) error {
+	for i, granted := range db.grants[username] {
+		if granted == role {
+			db.grants[username] = append(db.grants[username][:i], db.grants[username][i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrRoleNotGranted
+}
+
+func (db *testRoleDB) SetUserRole(ctx context.Context, username, role string) error {
+	if _, ok := db.roles[role]; !ok {
+		return models.ErrRoleNotFound
+	}
+	db.grants[username] = []string{role}
+	return nil
+}
+
+func TestUsersCommand(t *testing.T) {
+	db := newTestUserDB(
+		models.NewUser("admin", "admin", "admin@example.com"),
+		models.NewUser("alice", "Alice", "alice@example.com"),
+		models.NewUser("bob", "Bob", "bob@example.org"),
+		models.NewUser("carol", "Carol", "carol@example.org"),
+	)
+	roleDB := newTestRoleDB()
+	roleDB.grants["alice"] = []string{"user"}
+	db.roles = roleDB.grants
+	shell := ui.NewShellWrapper(TESTSERVER.logger)
+	shell.Register(usersCommand(db, roleDB, nil, models.DefaultPasswordPolicy))
+	if _, err := shell.Execute(context.TODO(), "user list"); !errors.Is(err, ui.ErrPermissionDenied) {
+		t.Errorf("Expected admins only, got %v", err)
+	}
+	shell.SetIdentity(ui.Identity{User: "admin", Permissions: []string{PermissionUsers}})
+	run := func(line string, input string, passwords ...string) (string, error) {
+		out := &bytes.Buffer{}
+		err := shell.Run(context.TODO(), line, ui.IO{
+			Stdin:        strings.NewReader(input),
+			Stdout:       out,
+			Stderr:       out,
+			ReadPassword: answers(passwords...),
+		})
+		return out.String(), err
+	}
+
+	out, err := run("user list -n 2", "")
+	cursor, ok := strings.CutPrefix(strings.TrimSpace(out[strings.LastIndex(out, "more with "):]), "more with -c ")
+	if err != nil || !strings.Contains(out, "alice") || strings.Contains(out, "bob") || !ok {
+		t.Fatalf("Expected the first page with a cursor, got %s (%v)", out, err)
+	}
+	if out, err := run("user list -n 2 -c "+cursor, ""); err != nil || !strings.Contains(out, "bob") || strings.Contains(out, "alice") || !strings.HasSuffix(out, "2 users\n") {
+		t.Errorf("Expected the last page, got %s (%v)", out, err)
+	}
+	if out, err := run("user list ca", ""); err != nil || !strings.Contains(out, "carol") || strings.Contains(out, "alice") {
+		t.Errorf("Expected users with the prefix, got %s (%v)", out, err)
+	}
+	if out, err := run("user list bob@example.org", ""); err != nil || !strings.Contains(out, "bob") || strings.Contains(out, "carol") {
+		t.Errorf("Expected the user with the email, got %s (%v)", out, err)
+	}
+	if out, err := run("user list -r user", ""); err != nil || !strings.Contains(out, "alice") || strings.Contains(out, "bob") {
+		t.Errorf("Expected users with the role, got %s (%v)", out, err)
+	}
+	if out, err := run("user list ca -s all", ""); err != nil || !strings.Contains(out, "carol") || strings.Contains(out, "alice") {
+		t.Errorf("Expected flags after the operands, got %s (%v)", out, err)
+	}
+
+	if _, err := run("user delete bob", "n\r"); !errors.Is(err, ui.ErrNotConfirmed) || db.users["bob"].deleted {
+		t.Errorf("Expected deletion to need confirmation, got %v", err)
+	}
+	if _, err := run("user delete bob", "y\r"); err != nil || !db.users["bob"].deleted {
+		t.Errorf("Expected bob to be deleted, got %v", err)
+	}
+	if out, err := run("user list", ""); err != nil || strings.Contains(out, "bob") {
+		t.Errorf("Expected deleted users to be hidden, got %s (%v)", out, err)
+	}
+	if out, err := run("user list -s deleted", ""); err != nil || !strings.Contains(out, "bob") {
+		t.Errorf("Expected deleted users, got %s (%v)", out, err)
+	}
+	if _, err := run("user restore bob", ""); err != nil || db.users["bob"].deleted {
+		t.Errorf("Expected bob to be restored, got %v", err)
+	}
+	if _, err := run("user disable -y carol", ""); err != nil || !db.users["carol"].disabled {
+		t.Errorf("Expected carol to be disabled, got %v", err)
+	}
+	if _, err := run("user disable admin", "y\r"); !errors.Is(err, ErrSelfAction) {
+		t.Errorf("Expected ErrSelfAction, got %v", err)
+	}
+
+	if _, err := run("user set-role alice viewer", "y\r"); err != nil || strings.Join(roleDB.grants["alice"], ",") != "viewer" {
+		t.Errorf("Expected the roles to be replaced, got %v %v", roleDB.grants["alice"], err)
+	}
+
+	if _, err := run("user add dave dave@example.com", "", "weak"); !errors.Is(err, models.ErrWeakPassword) {
+		t.Errorf("Expected ErrWeakPassword, got %v", err)
+	}
+	if _, err := run("user add guest guest@example.com", ""); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("Expected ErrInvalidUsername, got %v", err)
+	}
+	if out, err := run("user add dave dave@example.com Dave D", "", "Tall horse 42", "Tall horse 42"); err != nil || db.users["dave"].GetNickname() != "Dave D" {
+		t.Errorf("Expected dave to be added, got %s (%v)", out, err)
+	}
+	if out, err := run("user show alice", ""); err != nil || !strings.Contains(out, "viewer") || !strings.Contains(out, "active") {
+		t.Errorf("Expected details of alice, got %s (%v)", out, err)
+	}
+}
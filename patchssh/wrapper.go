@@ -2,15 +2,26 @@ package patchssh
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/myLogic207/cinnamon/internal/audit"
+	"github.com/myLogic207/cinnamon/internal/models"
+	"github.com/myLogic207/cinnamon/patchssh/recording"
+	"github.com/myLogic207/cinnamon/patchssh/registry"
 	"github.com/myLogic207/cinnamon/patchssh/ui"
 	log "github.com/myLogic207/gotils/logger"
 	"github.com/myLogic207/gotils/workers"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type contextKey string
@@ -23,13 +34,96 @@ type ChannelHandler func(ctx context.Context, channel ssh.NewChannel) error
 
 type RequestHandler func(ctx context.Context, channel ssh.Channel, request *ssh.Request)
 
-type SubsystemHandler func(ctx context.Context, subsystem string) error
+type SubsystemHandler func(ctx context.Context, channel ssh.Channel, subsystem string) error
+
+type GlobalRequestHandler func(ctx context.Context, request *ssh.Request)
+
+// permission extensions set by the server during authentication
+const (
+	extensionAuthMethod = "auth-method"
+	extensionAdmin      = "admin"
+	// set by the auth manager, a critical option for keys and an extension for guests
+	extensionFingerprint = "pubkey-fp"
+	// comma separated, loaded from the role database at login
+	extensionRoles       = "roles"
+	extensionPermissions = "permissions"
+	// forwarding the client may request, following the openssh certificate extensions
+	extensionAgentForwarding = "permit-agent-forwarding"
+	extensionX11Forwarding   = "permit-X11-forwarding"
+)
+
+// clients may not grow the session environment beyond this
+const maxEnvVars = 64
+
+// refused users get this long to open a channel and read the reason
+const refuseTimeout = 10 * time.Second
+
+// countingConn counts the raw bytes transferred over a connection
+type countingConn struct {
+	net.Conn
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesOut.Add(uint64(n))
+	return n, err
+}
 
 type connTaskWrapper struct {
 	workers.Task
 	logger    log.Logger
 	sshConfig *ssh.ServerConfig
-	conn      net.Conn
+	conn      *countingConn
+	startedAt time.Time
+	// registry lists the connection while it is active, admins may manage it from the shell
+	registry *registry.Registry
+	id       uint64
+	// details known after the handshake, guarded by infoMutex
+	infoMutex     sync.Mutex
+	user          string
+	guest         bool
+	clientVersion string
+	authMethod    string
+	admin         bool
+	roles         []string
+	permissions   []string
+	channels      map[int]string
+	// recordings stores the terminals of the connection, nil if recording is disabled
+	recordings *recording.Store
+	sessionID  string
+	// history keeps the shell history of the user, nil if disabled
+	history ui.History
+	// roleDB is managed by the roles command, nil without roles
+	roleDB models.RoleDB
+	// keyDB holds the login keys users manage with the keys command
+	keyDB models.KeyDB
+	// userDB holds the accounts users manage with profile and passwd, nil if not set
+	userDB         models.UserDB
+	passwordPolicy models.PasswordPolicy
+	// serverConn is set after the handshake, agentForwarding once the client offered its agent
+	serverConn      ssh.Conn
+	agentForwarding bool
+	// env collects the variables sent by the client before the shell starts
+	env map[string]string
+	// limiter holds the connection slot, released when the connection ends
+	limiter *connLimiter
+	// bans refuse users after they authenticated, nil if not set
+	bans *BanList
+	// onClose is called once the connection is closed
+	onClose   func(*connTaskWrapper)
+	closeOnce sync.Once
+	done      chan struct{}
+	// session channels of this connection, their terminals reach the user outside a command
+	termMutex sync.Mutex
+	sessions  map[ssh.Channel]*sessionChannel
 	// ChannelHandlers allow overriding the built-in session handlers or provide
 	// extensions to the protocol, such as tcpip forwarding. By default only the
 	// "session" handler is enabled.
@@ -44,6 +138,10 @@ type connTaskWrapper struct {
 	// handlers, but handle named subsystems.
 	SubsystemHandlers map[string]SubsystemHandler
 
+	// GlobalRequestHandlers answer requests outside of channels, such as remote
+	// port forwarding. By default no handlers are enabled.
+	GlobalRequestHandlers map[string]GlobalRequestHandler
+
 	// per default users need a shell after a shell request
 	ShellHandler ui.UserShell
 }
@@ -51,49 +149,166 @@ type connTaskWrapper struct {
 func NewConnTaskWrapper(conn net.Conn, sshConfig *ssh.ServerConfig, logger log.Logger) *connTaskWrapper {
 	wrapper := &connTaskWrapper{
 		logger:    logger,
-		conn:      conn,
+		conn:      &countingConn{Conn: conn},
 		sshConfig: sshConfig,
+		startedAt: time.Now(),
+		channels:  map[int]string{},
+		done:      make(chan struct{}),
+		sessions:  map[ssh.Channel]*sessionChannel{},
+		env:       map[string]string{},
 	}
 	wrapper.ChannelHandlers = map[string]ChannelHandler{
 		"session": wrapper.DefaultSessionHandler,
 	}
 	wrapper.RequestHandlers = map[string]RequestHandler{
-		"default": wrapper.DefaultRequestHandler,
-		"shell":   wrapper.ShellRequestHandler,
-		"pty-req": wrapper.TerminalRequestHandler,
+		"default":        wrapper.DefaultRequestHandler,
+		"shell":          wrapper.ShellRequestHandler,
+		"pty-req":        wrapper.TerminalRequestHandler,
+		"window-change":  wrapper.WindowChangeRequestHandler,
+		"env":            wrapper.EnvRequestHandler,
+		"subsystem":      wrapper.SubsystemRequestHandler,
+		agentRequestType: wrapper.AgentRequestHandler,
 	}
+	wrapper.SubsystemHandlers = map[string]SubsystemHandler{}
+	wrapper.GlobalRequestHandlers = map[string]GlobalRequestHandler{}
 	return wrapper
 }
 
 func (cw *connTaskWrapper) OnFinish(ctx context.Context) {
 	// workernode exited normally
-	if err := cw.conn.Close(); err != nil {
-		cw.logger.Error(ctx, err.Error())
-	}
+	cw.close(ctx)
 }
 
 func (cw *connTaskWrapper) OnError(ctx context.Context, err error) {
 	// workernode exited with error
-	if err := cw.conn.Close(); err != nil {
-		cw.logger.Error(ctx, err.Error())
+	cw.close(ctx)
+}
+
+func (cw *connTaskWrapper) close(ctx context.Context) {
+	cw.closeOnce.Do(func() {
+		if err := cw.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			cw.logger.Error(ctx, err.Error())
+		}
+		if cw.limiter != nil {
+			cw.infoMutex.Lock()
+			user := cw.user
+			cw.infoMutex.Unlock()
+			if user != "" {
+				cw.limiter.releaseUser(user)
+			}
+			cw.limiter.releaseConn(cw.conn.RemoteAddr())
+		}
+		if cw.onClose != nil {
+			cw.onClose(cw)
+		}
+		close(cw.done)
+	})
+}
+
+// Done returns a channel that is closed once the connection has ended
+func (cw *connTaskWrapper) Done() <-chan struct{} {
+	return cw.done
+}
+
+// Info returns a snapshot of the connection for the registry
+func (cw *connTaskWrapper) Info() registry.Info {
+	cw.infoMutex.Lock()
+	defer cw.infoMutex.Unlock()
+	channels := []string{}
+	for _, channelType := range cw.channels {
+		channels = append(channels, channelType)
+	}
+	return registry.Info{
+		ID:            cw.id,
+		User:          cw.user,
+		RemoteAddr:    cw.conn.RemoteAddr().String(),
+		ClientVersion: cw.clientVersion,
+		AuthMethod:    cw.authMethod,
+		StartedAt:     cw.startedAt,
+		BytesIn:       cw.conn.bytesIn.Load(),
+		BytesOut:      cw.conn.bytesOut.Load(),
+		Channels:      channels,
+	}
+}
+
+// Kick tells the user why the connection is closed and closes it
+func (cw *connTaskWrapper) Kick(ctx context.Context, reason string) {
+	cw.Notify(ctx, "Disconnected by server: "+reason)
+	cw.close(ctx)
+}
+
+// Notify writes a message to every terminal open on the connection
+func (cw *connTaskWrapper) Notify(ctx context.Context, message string) {
+	cw.termMutex.Lock()
+	defer cw.termMutex.Unlock()
+	for _, session := range cw.sessions {
+		terminal := session.terminal
+		if terminal == nil {
+			continue
+		}
+		if err := terminal.Notify(message); err != nil {
+			cw.logger.Debug(ctx, "Error notifying terminal: %s", err.Error())
+		}
 	}
 }
 
 func (cw *connTaskWrapper) Do(ctx context.Context) error {
+	workersQueued.Dec()
+	workersBusy.Inc()
+	defer workersBusy.Dec()
 	// handle connection
 	// perform ssh handshake
 	cw.logger.Debug(ctx, "Performing ssh handshake")
+	handshakeStart := time.Now()
 	sshConn, chans, reqs, err := ssh.NewServerConn(cw.conn, cw.sshConfig)
+	handshakeDuration.Observe(time.Since(handshakeStart).Seconds(), resultLabel(err))
 	if err != nil {
 		return err
 	}
+	if err := cw.admit(sshConn.User()); err != nil {
+		cw.refuse(ctx, sshConn, chans, reqs, err)
+		return err
+	}
+	session := audit.Session{
+		User:       sshConn.User(),
+		RemoteAddr: sshConn.RemoteAddr().String(),
+		SessionID:  hex.EncodeToString(sshConn.SessionID()),
+	}
+	cw.infoMutex.Lock()
+	cw.serverConn = sshConn
+	cw.user = sshConn.User()
+	cw.sessionID = session.SessionID
+	cw.clientVersion = string(sshConn.ClientVersion())
+	if sshConn.Permissions != nil {
+		cw.authMethod = sshConn.Permissions.Extensions[extensionAuthMethod]
+		cw.admin = sshConn.Permissions.Extensions[extensionAdmin] == "true"
+		cw.roles = splitList(sshConn.Permissions.Extensions[extensionRoles])
+		cw.permissions = splitList(sshConn.Permissions.Extensions[extensionPermissions])
+		session.Fingerprint = sshConn.Permissions.CriticalOptions[extensionFingerprint]
+		if session.Fingerprint == "" {
+			session.Fingerprint = sshConn.Permissions.Extensions[extensionFingerprint]
+		}
+	}
+	// all guests log in as guest without a key, so they get no shared history
+	cw.guest = sshConn.Permissions == nil || sshConn.Permissions.CriticalOptions[extensionFingerprint] == ""
+	authMethod := cw.authMethod
+	cw.infoMutex.Unlock()
+	// everything done on behalf of the user is audited with the session
+	ctx = audit.WithSession(ctx, session)
+	audit.Record(ctx, audit.Event{
+		Type: audit.EventLogin,
+		Details: map[string]string{
+			"method":         authMethod,
+			"client_version": string(sshConn.ClientVersion()),
+		},
+	})
 	cw.logger.Debug(ctx, "Connection from %s established", sshConn.RemoteAddr().String())
 	// handle ssh connection
 	// handle ssh channel requests
 	go cw.handleChannels(ctx, chans)
 
 	// handle ssh global requests
-	go ssh.DiscardRequests(reqs)
+	go cw.handleGlobalRequests(ctx, reqs)
 
 	cw.logger.Info(ctx, "Connection %s established", sshConn.RemoteAddr().String())
 	// block until ssh connection is finished
@@ -104,21 +319,109 @@ func (cw *connTaskWrapper) Do(ctx context.Context) error {
 	return sshConn.Close()
 }
 
+// admit checks the bans of the user and takes their connection slot, this happens after
+// authentication so only users with valid credentials learn why they are refused
+func (cw *connTaskWrapper) admit(user string) error {
+	if cw.bans != nil {
+		if ban, ok := cw.bans.bannedUser(user); ok {
+			return ErrBannedReason{ban.Reason}
+		}
+	}
+	if cw.limiter != nil {
+		return cw.limiter.acquireUser(user)
+	}
+	return nil
+}
+
+// refuse tells an authenticated user why the connection is closed. After the key exchange
+// x/crypto/ssh can not send a disconnect reason, so the first channel is rejected with it.
+func (cw *connTaskWrapper) refuse(ctx context.Context, sshConn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, reason error) {
+	defer sshConn.Close()
+	cw.logger.Warn(ctx, "Refusing '%s' from %s: %s", sshConn.User(), sshConn.RemoteAddr().String(), reason.Error())
+	method, fingerprint := "", ""
+	if sshConn.Permissions != nil {
+		method = sshConn.Permissions.Extensions[extensionAuthMethod]
+		fingerprint = sshConn.Permissions.CriticalOptions[extensionFingerprint]
+	}
+	recordLoginFailed(sshConn, method, fingerprint, reason)
+	go ssh.DiscardRequests(reqs)
+	timer := time.NewTimer(refuseTimeout)
+	defer timer.Stop()
+	select {
+	case newChannel, ok := <-chans:
+		if ok {
+			newChannel.Reject(ssh.Prohibited, reason.Error())
+		}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
 func (cw *connTaskWrapper) handleChannels(ctx context.Context, chans <-chan ssh.NewChannel) {
 	chanCounter := 0
 	for newChannel := range chans {
 		chanCtx := context.WithValue(ctx, contextKeyChannelID, chanCounter)
 		cw.handleChannel(chanCtx, newChannel)
+		chanCounter++
 	}
 }
 
 func (cw *connTaskWrapper) handleChannel(ctx context.Context, newChannel ssh.NewChannel) {
+	if !cw.permit(ctx, permissionChannel+newChannel.ChannelType(), newChannel.ChannelType()+" channel") {
+		// clients choose the type, so denied ones share a label
+		channelsOpened.Inc("unknown", "denied")
+		newChannel.Reject(ssh.Prohibited, "channel type not permitted")
+		return
+	}
 	handler, ok := cw.ChannelHandlers[newChannel.ChannelType()]
 	if !ok {
+		channelsOpened.Inc("unknown", "rejected")
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 		return
 	}
-	go handler(ctx, newChannel)
+	channelsOpened.Inc(newChannel.ChannelType(), "accepted")
+	if forwardChannelTypes[newChannel.ChannelType()] {
+		recordForward(ctx, newChannel)
+	}
+	channelID := ctx.Value(contextKeyChannelID).(int)
+	cw.infoMutex.Lock()
+	cw.channels[channelID] = newChannel.ChannelType()
+	cw.infoMutex.Unlock()
+	go func() {
+		if err := handler(ctx, newChannel); err != nil {
+			cw.logger.Error(ctx, "Error handling %s channel: %s", newChannel.ChannelType(), err.Error())
+		}
+		cw.infoMutex.Lock()
+		delete(cw.channels, channelID)
+		cw.infoMutex.Unlock()
+	}()
+}
+
+// channel types that forward traffic, they are audited when a handler accepts them
+var forwardChannelTypes = map[string]bool{
+	"direct-tcpip":                   true,
+	"forwarded-tcpip":                true,
+	"direct-streamlocal@openssh.com": true,
+	"x11":                            true,
+}
+
+// forwardTarget is the start of the extra data of direct-tcpip and forwarded-tcpip, see RFC 4254 section 7
+type forwardTarget struct {
+	Host string
+	Port uint32
+	Rest []byte `ssh:"rest"`
+}
+
+func recordForward(ctx context.Context, newChannel ssh.NewChannel) {
+	details := map[string]string{"type": newChannel.ChannelType()}
+	target := forwardTarget{}
+	if strings.HasSuffix(newChannel.ChannelType(), "-tcpip") && ssh.Unmarshal(newChannel.ExtraData(), &target) == nil {
+		details["target"] = net.JoinHostPort(target.Host, strconv.FormatUint(uint64(target.Port), 10))
+	}
+	audit.Record(ctx, audit.Event{
+		Type:    audit.EventForward,
+		Details: details,
+	})
 }
 
 func (cw *connTaskWrapper) DefaultSessionHandler(ctx context.Context, channel ssh.NewChannel) error {
@@ -126,12 +429,27 @@ func (cw *connTaskWrapper) DefaultSessionHandler(ctx context.Context, channel ss
 	if err != nil {
 		return err
 	}
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+	cw.termMutex.Lock()
+	cw.sessions[newChan] = &sessionChannel{}
+	cw.termMutex.Unlock()
+	defer func() {
+		cw.termMutex.Lock()
+		delete(cw.sessions, newChan)
+		cw.termMutex.Unlock()
+	}()
 	for req := range request {
+		if permission, ok := requestPermissions[req.Type]; ok && !cw.permit(ctx, permission, req.Type+" request") {
+			req.Reply(false, nil)
+			continue
+		}
 		requestHandler, ok := cw.RequestHandlers[req.Type]
 		if !ok {
 			requestHandler = cw.RequestHandlers["default"]
 		}
-		go requestHandler(ctx, newChan, req)
+		// handled in order, the shell depends on the env requests sent before it
+		requestHandler(ctx, newChan, req)
 	}
 	return nil
 }
@@ -148,20 +466,228 @@ func (cw *connTaskWrapper) DefaultRequestHandler(ctx context.Context, channel ss
 
 func (cw *connTaskWrapper) ShellRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
 	// prepare shell wrapper
-	cw.ShellHandler = ui.NewShellWrapper(cw.logger)
+	shell := ui.NewShellWrapper(cw.logger)
+	shell.Register(whoamiCommand())
+	// only shown to and run for users with the permission
+	if cw.registry != nil {
+		shell.Register(ui.SessionsCommand(cw.registry))
+	}
+	if cw.recordings != nil {
+		shell.Register(ui.RecordingsCommand(cw.recordings))
+	}
+	cw.infoMutex.Lock()
+	guest := cw.guest
+	cw.infoMutex.Unlock()
+	if cw.history != nil && !guest {
+		shell.Register(ui.HistoryCommand(cw.history))
+	}
+	if cw.roleDB != nil {
+		shell.Register(rolesCommand(cw.roleDB))
+	}
+	if cw.keyDB != nil {
+		shell.Register(keysCommand(cw.keyDB, cw.openAgent))
+	}
+	if cw.userDB != nil {
+		shell.Register(profileCommand(cw.userDB))
+		shell.Register(passwdCommand(cw.userDB, cw.passwordPolicy))
+		shell.Register(usersCommand(cw.userDB, cw.roleDB, cw.keyDB, cw.passwordPolicy))
+	}
+	cw.infoMutex.Lock()
+	for name, value := range cw.env {
+		shell.SetEnv(name, value)
+	}
+	shell.SetEnv("USER", cw.user)
+	cw.infoMutex.Unlock()
+	identity := cw.identity()
+	if session, ok := audit.SessionFrom(ctx); ok {
+		identity.Fingerprint = session.Fingerprint
+		identity.RemoteAddr = session.RemoteAddr
+	}
+	shell.SetIdentity(identity)
+	cw.ShellHandler = shell
 	request.Reply(true, nil)
+
+	// clients usually request the pty first, the terminal starts once both are there
+	cw.termMutex.Lock()
+	session, ok := cw.sessions[channel]
+	if ok {
+		session.shell = true
+	}
+	cw.termMutex.Unlock()
+	if ok && session.pty != nil {
+		cw.startTerminal(ctx, channel, session)
+	}
+}
+
+// agent forwarding of openssh, see PROTOCOL.agent
+const (
+	agentRequestType = "auth-agent-req@openssh.com"
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// AgentRequestHandler notes that the client forwards its agent, the server opens agent channels on demand
+func (cw *connTaskWrapper) AgentRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
+	cw.infoMutex.Lock()
+	cw.agentForwarding = true
+	cw.infoMutex.Unlock()
+	if request.WantReply {
+		request.Reply(true, nil)
+	}
+}
+
+// openAgent opens a channel to the agent forwarded by the client
+func (cw *connTaskWrapper) openAgent(ctx context.Context) (agent.Agent, io.Closer, error) {
+	cw.infoMutex.Lock()
+	conn, forwarding := cw.serverConn, cw.agentForwarding
+	cw.infoMutex.Unlock()
+	if conn == nil || !forwarding {
+		return nil, nil, ErrNoAgent
+	}
+	channel, requests, err := conn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	go ssh.DiscardRequests(requests)
+	return agent.NewClient(channel), channel, nil
+}
+
+// envRequest is the payload of an "env" request, see RFC 4254 section 6.4
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// EnvRequestHandler stores variables for $VAR expansion in the shell
+func (cw *connTaskWrapper) EnvRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
+	payload := envRequest{}
+	if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+		request.Reply(false, nil)
+		return
+	}
+	cw.infoMutex.Lock()
+	accepted := len(cw.env) < maxEnvVars || cw.env[payload.Name] != ""
+	if accepted {
+		cw.env[payload.Name] = payload.Value
+	}
+	cw.infoMutex.Unlock()
+	if request.WantReply {
+		request.Reply(accepted, nil)
+	}
+}
+
+// sessionChannel is the state of a session channel, built up by its requests
+type sessionChannel struct {
+	pty      *ptyRequest
+	shell    bool
+	terminal *ui.TerminalWrapper
+}
+
+// ptyRequest is the payload of a "pty-req" request, see RFC 4254 section 6.2
+type ptyRequest struct {
+	Term          string
+	Columns       uint32
+	Rows          uint32
+	PixelWidth    uint32
+	PixelHeight   uint32
+	TerminalModes string
+}
+
+// windowChange is the payload of a "window-change" request, see RFC 4254 section 6.7
+type windowChange struct {
+	Columns     uint32
+	Rows        uint32
+	PixelWidth  uint32
+	PixelHeight uint32
 }
 
+// TerminalRequestHandler accepts a pty, the terminal starts once the shell was requested as well
 func (cw *connTaskWrapper) TerminalRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
-	if cw.ShellHandler == nil {
-		// no shell handler available
+	payload := &ptyRequest{}
+	if err := ssh.Unmarshal(request.Payload, payload); err != nil {
 		request.Reply(false, nil)
 		return
 	}
-	// prepare terminal wrapper
-	terminal := ui.NewTerminalWrapper(cw.logger, channel, cw.ShellHandler)
-	go terminal.Do(ctx)
+	cw.termMutex.Lock()
+	session, ok := cw.sessions[channel]
+	accepted := ok && session.pty == nil
+	if accepted {
+		session.pty = payload
+	}
+	cw.termMutex.Unlock()
+	if !accepted {
+		request.Reply(false, nil)
+		return
+	}
+	if payload.Term != "" {
+		cw.infoMutex.Lock()
+		cw.env["TERM"] = payload.Term
+		cw.infoMutex.Unlock()
+	}
 	if request.WantReply {
 		request.Reply(true, nil)
 	}
+	if session.shell {
+		cw.startTerminal(ctx, channel, session)
+	}
+}
+
+// WindowChangeRequestHandler resizes the terminal of the session
+func (cw *connTaskWrapper) WindowChangeRequestHandler(ctx context.Context, channel ssh.Channel, request *ssh.Request) {
+	payload := windowChange{}
+	if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+		return
+	}
+	cw.termMutex.Lock()
+	session, ok := cw.sessions[channel]
+	var terminal *ui.TerminalWrapper
+	if ok && session.pty != nil {
+		session.pty.Columns, session.pty.Rows = payload.Columns, payload.Rows
+		terminal = session.terminal
+	}
+	cw.termMutex.Unlock()
+	if terminal == nil {
+		return
+	}
+	if err := terminal.SetSize(int(payload.Columns), int(payload.Rows)); err != nil {
+		cw.logger.Debug(ctx, "Error resizing terminal: %s", err.Error())
+	}
+}
+
+func (cw *connTaskWrapper) startTerminal(ctx context.Context, channel ssh.Channel, session *sessionChannel) {
+	cw.termMutex.Lock()
+	if session.terminal != nil || cw.ShellHandler == nil {
+		cw.termMutex.Unlock()
+		return
+	}
+	width, height := int(session.pty.Columns), int(session.pty.Rows)
+	if width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	terminal := ui.NewTerminalWrapper(cw.logger, channel, cw.ShellHandler)
+	terminal.SetSize(width, height)
+	session.terminal = terminal
+	cw.termMutex.Unlock()
+
+	cw.infoMutex.Lock()
+	user, sessionID, guest := cw.user, cw.sessionID, cw.guest
+	cw.infoMutex.Unlock()
+	if cw.history != nil && !guest {
+		if err := terminal.UseHistory(ctx, cw.history, user); err != nil {
+			cw.logger.Error(ctx, "Error loading history: %s", err.Error())
+		}
+	}
+	if cw.recordings != nil {
+		recorder, err := cw.recordings.Start(user, sessionID, width, height)
+		if err == nil {
+			terminal.Record(recorder)
+		} else if !errors.Is(err, recording.ErrOptedOut) {
+			cw.logger.Error(ctx, "Error starting recording: %s", err.Error())
+		}
+	}
+	go func() {
+		terminal.Do(ctx)
+		cw.termMutex.Lock()
+		session.terminal = nil
+		cw.termMutex.Unlock()
+	}()
 }